@@ -0,0 +1,145 @@
+//go:build linux
+// +build linux
+
+package main
+
+import (
+	"fmt"
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/afpacket"
+	"github.com/google/gopacket/layers"
+	"github.com/google/gopacket/pcap"
+	"golang.org/x/net/bpf"
+	"net"
+	"time"
+)
+
+// The hash fanout is done with defragmentation so all the fragments of a packet land on the same worker
+var afpacketFanoutTypes = map[string]afpacket.FanoutType{
+	"hash":     afpacket.FanoutHashWithDefrag,
+	"lb":       afpacket.FanoutLoadBalance,
+	"cpu":      afpacket.FanoutCPU,
+	"rollover": afpacket.FanoutRollover,
+	"random":   afpacket.FanoutRandom,
+	"qm":       afpacket.FanoutQueueMapping,
+}
+
+// AfpacketCaptureHandle reads packets from a memory mapped TPACKET_V3 ring
+type AfpacketCaptureHandle struct {
+	handle   *afpacket.TPacket
+	snaplen  int
+	linkType layers.LinkType
+}
+
+// A fanoutGroup of 0 disables fanout
+func NewAfpacketCaptureHandle(iface string, fanoutGroup int, timeout time.Duration) (CaptureHandle, error) {
+	opts, linkType, err := afpacketOptions(iface, timeout)
+	if err != nil {
+		return nil, err
+	}
+	var fanoutType afpacket.FanoutType
+	if fanoutGroup != 0 {
+		if fanoutType, err = afpacketFanoutType(cfg.Capture.Afpacket_fanout_type); err != nil {
+			return nil, err
+		}
+	}
+
+	handle, err := afpacket.NewTPacket(opts...)
+	if err != nil {
+		return nil, err
+	}
+
+	if fanoutGroup != 0 {
+		Logger().Infof("Joining afpacket fanout group %d on %q using %s fanout", fanoutGroup, iface, cfg.Capture.Afpacket_fanout_type)
+		if err := handle.SetFanout(fanoutType, uint16(fanoutGroup)); err != nil {
+			handle.Close()
+			return nil, err
+		}
+	}
+
+	return &AfpacketCaptureHandle{handle: handle, snaplen: cfg.Capture.Snaplen, linkType: linkType}, nil
+}
+
+// afpacketOptions returns the options of the ring capturing on an interface and the link type of the packets it reads
+func afpacketOptions(iface string, timeout time.Duration) ([]interface{}, layers.LinkType, error) {
+	opts := []interface{}{
+		afpacket.OptFrameSize(cfg.Capture.Afpacket_frame_size),
+		afpacket.OptBlockSize(cfg.Capture.Afpacket_block_size),
+		afpacket.OptNumBlocks(cfg.Capture.Afpacket_num_blocks),
+		afpacket.OptPollTimeout(timeout),
+		afpacket.TPacketVersion3,
+	}
+
+	// When capturing on all the interfaces (not binding to an interface), their link layers can differ so the kernel is asked to remove them
+	if iface == "any" {
+		return append(opts, afpacket.SocketDgram), layers.LinkTypeRaw, nil
+	}
+
+	netIface, err := net.InterfaceByName(iface)
+	if err != nil {
+		return nil, 0, err
+	}
+	// Interfaces without a hardware address (tun, wireguard, ...) don't have a link layer header
+	// The loopback has an all zeros address, which isn't reported, but its packets have an Ethernet header
+	linkType := layers.LinkTypeEthernet
+	if len(netIface.HardwareAddr) == 0 && netIface.Flags&net.FlagLoopback == 0 {
+		linkType = layers.LinkTypeRaw
+	}
+	return append(opts, afpacket.SocketRaw, afpacket.OptInterface(iface)), linkType, nil
+}
+
+func afpacketFanoutType(name string) (afpacket.FanoutType, error) {
+	fanoutType, ok := afpacketFanoutTypes[name]
+	if !ok {
+		return 0, fmt.Errorf("unknown afpacket fanout type %q", name)
+	}
+	return fanoutType, nil
+}
+
+func (self *AfpacketCaptureHandle) ZeroCopyReadPacketData() ([]byte, gopacket.CaptureInfo, error) {
+	data, ci, err := self.handle.ZeroCopyReadPacketData()
+	if err == afpacket.ErrTimeout {
+		err = ErrCaptureTimeout
+	}
+	return data, ci, err
+}
+
+// SetBPFFilter compiles the filter using libpcap and attaches the resulting program to the socket
+func (self *AfpacketCaptureHandle) SetBPFFilter(filter string) error {
+	instructions, err := pcap.CompileBPFFilter(self.linkType, self.snaplen, filter)
+	if err != nil {
+		return err
+	}
+	rawInstructions := make([]bpf.RawInstruction, len(instructions))
+	for i, instruction := range instructions {
+		rawInstructions[i] = bpf.RawInstruction{
+			Op: instruction.Code,
+			Jt: instruction.Jt,
+			Jf: instruction.Jf,
+			K:  instruction.K,
+		}
+	}
+	return self.handle.SetBPF(rawInstructions)
+}
+
+// LinkType is the link layer of the captured packets, raw IP when the interface has no hardware address
+func (self *AfpacketCaptureHandle) LinkType() layers.LinkType {
+	return self.linkType
+}
+
+// Stats reports the ring statistics. The kernel counters are accumulated by afpacket since they are reset on every read.
+func (self *AfpacketCaptureHandle) Stats() (*CaptureStats, error) {
+	_, statsV3, err := self.handle.SocketStats()
+	if err != nil {
+		return nil, err
+	}
+	return &CaptureStats{
+		PacketsReceived: uint64(statsV3.Packets()),
+		PacketsDropped:  uint64(statsV3.Drops()),
+		RingFreezes:     uint64(statsV3.QueueFreezes()),
+	}, nil
+}
+
+func (self *AfpacketCaptureHandle) Close() {
+	self.handle.Close()
+}
@@ -0,0 +1,87 @@
+//go:build linux
+// +build linux
+
+package main
+
+import (
+	"github.com/google/gopacket/afpacket"
+	"github.com/google/gopacket/layers"
+	"testing"
+	"time"
+)
+
+func TestAfpacketOptions(t *testing.T) {
+	tests := []struct {
+		iface      string
+		socketType afpacket.OptSocketType
+		linkType   layers.LinkType
+	}{
+		{"any", afpacket.SocketDgram, layers.LinkTypeRaw},
+		// The loopback has no hardware address but its packets have an Ethernet header
+		{"lo", afpacket.SocketRaw, layers.LinkTypeEthernet},
+	}
+	for _, test := range tests {
+		opts, linkType, err := afpacketOptions(test.iface, time.Second)
+		if err != nil {
+			t.Errorf("Can't build the options of %s : %s", test.iface, err)
+			continue
+		}
+		if linkType != test.linkType {
+			t.Errorf("Link type of %s is %s instead of %s", test.iface, linkType, test.linkType)
+		}
+
+		var socketType afpacket.OptSocketType
+		var boundIface afpacket.OptInterface
+		var frameSize afpacket.OptFrameSize
+		var pollTimeout afpacket.OptPollTimeout
+		for _, opt := range opts {
+			switch opt := opt.(type) {
+			case afpacket.OptSocketType:
+				socketType = opt
+			case afpacket.OptInterface:
+				boundIface = opt
+			case afpacket.OptFrameSize:
+				frameSize = opt
+			case afpacket.OptPollTimeout:
+				pollTimeout = opt
+			}
+		}
+		if socketType != test.socketType {
+			t.Errorf("Socket type of %s is %v instead of %v", test.iface, socketType, test.socketType)
+		}
+		// The any pseudo-interface is captured by not binding the socket
+		if test.iface == "any" && boundIface != "" || test.iface != "any" && string(boundIface) != test.iface {
+			t.Errorf("Socket of %s is bound to %q", test.iface, boundIface)
+		}
+		if int(frameSize) != cfg.Capture.Afpacket_frame_size || time.Duration(pollTimeout) != time.Second {
+			t.Errorf("Ring of %s doesn't have the configured frame size and timeout : %v %v", test.iface, frameSize, pollTimeout)
+		}
+	}
+
+	if _, _, err := afpacketOptions("garin-missing0", time.Second); err == nil {
+		t.Error("Options were built for an interface that doesn't exist")
+	}
+}
+
+func TestAfpacketFanoutType(t *testing.T) {
+	tests := []struct {
+		name       string
+		fanoutType afpacket.FanoutType
+		valid      bool
+	}{
+		{"hash", afpacket.FanoutHashWithDefrag, true},
+		{"lb", afpacket.FanoutLoadBalance, true},
+		{"cpu", afpacket.FanoutCPU, true},
+		{"rollover", afpacket.FanoutRollover, true},
+		{"random", afpacket.FanoutRandom, true},
+		{"qm", afpacket.FanoutQueueMapping, true},
+		{"HASH", 0, false},
+		{"", 0, false},
+	}
+	for _, test := range tests {
+		fanoutType, err := afpacketFanoutType(test.name)
+		if (err == nil) != test.valid || fanoutType != test.fanoutType {
+			t.Errorf("Fanout type %q is %v (%v) instead of %v", test.name, fanoutType, err, test.fanoutType)
+		}
+	}
+}
@@ -0,0 +1,13 @@
+//go:build !linux
+// +build !linux
+
+package main
+
+import (
+	"errors"
+	"time"
+)
+
+func NewAfpacketCaptureHandle(iface string, fanoutGroup int, timeout time.Duration) (CaptureHandle, error) {
+	return nil, errors.New("the afpacket capture backend is only available on Linux")
+}
@@ -0,0 +1,275 @@
+package main
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/julsemaan/garin/base"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	API_DEFAULT_LIMIT = 100
+	API_MAX_LIMIT     = 10000
+)
+
+// The queries are answered while someone waits for them so a lost connection is only retried once
+var apiRetryPolicy = base.RetryPolicy{MaxAttempts: 2, InitialBackoff: 100 * time.Millisecond, MaxBackoff: 100 * time.Millisecond}
+
+var apiCSVHeader = []string{"timestamp", "source_ip", "destination_ip", "server_name", "protocol", "interface", "tunnel_type", "tunnel_id", "source_port", "destination_port", "tls_fingerprint", "bytes_sent", "bytes_received", "packets_sent", "packets_received", "duration_ms", "out_of_order", "skipped_bytes", "end_reason"}
+
+// destinationsAPI answers the queries on the recorded destinations
+type destinationsAPI struct {
+	// The connections to the databases can't be shared by concurrent operations
+	mutex *sync.Mutex
+	db    base.GarinDB
+}
+
+func newDestinationsAPI(db base.GarinDB) *destinationsAPI {
+	return &destinationsAPI{mutex: &sync.Mutex{}, db: db}
+}
+
+type apiDestinationsResponse struct {
+	Destinations []*base.DestinationDocument `json:"destinations"`
+	Offset       int                         `json:"offset"`
+	Limit        int                         `json:"limit"`
+	// URL of the next page, when there is one
+	Next string `json:"next,omitempty"`
+}
+
+type apiErrorResponse struct {
+	Error string `json:"error"`
+}
+
+// Returns the type and the args of the database queried by the API
+// It is the output set in the configuration, or the first one that can be queried
+func queryDatabase() (string, string, error) {
+	if len(cfg.Output) == 0 {
+		if !base.SupportsQueries(cfg.Database.Type) {
+			return "", "", fmt.Errorf("the %s database can't be queried", cfg.Database.Type)
+		}
+		return cfg.Database.Type, cfg.Database.Args, nil
+	}
+	if cfg.Http.Query_output != "" {
+		outputCfg, ok := cfg.Output[cfg.Http.Query_output]
+		if !ok {
+			return "", "", fmt.Errorf("unknown output %s", cfg.Http.Query_output)
+		}
+		if !base.SupportsQueries(outputCfg.Type) {
+			return "", "", fmt.Errorf("the %s database of output %s can't be queried", outputCfg.Type, cfg.Http.Query_output)
+		}
+		return outputCfg.Type, outputCfg.Args, nil
+	}
+	names := make([]string, 0, len(cfg.Output))
+	for name := range cfg.Output {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		if base.SupportsQueries(cfg.Output[name].Type) {
+			return cfg.Output[name].Type, cfg.Output[name].Args, nil
+		}
+	}
+	return "", "", fmt.Errorf("none of the outputs can be queried")
+}
+
+// Parses a time that is either in RFC 3339, a local date or a duration before now (ex: 24h)
+func parseAPITime(value string, now time.Time) (time.Time, error) {
+	if timestamp, err := time.Parse(time.RFC3339, value); err == nil {
+		return timestamp, nil
+	}
+	if date, err := time.ParseInLocation("2006-01-02", value, time.Local); err == nil {
+		return date, nil
+	}
+	if duration, err := time.ParseDuration(value); err == nil {
+		return now.Add(-duration), nil
+	}
+	return time.Time{}, fmt.Errorf("invalid time %q, it must be in RFC 3339, a date or a duration", value)
+}
+
+// Builds the query of the parameters of a request along with the format of the response
+func parseAPIQuery(params url.Values, now time.Time) (*base.DestinationQuery, string, error) {
+	query := &base.DestinationQuery{
+		ServerName:      params.Get("server_name"),
+		ServerNameMatch: params.Get("match"),
+		Protocol:        params.Get("protocol"),
+		TLSFingerprint:  params.Get("tls_fingerprint"),
+		Limit:           API_DEFAULT_LIMIT,
+	}
+	var err error
+	if source := params.Get("source"); source != "" {
+		if query.Source, err = base.ParseSource(source); err != nil {
+			return nil, "", fmt.Errorf("invalid source %q: %s", source, err)
+		}
+	}
+	if since := params.Get("since"); since != "" {
+		if query.Since, err = parseAPITime(since, now); err != nil {
+			return nil, "", err
+		}
+	}
+	if until := params.Get("until"); until != "" {
+		if query.Until, err = parseAPITime(until, now); err != nil {
+			return nil, "", err
+		}
+	}
+	if limit := params.Get("limit"); limit != "" {
+		if query.Limit, err = strconv.Atoi(limit); err != nil || query.Limit <= 0 || query.Limit > API_MAX_LIMIT {
+			return nil, "", fmt.Errorf("invalid limit %q, it must be between 1 and %d", limit, API_MAX_LIMIT)
+		}
+	}
+	if offset := params.Get("offset"); offset != "" {
+		if query.Offset, err = strconv.Atoi(offset); err != nil {
+			return nil, "", fmt.Errorf("invalid offset %q", offset)
+		}
+	}
+	if err := query.Validate(); err != nil {
+		return nil, "", err
+	}
+
+	format := params.Get("format")
+	switch format {
+	case "":
+		format = "json"
+	case "json", "csv":
+	default:
+		return nil, "", fmt.Errorf("unknown format %q", format)
+	}
+	return query, format, nil
+}
+
+func (self *destinationsAPI) query(query *base.DestinationQuery) ([]*base.Destination, error) {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+	return self.db.QueryDestinations(query)
+}
+
+func (self *destinationsAPI) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" && r.Method != "HEAD" {
+		w.Header().Set("Allow", "GET, HEAD")
+		writeAPIError(w, http.StatusMethodNotAllowed, fmt.Errorf("method %s isn't allowed", r.Method))
+		return
+	}
+	query, format, err := parseAPIQuery(r.URL.Query(), time.Now())
+	if err != nil {
+		writeAPIError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	// One more destination is fetched to know if there is a next page
+	query.Limit++
+	destinations, err := self.query(query)
+	query.Limit--
+	if err != nil {
+		Logger().Errorf("can't query the destinations: %s", err)
+		status := http.StatusInternalServerError
+		if base.IsRetryable(err) {
+			status = http.StatusServiceUnavailable
+		} else if errors.Is(err, base.ErrResultWindowExceeded) {
+			status = http.StatusBadRequest
+		}
+		writeAPIError(w, status, err)
+		return
+	}
+	next := ""
+	if len(destinations) > query.Limit {
+		destinations = destinations[:query.Limit]
+		params := r.URL.Query()
+		params.Set("offset", strconv.Itoa(query.Offset+query.Limit))
+		next = r.URL.Path + "?" + params.Encode()
+		w.Header().Set("Link", "<"+next+`>; rel="next"`)
+	}
+
+	if format == "csv" {
+		w.Header().Set("Content-Type", "text/csv; charset=utf-8")
+		w.Header().Set("Content-Disposition", `attachment; filename="destinations.csv"`)
+		writer := csv.NewWriter(w)
+		writer.Write(apiCSVHeader)
+		for _, destination := range destinations {
+			writer.Write([]string{
+				destination.Timestamp.Format(time.RFC3339Nano),
+				destination.SourceIp,
+				destination.DestinationIp,
+				destination.ServerName,
+				destination.Protocol,
+				destination.Interface,
+				destination.TunnelType,
+				strconv.FormatUint(uint64(destination.TunnelId), 10),
+				strconv.FormatUint(uint64(destination.SourcePort), 10),
+				strconv.FormatUint(uint64(destination.DestinationPort), 10),
+				destination.TLSFingerprint,
+				strconv.FormatInt(destination.BytesSent, 10),
+				strconv.FormatInt(destination.BytesReceived, 10),
+				strconv.FormatInt(destination.PacketsSent, 10),
+				strconv.FormatInt(destination.PacketsReceived, 10),
+				strconv.FormatInt(destination.DurationMs, 10),
+				strconv.FormatInt(destination.OutOfOrder, 10),
+				strconv.FormatInt(destination.SkippedBytes, 10),
+				destination.EndReason,
+			})
+		}
+		writer.Flush()
+		return
+	}
+
+	response := &apiDestinationsResponse{Destinations: []*base.DestinationDocument{}, Offset: query.Offset, Limit: query.Limit, Next: next}
+	for _, destination := range destinations {
+		response.Destinations = append(response.Destinations, destination.Document())
+	}
+	writeAPIResponse(w, response)
+}
+
+func writeAPIResponse(w http.ResponseWriter, response interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(response)
+}
+
+func writeAPIError(w http.ResponseWriter, status int, err error) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(&apiErrorResponse{Error: err.Error()})
+}
+
+// runHTTPServer serves the metrics, the live feed and, when the destinations are recorded in a database that can be queried, the API and the dashboard
+func runHTTPServer() {
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", promhttp.HandlerFor(metricsRegistry, promhttp.HandlerOpts{}))
+	Logger().Infof("serving the metrics on http://%s/metrics", cfg.Http.Listen)
+	mux.Handle("/api/live", &liveAPI{})
+	Logger().Infof("serving the live feed on http://%s/api/live", cfg.Http.Listen)
+
+	if dbType, dbArgs, err := queryDatabase(); err != nil {
+		Logger().Warningf("the API is disabled: %s", err)
+	} else {
+		// The API doesn't keep retrying, while holding its lock, once garin is stopping
+		retry := apiRetryPolicy
+		retry.Stop = stopChan
+		db, err := base.NewGarinDB(dbType, dbArgs, retry, base.NewHealthState("the API"))
+		if err != nil {
+			base.Die("can't open the ", dbType, " database queried by the API: ", err)
+		}
+		api := newDestinationsAPI(db)
+		mux.Handle("/api/destinations", api)
+		mux.HandleFunc("/api/summary", api.serveSummary)
+		Logger().Infof("serving the API on http://%s/api/destinations", cfg.Http.Listen)
+		mux.Handle("/dashboard/", dashboardHandler())
+		mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+			if r.URL.Path != "/" {
+				http.NotFound(w, r)
+				return
+			}
+			http.Redirect(w, r, "/dashboard/", http.StatusFound)
+		})
+		Logger().Infof("serving the dashboard on http://%s/dashboard/", cfg.Http.Listen)
+	}
+
+	if err := http.ListenAndServe(cfg.Http.Listen, mux); err != nil {
+		base.Die("can't serve HTTP on ", cfg.Http.Listen, ": ", err)
+	}
+}
@@ -0,0 +1,95 @@
+package main
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"github.com/julsemaan/garin/base"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func newTestDestinationsAPI(t *testing.T, directory string) *destinationsAPI {
+	db, err := base.NewGarinDB("sqlite3", filepath.Join(directory, "garin.sqlite3"), apiRetryPolicy, base.NewHealthState("the API"))
+	if err != nil {
+		t.Fatalf("Can't open database : %s", err)
+	}
+	start := time.Date(2020, 1, 2, 12, 0, 0, 0, time.UTC)
+	var destinations []*base.Destination
+	for i, serverName := range []string{"example.com", "www.example.com", "example.org"} {
+		destination := base.NewDestination(serverName, "10.0.0.1", "192.0.2.1")
+		destination.Protocol = "HTTP"
+		destination.Timestamp = start.Add(time.Duration(i) * time.Hour)
+		destinations = append(destinations, destination)
+	}
+	destinations = append(destinations, &base.Destination{SourceIp: "10.0.1.1", DestinationIp: "192.0.2.1", ServerName: "other.example.com", Protocol: "TLS/SSL", Timestamp: start})
+	if err := db.RecordDestinations(destinations); err != nil {
+		t.Fatalf("Can't record destinations : %s", err)
+	}
+	return newDestinationsAPI(db)
+}
+
+func TestDestinationsAPI(t *testing.T) {
+	directory, _ := ioutil.TempDir("", "garin-api")
+	defer os.RemoveAll(directory)
+	api := newTestDestinationsAPI(t, directory)
+	defer api.db.Close()
+
+	get := func(url string) *httptest.ResponseRecorder {
+		recorder := httptest.NewRecorder()
+		api.ServeHTTP(recorder, httptest.NewRequest("GET", url, nil))
+		return recorder
+	}
+
+	recorder := get("/api/destinations?source=10.0.0.0/24&server_name=example.com&match=suffix&since=2020-01-02T12:00:00Z&limit=1")
+	response := &apiDestinationsResponse{}
+	if err := json.NewDecoder(recorder.Body).Decode(response); recorder.Code != http.StatusOK || err != nil {
+		t.Fatalf("Query returned %d : %v", recorder.Code, err)
+	}
+	if len(response.Destinations) != 1 || response.Destinations[0].ServerName != "www.example.com" {
+		t.Errorf("Query returned %+v", response.Destinations)
+	}
+	expectedNext := "/api/destinations?limit=1&match=suffix&offset=1&server_name=example.com&since=2020-01-02T12%3A00%3A00Z&source=10.0.0.0%2F24"
+	if response.Next != expectedNext || recorder.Header().Get("Link") != "<"+expectedNext+`>; rel="next"` {
+		t.Errorf("Next page is %s", response.Next)
+	}
+
+	response = &apiDestinationsResponse{}
+	json.NewDecoder(get(expectedNext).Body).Decode(response)
+	if len(response.Destinations) != 1 || response.Destinations[0].ServerName != "example.com" || response.Next != "" {
+		t.Errorf("Last page is %+v", response)
+	}
+
+	recorder = get("/api/destinations?protocol=http&format=csv")
+	records, err := csv.NewReader(recorder.Body).ReadAll()
+	if err != nil || recorder.Header().Get("Content-Type") != "text/csv; charset=utf-8" {
+		t.Fatalf("Invalid CSV export : %v", err)
+	}
+	if len(records) != 4 || records[0][0] != "timestamp" || records[1][0] != "2020-01-02T14:00:00Z" || records[1][3] != "example.org" {
+		t.Errorf("CSV export is %v", records)
+	}
+
+	for _, url := range []string{"/api/destinations?source=10.0.0", "/api/destinations?match=glob", "/api/destinations?limit=100000", "/api/destinations?since=yesterday", "/api/destinations?format=xml"} {
+		if recorder := get(url); recorder.Code != http.StatusBadRequest {
+			t.Errorf("%s returned %d", url, recorder.Code)
+		}
+	}
+}
+
+func TestParseAPITime(t *testing.T) {
+	now := time.Date(2020, 1, 2, 12, 0, 0, 0, time.UTC)
+	times := map[string]time.Time{
+		"2020-01-01T08:00:00-05:00": time.Date(2020, 1, 1, 13, 0, 0, 0, time.UTC),
+		"2020-01-01":                time.Date(2020, 1, 1, 0, 0, 0, 0, time.Local),
+		"24h":                       now.Add(-24 * time.Hour),
+	}
+	for value, expected := range times {
+		if parsed, err := parseAPITime(value, now); err != nil || !parsed.Equal(expected) {
+			t.Errorf("%s was parsed as %s instead of %s : %v", value, parsed, expected, err)
+		}
+	}
+}
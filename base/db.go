@@ -1,20 +1,33 @@
 package base
 
 import (
+	"math/rand"
 	"sync"
+	"time"
 )
 
 var creationMutex = &sync.Mutex{}
 
-var dbExists = false
+// The databases whose schema was migrated by this process, by type and args
+var schemaMigrated = map[string]bool{}
 
 const DESTINATIONS_TABLE_NAME = "destinations"
 
 type GarinDB interface {
 	Setup(string, string)
-	Open()
-	Close()
-	RecordDestination(*Destination)
+	Open() error
+	Close() error
+	RecordDestination(*Destination) error
+	// Records multiple destinations at once, which is much faster than recording them one by one
+	RecordDestinations([]*Destination) error
+	// Returns the recorded destinations selected by a validated query, or ErrQueriesNotSupported
+	QueryDestinations(*DestinationQuery) ([]*Destination, error)
+	// Counts the destinations selected by a validated query, the limit of the query is the amount of server names and clients returned
+	SummarizeDestinations(*DestinationQuery) (*DestinationSummary, error)
+	// Returns which of the server names were seen in the destinations selected by a validated query
+	SeenServerNames(*DestinationQuery, []string) (map[string]bool, error)
+	// Adds the sessions to the ones that were recorded, or returns ErrSessionsNotSupported
+	RecordSessions([]*Session) error
 }
 
 type AbstractGarinDB struct {
@@ -27,28 +40,297 @@ func (self *AbstractGarinDB) Setup(dbType string, dbArgs string) {
 	self.dbArgs = dbArgs
 }
 
-func (self *AbstractGarinDB) Open() {
+func (self *AbstractGarinDB) Open() error {
 	panic("unimplemented")
 }
 
-func (self *AbstractGarinDB) Close() {
+func (self *AbstractGarinDB) Close() error {
 	panic("unimplemented")
 }
 
-func (self *AbstractGarinDB) RecordDestination(destination *Destination) {
+func (self *AbstractGarinDB) RecordDestination(destination *Destination) error {
 	panic("unimplemented")
 }
 
-func NewGarinDB(dbType string, dbArgs string) GarinDB {
+func (self *AbstractGarinDB) RecordDestinations(destinations []*Destination) error {
+	panic("unimplemented")
+}
+
+// The databases are write only unless they implement the queries
+func (self *AbstractGarinDB) QueryDestinations(query *DestinationQuery) ([]*Destination, error) {
+	return nil, &DBError{Err: ErrQueriesNotSupported, Retryable: false}
+}
+
+func (self *AbstractGarinDB) SummarizeDestinations(query *DestinationQuery) (*DestinationSummary, error) {
+	return nil, &DBError{Err: ErrQueriesNotSupported, Retryable: false}
+}
+
+func (self *AbstractGarinDB) SeenServerNames(query *DestinationQuery, serverNames []string) (map[string]bool, error) {
+	return nil, &DBError{Err: ErrQueriesNotSupported, Retryable: false}
+}
+
+func (self *AbstractGarinDB) RecordSessions(sessions []*Session) error {
+	return &DBError{Err: ErrSessionsNotSupported, Retryable: false}
+}
+
+// RetryPolicy controls how the operations that fail with a retryable error are retried
+type RetryPolicy struct {
+	// Amount of times an operation is attempted, including the first one
+	MaxAttempts int
+	// Time to wait after the first failure, it doubles after each failure up to MaxBackoff
+	InitialBackoff time.Duration
+	MaxBackoff     time.Duration
+	// Closing Stop interrupts the backoff and stops the retries (ex: when shutting down), nil never stops them
+	Stop <-chan int
+}
+
+// Backoff gives the time to wait before the next attempt after a number of failures
+// A random jitter of up to half the backoff is removed so the recording threads don't all reconnect at the same time
+func (self RetryPolicy) Backoff(failures int) time.Duration {
+	backoff := self.InitialBackoff
+	for i := 1; i < failures && backoff < self.MaxBackoff; i++ {
+		backoff *= 2
+	}
+	if backoff > self.MaxBackoff {
+		backoff = self.MaxBackoff
+	}
+	if backoff <= 0 {
+		return 0
+	}
+	return backoff - time.Duration(rand.Int63n(int64(backoff)/2+1))
+}
+
+// Waits for the backoff and returns false if the retries were stopped before or while waiting
+func (self RetryPolicy) wait(backoff time.Duration) bool {
+	select {
+	case <-self.Stop:
+		return false
+	default:
+	}
+	timer := time.NewTimer(backoff)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return true
+	case <-self.Stop:
+		return false
+	}
+}
+
+// HealthState is the state of a database as seen by the connections that share it
+// Each output has its own so a database being unavailable doesn't make the others look unhealthy
+type HealthState struct {
+	name      string
+	mutex     *sync.Mutex
+	healthy   bool
+	since     time.Time
+	lastError error
+}
+
+// NewHealthState creates the health of a database, the name identifies who uses it in the logs
+func NewHealthState(name string) *HealthState {
+	return &HealthState{name: name, mutex: &sync.Mutex{}, healthy: true, since: time.Now()}
+}
+
+// Healthy returns whether or not the last operation on the database succeeded
+func (self *HealthState) Healthy() bool {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+	return self.healthy
+}
+
+// Status returns whether or not the database is healthy, since when and the last error that occured
+func (self *HealthState) Status() (bool, time.Time, error) {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+	return self.healthy, self.since, self.lastError
+}
+
+func (self *HealthState) succeeded() {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+	if !self.healthy {
+		Logger().Infof("database of %s is available again after %s", self.name, time.Since(self.since))
+		self.healthy = true
+		self.since = time.Now()
+	}
+}
+
+// Only the retryable errors make the database unhealthy since the permanent ones are caused by what is recorded
+func (self *HealthState) failed(err error) {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+	self.lastError = err
+	if self.healthy && IsRetryable(err) {
+		Logger().Errorf("database of %s is unavailable: %s", self.name, err)
+		self.healthy = false
+		self.since = time.Now()
+	}
+}
+
+// ReconnectingGarinDB reopens the database it wraps when an operation fails with a retryable error and retries the operation
+// The database isn't opened until the first operation when opening it fails with a retryable error
+type ReconnectingGarinDB struct {
+	db     GarinDB
+	opened bool
+	retry  RetryPolicy
+	health *HealthState
+}
+
+func (self *ReconnectingGarinDB) Setup(dbType string, dbArgs string) {
+	self.db.Setup(dbType, dbArgs)
+}
+
+func (self *ReconnectingGarinDB) Open() error {
+	return self.do(func() error { return nil })
+}
+
+func (self *ReconnectingGarinDB) Close() error {
+	if !self.opened {
+		return nil
+	}
+	self.opened = false
+	return self.db.Close()
+}
+
+func (self *ReconnectingGarinDB) RecordDestination(destination *Destination) error {
+	return self.do(func() error { return self.db.RecordDestination(destination) })
+}
+
+func (self *ReconnectingGarinDB) RecordDestinations(destinations []*Destination) error {
+	return self.do(func() error { return self.db.RecordDestinations(destinations) })
+}
+
+func (self *ReconnectingGarinDB) QueryDestinations(query *DestinationQuery) ([]*Destination, error) {
+	var destinations []*Destination
+	err := self.do(func() error {
+		var err error
+		destinations, err = self.db.QueryDestinations(query)
+		return err
+	})
+	return destinations, err
+}
+
+func (self *ReconnectingGarinDB) SummarizeDestinations(query *DestinationQuery) (*DestinationSummary, error) {
+	var summary *DestinationSummary
+	err := self.do(func() error {
+		var err error
+		summary, err = self.db.SummarizeDestinations(query)
+		return err
+	})
+	return summary, err
+}
+
+func (self *ReconnectingGarinDB) SeenServerNames(query *DestinationQuery, serverNames []string) (map[string]bool, error) {
+	var seen map[string]bool
+	err := self.do(func() error {
+		var err error
+		seen, err = self.db.SeenServerNames(query, serverNames)
+		return err
+	})
+	return seen, err
+}
+
+func (self *ReconnectingGarinDB) RecordSessions(sessions []*Session) error {
+	return self.do(func() error { return self.db.RecordSessions(sessions) })
+}
+
+// Opens the database if needed and runs the operation, retrying both as long as they fail with a retryable error
+func (self *ReconnectingGarinDB) do(operation func() error) error {
+	for failures := 1; ; failures++ {
+		var err error
+		if !self.opened {
+			err = self.db.Open()
+			self.opened = err == nil
+		}
+		if self.opened {
+			err = operation()
+		}
+		if err == nil {
+			self.health.succeeded()
+			return nil
+		}
+
+		err = classifyError(err)
+		self.health.failed(err)
+		if !IsRetryable(err) {
+			return err
+		}
+		// The connection can't be trusted anymore
+		if self.opened {
+			self.Close()
+		}
+		if failures >= self.retry.MaxAttempts {
+			return err
+		}
+		backoff := self.retry.Backoff(failures)
+		// The server can ask to wait longer than the backoff but not longer than the policy allows, it would hold the recording thread
+		if retryAfter := RetryAfter(err); retryAfter > backoff {
+			backoff = retryAfter
+			if backoff > self.retry.MaxBackoff {
+				backoff = self.retry.MaxBackoff
+			}
+		}
+		Logger().Warningf("database operation failed, retrying in %s: %s", backoff, err)
+		if !self.retry.wait(backoff) {
+			Logger().Warningf("database operation failed and the retries were stopped: %s", err)
+			return err
+		}
+	}
+}
+
+// NewReconnectingGarinDB wraps a database that was setup but not opened yet, the outcome of its operations updates the health
+// An error is only returned when the database can't be used at all, when it is unavailable the connection is retried on the first operation
+func NewReconnectingGarinDB(db GarinDB, retry RetryPolicy, health *HealthState) (*ReconnectingGarinDB, error) {
+	reconnectingDB := &ReconnectingGarinDB{db: db, retry: retry, health: health}
+	// Attempting to open the database only once avoids blocking the startup when it is unavailable
+	err := db.Open()
+	if err != nil {
+		err = classifyError(err)
+		health.failed(err)
+		if !IsRetryable(err) {
+			return nil, err
+		}
+		Logger().Warningf("can't open the database, it will be retried later: %s", err)
+	} else {
+		reconnectingDB.opened = true
+		health.succeeded()
+	}
+	return reconnectingDB, nil
+}
+
+// SupportsQueries returns whether or not the destinations recorded in a type of database can be queried
+func SupportsQueries(dbType string) bool {
+	switch dbType {
+	case "kafka", "syslog", "webhook", "ipfix":
+		return false
+	}
+	return true
+}
+
+// NewGarinDB creates and opens a connection to the database that reconnects according to the retry policy
+func NewGarinDB(dbType string, dbArgs string, retry RetryPolicy, health *HealthState) (GarinDB, error) {
 	var db GarinDB
 	switch dbType {
 	case "mongodb":
 		db = &MongoGarinDB{}
+	case "postgres":
+		db = &PostgresGarinDB{}
+	case "jsonl":
+		db = &JSONLGarinDB{}
+	case "elasticsearch":
+		db = &ElasticsearchGarinDB{}
+	case "kafka":
+		db = &KafkaGarinDB{}
+	case "syslog":
+		db = &SyslogGarinDB{}
+	case "webhook":
+		db = &WebhookGarinDB{}
+	case "ipfix":
+		db = &IPFIXGarinDB{}
 	default:
 		db = &SQLGarinDB{}
 	}
-
 	db.Setup(dbType, dbArgs)
-	db.Open()
-	return db
+	return NewReconnectingGarinDB(db, retry, health)
 }
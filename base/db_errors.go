@@ -0,0 +1,183 @@
+package base
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"github.com/go-sql-driver/mysql"
+	"github.com/lib/pq"
+	"github.com/mattn/go-sqlite3"
+	"github.com/twmb/franz-go/pkg/kerr"
+	"github.com/twmb/franz-go/pkg/kgo"
+	"gopkg.in/mgo.v2"
+	"io"
+	"net"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// DBError is an error of a database backend along with whether or not retrying the operation can succeed
+type DBError struct {
+	Err       error
+	Retryable bool
+}
+
+func (self *DBError) Error() string {
+	return self.Err.Error()
+}
+
+func (self *DBError) Unwrap() error {
+	return self.Err
+}
+
+// IsRetryable tells if an error is transient (ex: connection lost, database locked) or permanent (ex: invalid data)
+// The errors are looked up in the whole chain so wrapping them doesn't change how they are classified
+func IsRetryable(err error) bool {
+	var dbErr *DBError
+	if errors.As(err, &dbErr) {
+		return dbErr.Retryable
+	}
+	return isRetryableError(err)
+}
+
+// RetryAfter returns the minimum time to wait before retrying the operation that failed, 0 if it can be retried after the usual backoff
+func RetryAfter(err error) time.Duration {
+	var httpErr *HTTPStatusError
+	if errors.As(err, &httpErr) {
+		return httpErr.RetryAfter
+	}
+	return 0
+}
+
+func classifyError(err error) error {
+	if err == nil {
+		return nil
+	}
+	var dbErr *DBError
+	if errors.As(err, &dbErr) {
+		return err
+	}
+	return &DBError{Err: err, Retryable: isRetryableError(err)}
+}
+
+// MySQL server errors that are caused by the state of the server rather than the query
+var retryableMySQLErrors = map[uint16]bool{
+	1040: true, // Too many connections
+	1053: true, // Server shutdown in progress
+	1205: true, // Lock wait timeout exceeded
+	1213: true, // Deadlock found when trying to get lock
+	1290: true, // Running with the --read-only option
+}
+
+// PostgreSQL errors that are caused by the state of the server rather than the query
+// All the errors of the connection exception class (08) are retryable as well
+var retryablePostgresErrors = map[pq.ErrorCode]bool{
+	"40001": true, // serialization_failure
+	"40P01": true, // deadlock_detected
+	"53300": true, // too_many_connections
+	"57P01": true, // admin_shutdown
+	"57P02": true, // crash_shutdown
+	"57P03": true, // cannot_connect_now
+}
+
+// MongoDB server errors that are caused by the state of the replica set rather than the query
+var retryableMongoErrors = map[int]bool{
+	6:     true, // HostUnreachable
+	7:     true, // HostNotFound
+	89:    true, // NetworkTimeout
+	91:    true, // ShutdownInProgress
+	189:   true, // PrimarySteppedDown
+	10107: true, // NotMaster
+	11600: true, // InterruptedAtShutdown
+	11602: true, // InterruptedDueToReplStateChange
+	13435: true, // NotMasterNoSlaveOk
+}
+
+// Messages of the connection errors that the drivers don't expose as typed errors
+var retryableErrorMessages = []string{
+	"no reachable servers",
+	"Closed explicitly",
+	"connection reset",
+	"connection refused",
+	"broken pipe",
+	"i/o timeout",
+}
+
+// Errors of the TLS handshake and of the name resolution that retrying can't fix (ex: invalid certificate, unknown host)
+// They are looked up before the others since they can be wrapped in a network error
+func isPermanentNetworkError(err error) bool {
+	var unknownAuthorityErr x509.UnknownAuthorityError
+	var hostnameErr x509.HostnameError
+	var certificateInvalidErr x509.CertificateInvalidError
+	var certificateVerificationErr *tls.CertificateVerificationError
+	var recordHeaderErr tls.RecordHeaderError
+	var alertErr tls.AlertError
+	var dnsErr *net.DNSError
+	switch {
+	case errors.As(err, &unknownAuthorityErr), errors.As(err, &hostnameErr), errors.As(err, &certificateInvalidErr), errors.As(err, &certificateVerificationErr):
+		return true
+	case errors.As(err, &recordHeaderErr), errors.As(err, &alertErr):
+		return true
+	case errors.As(err, &dnsErr):
+		return dnsErr.IsNotFound
+	}
+	return false
+}
+
+func isRetryableError(err error) bool {
+	if isPermanentNetworkError(err) {
+		return false
+	}
+
+	// A closed connection is reopened by the retry
+	for _, retryableErr := range []error{driver.ErrBadConn, sql.ErrConnDone, mysql.ErrInvalidConn, io.EOF, io.ErrUnexpectedEOF, context.DeadlineExceeded, net.ErrClosed, kgo.ErrRecordTimeout, kgo.ErrRecordRetries} {
+		if errors.Is(err, retryableErr) {
+			return true
+		}
+	}
+
+	// The other network errors (ex: *url.Error, *net.OpError) are only retryable when they time out or wrap one of the retryable errnos below
+	var netErr net.Error
+	if errors.As(err, &netErr) && netErr.Timeout() {
+		return true
+	}
+
+	var errno syscall.Errno
+	var mysqlErr *mysql.MySQLError
+	var kafkaErr *kerr.Error
+	var httpErr *HTTPStatusError
+	var postgresErr *pq.Error
+	var sqliteErr sqlite3.Error
+	var mongoLastErr *mgo.LastError
+	var mongoQueryErr *mgo.QueryError
+	switch {
+	case errors.As(err, &errno):
+		return errno == syscall.ECONNRESET || errno == syscall.ECONNREFUSED || errno == syscall.EPIPE || errno == syscall.ETIMEDOUT
+	case errors.As(err, &mysqlErr):
+		return retryableMySQLErrors[mysqlErr.Number]
+	case errors.As(err, &kafkaErr):
+		return kafkaErr.Retriable
+	case errors.As(err, &httpErr):
+		return httpErr.Retryable()
+	case errors.As(err, &postgresErr):
+		return retryablePostgresErrors[postgresErr.Code] || postgresErr.Code.Class() == "08"
+	case errors.As(err, &sqliteErr):
+		return sqliteErr.Code == sqlite3.ErrBusy || sqliteErr.Code == sqlite3.ErrLocked
+	case errors.As(err, &mongoLastErr):
+		return retryableMongoErrors[mongoLastErr.Code]
+	case errors.As(err, &mongoQueryErr):
+		return retryableMongoErrors[mongoQueryErr.Code]
+	}
+
+	message := err.Error()
+	for _, retryableMessage := range retryableErrorMessages {
+		if strings.Contains(message, retryableMessage) {
+			return true
+		}
+	}
+	return false
+}
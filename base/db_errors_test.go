@@ -0,0 +1,75 @@
+package base
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"database/sql/driver"
+	"errors"
+	"fmt"
+	"github.com/go-sql-driver/mysql"
+	"github.com/lib/pq"
+	"github.com/mattn/go-sqlite3"
+	"net"
+	"net/url"
+	"os"
+	"syscall"
+	"testing"
+)
+
+func TestIsRetryable(t *testing.T) {
+	tests := []struct {
+		err       error
+		retryable bool
+	}{
+		{driver.ErrBadConn, true},
+		{&mysql.MySQLError{Number: 1213, Message: "Deadlock found when trying to get lock"}, true},
+		{&mysql.MySQLError{Number: 1406, Message: "Data too long for column"}, false},
+		{&pq.Error{Code: "08006"}, true},
+		{&pq.Error{Code: "40P01"}, true},
+		{&pq.Error{Code: "22P02"}, false},
+		{sqlite3.Error{Code: sqlite3.ErrBusy}, true},
+		{sqlite3.Error{Code: sqlite3.ErrConstraint}, false},
+		{errors.New("dial tcp 127.0.0.1:5432: connect: connection refused"), true},
+		{errors.New("invalid input syntax for type inet"), false},
+		{&DBError{Err: errors.New("database is unavailable"), Retryable: true}, true},
+		{fmt.Errorf("recording batch: %w", driver.ErrBadConn), true},
+		{fmt.Errorf("recording batch: %w", &mysql.MySQLError{Number: 1205, Message: "Lock wait timeout exceeded"}), true},
+		{fmt.Errorf("recording batch: %w", &pq.Error{Code: "22P02"}), false},
+		{fmt.Errorf("recording batch: %w", &DBError{Err: errors.New("invalid data"), Retryable: false}), false},
+		{syscall.ECONNRESET, true},
+		{syscall.EINVAL, false},
+		{&url.Error{Op: "Post", URL: "http://127.0.0.1:8080", Err: &net.OpError{Op: "dial", Net: "tcp", Err: os.NewSyscallError("connect", syscall.ECONNREFUSED)}}, true},
+		{&net.OpError{Op: "write", Net: "tcp", Err: os.NewSyscallError("write", syscall.EPIPE)}, true},
+		{&net.OpError{Op: "dial", Net: "tcp", Err: os.NewSyscallError("connect", syscall.EHOSTUNREACH)}, false},
+		{&url.Error{Op: "Post", URL: "http://127.0.0.1:8080", Err: &net.DNSError{Err: "i/o timeout", Name: "hooks.example.com", IsTimeout: true}}, true},
+		{fmt.Errorf("sending batch: %w", net.ErrClosed), true},
+		// Retrying can't fix the TLS and name resolution errors
+		{&url.Error{Op: "Post", URL: "https://hooks.example.com", Err: x509.UnknownAuthorityError{}}, false},
+		{&url.Error{Op: "Post", URL: "https://hooks.example.com", Err: &tls.CertificateVerificationError{Err: x509.HostnameError{Host: "hooks.example.com", Certificate: &x509.Certificate{}}}}, false},
+		{&net.OpError{Op: "remote error", Err: tls.AlertError(42)}, false},
+		{tls.RecordHeaderError{Msg: "first record does not look like a TLS handshake"}, false},
+		{&url.Error{Op: "Post", URL: "https://hooks.example.com", Err: &net.OpError{Op: "dial", Net: "tcp", Err: &net.DNSError{Err: "no such host", Name: "hooks.example.com", IsNotFound: true}}}, false},
+	}
+	for _, test := range tests {
+		if IsRetryable(test.err) != test.retryable {
+			t.Errorf("IsRetryable(%q) is %v instead of %v", test.err, !test.retryable, test.retryable)
+		}
+	}
+}
+
+func TestClassifyWrappedError(t *testing.T) {
+	err := classifyError(fmt.Errorf("recording batch: %w", &DBError{Err: errors.New("invalid data"), Retryable: false}))
+	var dbErr *DBError
+	if !errors.As(err, &dbErr) || dbErr.Retryable {
+		t.Errorf("The wrapped DBError was classified again: %#v", err)
+	}
+
+	err = classifyError(fmt.Errorf("recording batch: %w", sqlite3.Error{Code: sqlite3.ErrBusy}))
+	if !IsRetryable(err) {
+		t.Errorf("The wrapped SQLite error isn't retryable: %#v", err)
+	}
+	var sqliteErr sqlite3.Error
+	if !errors.As(err, &sqliteErr) || sqliteErr.Code != sqlite3.ErrBusy {
+		t.Errorf("The SQLite error can't be unwrapped from the DBError: %#v", err)
+	}
+}
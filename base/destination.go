@@ -12,10 +12,110 @@ type Destination struct {
 	ServerName    string    `db:"server_name"`
 	Protocol      string    `db:"protocol"`
 	Timestamp     time.Time `db:"timestamp"`
+	Interface     string    `db:"interface"`
+	TunnelType    string    `db:"tunnel_type"`
+	TunnelId      uint32    `db:"tunnel_id"`
+	// The ports and the fingerprint aren't part of the hash since the source port changes with every connection
+	SourcePort      uint16 `db:"source_port"`
+	DestinationPort uint16 `db:"destination_port"`
+	// JA3 fingerprint of the TLS client hello
+	TLSFingerprint string `db:"tls_fingerprint"`
+	Traffic
+}
+
+// How a connection ended
+const (
+	END_REASON_FIN = "fin"
+	END_REASON_RST = "rst"
+	// No packets were seen for a while or the capture ended before the connection did
+	END_REASON_FLUSH = "flush"
+)
+
+// Traffic is what was reassembled of the connection of a destination, in both directions
+// Sent is from the source to the destination and received is the other way around
+type Traffic struct {
+	BytesSent       int64 `db:"bytes_sent" json:"bytes_sent"`
+	BytesReceived   int64 `db:"bytes_received" json:"bytes_received"`
+	PacketsSent     int64 `db:"packets_sent" json:"packets_sent"`
+	PacketsReceived int64 `db:"packets_received" json:"packets_received"`
+	// Time between the first and the last packet of the connection
+	DurationMs int64 `db:"duration_ms" json:"duration_ms"`
+	// Packets seen before ones that were sent earlier
+	OutOfOrder int64 `db:"out_of_order" json:"out_of_order"`
+	// Bytes that were never seen, the assembler skips them when it gives up waiting for them
+	SkippedBytes int64  `db:"skipped_bytes" json:"skipped_bytes"`
+	EndReason    string `db:"end_reason" json:"end_reason"`
+}
+
+func (self Traffic) Bytes() int64 {
+	return self.BytesSent + self.BytesReceived
+}
+
+func (self Traffic) Packets() int64 {
+	return self.PacketsSent + self.PacketsReceived
 }
 
 func (self *Destination) Hash() string {
-	return fmt.Sprintf("%x", md5.Sum([]byte(self.SourceIp+self.DestinationIp+self.ServerName+self.Protocol)))
+	return fmt.Sprintf("%x", md5.Sum([]byte(self.SourceIp+self.DestinationIp+self.ServerName+self.Protocol+self.Interface+self.TunnelType+fmt.Sprint(self.TunnelId))))
+}
+
+// DestinationDocument is how a destination is represented in the outputs that serialize it to JSON
+type DestinationDocument struct {
+	Timestamp     time.Time `json:"timestamp"`
+	SourceIp      string    `json:"source_ip"`
+	DestinationIp string    `json:"destination_ip"`
+	ServerName    string    `json:"server_name"`
+	Protocol      string    `json:"protocol"`
+	Interface     string    `json:"interface,omitempty"`
+	TunnelType    string    `json:"tunnel_type,omitempty"`
+	TunnelId      uint32    `json:"tunnel_id,omitempty"`
+	// Empty for the destinations recorded by older versions
+	SourcePort      uint16 `json:"source_port,omitempty"`
+	DestinationPort uint16 `json:"destination_port,omitempty"`
+	TLSFingerprint  string `json:"tls_fingerprint,omitempty"`
+	// Only set when the traffic of the connection is known
+	Traffic *Traffic `json:"traffic,omitempty"`
+}
+
+func (self *Destination) Document() *DestinationDocument {
+	document := &DestinationDocument{
+		Timestamp:       self.Timestamp,
+		SourceIp:        self.SourceIp,
+		DestinationIp:   self.DestinationIp,
+		ServerName:      self.ServerName,
+		Protocol:        self.Protocol,
+		Interface:       self.Interface,
+		TunnelType:      self.TunnelType,
+		TunnelId:        self.TunnelId,
+		SourcePort:      self.SourcePort,
+		DestinationPort: self.DestinationPort,
+		TLSFingerprint:  self.TLSFingerprint,
+	}
+	if self.Traffic != (Traffic{}) {
+		traffic := self.Traffic
+		document.Traffic = &traffic
+	}
+	return document
+}
+
+func (self *DestinationDocument) Destination() *Destination {
+	destination := &Destination{
+		Timestamp:       self.Timestamp,
+		SourceIp:        self.SourceIp,
+		DestinationIp:   self.DestinationIp,
+		ServerName:      self.ServerName,
+		Protocol:        self.Protocol,
+		Interface:       self.Interface,
+		TunnelType:      self.TunnelType,
+		TunnelId:        self.TunnelId,
+		SourcePort:      self.SourcePort,
+		DestinationPort: self.DestinationPort,
+		TLSFingerprint:  self.TLSFingerprint,
+	}
+	if self.Traffic != nil {
+		destination.Traffic = *self.Traffic
+	}
+	return destination
 }
 
 func NewDestination(serverName string, sourceIp string, destIp string) *Destination {
@@ -23,8 +123,20 @@ func NewDestination(serverName string, sourceIp string, destIp string) *Destinat
 	return destination
 }
 
-func (self *Destination) Save(db GarinDB) {
+func (self *Destination) Save(db GarinDB) error {
 	Logger().Debugf("Saving destination - %s", self.Hash())
-	db.RecordDestination(self)
+	if err := db.RecordDestination(self); err != nil {
+		return err
+	}
 	Logger().Debugf("Destination saved - %s", self.Hash())
+	return nil
+}
+
+func SaveDestinations(destinations []*Destination, db GarinDB) error {
+	Logger().Debugf("Saving %d destinations", len(destinations))
+	if err := db.RecordDestinations(destinations); err != nil {
+		return err
+	}
+	Logger().Debugf("%d destinations saved", len(destinations))
+	return nil
 }
@@ -0,0 +1,144 @@
+package base
+
+import (
+	"encoding/binary"
+)
+
+// Avro schema of the destinations encoded by AppendDestinationAvro
+const DESTINATION_AVRO_SCHEMA = `{
+	"type": "record",
+	"name": "Destination",
+	"namespace": "com.github.julsemaan.garin",
+	"fields": [
+		{"name": "timestamp", "type": {"type": "long", "logicalType": "timestamp-micros"}},
+		{"name": "source_ip", "type": "string"},
+		{"name": "destination_ip", "type": "string"},
+		{"name": "server_name", "type": "string"},
+		{"name": "protocol", "type": "string"},
+		{"name": "interface", "type": "string"},
+		{"name": "tunnel_type", "type": "string"},
+		{"name": "tunnel_id", "type": "long"},
+		{"name": "bytes_sent", "type": "long", "default": 0},
+		{"name": "bytes_received", "type": "long", "default": 0},
+		{"name": "packets_sent", "type": "long", "default": 0},
+		{"name": "packets_received", "type": "long", "default": 0},
+		{"name": "duration_ms", "type": "long", "default": 0},
+		{"name": "out_of_order", "type": "long", "default": 0},
+		{"name": "skipped_bytes", "type": "long", "default": 0},
+		{"name": "end_reason", "type": "string", "default": ""},
+		{"name": "source_port", "type": "int", "default": 0},
+		{"name": "destination_port", "type": "int", "default": 0},
+		{"name": "tls_fingerprint", "type": "string", "default": ""}
+	]
+}`
+
+// Protocol Buffers schema of the destinations encoded by AppendDestinationProtobuf
+const DESTINATION_PROTOBUF_SCHEMA = `syntax = "proto3";
+
+package garin;
+
+message Destination {
+  // Microseconds since the epoch
+  int64 timestamp = 1;
+  string source_ip = 2;
+  string destination_ip = 3;
+  string server_name = 4;
+  string protocol = 5;
+  string interface = 6;
+  string tunnel_type = 7;
+  uint32 tunnel_id = 8;
+  // Traffic of the connection, sent is from the source IP to the destination IP
+  int64 bytes_sent = 9;
+  int64 bytes_received = 10;
+  int64 packets_sent = 11;
+  int64 packets_received = 12;
+  int64 duration_ms = 13;
+  int64 out_of_order = 14;
+  int64 skipped_bytes = 15;
+  string end_reason = 16;
+  uint32 source_port = 17;
+  uint32 destination_port = 18;
+  // JA3 fingerprint of the TLS client hello
+  string tls_fingerprint = 19;
+}
+`
+
+func appendAvroLong(dst []byte, value int64) []byte {
+	return binary.AppendVarint(dst, value)
+}
+
+func appendAvroString(dst []byte, value string) []byte {
+	dst = appendAvroLong(dst, int64(len(value)))
+	return append(dst, value...)
+}
+
+// AppendDestinationAvro appends the Avro binary encoding of a destination, without any container or framing
+func AppendDestinationAvro(dst []byte, destination *Destination) []byte {
+	dst = appendAvroLong(dst, destination.Timestamp.UnixNano()/1000)
+	dst = appendAvroString(dst, destination.SourceIp)
+	dst = appendAvroString(dst, destination.DestinationIp)
+	dst = appendAvroString(dst, destination.ServerName)
+	dst = appendAvroString(dst, destination.Protocol)
+	dst = appendAvroString(dst, destination.Interface)
+	dst = appendAvroString(dst, destination.TunnelType)
+	dst = appendAvroLong(dst, int64(destination.TunnelId))
+	dst = appendAvroLong(dst, destination.BytesSent)
+	dst = appendAvroLong(dst, destination.BytesReceived)
+	dst = appendAvroLong(dst, destination.PacketsSent)
+	dst = appendAvroLong(dst, destination.PacketsReceived)
+	dst = appendAvroLong(dst, destination.DurationMs)
+	dst = appendAvroLong(dst, destination.OutOfOrder)
+	dst = appendAvroLong(dst, destination.SkippedBytes)
+	dst = appendAvroString(dst, destination.EndReason)
+	dst = appendAvroLong(dst, int64(destination.SourcePort))
+	dst = appendAvroLong(dst, int64(destination.DestinationPort))
+	return appendAvroString(dst, destination.TLSFingerprint)
+}
+
+// Wire types of the Protocol Buffers fields
+const (
+	protobufVarint = 0
+	protobufBytes  = 2
+)
+
+func appendProtobufVarint(dst []byte, field int, value uint64) []byte {
+	// Fields with the default value aren't encoded in proto3
+	if value == 0 {
+		return dst
+	}
+	dst = binary.AppendUvarint(dst, uint64(field<<3|protobufVarint))
+	return binary.AppendUvarint(dst, value)
+}
+
+func appendProtobufString(dst []byte, field int, value string) []byte {
+	if value == "" {
+		return dst
+	}
+	dst = binary.AppendUvarint(dst, uint64(field<<3|protobufBytes))
+	dst = binary.AppendUvarint(dst, uint64(len(value)))
+	return append(dst, value...)
+}
+
+// AppendDestinationProtobuf appends the Protocol Buffers encoding of a destination
+func AppendDestinationProtobuf(dst []byte, destination *Destination) []byte {
+	dst = appendProtobufVarint(dst, 1, uint64(destination.Timestamp.UnixNano()/1000))
+	dst = appendProtobufString(dst, 2, destination.SourceIp)
+	dst = appendProtobufString(dst, 3, destination.DestinationIp)
+	dst = appendProtobufString(dst, 4, destination.ServerName)
+	dst = appendProtobufString(dst, 5, destination.Protocol)
+	dst = appendProtobufString(dst, 6, destination.Interface)
+	dst = appendProtobufString(dst, 7, destination.TunnelType)
+	dst = appendProtobufVarint(dst, 8, uint64(destination.TunnelId))
+	// The int64 fields are encoded as the two's complement of their value
+	dst = appendProtobufVarint(dst, 9, uint64(destination.BytesSent))
+	dst = appendProtobufVarint(dst, 10, uint64(destination.BytesReceived))
+	dst = appendProtobufVarint(dst, 11, uint64(destination.PacketsSent))
+	dst = appendProtobufVarint(dst, 12, uint64(destination.PacketsReceived))
+	dst = appendProtobufVarint(dst, 13, uint64(destination.DurationMs))
+	dst = appendProtobufVarint(dst, 14, uint64(destination.OutOfOrder))
+	dst = appendProtobufVarint(dst, 15, uint64(destination.SkippedBytes))
+	dst = appendProtobufString(dst, 16, destination.EndReason)
+	dst = appendProtobufVarint(dst, 17, uint64(destination.SourcePort))
+	dst = appendProtobufVarint(dst, 18, uint64(destination.DestinationPort))
+	return appendProtobufString(dst, 19, destination.TLSFingerprint)
+}
@@ -0,0 +1,272 @@
+package base
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// Stands in for an Elasticsearch cluster, the searches return all the documents and their aggregations count all of them
+// The first attempt of the documents whose server name starts with "busy" is rejected with a 429
+type testElasticsearch struct {
+	mutex     *sync.Mutex
+	templates map[string]string
+	// Documents by index and ID
+	documents map[string]map[string]DestinationDocument
+	attempts  map[string]int
+	auth      []string
+	// Path and body of the last search
+	searchPath string
+	search     map[string]interface{}
+}
+
+func newTestElasticsearch() (*testElasticsearch, *httptest.Server) {
+	cluster := &testElasticsearch{mutex: &sync.Mutex{}, templates: map[string]string{}, documents: map[string]map[string]DestinationDocument{}, attempts: map[string]int{}}
+	return cluster, httptest.NewServer(cluster)
+}
+
+func (self *testElasticsearch) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+	self.auth = append(self.auth, r.Header.Get("Authorization"))
+
+	if r.Method == "PUT" && strings.HasPrefix(r.URL.Path, "/_index_template/") {
+		template := map[string]interface{}{}
+		if err := json.NewDecoder(r.Body).Decode(&template); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		self.templates[strings.TrimPrefix(r.URL.Path, "/_index_template/")] = fmt.Sprint(template["index_patterns"])
+		w.Write([]byte(`{"acknowledged": true}`))
+		return
+	}
+	if r.Method == "POST" && strings.HasSuffix(r.URL.Path, "/_search") {
+		self.searchPath = r.URL.Path
+		self.search = map[string]interface{}{}
+		json.NewDecoder(r.Body).Decode(&self.search)
+		var hits []string
+		aggregations := map[string]interface{}{}
+		aggs, _ := self.search["aggs"].(map[string]interface{})
+		for _, documents := range self.documents {
+			for _, document := range documents {
+				source, _ := json.Marshal(document)
+				hits = append(hits, fmt.Sprintf(`{"_source": %s}`, source))
+				fields := map[string]interface{}{}
+				json.Unmarshal(source, &fields)
+				for name, agg := range aggs {
+					field := agg.(map[string]interface{})["terms"].(map[string]interface{})["field"].(string)
+					if aggregations[name] == nil {
+						aggregations[name] = map[string]interface{}{"buckets": []interface{}{}}
+					}
+					bucket := map[string]interface{}{"key": fields[field], "doc_count": 1, "first_seen": map[string]interface{}{"value": document.Timestamp.UnixNano() / int64(time.Millisecond)}}
+					aggregation := aggregations[name].(map[string]interface{})
+					aggregation["buckets"] = append(aggregation["buckets"].([]interface{}), bucket)
+				}
+			}
+		}
+		encoded, _ := json.Marshal(aggregations)
+		fmt.Fprintf(w, `{"hits": {"hits": [%s]}, "aggregations": %s}`, strings.Join(hits, ","), encoded)
+		return
+	}
+	if r.Method != "POST" || r.URL.Path != "/_bulk" || r.Header.Get("Content-Type") != "application/x-ndjson" {
+		http.Error(w, "unexpected request", http.StatusBadRequest)
+		return
+	}
+
+	var items []string
+	hasErrors := false
+	scanner := bufio.NewScanner(r.Body)
+	for scanner.Scan() {
+		action := map[string]map[string]string{}
+		json.Unmarshal(scanner.Bytes(), &action)
+		scanner.Scan()
+		document := DestinationDocument{}
+		json.Unmarshal(scanner.Bytes(), &document)
+
+		index, id := action["index"]["_index"], action["index"]["_id"]
+		self.attempts[id]++
+		status := 201
+		if strings.HasPrefix(document.ServerName, "busy") && self.attempts[id] == 1 {
+			status = 429
+		} else if strings.HasPrefix(document.ServerName, "invalid") {
+			status = 400
+		} else {
+			if self.documents[index] == nil {
+				self.documents[index] = map[string]DestinationDocument{}
+			}
+			self.documents[index][id] = document
+		}
+		hasErrors = hasErrors || status >= 300
+		items = append(items, fmt.Sprintf(`{"index": {"_index": %q, "_id": %q, "status": %d, "error": {"type": "test"}}}`, index, id, status))
+	}
+	fmt.Fprintf(w, `{"took": 1, "errors": %v, "items": [%s]}`, hasErrors, strings.Join(items, ","))
+}
+
+func openTestElasticsearch(t *testing.T, args string) *ElasticsearchGarinDB {
+	db := &ElasticsearchGarinDB{}
+	db.Setup("elasticsearch", args)
+	if err := db.Open(); err != nil {
+		t.Fatalf("Can't open Elasticsearch : %s", err)
+	}
+	return db
+}
+
+func TestElasticsearchBulk(t *testing.T) {
+	cluster, server := newTestElasticsearch()
+	defer server.Close()
+	db := openTestElasticsearch(t, strings.Replace(server.URL, "http://", "http://garin:passwerd@", 1)+"/?index=garin-{2006.01.02}")
+	defer db.Close()
+
+	if cluster.templates["garin"] != "[garin-*]" {
+		t.Errorf("Index template wasn't created : %v", cluster.templates)
+	}
+	if cluster.auth[0] != "Basic Z2FyaW46cGFzc3dlcmQ=" {
+		t.Errorf("Basic authentication wasn't used : %q", cluster.auth[0])
+	}
+
+	day := time.Date(2020, 1, 2, 23, 0, 0, 0, time.UTC)
+	destinations := []*Destination{
+		{SourceIp: "10.0.0.1", DestinationIp: "192.0.2.1", ServerName: "example.com", Timestamp: day},
+		{SourceIp: "10.0.0.1", DestinationIp: "192.0.2.1", ServerName: "busy.example.com", Timestamp: day},
+		{SourceIp: "10.0.0.1", DestinationIp: "192.0.2.1", ServerName: "example.com", Timestamp: day.Add(2 * time.Hour)},
+	}
+	if err := db.RecordDestinations(destinations); err != nil {
+		t.Fatalf("Can't record destinations : %s", err)
+	}
+	if len(cluster.documents["garin-2020.01.02"]) != 2 || len(cluster.documents["garin-2020.01.03"]) != 1 {
+		t.Errorf("Destinations weren't recorded in daily indices : %v", cluster.documents)
+	}
+	for id, attempts := range cluster.attempts {
+		if document := cluster.documents["garin-2020.01.02"][id]; document.ServerName == "example.com" && attempts != 1 {
+			t.Errorf("Destination that was recorded was sent %d times", attempts)
+		}
+	}
+
+	// Sending the same destinations again doesn't duplicate them
+	if err := db.RecordDestinations(destinations[:1]); err != nil {
+		t.Fatalf("Can't record destination : %s", err)
+	}
+	if len(cluster.documents["garin-2020.01.02"]) != 2 {
+		t.Errorf("Destination was duplicated : %v", cluster.documents)
+	}
+
+	err := db.RecordDestinations([]*Destination{{SourceIp: "10.0.0.1", DestinationIp: "192.0.2.1", ServerName: "invalid.example.com", Timestamp: day}})
+	if err == nil || IsRetryable(err) {
+		t.Errorf("Refused destination returned %v instead of a permanent error", err)
+	}
+}
+
+func TestElasticsearchQuery(t *testing.T) {
+	cluster, server := newTestElasticsearch()
+	defer server.Close()
+	db := openTestElasticsearch(t, server.URL+"/?index=garin-{2006.01.02}")
+	defer db.Close()
+	timestamp := time.Date(2020, 1, 2, 23, 0, 0, 0, time.UTC)
+	if err := db.RecordDestination(&Destination{SourceIp: "10.0.0.1", DestinationIp: "192.0.2.1", ServerName: "www.example.com", Protocol: "HTTP", Timestamp: timestamp}); err != nil {
+		t.Fatalf("Can't record destination : %s", err)
+	}
+
+	source, _ := ParseSource("10.0.0.0/8")
+	query := &DestinationQuery{Source: source, ServerName: "example.com", ServerNameMatch: SERVER_NAME_MATCH_SUFFIX, Since: timestamp, Offset: 10, Limit: 5}
+	query.Validate()
+	destinations, err := db.QueryDestinations(query)
+	if err != nil {
+		t.Fatalf("Can't query destinations : %s", err)
+	}
+	if len(destinations) != 1 || destinations[0].ServerName != "www.example.com" || !destinations[0].Timestamp.Equal(timestamp) {
+		t.Errorf("Destinations weren't read from the hits : %+v", destinations)
+	}
+	if cluster.searchPath != "/garin-*/_search" {
+		t.Errorf("Searched %s instead of all the indices", cluster.searchPath)
+	}
+	search, _ := json.Marshal(cluster.search)
+	for _, expected := range []string{`{"term":{"source_ip":"10.0.0.0/8"}}`, `{"wildcard":{"server_name":"*.example.com"}}`, `"range":{"timestamp":{"gte":"2020-01-02T23:00:00Z"}}`, `"from":10`, `"size":5`, `"sort":[{"timestamp":"desc"}]`} {
+		if !strings.Contains(string(search), expected) {
+			t.Errorf("Search %s doesn't contain %s", search, expected)
+		}
+	}
+
+	regexps := map[string]string{`^www\.`: `www\..*`, `example\.com$`: `.*example\.com`, `^a$`: "a", `a\$`: `.*a\$.*`}
+	for pattern, expected := range regexps {
+		if converted := elasticsearchRegexp(pattern); converted != expected {
+			t.Errorf("Regex %s was converted to %s instead of %s", pattern, converted, expected)
+		}
+	}
+}
+
+func TestElasticsearchSummary(t *testing.T) {
+	cluster, server := newTestElasticsearch()
+	defer server.Close()
+	db := openTestElasticsearch(t, server.URL)
+	defer db.Close()
+	timestamp := time.Date(2020, 1, 2, 23, 0, 0, 0, time.UTC)
+	if err := db.RecordDestination(&Destination{SourceIp: "10.0.0.1", DestinationIp: "192.0.2.1", ServerName: "www.example.com", Protocol: "HTTP", Timestamp: timestamp}); err != nil {
+		t.Fatalf("Can't record destination : %s", err)
+	}
+
+	query := &DestinationQuery{Protocol: "HTTP", Limit: 5}
+	query.Validate()
+	summary, err := db.SummarizeDestinations(query)
+	if err != nil {
+		t.Fatalf("Can't summarize destinations : %s", err)
+	}
+	if summary.Destinations != 1 || len(summary.ServerNames) != 1 || summary.ServerNames[0].Value != "www.example.com" || !summary.ServerNames[0].FirstSeen.Equal(timestamp) || len(summary.Clients) != 1 || summary.Clients[0].Value != "10.0.0.1" {
+		t.Errorf("Summary wasn't read from the aggregations : %+v", summary)
+	}
+	search, _ := json.Marshal(cluster.search)
+	for _, expected := range []string{`{"term":{"protocol":"HTTP"}}`, `"size":0`, `"server_names":{"aggs":{"first_seen":{"min":{"field":"timestamp"}}},"terms":{"field":"server_name"`, `"clients":{`, `"field":"source_ip","order":[{"_count":"desc"},{"_key":"asc"}],"size":5}`} {
+		if !strings.Contains(string(search), expected) {
+			t.Errorf("Search %s doesn't contain %s", search, expected)
+		}
+	}
+
+	seen, err := db.SeenServerNames(query, []string{"www.example.com", "example.com"})
+	if err != nil || !seen["www.example.com"] {
+		t.Errorf("Seen server names are %v and %v", seen, err)
+	}
+	if search, _ := json.Marshal(cluster.search); !strings.Contains(string(search), `{"terms":{"server_name":["www.example.com","example.com"]}}`) {
+		t.Errorf("Search %s doesn't look up the server names", search)
+	}
+
+	// The searches can't go past the result window
+	query = &DestinationQuery{Offset: ELASTICSEARCH_MAX_RESULT_WINDOW - 10, Limit: 100}
+	if _, err := db.QueryDestinations(query); err != nil || cluster.search["size"] != float64(10) {
+		t.Errorf("Page past the result window has the size %v : %v", cluster.search["size"], err)
+	}
+	query.Offset = ELASTICSEARCH_MAX_RESULT_WINDOW
+	if _, err := db.QueryDestinations(query); !errors.Is(err, ErrResultWindowExceeded) || IsRetryable(err) {
+		t.Errorf("Query past the result window returned %v", err)
+	}
+}
+
+func TestElasticsearchUnavailable(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "ApiKey secret" {
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		http.Error(w, "unavailable", http.StatusServiceUnavailable)
+	}))
+	defer server.Close()
+
+	db := &ElasticsearchGarinDB{}
+	db.Setup("elasticsearch", server.URL+"?api-key=secret")
+	if err := db.Open(); err == nil || !IsRetryable(err) {
+		t.Errorf("Unavailable cluster returned %v instead of a retryable error", err)
+	}
+	db.Setup("elasticsearch", server.URL)
+	if err := db.Open(); err == nil || IsRetryable(err) {
+		t.Errorf("Unauthorized request returned %v instead of a permanent error", err)
+	}
+	db.Setup("elasticsearch", server.URL+"?unknown=1")
+	if err := db.Open(); err == nil {
+		t.Error("Invalid args were accepted")
+	}
+}
@@ -0,0 +1,53 @@
+package base
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// Amount of bytes of the body of an error response that are kept in the HTTPStatusError
+const HTTP_ERROR_BODY_MAX_SIZE = 4096
+
+// HTTPStatusError is returned when an HTTP output responds with an error status
+// RetryAfter is how long the server asked to wait before retrying, it is the minimum backoff of the retry
+type HTTPStatusError struct {
+	StatusCode int
+	Body       string
+	RetryAfter time.Duration
+}
+
+func (self *HTTPStatusError) Error() string {
+	return fmt.Sprintf("HTTP status %d: %s", self.StatusCode, self.Body)
+}
+
+// Retryable returns whether or not the status is caused by the state of the server rather than the request
+func (self *HTTPStatusError) Retryable() bool {
+	return isRetryableHTTPStatus(self.StatusCode)
+}
+
+// Reads the error response of a request, only the beginning of the body is kept since an endpoint can answer with a page of any size
+func newHTTPStatusError(response *http.Response) *HTTPStatusError {
+	body, _ := ioutil.ReadAll(io.LimitReader(response.Body, HTTP_ERROR_BODY_MAX_SIZE))
+	return &HTTPStatusError{StatusCode: response.StatusCode, Body: string(body), RetryAfter: parseRetryAfter(response.Header.Get("Retry-After"))}
+}
+
+func isRetryableHTTPStatus(status int) bool {
+	return status == http.StatusTooManyRequests || status == http.StatusRequestTimeout || status >= 500
+}
+
+// Parses a Retry-After header, which is either an amount of seconds or an HTTP date
+func parseRetryAfter(value string) time.Duration {
+	if seconds, err := strconv.Atoi(value); err == nil && seconds > 0 {
+		return time.Duration(seconds) * time.Second
+	}
+	if date, err := http.ParseTime(value); err == nil {
+		if wait := time.Until(date); wait > 0 {
+			return wait
+		}
+	}
+	return 0
+}
@@ -0,0 +1,321 @@
+package base
+
+import (
+	"encoding/binary"
+	"fmt"
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// IPFIX (RFC 7011) constants
+const (
+	IPFIX_VERSION            = 10
+	IPFIX_HEADER_SIZE        = 16
+	IPFIX_SET_HEADER_SIZE    = 4
+	IPFIX_TEMPLATE_SET_ID    = 2
+	IPFIX_VARIABLE_LENGTH    = 65535
+	IPFIX_ENTERPRISE_BIT     = 0x8000
+	IPFIX_IPV4_TEMPLATE_ID   = 256
+	IPFIX_IPV6_TEMPLATE_ID   = 257
+	IPFIX_PROTOCOL_TCP       = 6
+	IPFIX_DEFAULT_ENTERPRISE = 32473
+	// The reverse information elements of RFC 5103 are the standard ones under this enterprise number
+	IPFIX_REVERSE_ENTERPRISE  = 29305
+	IPFIX_DEFAULT_MESSAGE_MAX = 1400
+)
+
+// Information elements of the enterprise of garin
+const (
+	IPFIX_IE_SERVER_NAME     = 1
+	IPFIX_IE_PROTOCOL        = 2
+	IPFIX_IE_TLS_FINGERPRINT = 3
+)
+
+type ipfixField struct {
+	id         uint16
+	length     uint16
+	enterprise bool
+	// Standard element of the reverse direction of a biflow, from the destination IP to the source IP
+	reverse bool
+}
+
+// Fields of the records, the IPv4 and IPv6 templates only differ by their addresses
+func ipfixTemplateFields(ipv6 bool) []ipfixField {
+	fields := []ipfixField{
+		{id: 8, length: 4},  // sourceIPv4Address
+		{id: 12, length: 4}, // destinationIPv4Address
+	}
+	if ipv6 {
+		fields = []ipfixField{
+			{id: 27, length: 16}, // sourceIPv6Address
+			{id: 28, length: 16}, // destinationIPv6Address
+		}
+	}
+	return append(fields,
+		ipfixField{id: 7, length: 2},                      // sourceTransportPort
+		ipfixField{id: 11, length: 2},                     // destinationTransportPort
+		ipfixField{id: 4, length: 1},                      // protocolIdentifier
+		ipfixField{id: 152, length: 8},                    // flowStartMilliseconds
+		ipfixField{id: 153, length: 8},                    // flowEndMilliseconds
+		ipfixField{id: 1, length: 8},                      // octetDeltaCount
+		ipfixField{id: 2, length: 8},                      // packetDeltaCount
+		ipfixField{id: 1, length: 8, reverse: true},       // reverseOctetDeltaCount
+		ipfixField{id: 2, length: 8, reverse: true},       // reversePacketDeltaCount
+		ipfixField{id: 82, length: IPFIX_VARIABLE_LENGTH}, // interfaceName
+		ipfixField{id: IPFIX_IE_SERVER_NAME, length: IPFIX_VARIABLE_LENGTH, enterprise: true},
+		ipfixField{id: IPFIX_IE_PROTOCOL, length: IPFIX_VARIABLE_LENGTH, enterprise: true},
+		ipfixField{id: IPFIX_IE_TLS_FINGERPRINT, length: IPFIX_VARIABLE_LENGTH, enterprise: true},
+	)
+}
+
+// IPFIXGarinDB exports the destinations as IPFIX flow records over UDP
+// The args are the address of the collector followed by the options (ex: 127.0.0.1:4739?observation-domain=1)
+// The templates are sent when the connection is opened and then periodically since UDP doesn't guarantee that the collector received them
+type IPFIXGarinDB struct {
+	AbstractGarinDB
+	options *ipfixOptions
+	conn    net.Conn
+	// Amount of data records sent, which is the sequence number of the next message
+	sequence uint32
+	// When the templates were last sent and how many messages were sent since then
+	templatesSent     time.Time
+	messagesSinceSent int
+}
+
+type ipfixOptions struct {
+	address           string
+	observationDomain uint32
+	enterprise        uint32
+	// The templates are sent again after this duration and after this amount of messages, 0 disables the refresh by messages
+	refreshTimeout  time.Duration
+	refreshMessages int
+	maxMessageSize  int
+}
+
+func parseIPFIXArgs(args string) (*ipfixOptions, error) {
+	options := &ipfixOptions{
+		enterprise:     IPFIX_DEFAULT_ENTERPRISE,
+		refreshTimeout: 10 * time.Minute,
+		maxMessageSize: IPFIX_DEFAULT_MESSAGE_MAX,
+	}
+	options.address = args
+	if i := strings.Index(args, "?"); i >= 0 {
+		options.address = args[:i]
+		query, err := url.ParseQuery(args[i+1:])
+		if err != nil {
+			return nil, err
+		}
+		for key, values := range query {
+			value := values[len(values)-1]
+			var number uint64
+			switch key {
+			case "observation-domain":
+				number, err = strconv.ParseUint(value, 10, 32)
+				options.observationDomain = uint32(number)
+			case "enterprise-number":
+				number, err = strconv.ParseUint(value, 10, 32)
+				options.enterprise = uint32(number)
+			case "template-refresh-timeout":
+				options.refreshTimeout, err = time.ParseDuration(value)
+			case "template-refresh-messages":
+				options.refreshMessages, err = strconv.Atoi(value)
+			case "max-message-size":
+				options.maxMessageSize, err = strconv.Atoi(value)
+				if err == nil && (options.maxMessageSize < 512 || options.maxMessageSize > 65535) {
+					err = fmt.Errorf("must be between 512 and 65535")
+				}
+			default:
+				err = fmt.Errorf("unknown option")
+			}
+			if err != nil {
+				return nil, fmt.Errorf("invalid IPFIX option %s=%s: %s", key, value, err)
+			}
+		}
+	}
+	if _, _, err := net.SplitHostPort(options.address); err != nil {
+		return nil, fmt.Errorf("invalid IPFIX collector address %q: %s", options.address, err)
+	}
+	return options, nil
+}
+
+// Appends a set of template records for the IPv4 and IPv6 records
+func (self *ipfixOptions) appendTemplateSet(message []byte) []byte {
+	start := len(message)
+	message = binary.BigEndian.AppendUint16(message, IPFIX_TEMPLATE_SET_ID)
+	message = binary.BigEndian.AppendUint16(message, 0)
+	for _, templateId := range []uint16{IPFIX_IPV4_TEMPLATE_ID, IPFIX_IPV6_TEMPLATE_ID} {
+		fields := ipfixTemplateFields(templateId == IPFIX_IPV6_TEMPLATE_ID)
+		message = binary.BigEndian.AppendUint16(message, templateId)
+		message = binary.BigEndian.AppendUint16(message, uint16(len(fields)))
+		for _, field := range fields {
+			if field.enterprise || field.reverse {
+				enterprise := self.enterprise
+				if field.reverse {
+					enterprise = IPFIX_REVERSE_ENTERPRISE
+				}
+				message = binary.BigEndian.AppendUint16(message, field.id|IPFIX_ENTERPRISE_BIT)
+				message = binary.BigEndian.AppendUint16(message, field.length)
+				message = binary.BigEndian.AppendUint32(message, enterprise)
+			} else {
+				message = binary.BigEndian.AppendUint16(message, field.id)
+				message = binary.BigEndian.AppendUint16(message, field.length)
+			}
+		}
+	}
+	binary.BigEndian.PutUint16(message[start+2:], uint16(len(message)-start))
+	return message
+}
+
+// Variable length fields are prefixed by their length on 1 byte, or 255 followed by the length on 2 bytes
+func appendIPFIXString(record []byte, value string) []byte {
+	if len(value) > 65535 {
+		value = value[:65535]
+	}
+	if len(value) < 255 {
+		record = append(record, byte(len(value)))
+	} else {
+		record = append(record, 255)
+		record = binary.BigEndian.AppendUint16(record, uint16(len(value)))
+	}
+	return append(record, value...)
+}
+
+// Returns the data record of a destination and the template it follows, or false if its IPs are invalid
+func appendIPFIXRecord(record []byte, destination *Destination) ([]byte, uint16, bool) {
+	sourceIp := net.ParseIP(destination.SourceIp)
+	destinationIp := net.ParseIP(destination.DestinationIp)
+	if sourceIp == nil || destinationIp == nil {
+		return record, 0, false
+	}
+	templateId := uint16(IPFIX_IPV4_TEMPLATE_ID)
+	if sourceIp.To4() != nil && destinationIp.To4() != nil {
+		record = append(record, sourceIp.To4()...)
+		record = append(record, destinationIp.To4()...)
+	} else {
+		templateId = IPFIX_IPV6_TEMPLATE_ID
+		record = append(record, sourceIp.To16()...)
+		record = append(record, destinationIp.To16()...)
+	}
+	record = binary.BigEndian.AppendUint16(record, destination.SourcePort)
+	record = binary.BigEndian.AppendUint16(record, destination.DestinationPort)
+	record = append(record, IPFIX_PROTOCOL_TCP)
+	start := destination.Timestamp.UnixNano() / int64(time.Millisecond)
+	record = binary.BigEndian.AppendUint64(record, uint64(start))
+	record = binary.BigEndian.AppendUint64(record, uint64(start+destination.DurationMs))
+	// Sent is the forward direction of the flow and received its reverse
+	record = binary.BigEndian.AppendUint64(record, uint64(destination.BytesSent))
+	record = binary.BigEndian.AppendUint64(record, uint64(destination.PacketsSent))
+	record = binary.BigEndian.AppendUint64(record, uint64(destination.BytesReceived))
+	record = binary.BigEndian.AppendUint64(record, uint64(destination.PacketsReceived))
+	record = appendIPFIXString(record, destination.Interface)
+	record = appendIPFIXString(record, destination.ServerName)
+	record = appendIPFIXString(record, destination.Protocol)
+	return appendIPFIXString(record, destination.TLSFingerprint), templateId, true
+}
+
+func (self *IPFIXGarinDB) Open() error {
+	options, err := parseIPFIXArgs(self.dbArgs)
+	if err != nil {
+		return &DBError{Err: err, Retryable: false}
+	}
+	self.options = options
+	if self.conn, err = net.Dial("udp", options.address); err != nil {
+		return err
+	}
+	// A new connection has a new source port, which the collector sees as a new session that needs the templates
+	self.templatesSent = time.Time{}
+	return nil
+}
+
+func (self *IPFIXGarinDB) Close() error {
+	if self.conn == nil {
+		return nil
+	}
+	err := self.conn.Close()
+	self.conn = nil
+	return err
+}
+
+func (self *IPFIXGarinDB) RecordDestination(destination *Destination) error {
+	return self.RecordDestinations([]*Destination{destination})
+}
+
+// The destinations are grouped in data sets by template and sent in as many messages as needed
+func (self *IPFIXGarinDB) RecordDestinations(destinations []*Destination) error {
+	var message []byte
+	records := 0
+	setStart := -1
+	var setTemplate uint16
+	invalid := 0
+
+	for _, destination := range destinations {
+		record, templateId, ok := appendIPFIXRecord(nil, destination)
+		if !ok {
+			invalid++
+			continue
+		}
+		if message != nil && len(message)+len(record)+IPFIX_SET_HEADER_SIZE > self.options.maxMessageSize {
+			if err := self.send(message, setStart, records); err != nil {
+				return err
+			}
+			message, records = nil, 0
+		}
+		if message == nil {
+			message = self.newMessage()
+			setStart = -1
+		}
+		if setStart < 0 || templateId != setTemplate {
+			if setStart >= 0 {
+				binary.BigEndian.PutUint16(message[setStart+2:], uint16(len(message)-setStart))
+			}
+			setStart, setTemplate = len(message), templateId
+			message = binary.BigEndian.AppendUint16(message, templateId)
+			message = binary.BigEndian.AppendUint16(message, 0)
+		}
+		message = append(message, record...)
+		records++
+	}
+	if message != nil {
+		if err := self.send(message, setStart, records); err != nil {
+			return err
+		}
+	}
+	if invalid > 0 {
+		return &DBError{Err: fmt.Errorf("%d destinations have invalid IPs and can't be exported in IPFIX", invalid), Retryable: false}
+	}
+	return nil
+}
+
+// Starts a message with the header and the templates when they are due
+func (self *IPFIXGarinDB) newMessage() []byte {
+	message := make([]byte, IPFIX_HEADER_SIZE, self.options.maxMessageSize)
+	refreshByTime := self.templatesSent.IsZero() || time.Since(self.templatesSent) >= self.options.refreshTimeout
+	refreshByCount := self.options.refreshMessages > 0 && self.messagesSinceSent >= self.options.refreshMessages
+	if refreshByTime || refreshByCount {
+		message = self.options.appendTemplateSet(message)
+		self.templatesSent = time.Now()
+		self.messagesSinceSent = 0
+	}
+	return message
+}
+
+// Completes the header and the last set of a message and sends it
+func (self *IPFIXGarinDB) send(message []byte, setStart int, records int) error {
+	binary.BigEndian.PutUint16(message[setStart+2:], uint16(len(message)-setStart))
+	binary.BigEndian.PutUint16(message[0:], IPFIX_VERSION)
+	binary.BigEndian.PutUint16(message[2:], uint16(len(message)))
+	binary.BigEndian.PutUint32(message[4:], uint32(time.Now().Unix()))
+	binary.BigEndian.PutUint32(message[8:], self.sequence)
+	binary.BigEndian.PutUint32(message[12:], self.options.observationDomain)
+	if _, err := self.conn.Write(message); err != nil {
+		// The templates may not have reached the collector
+		self.templatesSent = time.Time{}
+		return err
+	}
+	self.sequence += uint32(records)
+	self.messagesSinceSent++
+	return nil
+}
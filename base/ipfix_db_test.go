@@ -0,0 +1,215 @@
+package base
+
+import (
+	"encoding/binary"
+	"net"
+	"testing"
+	"time"
+)
+
+type testIPFIXRecord struct {
+	templateId      uint16
+	sourceIp        net.IP
+	destinationIp   net.IP
+	sourcePort      uint16
+	destinationPort uint16
+	start           time.Time
+	end             time.Time
+	// Counters of the forward and reverse directions
+	octets  [2]uint64
+	packets [2]uint64
+	strings []string
+}
+
+type testIPFIXMessage struct {
+	sequence  uint32
+	domain    uint32
+	templates map[uint16][]ipfixField
+	records   []testIPFIXRecord
+}
+
+// Decodes a message using the templates the collector knows about, as a collector would
+func decodeTestIPFIX(t *testing.T, data []byte, templates map[uint16][]ipfixField) testIPFIXMessage {
+	if binary.BigEndian.Uint16(data[0:]) != IPFIX_VERSION || int(binary.BigEndian.Uint16(data[2:])) != len(data) {
+		t.Fatalf("Invalid IPFIX header %v", data[:IPFIX_HEADER_SIZE])
+	}
+	message := testIPFIXMessage{sequence: binary.BigEndian.Uint32(data[8:]), domain: binary.BigEndian.Uint32(data[12:]), templates: map[uint16][]ipfixField{}}
+	data = data[IPFIX_HEADER_SIZE:]
+	for len(data) > 0 {
+		setId, setLength := binary.BigEndian.Uint16(data[0:]), int(binary.BigEndian.Uint16(data[2:]))
+		set := data[IPFIX_SET_HEADER_SIZE:setLength]
+		data = data[setLength:]
+		if setId == IPFIX_TEMPLATE_SET_ID {
+			for len(set) > 0 {
+				templateId, count := binary.BigEndian.Uint16(set[0:]), int(binary.BigEndian.Uint16(set[2:]))
+				set = set[4:]
+				var fields []ipfixField
+				for i := 0; i < count; i++ {
+					field := ipfixField{id: binary.BigEndian.Uint16(set[0:]), length: binary.BigEndian.Uint16(set[2:])}
+					set = set[4:]
+					if field.id&IPFIX_ENTERPRISE_BIT != 0 {
+						field.id &^= IPFIX_ENTERPRISE_BIT
+						switch enterprise := binary.BigEndian.Uint32(set); enterprise {
+						case IPFIX_DEFAULT_ENTERPRISE:
+							field.enterprise = true
+						case IPFIX_REVERSE_ENTERPRISE:
+							field.reverse = true
+						default:
+							t.Errorf("Enterprise number is %d", enterprise)
+						}
+						set = set[4:]
+					}
+					fields = append(fields, field)
+				}
+				message.templates[templateId] = fields
+				templates[templateId] = fields
+			}
+			continue
+		}
+
+		fields, ok := templates[setId]
+		if !ok {
+			t.Fatalf("Data set %d was received before its template", setId)
+		}
+		for len(set) > 0 {
+			record := testIPFIXRecord{templateId: setId}
+			for _, field := range fields {
+				length := int(field.length)
+				if field.length == IPFIX_VARIABLE_LENGTH {
+					length = int(set[0])
+					set = set[1:]
+					if length == 255 {
+						length = int(binary.BigEndian.Uint16(set))
+						set = set[2:]
+					}
+				}
+				value := set[:length]
+				set = set[length:]
+				if field.enterprise || field.id == 82 {
+					record.strings = append(record.strings, string(value))
+					continue
+				}
+				direction := 0
+				if field.reverse {
+					direction = 1
+				}
+				switch field.id {
+				case 1:
+					record.octets[direction] = binary.BigEndian.Uint64(value)
+				case 2:
+					record.packets[direction] = binary.BigEndian.Uint64(value)
+				case 8, 27:
+					record.sourceIp = net.IP(value)
+				case 12, 28:
+					record.destinationIp = net.IP(value)
+				case 7:
+					record.sourcePort = binary.BigEndian.Uint16(value)
+				case 11:
+					record.destinationPort = binary.BigEndian.Uint16(value)
+				case 152:
+					record.start = time.Unix(0, int64(binary.BigEndian.Uint64(value))*int64(time.Millisecond))
+				case 153:
+					record.end = time.Unix(0, int64(binary.BigEndian.Uint64(value))*int64(time.Millisecond))
+				}
+			}
+			message.records = append(message.records, record)
+		}
+	}
+	return message
+}
+
+func TestIPFIXExport(t *testing.T) {
+	collector, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Can't listen : %s", err)
+	}
+	defer collector.Close()
+	receive := func() []byte {
+		buffer := make([]byte, 65535)
+		collector.SetReadDeadline(time.Now().Add(5 * time.Second))
+		n, _, err := collector.ReadFrom(buffer)
+		if err != nil {
+			t.Fatalf("Didn't receive IPFIX message : %s", err)
+		}
+		return buffer[:n]
+	}
+
+	db := &IPFIXGarinDB{}
+	db.Setup("ipfix", collector.LocalAddr().String()+"?observation-domain=7&template-refresh-messages=2")
+	if err := db.Open(); err != nil {
+		t.Fatalf("Can't open IPFIX : %s", err)
+	}
+	defer db.Close()
+
+	timestamp := time.Unix(1577934245, 6000000)
+	destinations := []*Destination{
+		{SourceIp: "10.0.0.1", DestinationIp: "192.0.2.1", SourcePort: 50000, DestinationPort: 443, ServerName: "a.example.com", Protocol: "TLS/SSL", TLSFingerprint: "e7d705a3286e19ea42f587b344ee6865", Timestamp: timestamp, Interface: "eth0",
+			Traffic: Traffic{BytesSent: 517, BytesReceived: 4096, PacketsSent: 5, PacketsReceived: 7, DurationMs: 1500}},
+		{SourceIp: "10.0.0.2", DestinationIp: "192.0.2.2", SourcePort: 50001, DestinationPort: 80, ServerName: "b.example.com", Protocol: "HTTP", Timestamp: timestamp},
+		{SourceIp: "2001:db8::1", DestinationIp: "2001:db8::2", SourcePort: 50002, DestinationPort: 443, ServerName: "c.example.com", Protocol: "TLS/SSL", Timestamp: timestamp},
+	}
+	if err := db.RecordDestinations(destinations); err != nil {
+		t.Fatalf("Can't export destinations : %s", err)
+	}
+
+	templates := map[uint16][]ipfixField{}
+	message := decodeTestIPFIX(t, receive(), templates)
+	if len(message.templates) != 2 || message.domain != 7 || message.sequence != 0 {
+		t.Errorf("First message doesn't start the session : %d templates, domain %d, sequence %d", len(message.templates), message.domain, message.sequence)
+	}
+	if len(message.records) != 3 {
+		t.Fatalf("Received %d records instead of 3", len(message.records))
+	}
+	first := message.records[0]
+	if first.templateId != IPFIX_IPV4_TEMPLATE_ID || !first.sourceIp.Equal(net.ParseIP("10.0.0.1")) || !first.destinationIp.Equal(net.ParseIP("192.0.2.1")) || first.sourcePort != 50000 || first.destinationPort != 443 || !first.start.Equal(timestamp) {
+		t.Errorf("Invalid IPv4 record %+v", first)
+	}
+	if !first.end.Equal(timestamp.Add(1500*time.Millisecond)) || first.octets != [2]uint64{517, 4096} || first.packets != [2]uint64{5, 7} {
+		t.Errorf("Invalid traffic in IPv4 record %+v", first)
+	}
+	if expected := []string{"eth0", "a.example.com", "TLS/SSL", "e7d705a3286e19ea42f587b344ee6865"}; len(first.strings) != 4 || first.strings[0] != expected[0] || first.strings[1] != expected[1] || first.strings[2] != expected[2] || first.strings[3] != expected[3] {
+		t.Errorf("Variable length fields are %q instead of %q", first.strings, expected)
+	}
+	if last := message.records[2]; last.templateId != IPFIX_IPV6_TEMPLATE_ID || !last.sourceIp.Equal(net.ParseIP("2001:db8::1")) || last.strings[1] != "c.example.com" {
+		t.Errorf("Invalid IPv6 record %+v", last)
+	}
+
+	// The templates are sent again every 2 messages
+	db.RecordDestination(destinations[0])
+	message = decodeTestIPFIX(t, receive(), templates)
+	if len(message.templates) != 0 || message.sequence != 3 {
+		t.Errorf("Second message has %d templates and sequence %d", len(message.templates), message.sequence)
+	}
+	db.RecordDestination(destinations[0])
+	if message = decodeTestIPFIX(t, receive(), templates); len(message.templates) != 2 || message.sequence != 4 {
+		t.Errorf("Third message has %d templates and sequence %d", len(message.templates), message.sequence)
+	}
+
+	// And once the refresh timeout is reached
+	db.templatesSent = time.Now().Add(-db.options.refreshTimeout)
+	db.RecordDestination(destinations[0])
+	if message = decodeTestIPFIX(t, receive(), templates); len(message.templates) != 2 {
+		t.Errorf("Templates weren't refreshed after the timeout")
+	}
+
+	// Batches larger than a message are split
+	var batch []*Destination
+	for i := 0; i < 100; i++ {
+		batch = append(batch, destinations[i%3])
+	}
+	if err := db.RecordDestinations(batch); err != nil {
+		t.Fatalf("Can't export destinations : %s", err)
+	}
+	received := 0
+	for received < 100 {
+		data := receive()
+		if len(data) > IPFIX_DEFAULT_MESSAGE_MAX {
+			t.Errorf("Message of %d bytes is larger than the maximum", len(data))
+		}
+		received += len(decodeTestIPFIX(t, data, templates).records)
+	}
+
+	if err := db.RecordDestination(&Destination{SourceIp: "invalid", DestinationIp: "192.0.2.1"}); err == nil || IsRetryable(err) {
+		t.Errorf("Destination with an invalid IP was exported : %v", err)
+	}
+}
@@ -0,0 +1,402 @@
+package base
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"github.com/klauspost/compress/zstd"
+	"io"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// How the closed segments of a JSON Lines file are compressed
+const (
+	JSONL_COMPRESS_NONE = ""
+	JSONL_COMPRESS_GZIP = "gzip"
+	JSONL_COMPRESS_ZSTD = "zstd"
+)
+
+// Suffix of the closed segments, followed by the extension of the compression
+const JSONL_SEGMENT_TIME_FORMAT = "20060102T150405.000000000"
+
+// JSONLGarinDB writes the destinations in a file, one JSON object per line
+// The args are the path of the file followed by the rotation options (ex: /var/log/garin/destinations.jsonl?max-size=104857600&max-age=1h&compress=gzip&keep=10)
+// All the connections to the same file share it so the recording threads don't interleave their lines
+type JSONLGarinDB struct {
+	AbstractGarinDB
+	file *jsonlFile
+}
+
+type jsonlOptions struct {
+	path string
+	// The file is rotated once it reaches this size in bytes, 0 disables the rotation by size
+	maxSize int64
+	// The file is rotated on the first write after it is opened for this long, 0 disables the rotation by time
+	maxAge   time.Duration
+	compress string
+	// Amount of closed segments kept, 0 keeps all of them
+	keep int
+}
+
+func parseJSONLArgs(args string) (*jsonlOptions, error) {
+	options := &jsonlOptions{path: args}
+	if i := strings.LastIndex(args, "?"); i >= 0 {
+		options.path = args[:i]
+		query, err := url.ParseQuery(args[i+1:])
+		if err != nil {
+			return nil, err
+		}
+		for key, values := range query {
+			value := values[len(values)-1]
+			switch key {
+			case "max-size":
+				options.maxSize, err = strconv.ParseInt(value, 10, 64)
+			case "max-age":
+				options.maxAge, err = time.ParseDuration(value)
+			case "compress":
+				options.compress = value
+			case "keep":
+				options.keep, err = strconv.Atoi(value)
+			default:
+				err = fmt.Errorf("unknown option")
+			}
+			if err != nil {
+				return nil, fmt.Errorf("invalid JSON Lines option %s=%s: %s", key, value, err)
+			}
+		}
+	}
+	switch options.compress {
+	case JSONL_COMPRESS_NONE, JSONL_COMPRESS_GZIP, JSONL_COMPRESS_ZSTD:
+	default:
+		return nil, fmt.Errorf("unknown JSON Lines compression %q", options.compress)
+	}
+	if options.path == "" {
+		return nil, fmt.Errorf("no JSON Lines file specified")
+	}
+	return options, nil
+}
+
+// The files being written to along with the amount of connections using them
+var jsonlFiles = map[string]*jsonlFile{}
+var jsonlFilesMutex = &sync.Mutex{}
+
+type jsonlFile struct {
+	options *jsonlOptions
+	refs    int
+
+	mutex  *sync.Mutex
+	writer *os.File
+	size   int64
+	opened time.Time
+
+	// Closed segments are compressed and pruned in the background, one rotation at a time
+	rotations  *sync.WaitGroup
+	pruneMutex *sync.Mutex
+}
+
+func (self *JSONLGarinDB) Open() error {
+	options, err := parseJSONLArgs(self.dbArgs)
+	if err != nil {
+		return &DBError{Err: err, Retryable: false}
+	}
+
+	jsonlFilesMutex.Lock()
+	defer jsonlFilesMutex.Unlock()
+	file := jsonlFiles[options.path]
+	if file == nil {
+		file = &jsonlFile{options: options, mutex: &sync.Mutex{}, rotations: &sync.WaitGroup{}, pruneMutex: &sync.Mutex{}}
+		if err := file.open(); err != nil {
+			return err
+		}
+		jsonlFiles[options.path] = file
+	}
+	file.refs++
+	self.file = file
+	return nil
+}
+
+// Close closes the file once all the connections using it are closed
+func (self *JSONLGarinDB) Close() error {
+	jsonlFilesMutex.Lock()
+	defer jsonlFilesMutex.Unlock()
+	self.file.refs--
+	if self.file.refs > 0 {
+		return nil
+	}
+	delete(jsonlFiles, self.file.options.path)
+	return self.file.close()
+}
+
+func (self *JSONLGarinDB) RecordDestination(destination *Destination) error {
+	return self.RecordDestinations([]*Destination{destination})
+}
+
+func (self *JSONLGarinDB) RecordDestinations(destinations []*Destination) error {
+	buffer := &bytes.Buffer{}
+	encoder := json.NewEncoder(buffer)
+	for _, destination := range destinations {
+		if err := encoder.Encode(destination.Document()); err != nil {
+			return &DBError{Err: err, Retryable: false}
+		}
+	}
+	return self.file.write(buffer.Bytes())
+}
+
+func (self *jsonlFile) open() error {
+	if err := os.MkdirAll(filepath.Dir(self.options.path), 0755); err != nil {
+		return err
+	}
+	writer, err := os.OpenFile(self.options.path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	info, err := writer.Stat()
+	if err != nil {
+		writer.Close()
+		return err
+	}
+	self.writer = writer
+	self.size = info.Size()
+	self.opened = time.Now()
+	return nil
+}
+
+func (self *jsonlFile) close() error {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+	var err error
+	if self.writer != nil {
+		err = self.writer.Close()
+		self.writer = nil
+	}
+	self.rotations.Wait()
+	return err
+}
+
+// Writes whole lines so a batch is never split between two segments
+func (self *jsonlFile) write(lines []byte) error {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+
+	if self.writer == nil {
+		// A previous rotation failed to open the new file
+		if err := self.open(); err != nil {
+			return err
+		}
+	}
+	if self.size > 0 && self.shouldRotate(int64(len(lines))) {
+		if err := self.rotate(); err != nil {
+			return err
+		}
+	}
+	n, err := self.writer.Write(lines)
+	self.size += int64(n)
+	return err
+}
+
+func (self *jsonlFile) shouldRotate(length int64) bool {
+	if self.options.maxSize > 0 && self.size+length > self.options.maxSize {
+		return true
+	}
+	return self.options.maxAge > 0 && time.Since(self.opened) >= self.options.maxAge
+}
+
+// Closes the file, renames it with the current time so it is picked up as a closed segment and opens a new one
+func (self *jsonlFile) rotate() error {
+	if err := self.writer.Close(); err != nil {
+		Logger().Errorf("can't close %s: %s", self.options.path, err)
+	}
+	self.writer = nil
+	segment := self.options.path + "." + time.Now().UTC().Format(JSONL_SEGMENT_TIME_FORMAT)
+	if err := os.Rename(self.options.path, segment); err != nil {
+		return err
+	}
+
+	self.rotations.Add(1)
+	go func() {
+		defer self.rotations.Done()
+		self.pruneMutex.Lock()
+		defer self.pruneMutex.Unlock()
+		if err := compressSegment(segment, self.options.compress); err != nil {
+			Logger().Errorf("can't compress %s: %s", segment, err)
+		}
+		self.prune()
+	}()
+
+	return self.open()
+}
+
+func compressSegment(segment string, compress string) error {
+	var extension string
+	var newWriter func(io.Writer) (io.WriteCloser, error)
+	switch compress {
+	case JSONL_COMPRESS_GZIP:
+		extension = ".gz"
+		newWriter = func(w io.Writer) (io.WriteCloser, error) { return gzip.NewWriter(w), nil }
+	case JSONL_COMPRESS_ZSTD:
+		extension = ".zst"
+		newWriter = func(w io.Writer) (io.WriteCloser, error) { return zstd.NewWriter(w) }
+	default:
+		return nil
+	}
+
+	reader, err := os.Open(segment)
+	if err != nil {
+		return err
+	}
+	defer reader.Close()
+	// The compressed segment only gets its final name once it is complete so the log shippers don't read it partially
+	tmpPath := segment + extension + ".tmp"
+	file, err := os.OpenFile(tmpPath, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+	writer, err := newWriter(file)
+	if err == nil {
+		_, err = io.Copy(writer, reader)
+		if closeErr := writer.Close(); err == nil {
+			err = closeErr
+		}
+	}
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(tmpPath, segment+extension)
+	}
+	if err != nil {
+		os.Remove(tmpPath)
+		return err
+	}
+	return os.Remove(segment)
+}
+
+// Removes the oldest closed segments so only the configured amount of them is kept
+func (self *jsonlFile) prune() {
+	if self.options.keep <= 0 {
+		return
+	}
+	segments, err := closedJSONLSegments(self.options.path)
+	if err != nil {
+		Logger().Errorf("can't list the segments of %s: %s", self.options.path, err)
+		return
+	}
+	for len(segments) > self.options.keep {
+		if err := os.Remove(segments[0]); err != nil {
+			Logger().Errorf("can't remove %s: %s", segments[0], err)
+		}
+		segments = segments[1:]
+	}
+}
+
+// Returns the closed segments of a file from the oldest to the newest
+func closedJSONLSegments(path string) ([]string, error) {
+	matches, err := filepath.Glob(path + ".*")
+	if err != nil {
+		return nil, err
+	}
+	var segments []string
+	for _, match := range matches {
+		if !strings.HasSuffix(match, ".tmp") {
+			segments = append(segments, match)
+		}
+	}
+	// The time format sorts chronologically
+	sort.Strings(segments)
+	return segments, nil
+}
+
+// The file and its closed segments are read and filtered in memory
+func (self *JSONLGarinDB) QueryDestinations(query *DestinationQuery) ([]*Destination, error) {
+	page := &destinationsPage{query: query}
+	if err := self.read(page.add); err != nil {
+		return nil, err
+	}
+	return page.result(), nil
+}
+
+// The destinations are counted while reading the file and its segments once
+func (self *JSONLGarinDB) SummarizeDestinations(query *DestinationQuery) (*DestinationSummary, error) {
+	summary := newDestinationsSummary(query)
+	if err := self.read(summary.add); err != nil {
+		return nil, err
+	}
+	return summary.result(), nil
+}
+
+func (self *JSONLGarinDB) SeenServerNames(query *DestinationQuery, serverNames []string) (map[string]bool, error) {
+	seen := newServerNamesSeen(query, serverNames)
+	if err := self.read(seen.add); err != nil {
+		return nil, err
+	}
+	return seen.seen, nil
+}
+
+// Reads all the destinations of the file and its closed segments
+func (self *JSONLGarinDB) read(add func(*Destination)) error {
+	path := self.file.options.path
+	segments, err := closedJSONLSegments(path)
+	if err != nil {
+		return err
+	}
+	found := map[string]bool{}
+	for _, segment := range segments {
+		found[segment] = true
+	}
+	for _, segment := range append(segments, path) {
+		// A segment that was just compressed is there twice until the uncompressed one is removed
+		if found[segment+".gz"] || found[segment+".zst"] {
+			continue
+		}
+		// The segments can be pruned while they are listed
+		if err := readJSONLFile(segment, add); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	return nil
+}
+
+func readJSONLFile(path string, add func(*Destination)) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	var reader io.Reader = file
+	switch filepath.Ext(path) {
+	case ".gz":
+		gzipReader, err := gzip.NewReader(file)
+		if err != nil {
+			return err
+		}
+		reader = gzipReader
+	case ".zst":
+		zstdReader, err := zstd.NewReader(file)
+		if err != nil {
+			return err
+		}
+		defer zstdReader.Close()
+		reader = zstdReader
+	}
+
+	scanner := bufio.NewScanner(reader)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		document := &DestinationDocument{}
+		// The last line may still be being written
+		if err := json.Unmarshal(scanner.Bytes(), document); err != nil {
+			continue
+		}
+		add(document.Destination())
+	}
+	return scanner.Err()
+}
@@ -0,0 +1,113 @@
+package base
+
+import (
+	"bufio"
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"github.com/klauspost/compress/zstd"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func openTestJSONL(t *testing.T, args string) *JSONLGarinDB {
+	db := &JSONLGarinDB{}
+	db.Setup("jsonl", args)
+	if err := db.Open(); err != nil {
+		t.Fatalf("Can't open JSON Lines file : %s", err)
+	}
+	return db
+}
+
+func readTestJSONL(t *testing.T, path string) []DestinationDocument {
+	file, err := os.Open(path)
+	if err != nil {
+		t.Fatalf("Can't open %s : %s", path, err)
+	}
+	defer file.Close()
+	var reader io.Reader = file
+	switch filepath.Ext(path) {
+	case ".gz":
+		if reader, err = gzip.NewReader(file); err != nil {
+			t.Fatalf("Can't decompress %s : %s", path, err)
+		}
+	case ".zst":
+		decoder, err := zstd.NewReader(file)
+		if err != nil {
+			t.Fatalf("Can't decompress %s : %s", path, err)
+		}
+		defer decoder.Close()
+		reader = decoder
+	}
+
+	var documents []DestinationDocument
+	scanner := bufio.NewScanner(reader)
+	for scanner.Scan() {
+		document := DestinationDocument{}
+		if err := json.Unmarshal(scanner.Bytes(), &document); err != nil {
+			t.Fatalf("Invalid line in %s : %s", path, err)
+		}
+		documents = append(documents, document)
+	}
+	return documents
+}
+
+func testDestinations(count int) []*Destination {
+	destinations := make([]*Destination, count)
+	for i := range destinations {
+		destinations[i] = &Destination{SourceIp: "10.0.0.1", DestinationIp: "2001:db8::1", ServerName: fmt.Sprintf("%d.example.com", i), Protocol: "HTTPS", Timestamp: time.Now()}
+	}
+	return destinations
+}
+
+func TestJSONLRotation(t *testing.T) {
+	for _, compress := range []string{JSONL_COMPRESS_NONE, JSONL_COMPRESS_GZIP, JSONL_COMPRESS_ZSTD} {
+		directory, _ := ioutil.TempDir("", "garin-jsonl")
+		defer os.RemoveAll(directory)
+		path := filepath.Join(directory, "destinations.jsonl")
+
+		// Every batch is bigger than half the maximum size so each one ends up in its own segment
+		db := openTestJSONL(t, path+"?max-size=300&keep=2&compress="+compress)
+		// A second connection shares the same file
+		otherDB := openTestJSONL(t, path+"?max-size=300&keep=2&compress="+compress)
+		for i := 0; i < 4; i++ {
+			if err := db.RecordDestinations(testDestinations(2)); err != nil {
+				t.Fatalf("Can't record destinations : %s", err)
+			}
+			// Makes sure the segments have different names
+			time.Sleep(time.Millisecond)
+		}
+		otherDB.Close()
+		db.Close()
+
+		segments, _ := closedJSONLSegments(path)
+		if len(segments) != 2 {
+			t.Fatalf("%d segments were kept with %q compression instead of 2 : %v", len(segments), compress, segments)
+		}
+		for _, segment := range append(segments, path) {
+			documents := readTestJSONL(t, segment)
+			if len(documents) != 2 || documents[1].ServerName != "1.example.com" || documents[0].DestinationIp != "2001:db8::1" {
+				t.Errorf("%s doesn't contain the destinations of a batch : %+v", segment, documents)
+			}
+		}
+	}
+}
+
+func TestJSONLArgs(t *testing.T) {
+	options, err := parseJSONLArgs("/tmp/garin.jsonl?max-size=1024&max-age=1h&compress=zstd&keep=3")
+	if err != nil {
+		t.Fatalf("Can't parse args : %s", err)
+	}
+	if options.path != "/tmp/garin.jsonl" || options.maxSize != 1024 || options.maxAge != time.Hour || options.compress != JSONL_COMPRESS_ZSTD || options.keep != 3 {
+		t.Errorf("Args weren't parsed properly : %+v", options)
+	}
+	for _, args := range []string{"", "/tmp/garin.jsonl?compress=lz4", "/tmp/garin.jsonl?max-size=big", "/tmp/garin.jsonl?unknown=1"} {
+		if _, err := parseJSONLArgs(args); err == nil {
+			t.Errorf("Invalid args %q were accepted", args)
+		}
+	}
+}
@@ -0,0 +1,284 @@
+package base
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"github.com/twmb/franz-go/pkg/kgo"
+	"github.com/twmb/franz-go/pkg/sasl/plain"
+	"github.com/twmb/franz-go/pkg/sasl/scram"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// How the destinations are encoded in the Kafka messages
+const (
+	KAFKA_ENCODING_JSON     = "json"
+	KAFKA_ENCODING_AVRO     = "avro"
+	KAFKA_ENCODING_PROTOBUF = "protobuf"
+)
+
+// KafkaGarinDB publishes the destinations to a Kafka topic, keyed by source IP so all the destinations of a client go to the same partition
+// The args are the brokers and the topic followed by the options (ex: 127.0.0.1:9092,127.0.0.2:9092/garin?encoding=avro&compression=zstd&acks=all)
+// All the connections to the same brokers and topic share a producer since it already batches the messages of all the threads
+type KafkaGarinDB struct {
+	AbstractGarinDB
+	producer *kafkaProducer
+}
+
+type kafkaOptions struct {
+	brokers  []string
+	topic    string
+	encoding string
+	// ID of the schema in the schema registry, the messages are framed in the Confluent wire format when it is set
+	schemaId    int
+	compression kgo.CompressionCodec
+	acks        kgo.Acks
+	allAcks     bool
+	linger      time.Duration
+	maxBytes    int32
+	timeout     time.Duration
+	tls         bool
+	skipVerify  bool
+	sasl        string
+	username    string
+	password    string
+}
+
+func parseKafkaArgs(args string) (*kafkaOptions, error) {
+	options := &kafkaOptions{
+		encoding:    KAFKA_ENCODING_JSON,
+		compression: kgo.NoCompression(),
+		acks:        kgo.AllISRAcks(),
+		allAcks:     true,
+		timeout:     30 * time.Second,
+	}
+
+	target := args
+	if i := strings.Index(args, "?"); i >= 0 {
+		target = args[:i]
+		query, err := url.ParseQuery(args[i+1:])
+		if err != nil {
+			return nil, err
+		}
+		for key, values := range query {
+			value := values[len(values)-1]
+			switch key {
+			case "encoding":
+				options.encoding = value
+				if value != KAFKA_ENCODING_JSON && value != KAFKA_ENCODING_AVRO && value != KAFKA_ENCODING_PROTOBUF {
+					err = fmt.Errorf("unknown encoding")
+				}
+			case "schema-id":
+				options.schemaId, err = strconv.Atoi(value)
+			case "compression":
+				options.compression, err = parseKafkaCompression(value)
+			case "acks":
+				options.allAcks = value == "all"
+				switch value {
+				case "all":
+					options.acks = kgo.AllISRAcks()
+				case "leader":
+					options.acks = kgo.LeaderAck()
+				case "none":
+					options.acks = kgo.NoAck()
+				default:
+					err = fmt.Errorf("must be all, leader or none")
+				}
+			case "linger":
+				options.linger, err = time.ParseDuration(value)
+			case "batch-max-bytes":
+				var maxBytes int64
+				maxBytes, err = strconv.ParseInt(value, 10, 32)
+				options.maxBytes = int32(maxBytes)
+			case "timeout":
+				options.timeout, err = time.ParseDuration(value)
+			case "tls":
+				options.tls, err = strconv.ParseBool(value)
+			case "tls-skip-verify":
+				options.skipVerify, err = strconv.ParseBool(value)
+			case "sasl":
+				options.sasl = value
+				if value != "plain" && value != "scram-sha-256" && value != "scram-sha-512" {
+					err = fmt.Errorf("must be plain, scram-sha-256 or scram-sha-512")
+				}
+			case "username":
+				options.username = value
+			case "password":
+				options.password = value
+			default:
+				err = fmt.Errorf("unknown option")
+			}
+			if err != nil {
+				return nil, fmt.Errorf("invalid Kafka option %s=%s: %s", key, value, err)
+			}
+		}
+	}
+
+	i := strings.LastIndex(target, "/")
+	if i < 0 || i == len(target)-1 {
+		return nil, fmt.Errorf("no Kafka topic specified in %q", args)
+	}
+	options.topic = target[i+1:]
+	for _, broker := range strings.Split(target[:i], ",") {
+		if broker = strings.TrimSpace(broker); broker != "" {
+			options.brokers = append(options.brokers, broker)
+		}
+	}
+	if len(options.brokers) == 0 {
+		return nil, fmt.Errorf("no Kafka broker specified in %q", args)
+	}
+	return options, nil
+}
+
+func parseKafkaCompression(compression string) (kgo.CompressionCodec, error) {
+	switch compression {
+	case "none":
+		return kgo.NoCompression(), nil
+	case "gzip":
+		return kgo.GzipCompression(), nil
+	case "snappy":
+		return kgo.SnappyCompression(), nil
+	case "lz4":
+		return kgo.Lz4Compression(), nil
+	case "zstd":
+		return kgo.ZstdCompression(), nil
+	}
+	return kgo.CompressionCodec{}, fmt.Errorf("must be none, gzip, snappy, lz4 or zstd")
+}
+
+func (self *kafkaOptions) clientOptions() []kgo.Opt {
+	clientOptions := []kgo.Opt{
+		kgo.SeedBrokers(self.brokers...),
+		kgo.DefaultProduceTopic(self.topic),
+		kgo.ClientID("garin"),
+		kgo.ProducerBatchCompression(self.compression),
+		kgo.RequiredAcks(self.acks),
+		kgo.ProduceRequestTimeout(self.timeout),
+	}
+	// Idempotent writes require all the in-sync replicas to acknowledge the messages
+	if !self.allAcks {
+		clientOptions = append(clientOptions, kgo.DisableIdempotentWrite())
+	}
+	if self.linger > 0 {
+		clientOptions = append(clientOptions, kgo.ProducerLinger(self.linger))
+	}
+	if self.maxBytes > 0 {
+		clientOptions = append(clientOptions, kgo.ProducerBatchMaxBytes(self.maxBytes))
+	}
+	if self.tls {
+		clientOptions = append(clientOptions, kgo.DialTLSConfig(&tls.Config{InsecureSkipVerify: self.skipVerify}))
+	}
+	switch self.sasl {
+	case "plain":
+		clientOptions = append(clientOptions, kgo.SASL(plain.Auth{User: self.username, Pass: self.password}.AsMechanism()))
+	case "scram-sha-256":
+		clientOptions = append(clientOptions, kgo.SASL(scram.Auth{User: self.username, Pass: self.password}.AsSha256Mechanism()))
+	case "scram-sha-512":
+		clientOptions = append(clientOptions, kgo.SASL(scram.Auth{User: self.username, Pass: self.password}.AsSha512Mechanism()))
+	}
+	return clientOptions
+}
+
+// The producers being used along with the amount of connections using them
+var kafkaProducers = map[string]*kafkaProducer{}
+var kafkaProducersMutex = &sync.Mutex{}
+
+type kafkaProducer struct {
+	args    string
+	refs    int
+	options *kafkaOptions
+	client  *kgo.Client
+}
+
+func (self *KafkaGarinDB) Open() error {
+	options, err := parseKafkaArgs(self.dbArgs)
+	if err != nil {
+		return &DBError{Err: err, Retryable: false}
+	}
+
+	kafkaProducersMutex.Lock()
+	defer kafkaProducersMutex.Unlock()
+	producer := kafkaProducers[self.dbArgs]
+	if producer == nil {
+		client, err := kgo.NewClient(options.clientOptions()...)
+		if err != nil {
+			return &DBError{Err: err, Retryable: false}
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), options.timeout)
+		defer cancel()
+		if err := client.Ping(ctx); err != nil {
+			client.Close()
+			return err
+		}
+		producer = &kafkaProducer{args: self.dbArgs, options: options, client: client}
+		kafkaProducers[self.dbArgs] = producer
+	}
+	producer.refs++
+	self.producer = producer
+	return nil
+}
+
+// Close flushes the messages and closes the producer once all the connections using it are closed
+func (self *KafkaGarinDB) Close() error {
+	kafkaProducersMutex.Lock()
+	defer kafkaProducersMutex.Unlock()
+	self.producer.refs--
+	if self.producer.refs > 0 {
+		return nil
+	}
+	delete(kafkaProducers, self.producer.args)
+	ctx, cancel := context.WithTimeout(context.Background(), self.producer.options.timeout)
+	defer cancel()
+	err := self.producer.client.Flush(ctx)
+	self.producer.client.Close()
+	return err
+}
+
+func (self *KafkaGarinDB) RecordDestination(destination *Destination) error {
+	return self.RecordDestinations([]*Destination{destination})
+}
+
+// Waits for all the destinations to be acknowledged according to the acks option
+func (self *KafkaGarinDB) RecordDestinations(destinations []*Destination) error {
+	records := make([]*kgo.Record, len(destinations))
+	for i, destination := range destinations {
+		value, err := self.producer.options.encode(destination)
+		if err != nil {
+			return &DBError{Err: err, Retryable: false}
+		}
+		records[i] = &kgo.Record{Key: []byte(destination.SourceIp), Value: value, Timestamp: destination.Timestamp}
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), self.producer.options.timeout)
+	defer cancel()
+	return self.producer.client.ProduceSync(ctx, records...).FirstErr()
+}
+
+func (self *kafkaOptions) encode(destination *Destination) ([]byte, error) {
+	var header []byte
+	if self.schemaId > 0 {
+		// Confluent wire format : magic byte and schema ID
+		header = make([]byte, 5)
+		binary.BigEndian.PutUint32(header[1:], uint32(self.schemaId))
+	}
+
+	switch self.encoding {
+	case KAFKA_ENCODING_AVRO:
+		return AppendDestinationAvro(header, destination), nil
+	case KAFKA_ENCODING_PROTOBUF:
+		if header != nil {
+			// Index of the message in the schema, the first one
+			header = append(header, 0)
+		}
+		return AppendDestinationProtobuf(header, destination), nil
+	default:
+		value, err := json.Marshal(destination.Document())
+		return append(header, value...), err
+	}
+}
@@ -0,0 +1,403 @@
+package base
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"github.com/twmb/franz-go/pkg/kmsg"
+	"io"
+	"net"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+)
+
+const TEST_KAFKA_PARTITIONS = 3
+
+type testKafkaMessage struct {
+	partition int32
+	key       string
+	value     []byte
+}
+
+// Kafka broker that only implements what a producer needs and keeps the messages it receives in memory
+type testKafkaBroker struct {
+	listener net.Listener
+	host     string
+	port     int32
+	mutex    *sync.Mutex
+	messages []testKafkaMessage
+	acks     []int16
+}
+
+func newTestKafkaBroker(t *testing.T) *testKafkaBroker {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Can't listen : %s", err)
+	}
+	host, port, _ := net.SplitHostPort(listener.Addr().String())
+	portNumber, _ := strconv.Atoi(port)
+	broker := &testKafkaBroker{listener: listener, host: host, port: int32(portNumber), mutex: &sync.Mutex{}}
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go broker.serve(conn)
+		}
+	}()
+	return broker
+}
+
+func (self *testKafkaBroker) Addr() string {
+	return self.listener.Addr().String()
+}
+
+func (self *testKafkaBroker) Close() {
+	self.listener.Close()
+}
+
+func (self *testKafkaBroker) serve(conn net.Conn) {
+	defer conn.Close()
+	for {
+		header := make([]byte, 4)
+		if _, err := io.ReadFull(conn, header); err != nil {
+			return
+		}
+		data := make([]byte, binary.BigEndian.Uint32(header))
+		if _, err := io.ReadFull(conn, data); err != nil {
+			return
+		}
+
+		// Request header : API key, version, correlation ID and client ID
+		request := kmsg.RequestForKey(int16(binary.BigEndian.Uint16(data[0:2])))
+		if request == nil {
+			return
+		}
+		request.SetVersion(int16(binary.BigEndian.Uint16(data[2:4])))
+		correlationId := data[4:8]
+		clientIdLength := int(int16(binary.BigEndian.Uint16(data[8:10])))
+		body := data[10:]
+		if clientIdLength > 0 {
+			body = body[clientIdLength:]
+		}
+		if request.IsFlexible() {
+			// No tagged fields
+			body = body[1:]
+		}
+		if err := request.ReadFrom(body); err != nil {
+			return
+		}
+
+		response := self.handle(request)
+		if response == nil {
+			continue
+		}
+		payload := append([]byte{}, correlationId...)
+		// The header of the ApiVersions responses is never flexible
+		if response.IsFlexible() && request.Key() != 18 {
+			payload = append(payload, 0)
+		}
+		payload = response.AppendTo(payload)
+		size := make([]byte, 4)
+		binary.BigEndian.PutUint32(size, uint32(len(payload)))
+		if _, err := conn.Write(append(size, payload...)); err != nil {
+			return
+		}
+	}
+}
+
+func (self *testKafkaBroker) handle(request kmsg.Request) kmsg.Response {
+	switch request := request.(type) {
+	case *kmsg.ApiVersionsRequest:
+		response := kmsg.NewPtrApiVersionsResponse()
+		response.SetVersion(request.GetVersion())
+		// Versions that aren't flexible, except for ApiVersions
+		for _, key := range []struct{ key, max int16 }{{0, 7}, {3, 7}, {18, 3}, {22, 1}} {
+			response.ApiKeys = append(response.ApiKeys, kmsg.ApiVersionsResponseApiKey{ApiKey: key.key, MinVersion: 0, MaxVersion: key.max})
+		}
+		return response
+
+	case *kmsg.MetadataRequest:
+		response := kmsg.NewPtrMetadataResponse()
+		response.SetVersion(request.GetVersion())
+		response.Brokers = []kmsg.MetadataResponseBroker{{NodeID: 0, Host: self.host, Port: self.port}}
+		for _, requestTopic := range request.Topics {
+			topic := kmsg.NewMetadataResponseTopic()
+			topic.Topic = requestTopic.Topic
+			for i := int32(0); i < TEST_KAFKA_PARTITIONS; i++ {
+				topic.Partitions = append(topic.Partitions, kmsg.MetadataResponseTopicPartition{Partition: i, Leader: 0, Replicas: []int32{0}, ISR: []int32{0}})
+			}
+			response.Topics = append(response.Topics, topic)
+		}
+		return response
+
+	case *kmsg.InitProducerIDRequest:
+		response := kmsg.NewPtrInitProducerIDResponse()
+		response.SetVersion(request.GetVersion())
+		response.ProducerID = 1
+		return response
+
+	case *kmsg.ProduceRequest:
+		self.mutex.Lock()
+		defer self.mutex.Unlock()
+		self.acks = append(self.acks, request.Acks)
+		response := kmsg.NewPtrProduceResponse()
+		response.SetVersion(request.GetVersion())
+		for _, requestTopic := range request.Topics {
+			topic := kmsg.NewProduceResponseTopic()
+			topic.Topic = requestTopic.Topic
+			for _, requestPartition := range requestTopic.Partitions {
+				self.readRecords(requestPartition.Partition, requestPartition.Records)
+				partition := kmsg.NewProduceResponseTopicPartition()
+				partition.Partition = requestPartition.Partition
+				topic.Partitions = append(topic.Partitions, partition)
+			}
+			response.Topics = append(response.Topics, topic)
+		}
+		// Nothing is sent back when the producer doesn't wait for an acknowledgement
+		if request.Acks == 0 {
+			return nil
+		}
+		return response
+	}
+	return nil
+}
+
+// Only uncompressed record batches are supported
+func (self *testKafkaBroker) readRecords(partition int32, data []byte) {
+	for len(data) > 0 {
+		batch := kmsg.NewRecordBatch()
+		if err := batch.ReadFrom(data); err != nil {
+			return
+		}
+		// Length of the batch after the offset and the length itself
+		data = data[12+batch.Length:]
+		records := batch.Records
+		for i := int32(0); i < batch.NumRecords; i++ {
+			length, n := binary.Varint(records)
+			record := kmsg.NewRecord()
+			if err := record.ReadFrom(records[:n+int(length)]); err != nil {
+				return
+			}
+			records = records[n+int(length):]
+			self.messages = append(self.messages, testKafkaMessage{partition: partition, key: string(record.Key), value: record.Value})
+		}
+	}
+}
+
+func openTestKafka(t *testing.T, args string) *KafkaGarinDB {
+	db := &KafkaGarinDB{}
+	db.Setup("kafka", args)
+	if err := db.Open(); err != nil {
+		t.Fatalf("Can't open Kafka : %s", err)
+	}
+	return db
+}
+
+func TestKafkaProduce(t *testing.T) {
+	broker := newTestKafkaBroker(t)
+	defer broker.Close()
+
+	for _, acks := range []string{"all", "leader"} {
+		broker.messages = nil
+		args := broker.Addr() + "/garin?acks=" + acks + "&timeout=5s"
+		db := openTestKafka(t, args)
+		// A second connection shares the producer
+		otherDB := openTestKafka(t, args)
+		if db.producer != otherDB.producer {
+			t.Error("Connections to the same topic don't share their producer")
+		}
+
+		var destinations []*Destination
+		for i := 0; i < 10; i++ {
+			destinations = append(destinations, &Destination{SourceIp: fmt.Sprintf("10.0.0.%d", i%4), DestinationIp: "192.0.2.1", ServerName: fmt.Sprintf("%d.example.com", i), Protocol: "HTTPS", Timestamp: time.Now()})
+		}
+		if err := db.RecordDestinations(destinations); err != nil {
+			t.Fatalf("Can't record destinations with acks=%s : %s", acks, err)
+		}
+		otherDB.Close()
+		db.Close()
+
+		broker.mutex.Lock()
+		if len(broker.messages) != 10 {
+			t.Errorf("Broker received %d messages with acks=%s instead of 10", len(broker.messages), acks)
+		}
+		// The messages of a source IP all go to the same partition
+		partitions := make(map[string]int32)
+		for _, message := range broker.messages {
+			if partition, ok := partitions[message.key]; ok && partition != message.partition {
+				t.Errorf("Messages of %s were sent to partitions %d and %d", message.key, partition, message.partition)
+			}
+			partitions[message.key] = message.partition
+			document := DestinationDocument{}
+			if err := json.Unmarshal(message.value, &document); err != nil || document.SourceIp != message.key {
+				t.Errorf("Message isn't the JSON document of the destination : %s", message.value)
+			}
+		}
+		broker.mutex.Unlock()
+	}
+}
+
+func TestKafkaEncodings(t *testing.T) {
+	destination := &Destination{SourceIp: "10.0.0.1", DestinationIp: "192.0.2.1", ServerName: "a", Protocol: "HTTP", Timestamp: time.Unix(1, 0), TunnelId: 1}
+
+	avro := AppendDestinationAvro(nil, destination)
+	expectedAvro := []byte{0x80, 0x89, 0x7a, 16, '1', '0', '.', '0', '.', '0', '.', '1', 18, '1', '9', '2', '.', '0', '.', '2', '.', '1', 2, 'a', 8, 'H', 'T', 'T', 'P', 0, 0, 2, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0}
+	if !bytes.Equal(avro, expectedAvro) {
+		t.Errorf("Avro encoding is %v instead of %v", avro, expectedAvro)
+	}
+
+	protobuf := AppendDestinationProtobuf(nil, destination)
+	expectedProtobuf := []byte{0x08, 0xc0, 0x84, 0x3d, 0x12, 8, '1', '0', '.', '0', '.', '0', '.', '1', 0x1a, 9, '1', '9', '2', '.', '0', '.', '2', '.', '1', 0x22, 1, 'a', 0x2a, 4, 'H', 'T', 'T', 'P', 0x40, 1}
+	if !bytes.Equal(protobuf, expectedProtobuf) {
+		t.Errorf("Protobuf encoding is %v instead of %v", protobuf, expectedProtobuf)
+	}
+
+	// The traffic, the ports and the fingerprint survive the round trip through both encodings
+	destination.SourcePort, destination.DestinationPort, destination.TLSFingerprint = 49152, 443, "e7d705a3286e19ea42f587b344ee6865"
+	destination.Traffic = Traffic{BytesSent: 517, BytesReceived: 4096, PacketsSent: 5, PacketsReceived: 7, DurationMs: 1500, OutOfOrder: 1, SkippedBytes: 3, EndReason: END_REASON_RST}
+	for encoding, decoded := range map[string]*Destination{
+		"Avro":     decodeTestAvro(t, AppendDestinationAvro(nil, destination)),
+		"Protobuf": decodeTestProtobuf(t, AppendDestinationProtobuf(nil, destination)),
+	} {
+		if !decoded.Timestamp.Equal(destination.Timestamp) {
+			t.Errorf("%s round trip returned the timestamp %s instead of %s", encoding, decoded.Timestamp, destination.Timestamp)
+		}
+		decoded.Timestamp = destination.Timestamp
+		if *decoded != *destination {
+			t.Errorf("%s round trip returned %+v instead of %+v", encoding, decoded, destination)
+		}
+	}
+	destination.SourcePort, destination.DestinationPort, destination.TLSFingerprint = 0, 0, ""
+	destination.Traffic = Traffic{}
+
+	options, err := parseKafkaArgs("127.0.0.1:9092/garin?encoding=avro&schema-id=7")
+	if err != nil {
+		t.Fatalf("Can't parse args : %s", err)
+	}
+	value, _ := options.encode(destination)
+	if !bytes.Equal(value[:5], []byte{0, 0, 0, 0, 7}) || !bytes.Equal(value[5:], expectedAvro) {
+		t.Errorf("Message isn't in the Confluent wire format : %v", value)
+	}
+
+	for _, args := range []string{"127.0.0.1:9092", "/garin", "127.0.0.1:9092/garin?acks=2", "127.0.0.1:9092/garin?encoding=xml", "127.0.0.1:9092/garin?compression=brotli"} {
+		if _, err := parseKafkaArgs(args); err == nil {
+			t.Errorf("Invalid args %q were accepted", args)
+		}
+	}
+}
+
+// Decodes the fields of DESTINATION_AVRO_SCHEMA in order
+func decodeTestAvro(t *testing.T, data []byte) *Destination {
+	reader := bytes.NewReader(data)
+	readLong := func() int64 {
+		value, err := binary.ReadVarint(reader)
+		if err != nil {
+			t.Fatalf("Can't read Avro long : %s", err)
+		}
+		return value
+	}
+	readString := func() string {
+		value := make([]byte, readLong())
+		if _, err := io.ReadFull(reader, value); err != nil {
+			t.Fatalf("Can't read Avro string : %s", err)
+		}
+		return string(value)
+	}
+
+	destination := &Destination{Timestamp: time.Unix(0, readLong()*1000)}
+	destination.SourceIp = readString()
+	destination.DestinationIp = readString()
+	destination.ServerName = readString()
+	destination.Protocol = readString()
+	destination.Interface = readString()
+	destination.TunnelType = readString()
+	destination.TunnelId = uint32(readLong())
+	destination.BytesSent = readLong()
+	destination.BytesReceived = readLong()
+	destination.PacketsSent = readLong()
+	destination.PacketsReceived = readLong()
+	destination.DurationMs = readLong()
+	destination.OutOfOrder = readLong()
+	destination.SkippedBytes = readLong()
+	destination.EndReason = readString()
+	destination.SourcePort = uint16(readLong())
+	destination.DestinationPort = uint16(readLong())
+	destination.TLSFingerprint = readString()
+	if reader.Len() != 0 {
+		t.Errorf("%d bytes are left after the Avro record", reader.Len())
+	}
+	return destination
+}
+
+// Decodes the fields of DESTINATION_PROTOBUF_SCHEMA by their number
+func decodeTestProtobuf(t *testing.T, data []byte) *Destination {
+	reader := bytes.NewReader(data)
+	destination := &Destination{Timestamp: time.Unix(0, 0)}
+	for reader.Len() > 0 {
+		key, err := binary.ReadUvarint(reader)
+		if err != nil {
+			t.Fatalf("Can't read Protobuf key : %s", err)
+		}
+		value, err := binary.ReadUvarint(reader)
+		if err != nil {
+			t.Fatalf("Can't read Protobuf value : %s", err)
+		}
+		var text string
+		if key&7 == protobufBytes {
+			raw := make([]byte, value)
+			if _, err := io.ReadFull(reader, raw); err != nil {
+				t.Fatalf("Can't read Protobuf string : %s", err)
+			}
+			text = string(raw)
+		}
+
+		switch key >> 3 {
+		case 1:
+			destination.Timestamp = time.Unix(0, int64(value)*1000)
+		case 2:
+			destination.SourceIp = text
+		case 3:
+			destination.DestinationIp = text
+		case 4:
+			destination.ServerName = text
+		case 5:
+			destination.Protocol = text
+		case 6:
+			destination.Interface = text
+		case 7:
+			destination.TunnelType = text
+		case 8:
+			destination.TunnelId = uint32(value)
+		case 9:
+			destination.BytesSent = int64(value)
+		case 10:
+			destination.BytesReceived = int64(value)
+		case 11:
+			destination.PacketsSent = int64(value)
+		case 12:
+			destination.PacketsReceived = int64(value)
+		case 13:
+			destination.DurationMs = int64(value)
+		case 14:
+			destination.OutOfOrder = int64(value)
+		case 15:
+			destination.SkippedBytes = int64(value)
+		case 16:
+			destination.EndReason = text
+		case 17:
+			destination.SourcePort = uint16(value)
+		case 18:
+			destination.DestinationPort = uint16(value)
+		case 19:
+			destination.TLSFingerprint = text
+		default:
+			t.Errorf("Unknown Protobuf field %d", key>>3)
+		}
+	}
+	return destination
+}
@@ -0,0 +1,268 @@
+package base
+
+import (
+	"fmt"
+	"github.com/jmoiron/sqlx"
+	"time"
+)
+
+const SCHEMA_VERSION_TABLE_NAME = "schema_version"
+
+// Migration brings the schema of a SQL database from the previous version to Version
+type Migration struct {
+	Version     int
+	Description string
+	// Executed in order, unless Apply is set
+	Statements []string
+	Apply      func(tx *sqlx.Tx) error
+}
+
+// The migrations of each SQL dialect, in order
+// Only new migrations can be added since the ones that were released may already have been applied
+var migrations = map[string][]Migration{
+	"sqlite3": {
+		createLegacyDestinationsMigration,
+		addLegacyColumnsMigration,
+		{
+			Version:     3,
+			Description: "store IPv6 addresses, long server names and the time of day",
+			// SQLite can't change the type of a column so the table is rebuilt
+			Statements: []string{
+				"create table destinations_new (source_ip VARCHAR(45), destination_ip VARCHAR(45), server_name VARCHAR(255), protocol VARCHAR(10), timestamp DATETIME, interface VARCHAR(32), tunnel_type VARCHAR(10), tunnel_id INTEGER)",
+				"insert into destinations_new select source_ip, destination_ip, server_name, protocol, timestamp, interface, tunnel_type, tunnel_id from destinations",
+				"drop table destinations",
+				"alter table destinations_new rename to destinations",
+			},
+		},
+		createIndexesMigration,
+		{
+			Version:     5,
+			Description: "create the destination sessions table",
+			Statements: []string{
+				"create table destination_sessions (source_ip VARCHAR(45) not null, destination_ip VARCHAR(45) not null, server_name VARCHAR(255) not null, protocol VARCHAR(10) not null, first_seen DATETIME not null, last_seen DATETIME not null, connections BIGINT not null, bytes BIGINT not null, packets BIGINT not null, primary key (source_ip, destination_ip, server_name, protocol))",
+				"create index destination_sessions_last_seen_idx on destination_sessions (last_seen)",
+			},
+		},
+		addTrafficColumnsMigration,
+		addConnectionColumnsMigration,
+		{
+			Version:     8,
+			Description: "index the timestamp as it is compared",
+			// The timestamps are stored with the offset of their time zone so they are compared with julianday(), which can't use the index of the column
+			Statements: []string{
+				"create index destinations_julianday_idx on destinations (julianday(timestamp))",
+			},
+		},
+	},
+	"mysql": {
+		createLegacyDestinationsMigration,
+		addLegacyColumnsMigration,
+		{
+			Version:     3,
+			Description: "store IPv6 addresses, long server names and the time of day",
+			Statements: []string{
+				"alter table destinations modify source_ip VARCHAR(45), modify destination_ip VARCHAR(45), modify server_name VARCHAR(255), modify timestamp DATETIME(6)",
+			},
+		},
+		createIndexesMigration,
+		{
+			Version:     5,
+			Description: "create the destination sessions table",
+			Statements: []string{
+				"create table destination_sessions (source_ip VARCHAR(45) not null, destination_ip VARCHAR(45) not null, server_name VARCHAR(255) not null, protocol VARCHAR(10) not null, first_seen DATETIME(6) not null, last_seen DATETIME(6) not null, connections BIGINT not null, bytes BIGINT not null, packets BIGINT not null, primary key (source_ip, destination_ip, server_name, protocol))",
+				"create index destination_sessions_last_seen_idx on destination_sessions (last_seen)",
+			},
+		},
+		addTrafficColumnsMigration,
+		addConnectionColumnsMigration,
+	},
+	"postgres": {
+		{
+			Version:     1,
+			Description: "create the destinations table",
+			Statements:  postgresSchema,
+		},
+		{
+			Version:     2,
+			Description: "create the destination sessions table",
+			Statements:  postgresSessionsSchema,
+		},
+		{
+			Version:     3,
+			Description: "index the TLS fingerprint",
+			Statements:  postgresFingerprintSchema,
+		},
+	},
+}
+
+// The table as it was created before the migrations existed
+var createLegacyDestinationsMigration = Migration{
+	Version:     1,
+	Description: "create the destinations table",
+	Statements: []string{
+		"create table if not exists destinations (source_ip VARCHAR(15), destination_ip VARCHAR(15), server_name VARCHAR(100), protocol VARCHAR(10), timestamp DATE)",
+	},
+}
+
+// Tables created before the migrations existed may already have some of these columns
+var addLegacyColumnsMigration = Migration{
+	Version:     2,
+	Description: "add the interface and tunnel columns",
+	Apply: func(tx *sqlx.Tx) error {
+		columns := [][2]string{
+			{"interface", "VARCHAR(32)"},
+			{"tunnel_type", "VARCHAR(10)"},
+			{"tunnel_id", "INTEGER"},
+		}
+		for _, column := range columns {
+			if _, err := tx.Exec("select " + column[0] + " from destinations limit 1"); err == nil {
+				continue
+			}
+			if _, err := tx.Exec("alter table destinations add column " + column[0] + " " + column[1]); err != nil {
+				return err
+			}
+		}
+		return nil
+	},
+}
+
+var createIndexesMigration = Migration{
+	Version:     4,
+	Description: "index the server name, the source IP and the timestamp",
+	Statements: []string{
+		"create index destinations_server_name_idx on destinations (server_name)",
+		"create index destinations_source_ip_idx on destinations (source_ip)",
+		"create index destinations_timestamp_idx on destinations (timestamp)",
+	},
+}
+
+var addTrafficColumnsMigration = Migration{
+	Version:     6,
+	Description: "add the traffic columns",
+	Statements: []string{
+		"alter table destinations add column bytes_sent BIGINT",
+		"alter table destinations add column bytes_received BIGINT",
+		"alter table destinations add column packets_sent BIGINT",
+		"alter table destinations add column packets_received BIGINT",
+		"alter table destinations add column duration_ms BIGINT",
+		"alter table destinations add column out_of_order BIGINT",
+		"alter table destinations add column skipped_bytes BIGINT",
+		"alter table destinations add column end_reason VARCHAR(5)",
+	},
+}
+
+var addConnectionColumnsMigration = Migration{
+	Version:     7,
+	Description: "add the ports and TLS fingerprint columns",
+	Statements: []string{
+		"alter table destinations add column source_port INTEGER",
+		"alter table destinations add column destination_port INTEGER",
+		"alter table destinations add column tls_fingerprint VARCHAR(32)",
+		"create index destinations_tls_fingerprint_idx on destinations (tls_fingerprint)",
+	},
+}
+
+// Migrations returns the migrations of a SQL dialect
+func Migrations(dialect string) ([]Migration, error) {
+	dialectMigrations, ok := migrations[dialect]
+	if !ok {
+		return nil, &DBError{Err: fmt.Errorf("no schema migrations for database type %q", dialect), Retryable: false}
+	}
+	return dialectMigrations, nil
+}
+
+// SchemaVersion returns the version of the last migration that was applied, 0 if none was
+func SchemaVersion(handle *sqlx.DB) (int, error) {
+	_, err := handle.Exec("create table if not exists " + SCHEMA_VERSION_TABLE_NAME + " (version INTEGER primary key, description VARCHAR(255) not null, applied_at TIMESTAMP not null)")
+	if err != nil {
+		return 0, err
+	}
+	var version int
+	err = handle.Get(&version, "select coalesce(max(version), 0) from "+SCHEMA_VERSION_TABLE_NAME)
+	return version, err
+}
+
+// Migrate applies the migrations that weren't applied yet and returns them
+// Each migration is applied in its own transaction along with the update of the schema version
+// MySQL commits the changes to the schema right away so a migration that fails there must be fixed by hand
+func Migrate(handle *sqlx.DB, dialect string) ([]Migration, error) {
+	dialectMigrations, err := Migrations(dialect)
+	if err != nil {
+		return nil, err
+	}
+	version, err := SchemaVersion(handle)
+	if err != nil {
+		return nil, err
+	}
+
+	var applied []Migration
+	for _, migration := range dialectMigrations {
+		if migration.Version <= version {
+			continue
+		}
+		Logger().Infof("migrating the database schema to version %d : %s", migration.Version, migration.Description)
+		if err := applyMigration(handle, migration); err != nil {
+			return applied, &DBError{Err: fmt.Errorf("can't migrate the database schema to version %d: %s", migration.Version, err), Retryable: IsRetryable(err)}
+		}
+		applied = append(applied, migration)
+	}
+	return applied, nil
+}
+
+func applyMigration(handle *sqlx.DB, migration Migration) error {
+	tx, err := handle.Beginx()
+	if err != nil {
+		return err
+	}
+	if migration.Apply != nil {
+		err = migration.Apply(tx)
+	} else {
+		for _, statement := range migration.Statements {
+			if _, err = tx.Exec(statement); err != nil {
+				break
+			}
+		}
+	}
+	if err == nil {
+		_, err = tx.Exec(tx.Rebind("insert into "+SCHEMA_VERSION_TABLE_NAME+" (version, description, applied_at) values (?, ?, ?)"), migration.Version, migration.Description, time.Now().UTC())
+	}
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	return tx.Commit()
+}
+
+// Migrates the schema of each database once per process, the connections opened after that use it as is
+func migrateOnce(handle *sqlx.DB, dialect string, dbArgs string) error {
+	creationMutex.Lock()
+	defer creationMutex.Unlock()
+	// The separator keeps different types and args from making the same key
+	key := dialect + "\x00" + dbArgs
+	if schemaMigrated[key] {
+		return nil
+	}
+	if _, err := Migrate(handle, dialect); err != nil {
+		return err
+	}
+	schemaMigrated[key] = true
+	return nil
+}
+
+// MigrateDB opens a SQL database and migrates its schema
+func MigrateDB(dbType string, dbArgs string) ([]Migration, int, error) {
+	if _, err := Migrations(dbType); err != nil {
+		return nil, 0, err
+	}
+	handle, err := sqlx.Open(dbType, dbArgs)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer handle.Close()
+	applied, err := Migrate(handle, dbType)
+	if err != nil {
+		return applied, 0, err
+	}
+	version, err := SchemaVersion(handle)
+	return applied, version, err
+}
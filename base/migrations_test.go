@@ -0,0 +1,97 @@
+package base
+
+import (
+	"github.com/jmoiron/sqlx"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestMigrateLegacySQLite(t *testing.T) {
+	directory, _ := ioutil.TempDir("", "garin-migrations")
+	defer os.RemoveAll(directory)
+	handle, err := sqlx.Open("sqlite3", filepath.Join(directory, "garin.sqlite3"))
+	if err != nil {
+		t.Fatalf("Can't open database : %s", err)
+	}
+	defer handle.Close()
+
+	// Table created by a version that didn't have the migrations nor the tunnel columns
+	handle.MustExec("create table destinations (source_ip VARCHAR(15), destination_ip VARCHAR(15), server_name VARCHAR(100), protocol VARCHAR(10), timestamp DATE, interface VARCHAR(32))")
+	timestamp := time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)
+	handle.MustExec("insert into destinations (source_ip, destination_ip, server_name, protocol, timestamp, interface) values (?, ?, ?, ?, ?, ?)", "10.0.0.1", "10.0.0.2", "example.com", "HTTP", timestamp, "eth0")
+
+	applied, err := Migrate(handle, "sqlite3")
+	if err != nil {
+		t.Fatalf("Can't migrate database : %s", err)
+	}
+	if len(applied) != 8 {
+		t.Errorf("%d migrations were applied instead of 8", len(applied))
+	}
+	if version, _ := SchemaVersion(handle); version != 8 {
+		t.Errorf("Schema version is %d instead of 8", version)
+	}
+
+	destination := &Destination{SourceIp: "2001:db8::1", DestinationIp: "2001:db8::2", ServerName: "example.com", Protocol: "HTTPS", Timestamp: timestamp.Add(time.Hour), TunnelType: "vxlan", TunnelId: 42}
+	if _, err := handle.NamedExec(insertDestinationQuery, destination); err != nil {
+		t.Fatalf("Can't record destination after migrating : %s", err)
+	}
+	var destinations []Destination
+	if err := handle.Select(&destinations, "select source_ip, destination_ip, server_name, protocol, timestamp, interface, coalesce(tunnel_type, '') as tunnel_type, coalesce(tunnel_id, 0) as tunnel_id from destinations order by timestamp"); err != nil {
+		t.Fatalf("Can't read destinations : %s", err)
+	}
+	if len(destinations) != 2 || destinations[0].Interface != "eth0" || destinations[1].SourceIp != "2001:db8::1" || !destinations[1].Timestamp.Equal(timestamp.Add(time.Hour)) {
+		t.Errorf("Destinations weren't kept by the migrations : %+v", destinations)
+	}
+
+	if applied, err := Migrate(handle, "sqlite3"); err != nil || len(applied) != 0 {
+		t.Errorf("Migrating again applied %d migrations and returned %v", len(applied), err)
+	}
+}
+
+func TestSQLiteTimestampIndex(t *testing.T) {
+	handle, err := sqlx.Open("sqlite3", ":memory:")
+	if err != nil {
+		t.Fatalf("Can't open database : %s", err)
+	}
+	defer handle.Close()
+	if _, err := Migrate(handle, "sqlite3"); err != nil {
+		t.Fatalf("Can't migrate database : %s", err)
+	}
+
+	query := &DestinationQuery{Since: time.Now().Add(-time.Hour), Limit: 10}
+	where, args := sqlWhere(query, "sqlite3")
+	rows, err := handle.Query("EXPLAIN QUERY PLAN SELECT * FROM "+DESTINATIONS_TABLE_NAME+where, args...)
+	if err != nil {
+		t.Fatalf("Can't explain query : %s", err)
+	}
+	defer rows.Close()
+	plan := []string{}
+	for rows.Next() {
+		var id, parent, unused int
+		var detail string
+		if err := rows.Scan(&id, &parent, &unused, &detail); err != nil {
+			t.Fatalf("Can't read query plan : %s", err)
+		}
+		plan = append(plan, detail)
+	}
+	if len(plan) != 1 || !strings.Contains(plan[0], "destinations_julianday_idx") {
+		t.Errorf("Time range isn't looked up and sorted with the index : %v", plan)
+	}
+}
+
+func TestMigrationsAreOrdered(t *testing.T) {
+	for dialect, dialectMigrations := range migrations {
+		for i, migration := range dialectMigrations {
+			if migration.Version != i+1 {
+				t.Errorf("Migration %d of %s has version %d", i, dialect, migration.Version)
+			}
+		}
+	}
+	if _, err := Migrations("mongodb"); err == nil {
+		t.Error("MongoDB has SQL migrations")
+	}
+}
@@ -2,6 +2,8 @@ package base
 
 import (
 	"gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+	"regexp"
 )
 
 type MongoGarinDB struct {
@@ -9,25 +11,152 @@ type MongoGarinDB struct {
 	Session *mgo.Session
 }
 
-func (self *MongoGarinDB) Open() {
+func (self *MongoGarinDB) Open() error {
 	session, err := mgo.Dial(self.dbArgs)
 
 	if err != nil {
-		Die(err)
+		return err
 	}
 
 	self.Session = session
 	self.Session.SetMode(mgo.Monotonic, true)
+	return nil
 }
 
-func (self *MongoGarinDB) Close() {
+func (self *MongoGarinDB) Close() error {
 	self.Session.Close()
+	return nil
 }
 
-func (self *MongoGarinDB) RecordDestination(destination *Destination) {
+func (self *MongoGarinDB) RecordDestination(destination *Destination) error {
 	c := self.Session.DB("").C(DESTINATIONS_TABLE_NAME)
-	err := c.Insert(destination)
-	if err != nil {
-		panic(err)
+	return c.Insert(destination)
+}
+
+func (self *MongoGarinDB) RecordDestinations(destinations []*Destination) error {
+	docs := make([]interface{}, len(destinations))
+	for i, destination := range destinations {
+		docs[i] = destination
+	}
+	c := self.Session.DB("").C(DESTINATIONS_TABLE_NAME)
+	return c.Insert(docs...)
+}
+
+// Builds the selector of the filters MongoDB can apply, the fields are named after the ones of Destination in lower case
+func mongoSelector(query *DestinationQuery) bson.M {
+	selector := bson.M{}
+	if ip, single := query.singleSource(); single {
+		selector["sourceip"] = ip
+	}
+	if query.ServerName != "" {
+		switch query.ServerNameMatch {
+		case SERVER_NAME_MATCH_SUFFIX:
+			selector["servername"] = bson.M{"$regex": `(^|\.)` + regexp.QuoteMeta(query.ServerName) + "$"}
+		case SERVER_NAME_MATCH_REGEX:
+			selector["servername"] = bson.M{"$regex": query.ServerName}
+		default:
+			selector["servername"] = query.ServerName
+		}
+	}
+	if query.Protocol != "" {
+		selector["protocol"] = query.Protocol
+	}
+	if query.TLSFingerprint != "" {
+		selector["tlsfingerprint"] = query.TLSFingerprint
+	}
+	timestamp := bson.M{}
+	if !query.Since.IsZero() {
+		timestamp["$gte"] = query.Since
+	}
+	if !query.Until.IsZero() {
+		timestamp["$lt"] = query.Until
+	}
+	if len(timestamp) > 0 {
+		selector["timestamp"] = timestamp
+	}
+	return selector
+}
+
+// The IPs are stored as strings so the subnets are filtered while reading the other matching destinations
+func (self *MongoGarinDB) QueryDestinations(query *DestinationQuery) ([]*Destination, error) {
+	c := self.Session.DB("").C(DESTINATIONS_TABLE_NAME)
+	find := c.Find(mongoSelector(query)).Sort("-timestamp")
+	var destinations []*Destination
+	if _, single := query.singleSource(); query.Source == nil || single {
+		err := find.Skip(query.Offset).Limit(query.Limit).All(&destinations)
+		return destinations, err
+	}
+
+	iter := find.Iter()
+	skipped := 0
+	for len(destinations) < query.Limit {
+		destination := &Destination{}
+		if !iter.Next(destination) {
+			break
+		}
+		if !query.Match(destination) {
+			continue
+		}
+		if skipped < query.Offset {
+			skipped++
+			continue
+		}
+		destinations = append(destinations, destination)
+	}
+	if err := iter.Close(); err != nil {
+		return nil, err
+	}
+	return destinations, nil
+}
+
+// The destinations are counted while reading them since the subnets can only be filtered in memory
+func (self *MongoGarinDB) SummarizeDestinations(query *DestinationQuery) (*DestinationSummary, error) {
+	summary := newDestinationsSummary(query)
+	if err := self.read(mongoSelector(query), summary.add); err != nil {
+		return nil, err
+	}
+	return summary.result(), nil
+}
+
+func (self *MongoGarinDB) SeenServerNames(query *DestinationQuery, serverNames []string) (map[string]bool, error) {
+	selector := mongoSelector(query)
+	if _, filtered := selector["servername"]; !filtered {
+		selector["servername"] = bson.M{"$in": serverNames}
+	}
+	seen := newServerNamesSeen(query, serverNames)
+	if err := self.read(selector, seen.add); err != nil {
+		return nil, err
+	}
+	return seen.seen, nil
+}
+
+// Reads all the destinations of a selector
+func (self *MongoGarinDB) read(selector bson.M, add func(*Destination)) error {
+	iter := self.Session.DB("").C(DESTINATIONS_TABLE_NAME).Find(selector).Iter()
+	for {
+		destination := &Destination{}
+		if !iter.Next(destination) {
+			break
+		}
+		add(destination)
+	}
+	return iter.Close()
+}
+
+// The sessions are upserted in a single bulk operation, the fields are named like the ones of the destinations
+func (self *MongoGarinDB) RecordSessions(sessions []*Session) error {
+	c := self.Session.DB("").C(SESSIONS_TABLE_NAME)
+	bulk := c.Bulk()
+	bulk.Unordered()
+	for _, session := range sessions {
+		selector := bson.M{"sourceip": session.SourceIp, "destinationip": session.DestinationIp, "servername": session.ServerName, "protocol": session.Protocol}
+		update := bson.M{
+			"$min": bson.M{"firstseen": session.FirstSeen},
+			"$max": bson.M{"lastseen": session.LastSeen},
+			"$inc": bson.M{"connections": session.Connections, "bytes": session.Bytes, "packets": session.Packets},
+		}
+		bulk.Upsert(selector, update)
 	}
+	_, err := bulk.Run()
+	return err
 }
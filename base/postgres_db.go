@@ -0,0 +1,237 @@
+package base
+
+import (
+	"encoding/json"
+	"github.com/jmoiron/sqlx"
+	"github.com/lib/pq"
+)
+
+// PostgresGarinDB records the destinations in PostgreSQL using its native types
+// The IPs are stored as inet, the timestamps as timestamptz and the attributes that don't have a column of their own as jsonb
+type PostgresGarinDB struct {
+	AbstractGarinDB
+	Handle *sqlx.DB
+}
+
+// Applied by the first migration
+var postgresSchema = []string{
+	`create table if not exists destinations (
+		id bigserial primary key,
+		source_ip inet not null,
+		destination_ip inet not null,
+		server_name text not null,
+		protocol text not null,
+		timestamp timestamptz not null,
+		interface text not null default '',
+		attributes jsonb not null default '{}'
+	)`,
+	"create index if not exists destinations_timestamp_idx on destinations (timestamp)",
+	"create index if not exists destinations_server_name_idx on destinations (server_name)",
+	// Allows looking up the destinations of a subnet with the << and <<= operators
+	"create index if not exists destinations_source_ip_idx on destinations using gist (source_ip inet_ops)",
+}
+
+// Applied by the third migration, the fingerprint is one of the attributes
+var postgresFingerprintSchema = []string{
+	"create index if not exists destinations_tls_fingerprint_idx on destinations ((attributes->>'tls_fingerprint'))",
+}
+
+// Applied by the second migration
+var postgresSessionsSchema = []string{
+	`create table if not exists destination_sessions (
+		source_ip inet not null,
+		destination_ip inet not null,
+		server_name text not null,
+		protocol text not null,
+		first_seen timestamptz not null,
+		last_seen timestamptz not null,
+		connections bigint not null,
+		bytes bigint not null,
+		packets bigint not null,
+		primary key (source_ip, destination_ip, server_name, protocol)
+	)`,
+	"create index if not exists destination_sessions_last_seen_idx on destination_sessions (last_seen)",
+}
+
+var postgresColumns = []string{"source_ip", "destination_ip", "server_name", "protocol", "timestamp", "interface", "attributes"}
+
+const insertPostgresDestinationQuery = "INSERT INTO " + DESTINATIONS_TABLE_NAME + " (source_ip, destination_ip, server_name, protocol, timestamp, interface, attributes) VALUES($1, $2, $3, $4, $5, $6, $7)"
+
+// Attributes of a destination that are only set in some cases
+type postgresAttributes struct {
+	TunnelType      string   `json:"tunnel_type,omitempty"`
+	TunnelId        uint32   `json:"tunnel_id,omitempty"`
+	SourcePort      uint16   `json:"source_port,omitempty"`
+	DestinationPort uint16   `json:"destination_port,omitempty"`
+	TLSFingerprint  string   `json:"tls_fingerprint,omitempty"`
+	Traffic         *Traffic `json:"traffic,omitempty"`
+}
+
+func (self *PostgresGarinDB) Open() error {
+	db, err := sqlx.Open("postgres", self.dbArgs)
+	if err != nil {
+		return err
+	}
+	if err := db.Ping(); err != nil {
+		db.Close()
+		return err
+	}
+
+	self.Handle = db
+	if err := migrateOnce(db, "postgres", self.dbArgs); err != nil {
+		db.Close()
+		return err
+	}
+	return nil
+}
+
+func (self *PostgresGarinDB) Close() error {
+	return self.Handle.Close()
+}
+
+func newPostgresAttributes(destination *Destination) postgresAttributes {
+	return postgresAttributes{
+		TunnelType:      destination.TunnelType,
+		TunnelId:        destination.TunnelId,
+		SourcePort:      destination.SourcePort,
+		DestinationPort: destination.DestinationPort,
+		TLSFingerprint:  destination.TLSFingerprint,
+		Traffic:         destination.Document().Traffic,
+	}
+}
+
+func postgresValues(destination *Destination) ([]interface{}, error) {
+	attributes, err := json.Marshal(newPostgresAttributes(destination))
+	if err != nil {
+		return nil, err
+	}
+	return []interface{}{
+		destination.SourceIp,
+		destination.DestinationIp,
+		destination.ServerName,
+		destination.Protocol,
+		destination.Timestamp,
+		destination.Interface,
+		string(attributes),
+	}, nil
+}
+
+func (self *PostgresGarinDB) RecordDestination(destination *Destination) error {
+	values, err := postgresValues(destination)
+	if err != nil {
+		return err
+	}
+	_, err = self.Handle.Exec(insertPostgresDestinationQuery, values...)
+	return err
+}
+
+// The destinations are loaded with COPY which is much faster than inserting them, nothing is recorded if one of them fails
+func (self *PostgresGarinDB) RecordDestinations(destinations []*Destination) error {
+	tx, err := self.Handle.Begin()
+	if err != nil {
+		return err
+	}
+	stmt, err := tx.Prepare(pq.CopyIn(DESTINATIONS_TABLE_NAME, postgresColumns...))
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	for _, destination := range destinations {
+		values, err := postgresValues(destination)
+		if err == nil {
+			_, err = stmt.Exec(values...)
+		}
+		if err != nil {
+			stmt.Close()
+			tx.Rollback()
+			return err
+		}
+	}
+	// Flushes the rows, this is where the errors caused by their content are returned
+	if _, err := stmt.Exec(); err != nil {
+		stmt.Close()
+		tx.Rollback()
+		return err
+	}
+	if err := stmt.Close(); err != nil {
+		tx.Rollback()
+		return err
+	}
+	return tx.Commit()
+}
+
+const selectPostgresDestinationsQuery = "SELECT host(source_ip), host(destination_ip), server_name, protocol, timestamp, interface, attributes FROM " + DESTINATIONS_TABLE_NAME
+
+// The subnets are looked up with the inet operators so they use the index of the source IPs
+func (self *PostgresGarinDB) QueryDestinations(query *DestinationQuery) ([]*Destination, error) {
+	where, args := sqlWhere(query, "postgres")
+	rows, err := self.Handle.Query(selectPostgresDestinationsQuery+where, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var destinations []*Destination
+	for rows.Next() {
+		destination := &Destination{}
+		var attributes []byte
+		if err := rows.Scan(&destination.SourceIp, &destination.DestinationIp, &destination.ServerName, &destination.Protocol, &destination.Timestamp, &destination.Interface, &attributes); err != nil {
+			return nil, err
+		}
+		if err := readPostgresAttributes(attributes, destination); err != nil {
+			return nil, err
+		}
+		destinations = append(destinations, destination)
+	}
+	return destinations, rows.Err()
+}
+
+// Sets the attributes of a destination read from the database
+func readPostgresAttributes(attributes []byte, destination *Destination) error {
+	decoded := postgresAttributes{}
+	if err := json.Unmarshal(attributes, &decoded); err != nil {
+		return err
+	}
+	destination.TunnelType = decoded.TunnelType
+	destination.TunnelId = decoded.TunnelId
+	destination.SourcePort = decoded.SourcePort
+	destination.DestinationPort = decoded.DestinationPort
+	destination.TLSFingerprint = decoded.TLSFingerprint
+	if decoded.Traffic != nil {
+		destination.Traffic = *decoded.Traffic
+	}
+	return nil
+}
+
+func (self *PostgresGarinDB) SummarizeDestinations(query *DestinationQuery) (*DestinationSummary, error) {
+	return sqlSummarize(self.Handle, query, "postgres")
+}
+
+func (self *PostgresGarinDB) SeenServerNames(query *DestinationQuery, serverNames []string) (map[string]bool, error) {
+	return sqlSeenServerNames(self.Handle, query, "postgres", serverNames)
+}
+
+const upsertPostgresSessionQuery = "INSERT INTO " + SESSIONS_TABLE_NAME + " AS s (source_ip, destination_ip, server_name, protocol, first_seen, last_seen, connections, bytes, packets) VALUES($1, $2, $3, $4, $5, $6, $7, $8, $9)" +
+	" ON CONFLICT (source_ip, destination_ip, server_name, protocol) DO UPDATE SET" +
+	" first_seen = LEAST(s.first_seen, excluded.first_seen), last_seen = GREATEST(s.last_seen, excluded.last_seen)," +
+	" connections = s.connections + excluded.connections, bytes = s.bytes + excluded.bytes, packets = s.packets + excluded.packets"
+
+// The sessions are upserted in a single transaction, nothing is recorded if one of them fails
+func (self *PostgresGarinDB) RecordSessions(sessions []*Session) error {
+	tx, err := self.Handle.Begin()
+	if err != nil {
+		return err
+	}
+	stmt, err := tx.Prepare(upsertPostgresSessionQuery)
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	defer stmt.Close()
+	for _, session := range sessions {
+		if _, err := stmt.Exec(session.SourceIp, session.DestinationIp, session.ServerName, session.Protocol, session.FirstSeen, session.LastSeen, session.Connections, session.Bytes, session.Packets); err != nil {
+			tx.Rollback()
+			return err
+		}
+	}
+	return tx.Commit()
+}
@@ -0,0 +1,71 @@
+package base
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestPostgresWhere(t *testing.T) {
+	source, err := ParseSource("10.0.0.0/24")
+	if err != nil {
+		t.Fatalf("Can't parse source : %s", err)
+	}
+	query := &DestinationQuery{
+		Source:          source,
+		ServerName:      "example.com",
+		ServerNameMatch: SERVER_NAME_MATCH_SUFFIX,
+		Protocol:        "HTTP",
+		TLSFingerprint:  queryTestFingerprint,
+		Since:           queryTestStart,
+		Until:           queryTestStart.Add(time.Hour),
+		Offset:          20,
+		Limit:           10,
+	}
+	where, args := sqlWhere(query, "postgres")
+	expected := " WHERE source_ip <<= $1::inet AND (server_name = $2 OR server_name LIKE $3 ESCAPE '!') AND protocol = $4 AND attributes->>'tls_fingerprint' = $5 AND timestamp >= $6 AND timestamp < $7 ORDER BY timestamp DESC LIMIT $8 OFFSET $9"
+	if where != expected {
+		t.Errorf("WHERE clause is %q instead of %q", where, expected)
+	}
+	expectedArgs := []interface{}{"10.0.0.0/24", "example.com", "%.example.com", "HTTP", queryTestFingerprint, queryTestStart, queryTestStart.Add(time.Hour), 10, 20}
+	if !reflect.DeepEqual(args, expectedArgs) {
+		t.Errorf("Arguments are %v instead of %v", args, expectedArgs)
+	}
+
+	// A single IP is compared as is and the regexes use the operator of PostgreSQL
+	source, _ = ParseSource("2001:db8::1")
+	where, args = sqlWhere(&DestinationQuery{Source: source, ServerName: `^www\.`, ServerNameMatch: SERVER_NAME_MATCH_REGEX, Limit: 10}, "postgres")
+	if where != " WHERE source_ip = $1 AND server_name ~ $2 ORDER BY timestamp DESC LIMIT $3 OFFSET $4" || len(args) != 4 || args[0] != "2001:db8::1" {
+		t.Errorf("WHERE clause is %q with the arguments %v", where, args)
+	}
+	if where, _ := sqlWhere(&DestinationQuery{Limit: 10}, "postgres"); strings.Contains(where, "WHERE") {
+		t.Errorf("WHERE clause without filters is %q", where)
+	}
+}
+
+func TestPostgresAttributes(t *testing.T) {
+	for _, destination := range queryTestDestinations() {
+		values, err := postgresValues(destination)
+		if err != nil {
+			t.Fatalf("Can't encode destination : %s", err)
+		}
+		if len(values) != len(postgresColumns) {
+			t.Fatalf("%d values for %d columns", len(values), len(postgresColumns))
+		}
+		attributes := values[len(values)-1].(string)
+		decoded := &Destination{SourceIp: destination.SourceIp, DestinationIp: destination.DestinationIp, ServerName: destination.ServerName, Protocol: destination.Protocol, Timestamp: destination.Timestamp, Interface: destination.Interface}
+		if err := readPostgresAttributes([]byte(attributes), decoded); err != nil {
+			t.Fatalf("Can't decode attributes %s : %s", attributes, err)
+		}
+		if !reflect.DeepEqual(decoded, destination) {
+			t.Errorf("Attributes %s were decoded as %+v instead of %+v", attributes, decoded, destination)
+		}
+	}
+
+	// The destinations without attributes have the default of the column
+	values, _ := postgresValues(&Destination{SourceIp: "10.0.0.1"})
+	if values[len(values)-1] != "{}" {
+		t.Errorf("Empty attributes are %s", values[len(values)-1])
+	}
+}
@@ -0,0 +1,286 @@
+package base
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+)
+
+// How the server name of a query is compared to the one of the destinations
+const (
+	// The server name is the same
+	SERVER_NAME_MATCH_EXACT = "exact"
+	// The server name is the same or one of its subdomains
+	SERVER_NAME_MATCH_SUFFIX = "suffix"
+	// The server name contains a match of the regular expression
+	SERVER_NAME_MATCH_REGEX = "regex"
+)
+
+// ErrQueriesNotSupported is returned by the databases that destinations can be sent to but not read from
+var ErrQueriesNotSupported = errors.New("this database can't be queried")
+
+// DestinationQuery selects recorded destinations, the fields that aren't set don't filter anything
+// The destinations are returned from the newest to the oldest
+type DestinationQuery struct {
+	// Subnet of the source IP, a single IP has a full mask
+	Source          *net.IPNet
+	ServerName      string
+	ServerNameMatch string
+	Protocol        string
+	// JA3 fingerprint of the TLS client hello
+	TLSFingerprint string
+	// Since is inclusive and Until exclusive
+	Since time.Time
+	Until time.Time
+	// Amount of destinations skipped and maximum amount returned
+	Offset int
+	Limit  int
+
+	serverNameRegexp *regexp.Regexp
+}
+
+// ParseSource parses an IP or a CIDR
+func ParseSource(source string) (*net.IPNet, error) {
+	if strings.Contains(source, "/") {
+		_, subnet, err := net.ParseCIDR(source)
+		return subnet, err
+	}
+	ip := net.ParseIP(source)
+	if ip == nil {
+		return nil, fmt.Errorf("invalid IP %q", source)
+	}
+	if ip4 := ip.To4(); ip4 != nil {
+		return &net.IPNet{IP: ip4, Mask: net.CIDRMask(32, 32)}, nil
+	}
+	return &net.IPNet{IP: ip, Mask: net.CIDRMask(128, 128)}, nil
+}
+
+// Validate checks the query and prepares it to be executed, it must be called before passing the query to a database
+func (self *DestinationQuery) Validate() error {
+	switch self.ServerNameMatch {
+	case "":
+		self.ServerNameMatch = SERVER_NAME_MATCH_EXACT
+	case SERVER_NAME_MATCH_EXACT, SERVER_NAME_MATCH_SUFFIX:
+	case SERVER_NAME_MATCH_REGEX:
+		var err error
+		if self.serverNameRegexp, err = regexp.Compile(self.ServerName); err != nil {
+			return fmt.Errorf("invalid server name regex: %s", err)
+		}
+	default:
+		return fmt.Errorf("unknown server name match %q", self.ServerNameMatch)
+	}
+	// The protocols are recorded in upper case
+	self.Protocol = strings.ToUpper(self.Protocol)
+	if self.Offset < 0 {
+		return fmt.Errorf("invalid offset %d", self.Offset)
+	}
+	if self.Limit <= 0 {
+		return fmt.Errorf("invalid limit %d", self.Limit)
+	}
+	if !self.Since.IsZero() && !self.Until.IsZero() && !self.Since.Before(self.Until) {
+		return fmt.Errorf("the start of the time range must be before its end")
+	}
+	return nil
+}
+
+// singleSource returns the IP of the source when it isn't a subnet
+func (self *DestinationQuery) singleSource() (string, bool) {
+	if self.Source == nil {
+		return "", false
+	}
+	ones, bits := self.Source.Mask.Size()
+	return self.Source.IP.String(), ones == bits
+}
+
+// Match returns whether or not a destination is selected by the query, for the databases that are filtered in memory
+func (self *DestinationQuery) Match(destination *Destination) bool {
+	if self.Source != nil {
+		ip := net.ParseIP(destination.SourceIp)
+		if ip == nil || !self.Source.Contains(ip) {
+			return false
+		}
+	}
+	if self.ServerName != "" {
+		switch self.ServerNameMatch {
+		case SERVER_NAME_MATCH_SUFFIX:
+			if destination.ServerName != self.ServerName && !strings.HasSuffix(destination.ServerName, "."+self.ServerName) {
+				return false
+			}
+		case SERVER_NAME_MATCH_REGEX:
+			if !self.serverNameRegexp.MatchString(destination.ServerName) {
+				return false
+			}
+		default:
+			if destination.ServerName != self.ServerName {
+				return false
+			}
+		}
+	}
+	if self.Protocol != "" && destination.Protocol != self.Protocol {
+		return false
+	}
+	if self.TLSFingerprint != "" && destination.TLSFingerprint != self.TLSFingerprint {
+		return false
+	}
+	if !self.Since.IsZero() && destination.Timestamp.Before(self.Since) {
+		return false
+	}
+	if !self.Until.IsZero() && !destination.Timestamp.Before(self.Until) {
+		return false
+	}
+	return true
+}
+
+// destinationsPage keeps the newest destinations of a query that are filtered in memory
+// Only the ones that can be part of the page are kept so scanning a large database doesn't hold all of it
+type destinationsPage struct {
+	query        *DestinationQuery
+	destinations []*Destination
+}
+
+func (self *destinationsPage) add(destination *Destination) {
+	if !self.query.Match(destination) {
+		return
+	}
+	self.destinations = append(self.destinations, destination)
+	if len(self.destinations) >= 2*(self.query.Offset+self.query.Limit) {
+		self.truncate()
+	}
+}
+
+func (self *destinationsPage) truncate() {
+	sort.SliceStable(self.destinations, func(i, j int) bool {
+		return self.destinations[i].Timestamp.After(self.destinations[j].Timestamp)
+	})
+	if keep := self.query.Offset + self.query.Limit; len(self.destinations) > keep {
+		self.destinations = self.destinations[:keep]
+	}
+}
+
+// Returns the destinations of the page, from the newest to the oldest
+func (self *destinationsPage) result() []*Destination {
+	self.truncate()
+	if self.query.Offset >= len(self.destinations) {
+		return nil
+	}
+	return self.destinations[self.query.Offset:]
+}
+
+// Escapes the wildcards of a LIKE pattern, using ! as the escape character since it has no special meaning in any dialect
+func escapeLike(value string) string {
+	return strings.NewReplacer("!", "!!", "%", "!%", "_", "!_").Replace(value)
+}
+
+// Returns the last IP of a subnet
+func lastIP(subnet *net.IPNet) net.IP {
+	last := make(net.IP, len(subnet.IP))
+	for i := range subnet.IP {
+		last[i] = subnet.IP[i] | ^subnet.Mask[i]
+	}
+	return last
+}
+
+// sqlQuery builds the WHERE clause of a query in a SQL dialect
+type sqlQuery struct {
+	dialect    string
+	conditions []string
+	args       []interface{}
+}
+
+// Adds a condition where ? are the placeholders of the arguments
+func (self *sqlQuery) add(condition string, args ...interface{}) {
+	if self.dialect == "postgres" {
+		for i := range args {
+			condition = strings.Replace(condition, "?", fmt.Sprintf("$%d", len(self.args)+i+1), 1)
+		}
+	}
+	self.conditions = append(self.conditions, condition)
+	self.args = append(self.args, args...)
+}
+
+// Returns the expression the timestamps are compared with
+// SQLite stores them as text with the offset of their time zone so they are converted to compare them in time rather than as strings
+func (self *sqlQuery) timestamp(expression string) string {
+	if self.dialect == "sqlite3" {
+		return "julianday(" + expression + ")"
+	}
+	return expression
+}
+
+// Returns the WHERE clause of the conditions, nothing when there are none
+func (self *sqlQuery) where() string {
+	if len(self.conditions) == 0 {
+		return ""
+	}
+	return " WHERE " + strings.Join(self.conditions, " AND ")
+}
+
+// Returns the clause of an argument that follows the conditions, like the LIMIT
+func (self *sqlQuery) clause(clause string, args ...interface{}) string {
+	conditions := self.conditions
+	self.add(clause, args...)
+	clause = self.conditions[len(self.conditions)-1]
+	self.conditions = conditions
+	return clause
+}
+
+// Returns the WHERE clause of a query, along with the ORDER BY and the LIMIT, and its arguments
+func sqlWhere(query *DestinationQuery, dialect string) (string, []interface{}) {
+	self := sqlFilters(query, dialect)
+	where := self.where() + " ORDER BY " + self.timestamp("timestamp") + " DESC "
+	return where + self.clause("LIMIT ? OFFSET ?", query.Limit, query.Offset), self.args
+}
+
+// Returns the conditions of the filters of a query
+func sqlFilters(query *DestinationQuery, dialect string) *sqlQuery {
+	self := &sqlQuery{dialect: dialect}
+	if ip, single := query.singleSource(); single {
+		self.add("source_ip = ?", ip)
+	} else if query.Source != nil {
+		switch dialect {
+		case "postgres":
+			self.add("source_ip <<= ?::inet", query.Source.String())
+		case "mysql":
+			// The length excludes the IPv6 addresses that start with the same bytes as an IPv4 subnet
+			self.add("INET6_ATON(source_ip) BETWEEN INET6_ATON(?) AND INET6_ATON(?) AND LENGTH(INET6_ATON(source_ip)) = ?", query.Source.IP.String(), lastIP(query.Source).String(), len(query.Source.IP))
+		default:
+			self.add(SQLITE_IN_SUBNET_FUNCTION+"(source_ip, ?)", query.Source.String())
+		}
+	}
+	if query.ServerName != "" {
+		switch query.ServerNameMatch {
+		case SERVER_NAME_MATCH_SUFFIX:
+			self.add("(server_name = ? OR server_name LIKE ? ESCAPE '!')", query.ServerName, "%."+escapeLike(query.ServerName))
+		case SERVER_NAME_MATCH_REGEX:
+			if dialect == "postgres" {
+				self.add("server_name ~ ?", query.ServerName)
+			} else {
+				self.add("server_name REGEXP ?", query.ServerName)
+			}
+		default:
+			self.add("server_name = ?", query.ServerName)
+		}
+	}
+	if query.Protocol != "" {
+		self.add("protocol = ?", query.Protocol)
+	}
+	if query.TLSFingerprint != "" {
+		// PostgreSQL keeps the fingerprint in the attributes
+		if dialect == "postgres" {
+			self.add("attributes->>'tls_fingerprint' = ?", query.TLSFingerprint)
+		} else {
+			self.add("tls_fingerprint = ?", query.TLSFingerprint)
+		}
+	}
+	if !query.Since.IsZero() {
+		self.add(self.timestamp("timestamp")+" >= "+self.timestamp("?"), query.Since)
+	}
+	if !query.Until.IsZero() {
+		self.add(self.timestamp("timestamp")+" < "+self.timestamp("?"), query.Until)
+	}
+	return self
+}
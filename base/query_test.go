@@ -0,0 +1,201 @@
+package base
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+var queryTestStart = time.Date(2020, 1, 2, 12, 0, 0, 0, time.UTC)
+
+const queryTestFingerprint = "e7d705a3286e19ea42f587b344ee6865"
+
+var queryTestTraffic = Traffic{BytesSent: 517, BytesReceived: 4096, PacketsSent: 3, PacketsReceived: 5, DurationMs: 1500, OutOfOrder: 1, SkippedBytes: 20, EndReason: END_REASON_RST}
+
+// Destinations one hour apart from the oldest to the newest, one of them has a timestamp in another time zone
+func queryTestDestinations() []*Destination {
+	return []*Destination{
+		{SourceIp: "10.0.0.1", DestinationIp: "192.0.2.1", ServerName: "example.com", Protocol: "HTTP", Timestamp: queryTestStart},
+		{SourceIp: "10.0.0.2", DestinationIp: "192.0.2.2", ServerName: "www.example.com", Protocol: "TLS/SSL", Timestamp: queryTestStart.Add(time.Hour), Interface: "eth0"},
+		{SourceIp: "10.0.1.1", DestinationIp: "192.0.2.3", ServerName: "notexample.com", Protocol: "TLS/SSL", Timestamp: queryTestStart.Add(2 * time.Hour).In(time.FixedZone("EST", -5*3600))},
+		{SourceIp: "2001:db8::1", DestinationIp: "2001:db8::2", ServerName: "api.example.org", Protocol: "HTTP", Timestamp: queryTestStart.Add(3 * time.Hour), TunnelType: "vxlan", TunnelId: 42, Traffic: queryTestTraffic},
+		{SourceIp: "10.0.0.1", DestinationIp: "192.0.2.4", ServerName: "a_b.example.net", Protocol: "TLS/SSL", Timestamp: queryTestStart.Add(4 * time.Hour), SourcePort: 49152, DestinationPort: 443, TLSFingerprint: queryTestFingerprint},
+	}
+}
+
+// Runs the same queries on a database that recorded the test destinations
+func testQueryDestinations(t *testing.T, db GarinDB) {
+	source := func(value string) *DestinationQuery {
+		subnet, err := ParseSource(value)
+		if err != nil {
+			t.Fatalf("Can't parse source %s : %s", value, err)
+		}
+		return &DestinationQuery{Source: subnet}
+	}
+	tests := []struct {
+		name     string
+		query    *DestinationQuery
+		expected []string
+	}{
+		{"all", &DestinationQuery{}, []string{"a_b.example.net", "api.example.org", "notexample.com", "www.example.com", "example.com"}},
+		{"ip", source("10.0.0.1"), []string{"a_b.example.net", "example.com"}},
+		{"subnet", source("10.0.0.0/24"), []string{"a_b.example.net", "www.example.com", "example.com"}},
+		{"ipv6 subnet", source("2001:db8::/32"), []string{"api.example.org"}},
+		{"exact", &DestinationQuery{ServerName: "example.com"}, []string{"example.com"}},
+		{"suffix", &DestinationQuery{ServerName: "example.com", ServerNameMatch: SERVER_NAME_MATCH_SUFFIX}, []string{"www.example.com", "example.com"}},
+		{"suffix wildcards", &DestinationQuery{ServerName: "example_net", ServerNameMatch: SERVER_NAME_MATCH_SUFFIX}, nil},
+		{"regex", &DestinationQuery{ServerName: `^(www|api)\.`, ServerNameMatch: SERVER_NAME_MATCH_REGEX}, []string{"api.example.org", "www.example.com"}},
+		{"protocol", &DestinationQuery{Protocol: "http"}, []string{"api.example.org", "example.com"}},
+		{"tls fingerprint", &DestinationQuery{TLSFingerprint: queryTestFingerprint}, []string{"a_b.example.net"}},
+		{"time range", &DestinationQuery{Since: queryTestStart.Add(time.Hour), Until: queryTestStart.Add(3 * time.Hour)}, []string{"notexample.com", "www.example.com"}},
+		{"page", &DestinationQuery{Offset: 1, Limit: 2}, []string{"api.example.org", "notexample.com"}},
+		{"past the end", &DestinationQuery{Offset: 5}, nil},
+	}
+	for _, test := range tests {
+		if test.query.Limit == 0 {
+			test.query.Limit = 10
+		}
+		if err := test.query.Validate(); err != nil {
+			t.Fatalf("Invalid %s query : %s", test.name, err)
+		}
+		destinations, err := db.QueryDestinations(test.query)
+		if err != nil {
+			t.Errorf("Can't run %s query : %s", test.name, err)
+			continue
+		}
+		var serverNames []string
+		for _, destination := range destinations {
+			serverNames = append(serverNames, destination.ServerName)
+		}
+		if strings.Join(serverNames, ",") != strings.Join(test.expected, ",") {
+			t.Errorf("%s query returned %v instead of %v", test.name, serverNames, test.expected)
+		}
+		if test.name == "all" && len(destinations) == 5 {
+			if last := destinations[1]; !last.Timestamp.Equal(queryTestStart.Add(3*time.Hour)) || last.SourceIp != "2001:db8::1" || last.TunnelType != "vxlan" || last.TunnelId != 42 || last.Traffic != queryTestTraffic {
+				t.Errorf("Destination wasn't read back : %+v", last)
+			}
+			if first := destinations[0]; first.SourcePort != 49152 || first.DestinationPort != 443 || first.TLSFingerprint != queryTestFingerprint {
+				t.Errorf("Ports and fingerprint weren't read back : %+v", first)
+			}
+		}
+	}
+}
+
+// Runs the same summaries on a database that recorded the test destinations
+func testSummarizeDestinations(t *testing.T, db GarinDB) {
+	query := &DestinationQuery{Limit: 1}
+	query.Validate()
+	summary, err := db.SummarizeDestinations(query)
+	if err != nil {
+		t.Fatalf("Can't summarize destinations : %s", err)
+	}
+	if summary.Destinations != 5 {
+		t.Errorf("Summary counted %d destinations instead of 5", summary.Destinations)
+	}
+	if len(summary.ServerNames) != 1 || summary.ServerNames[0].Value != "a_b.example.net" || summary.ServerNames[0].Count != 1 {
+		t.Errorf("Top server names are %+v", summary.ServerNames)
+	}
+	if len(summary.Clients) != 1 || summary.Clients[0].Value != "10.0.0.1" || summary.Clients[0].Count != 2 || !summary.Clients[0].FirstSeen.Equal(queryTestStart) {
+		t.Errorf("Top clients are %+v", summary.Clients)
+	}
+	if len(summary.Protocols) != 2 || summary.Protocols[0].Value != "TLS/SSL" || summary.Protocols[0].Count != 3 || summary.Protocols[1].Value != "HTTP" || summary.Protocols[1].Count != 2 {
+		t.Errorf("Protocols are %+v", summary.Protocols)
+	}
+
+	source, _ := ParseSource("10.0.0.0/8")
+	query = &DestinationQuery{Source: source, Since: queryTestStart.Add(time.Hour), Limit: 10}
+	query.Validate()
+	if summary, err = db.SummarizeDestinations(query); err != nil || summary.Destinations != 3 || len(summary.ServerNames) != 3 {
+		t.Fatalf("Summary of a subnet is %+v and %v", summary, err)
+	}
+	// The time zones of the timestamps don't change which one is the oldest
+	for _, count := range summary.ServerNames {
+		if count.Value == "notexample.com" && !count.FirstSeen.Equal(queryTestStart.Add(2*time.Hour)) {
+			t.Errorf("%s was first seen at %s", count.Value, count.FirstSeen)
+		}
+	}
+
+	query = &DestinationQuery{Since: queryTestStart.Add(time.Hour), Until: queryTestStart.Add(3 * time.Hour), Limit: 1}
+	query.Validate()
+	seen, err := db.SeenServerNames(query, []string{"example.com", "www.example.com", "notexample.com", "missing.example.com"})
+	if err != nil || len(seen) != 2 || !seen["www.example.com"] || !seen["notexample.com"] {
+		t.Errorf("Seen server names are %v and %v", seen, err)
+	}
+}
+
+func TestQueryValidate(t *testing.T) {
+	invalid := []*DestinationQuery{
+		{Limit: 0},
+		{Limit: 1, Offset: -1},
+		{Limit: 1, ServerName: "(", ServerNameMatch: SERVER_NAME_MATCH_REGEX},
+		{Limit: 1, ServerNameMatch: "glob"},
+		{Limit: 1, Since: queryTestStart, Until: queryTestStart},
+	}
+	for _, query := range invalid {
+		if err := query.Validate(); err == nil {
+			t.Errorf("Invalid query %+v was accepted", query)
+		}
+	}
+	if _, err := ParseSource("10.0.0.256"); err == nil {
+		t.Error("Invalid source was accepted")
+	}
+	if subnet, _ := ParseSource("2001:db8::1"); subnet.String() != "2001:db8::1/128" {
+		t.Errorf("IPv6 source is %s", subnet)
+	}
+}
+
+func TestSQLiteQueryDestinations(t *testing.T) {
+	directory, _ := ioutil.TempDir("", "garin-query")
+	defer os.RemoveAll(directory)
+	db := &SQLGarinDB{}
+	db.Setup("sqlite3", filepath.Join(directory, "garin.sqlite3"))
+	if err := db.Open(); err != nil {
+		t.Fatalf("Can't open database : %s", err)
+	}
+	defer db.Close()
+	if err := db.RecordDestinations(queryTestDestinations()); err != nil {
+		t.Fatalf("Can't record destinations : %s", err)
+	}
+	testQueryDestinations(t, db)
+	testSummarizeDestinations(t, db)
+}
+
+func TestJSONLQueryDestinations(t *testing.T) {
+	directory, _ := ioutil.TempDir("", "garin-query")
+	defer os.RemoveAll(directory)
+	path := filepath.Join(directory, "destinations.jsonl")
+	db := openTestJSONL(t, path)
+	defer db.Close()
+	destinations := queryTestDestinations()
+	if err := db.RecordDestinations(destinations[:3]); err != nil {
+		t.Fatalf("Can't record destinations : %s", err)
+	}
+	// Some of the destinations are in a compressed segment
+	db.file.mutex.Lock()
+	db.file.options.compress = JSONL_COMPRESS_GZIP
+	if err := db.file.rotate(); err != nil {
+		t.Fatalf("Can't rotate : %s", err)
+	}
+	db.file.mutex.Unlock()
+	db.file.rotations.Wait()
+	if err := db.RecordDestinations(destinations[3:]); err != nil {
+		t.Fatalf("Can't record destinations : %s", err)
+	}
+	// Along with a line that is still being written
+	db.file.write([]byte(`{"timestamp":`))
+	testQueryDestinations(t, db)
+	testSummarizeDestinations(t, db)
+}
+
+func TestWriteOnlyQueryDestinations(t *testing.T) {
+	db := &KafkaGarinDB{}
+	if _, err := db.QueryDestinations(&DestinationQuery{Limit: 1}); err == nil || IsRetryable(err) || SupportsQueries("kafka") {
+		t.Errorf("Querying Kafka returned %v", err)
+	}
+	if _, err := db.SummarizeDestinations(&DestinationQuery{Limit: 1}); err == nil || IsRetryable(err) {
+		t.Errorf("Summarizing Kafka returned %v", err)
+	}
+}
@@ -0,0 +1,72 @@
+package base
+
+import (
+	"errors"
+	"time"
+)
+
+const SESSIONS_TABLE_NAME = "destination_sessions"
+
+var ErrSessionsNotSupported = errors.New("this type of database can't record sessions")
+
+// Session aggregates the destinations of a source to the same destination IP, server name and protocol
+// Recording the same session again adds its connections, bytes and packets and widens the time it was seen
+type Session struct {
+	SourceIp      string    `db:"source_ip"`
+	DestinationIp string    `db:"destination_ip"`
+	ServerName    string    `db:"server_name"`
+	Protocol      string    `db:"protocol"`
+	FirstSeen     time.Time `db:"first_seen"`
+	LastSeen      time.Time `db:"last_seen"`
+	Connections   int64     `db:"connections"`
+	Bytes         int64     `db:"bytes"`
+	Packets       int64     `db:"packets"`
+}
+
+// SessionKey identifies the session a destination is part of
+type SessionKey struct {
+	SourceIp      string
+	DestinationIp string
+	ServerName    string
+	Protocol      string
+}
+
+func (self *Destination) SessionKey() SessionKey {
+	return SessionKey{SourceIp: self.SourceIp, DestinationIp: self.DestinationIp, ServerName: self.ServerName, Protocol: self.Protocol}
+}
+
+func NewSession(destination *Destination) *Session {
+	return &Session{
+		SourceIp:      destination.SourceIp,
+		DestinationIp: destination.DestinationIp,
+		ServerName:    destination.ServerName,
+		Protocol:      destination.Protocol,
+		FirstSeen:     destination.Timestamp,
+		LastSeen:      destination.Timestamp,
+		Connections:   1,
+		Bytes:         destination.Traffic.Bytes(),
+		Packets:       destination.Traffic.Packets(),
+	}
+}
+
+// Add counts another connection of the session
+func (self *Session) Add(destination *Destination) {
+	if destination.Timestamp.Before(self.FirstSeen) {
+		self.FirstSeen = destination.Timestamp
+	}
+	if destination.Timestamp.After(self.LastSeen) {
+		self.LastSeen = destination.Timestamp
+	}
+	self.Connections++
+	self.Bytes += destination.Traffic.Bytes()
+	self.Packets += destination.Traffic.Packets()
+}
+
+// SupportsSessions returns whether or not a type of database can record sessions
+func SupportsSessions(dbType string) bool {
+	switch dbType {
+	case "sqlite3", "mysql", "postgres", "mongodb":
+		return true
+	}
+	return false
+}
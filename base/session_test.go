@@ -0,0 +1,74 @@
+package base
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestSessionAdd(t *testing.T) {
+	now := time.Now()
+	session := NewSession(&Destination{SourceIp: "10.0.0.1", DestinationIp: "192.0.2.1", ServerName: "example.com", Protocol: "HTTP", Timestamp: now, Traffic: Traffic{BytesSent: 60, BytesReceived: 40, PacketsSent: 1, PacketsReceived: 1}})
+	session.Add(&Destination{Timestamp: now.Add(-time.Minute), Traffic: Traffic{BytesSent: 50, PacketsSent: 1}})
+	session.Add(&Destination{Timestamp: now.Add(time.Minute), Traffic: Traffic{BytesReceived: 10, PacketsReceived: 1}})
+	if !session.FirstSeen.Equal(now.Add(-time.Minute)) || !session.LastSeen.Equal(now.Add(time.Minute)) {
+		t.Errorf("Session was seen from %s to %s", session.FirstSeen, session.LastSeen)
+	}
+	if session.Connections != 3 || session.Bytes != 160 || session.Packets != 4 {
+		t.Errorf("Session counts are %+v", session)
+	}
+}
+
+func TestSQLiteRecordSessions(t *testing.T) {
+	directory, _ := ioutil.TempDir("", "garin-sessions")
+	defer os.RemoveAll(directory)
+	db := &SQLGarinDB{}
+	db.Setup("sqlite3", filepath.Join(directory, "garin.sqlite3"))
+	if err := db.Open(); err != nil {
+		t.Fatalf("Can't open database : %s", err)
+	}
+	defer db.Close()
+
+	firstSeen := time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)
+	session := Session{SourceIp: "10.0.0.1", DestinationIp: "192.0.2.1", ServerName: "example.com", Protocol: "TLS/SSL", FirstSeen: firstSeen, LastSeen: firstSeen.Add(time.Minute), Connections: 2, Bytes: 1000, Packets: 10}
+	other := session
+	other.ServerName = "other.example.com"
+	if err := db.RecordSessions([]*Session{&session, &other}); err != nil {
+		t.Fatalf("Can't record sessions : %s", err)
+	}
+	// Seen again later and earlier, in another zone
+	later := session
+	later.FirstSeen = firstSeen.Add(-time.Hour).In(time.FixedZone("EST", -5*3600))
+	later.LastSeen = firstSeen.Add(time.Hour)
+	later.Connections, later.Bytes, later.Packets = 1, 500, 4
+	if err := db.RecordSessions([]*Session{&later}); err != nil {
+		t.Fatalf("Can't record sessions again : %s", err)
+	}
+
+	var sessions []Session
+	if err := db.Handle.Select(&sessions, "select * from "+SESSIONS_TABLE_NAME+" order by server_name"); err != nil {
+		t.Fatalf("Can't read sessions : %s", err)
+	}
+	if len(sessions) != 2 {
+		t.Fatalf("%d sessions were recorded instead of 2", len(sessions))
+	}
+	recorded := sessions[0]
+	if !recorded.FirstSeen.Equal(firstSeen.Add(-time.Hour)) || !recorded.LastSeen.Equal(firstSeen.Add(time.Hour)) {
+		t.Errorf("Session was seen from %s to %s", recorded.FirstSeen, recorded.LastSeen)
+	}
+	if recorded.Connections != 3 || recorded.Bytes != 1500 || recorded.Packets != 14 {
+		t.Errorf("Session counts weren't added : %+v", recorded)
+	}
+	if sessions[1].Connections != 2 {
+		t.Errorf("Other session was updated : %+v", sessions[1])
+	}
+}
+
+func TestWriteOnlyRecordSessions(t *testing.T) {
+	db := &SyslogGarinDB{}
+	if err := db.RecordSessions([]*Session{{}}); err == nil || IsRetryable(err) {
+		t.Errorf("Recording sessions in syslog returned %v", err)
+	}
+}
@@ -1,64 +1,183 @@
 package base
 
 import (
-	_ "github.com/go-sql-driver/mysql"
+	"database/sql"
+	"github.com/go-sql-driver/mysql"
 	"github.com/jmoiron/sqlx"
-	_ "github.com/mattn/go-sqlite3"
+	"github.com/mattn/go-sqlite3"
+	"net"
+	"regexp"
 )
 
+// SQLite doesn't have the functions the queries need so they are registered by a driver of our own
+const (
+	SQLITE_DRIVER_NAME        = "sqlite3_garin"
+	SQLITE_IN_SUBNET_FUNCTION = "garin_in_subnet"
+)
+
+func init() {
+	sql.Register(SQLITE_DRIVER_NAME, &sqlite3.SQLiteDriver{ConnectHook: registerSQLiteFunctions})
+	sqlx.BindDriver(SQLITE_DRIVER_NAME, sqlx.QUESTION)
+}
+
+func registerSQLiteFunctions(conn *sqlite3.SQLiteConn) error {
+	// The pattern is the same for all the rows of a query so the last one is kept compiled
+	var lastRegexp *regexp.Regexp
+	// Used by the REGEXP operator
+	matchRegexp := func(pattern string, value string) (bool, error) {
+		if lastRegexp == nil || lastRegexp.String() != pattern {
+			compiled, err := regexp.Compile(pattern)
+			if err != nil {
+				return false, err
+			}
+			lastRegexp = compiled
+		}
+		return lastRegexp.MatchString(value), nil
+	}
+	if err := conn.RegisterFunc("regexp", matchRegexp, true); err != nil {
+		return err
+	}
+	inSubnet := func(ip string, cidr string) bool {
+		_, subnet, err := net.ParseCIDR(cidr)
+		return err == nil && subnet.Contains(net.ParseIP(ip))
+	}
+	return conn.RegisterFunc(SQLITE_IN_SUBNET_FUNCTION, inSubnet, true)
+}
+
 type SQLGarinDB struct {
 	AbstractGarinDB
 	Handle *sqlx.DB
 }
 
-func (self *SQLGarinDB) Open() {
-	db, err := sqlx.Open(self.dbType, self.dbArgs)
+func (self *SQLGarinDB) Open() error {
+	driverName := self.dbType
+	if driverName == "sqlite3" {
+		driverName = SQLITE_DRIVER_NAME
+	}
+	db, err := sqlx.Open(driverName, self.dbArgs)
 	if err != nil {
-		Die(err)
+		return err
+	}
+	// sqlx.Open doesn't connect to the database
+	if err := db.Ping(); err != nil {
+		db.Close()
+		return err
 	}
 
 	self.Handle = db
-	self.createIfNotExists()
+	if err := migrateOnce(db, self.dbType, self.dbArgs); err != nil {
+		db.Close()
+		return err
+	}
+	return nil
 }
 
-func (self *SQLGarinDB) Close() {
-	self.Handle.Close()
+func (self *SQLGarinDB) Close() error {
+	return self.Handle.Close()
 }
 
-func (self *SQLGarinDB) checkIfExists() bool {
-	if dbExists {
-		return true
+const insertDestinationQuery = "INSERT INTO " + DESTINATIONS_TABLE_NAME + " (source_ip, destination_ip, server_name, protocol, timestamp, interface, tunnel_type, tunnel_id, bytes_sent, bytes_received, packets_sent, packets_received, duration_ms, out_of_order, skipped_bytes, end_reason, source_port, destination_port, tls_fingerprint)" +
+	" VALUES(:source_ip, :destination_ip, :server_name, :protocol, :timestamp, :interface, :tunnel_type, :tunnel_id, :bytes_sent, :bytes_received, :packets_sent, :packets_received, :duration_ms, :out_of_order, :skipped_bytes, :end_reason, :source_port, :destination_port, :tls_fingerprint)"
+
+func (self *SQLGarinDB) RecordDestination(destination *Destination) error {
+	_, err := self.Handle.NamedExec(insertDestinationQuery, destination)
+	return err
+}
+
+// The destinations are inserted in a single transaction using a prepared statement
+// Nothing is recorded if one of them fails
+func (self *SQLGarinDB) RecordDestinations(destinations []*Destination) error {
+	tx, err := self.Handle.Beginx()
+	if err != nil {
+		return err
 	}
-	_, err := self.Handle.Exec("select * from destinations limit 1")
+	stmt, err := tx.PrepareNamed(insertDestinationQuery)
 	if err != nil {
-		return false
-	} else {
-		dbExists = true
-		return true
+		tx.Rollback()
+		return err
 	}
+	defer stmt.Close()
+	for _, destination := range destinations {
+		if _, err := stmt.Exec(destination); err != nil {
+			tx.Rollback()
+			return err
+		}
+	}
+	return tx.Commit()
 }
 
-func (self *SQLGarinDB) createIfNotExists() {
-	creationMutex.Lock()
-	self._createIfNotExists()
-	creationMutex.Unlock()
-}
+// The columns added after the table was created are NULL in the rows that were recorded before
+const selectDestinationsQuery = "SELECT source_ip, destination_ip, server_name, protocol, timestamp, COALESCE(interface, ''), COALESCE(tunnel_type, ''), COALESCE(tunnel_id, 0)," +
+	" COALESCE(bytes_sent, 0), COALESCE(bytes_received, 0), COALESCE(packets_sent, 0), COALESCE(packets_received, 0), COALESCE(duration_ms, 0), COALESCE(out_of_order, 0), COALESCE(skipped_bytes, 0), COALESCE(end_reason, '')" +
+	", COALESCE(source_port, 0), COALESCE(destination_port, 0), COALESCE(tls_fingerprint, '') FROM " + DESTINATIONS_TABLE_NAME
 
-func (self *SQLGarinDB) _createIfNotExists() {
-	if self.checkIfExists() {
-		return
+func (self *SQLGarinDB) QueryDestinations(query *DestinationQuery) ([]*Destination, error) {
+	where, args := sqlWhere(query, self.dbType)
+	rows, err := self.Handle.Query(selectDestinationsQuery+where, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var destinations []*Destination
+	for rows.Next() {
+		destination := &Destination{}
+		// The MySQL driver only returns times when parseTime is set in the DSN, the type of the driver parses them otherwise
+		var timestamp mysql.NullTime
+		traffic := &destination.Traffic
+		if err := rows.Scan(&destination.SourceIp, &destination.DestinationIp, &destination.ServerName, &destination.Protocol, &timestamp, &destination.Interface, &destination.TunnelType, &destination.TunnelId,
+			&traffic.BytesSent, &traffic.BytesReceived, &traffic.PacketsSent, &traffic.PacketsReceived, &traffic.DurationMs, &traffic.OutOfOrder, &traffic.SkippedBytes, &traffic.EndReason,
+			&destination.SourcePort, &destination.DestinationPort, &destination.TLSFingerprint); err != nil {
+			return nil, err
+		}
+		destination.Timestamp = timestamp.Time
+		destinations = append(destinations, destination)
 	}
-	schema := `
-		create table destinations (source_ip VARCHAR(15), destination_ip VARCHAR(15), server_name VARCHAR(100), protocol VARCHAR(10),timestamp DATE);
-	`
-	// exec the schema or fail; multi-statement Exec behavior varies between
-	// database drivers;  pq will exec them all, sqlite3 won't, ymmv
-	self.Handle.MustExec(schema)
+	return destinations, rows.Err()
+}
+
+func (self *SQLGarinDB) SummarizeDestinations(query *DestinationQuery) (*DestinationSummary, error) {
+	return sqlSummarize(self.Handle, query, self.dbType)
+}
+
+func (self *SQLGarinDB) SeenServerNames(query *DestinationQuery, serverNames []string) (map[string]bool, error) {
+	return sqlSeenServerNames(self.Handle, query, self.dbType, serverNames)
 }
 
-func (self *SQLGarinDB) RecordDestination(destination *Destination) {
-	_, err := self.Handle.NamedExec("INSERT INTO "+DESTINATIONS_TABLE_NAME+" (source_ip, destination_ip, server_name, protocol, timestamp) VALUES(:source_ip, :destination_ip, :server_name, :protocol, :timestamp)", destination)
+const insertSessionQuery = "INSERT INTO " + SESSIONS_TABLE_NAME + " (source_ip, destination_ip, server_name, protocol, first_seen, last_seen, connections, bytes, packets) VALUES(:source_ip, :destination_ip, :server_name, :protocol, :first_seen, :last_seen, :connections, :bytes, :packets)"
+
+// The sessions that were already recorded are updated in place
+// SQLite stores the times as text with their zone so they are compared as julian days
+var upsertSessionQueries = map[string]string{
+	"sqlite3": insertSessionQuery + " ON CONFLICT (source_ip, destination_ip, server_name, protocol) DO UPDATE SET" +
+		" first_seen = CASE WHEN julianday(excluded.first_seen) < julianday(first_seen) THEN excluded.first_seen ELSE first_seen END," +
+		" last_seen = CASE WHEN julianday(excluded.last_seen) > julianday(last_seen) THEN excluded.last_seen ELSE last_seen END," +
+		" connections = connections + excluded.connections, bytes = bytes + excluded.bytes, packets = packets + excluded.packets",
+	"mysql": insertSessionQuery + " ON DUPLICATE KEY UPDATE" +
+		" first_seen = LEAST(first_seen, VALUES(first_seen)), last_seen = GREATEST(last_seen, VALUES(last_seen))," +
+		" connections = connections + VALUES(connections), bytes = bytes + VALUES(bytes), packets = packets + VALUES(packets)",
+}
+
+// The sessions are upserted in a single transaction, nothing is recorded if one of them fails
+func (self *SQLGarinDB) RecordSessions(sessions []*Session) error {
+	query, ok := upsertSessionQueries[self.dbType]
+	if !ok {
+		return &DBError{Err: ErrSessionsNotSupported, Retryable: false}
+	}
+	tx, err := self.Handle.Beginx()
 	if err != nil {
-		panic(err)
+		return err
+	}
+	stmt, err := tx.PrepareNamed(query)
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	defer stmt.Close()
+	for _, session := range sessions {
+		if _, err := stmt.Exec(session); err != nil {
+			tx.Rollback()
+			return err
+		}
 	}
+	return tx.Commit()
 }
@@ -0,0 +1,200 @@
+package base
+
+import (
+	"github.com/go-sql-driver/mysql"
+	"github.com/jmoiron/sqlx"
+	"sort"
+	"strings"
+	"time"
+)
+
+// DestinationCount is the amount of destinations that have a value, along with the time the oldest of them was seen
+type DestinationCount struct {
+	Value     string
+	Count     int64
+	FirstSeen time.Time
+}
+
+// DestinationSummary counts the destinations selected by a query
+type DestinationSummary struct {
+	Destinations int64
+	// The server names and clients counted the most, up to the limit of the query, from the most to the least counted
+	ServerNames []*DestinationCount
+	Clients     []*DestinationCount
+	// All the protocols, from the most to the least counted
+	Protocols []*DestinationCount
+}
+
+// Sorts the counts from the most to the least counted, the ties by value, and keeps the first ones when the limit is positive
+func sortCounts(counts map[string]*DestinationCount, limit int) []*DestinationCount {
+	sorted := make([]*DestinationCount, 0, len(counts))
+	for _, count := range counts {
+		sorted = append(sorted, count)
+	}
+	sort.Slice(sorted, func(i, j int) bool {
+		if sorted[i].Count != sorted[j].Count {
+			return sorted[i].Count > sorted[j].Count
+		}
+		return sorted[i].Value < sorted[j].Value
+	})
+	if limit > 0 && len(sorted) > limit {
+		sorted = sorted[:limit]
+	}
+	return sorted
+}
+
+// destinationsSummary counts the destinations of a query that are filtered in memory, in a single pass
+type destinationsSummary struct {
+	query        *DestinationQuery
+	destinations int64
+	serverNames  map[string]*DestinationCount
+	clients      map[string]*DestinationCount
+	protocols    map[string]*DestinationCount
+}
+
+func newDestinationsSummary(query *DestinationQuery) *destinationsSummary {
+	return &destinationsSummary{
+		query:       query,
+		serverNames: map[string]*DestinationCount{},
+		clients:     map[string]*DestinationCount{},
+		protocols:   map[string]*DestinationCount{},
+	}
+}
+
+func countDestination(counts map[string]*DestinationCount, value string, timestamp time.Time) {
+	count := counts[value]
+	if count == nil {
+		count = &DestinationCount{Value: value, FirstSeen: timestamp}
+		counts[value] = count
+	}
+	count.Count++
+	if timestamp.Before(count.FirstSeen) {
+		count.FirstSeen = timestamp
+	}
+}
+
+func (self *destinationsSummary) add(destination *Destination) {
+	if !self.query.Match(destination) {
+		return
+	}
+	self.destinations++
+	countDestination(self.serverNames, destination.ServerName, destination.Timestamp)
+	countDestination(self.clients, destination.SourceIp, destination.Timestamp)
+	countDestination(self.protocols, destination.Protocol, destination.Timestamp)
+}
+
+func (self *destinationsSummary) result() *DestinationSummary {
+	return &DestinationSummary{
+		Destinations: self.destinations,
+		ServerNames:  sortCounts(self.serverNames, self.query.Limit),
+		Clients:      sortCounts(self.clients, self.query.Limit),
+		Protocols:    sortCounts(self.protocols, 0),
+	}
+}
+
+// serverNamesSeen looks up server names in the destinations of a query that are filtered in memory
+type serverNamesSeen struct {
+	query       *DestinationQuery
+	serverNames map[string]bool
+	seen        map[string]bool
+}
+
+func newServerNamesSeen(query *DestinationQuery, serverNames []string) *serverNamesSeen {
+	self := &serverNamesSeen{query: query, serverNames: map[string]bool{}, seen: map[string]bool{}}
+	for _, serverName := range serverNames {
+		self.serverNames[serverName] = true
+	}
+	return self
+}
+
+func (self *serverNamesSeen) add(destination *Destination) {
+	if self.serverNames[destination.ServerName] && !self.seen[destination.ServerName] && self.query.Match(destination) {
+		self.seen[destination.ServerName] = true
+	}
+}
+
+// Returns the expression of the oldest timestamp of a group
+// SQLite returns it as text in UTC, in the layout the MySQL driver parses, since the timestamps are stored with the offset of their time zone
+func (self *sqlQuery) firstSeen() string {
+	if self.dialect == "sqlite3" {
+		return "strftime('%Y-%m-%d %H:%M:%f', MIN(julianday(timestamp)))"
+	}
+	return "MIN(timestamp)"
+}
+
+// Counts the destinations of a query by the values of an expression, from the most to the least counted, and keeps the first ones when the limit is positive
+func sqlCountBy(handle *sqlx.DB, query *DestinationQuery, dialect string, expression string, limit int) ([]*DestinationCount, error) {
+	self := sqlFilters(query, dialect)
+	statement := "SELECT " + expression + ", COUNT(*), " + self.firstSeen() + " FROM " + DESTINATIONS_TABLE_NAME + self.where() +
+		" GROUP BY " + expression + " ORDER BY COUNT(*) DESC, " + expression
+	if limit > 0 {
+		statement += " " + self.clause("LIMIT ?", limit)
+	}
+	rows, err := handle.Query(statement, self.args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	counts := []*DestinationCount{}
+	for rows.Next() {
+		count := &DestinationCount{}
+		var firstSeen mysql.NullTime
+		if err := rows.Scan(&count.Value, &count.Count, &firstSeen); err != nil {
+			return nil, err
+		}
+		count.FirstSeen = firstSeen.Time
+		counts = append(counts, count)
+	}
+	return counts, rows.Err()
+}
+
+// Summarizes the destinations of a query with a GROUP BY for each of the fields
+func sqlSummarize(handle *sqlx.DB, query *DestinationQuery, dialect string) (*DestinationSummary, error) {
+	client := "source_ip"
+	if dialect == "postgres" {
+		client = "host(source_ip)"
+	}
+	summary := &DestinationSummary{}
+	var err error
+	if summary.ServerNames, err = sqlCountBy(handle, query, dialect, "server_name", query.Limit); err != nil {
+		return nil, err
+	}
+	if summary.Clients, err = sqlCountBy(handle, query, dialect, client, query.Limit); err != nil {
+		return nil, err
+	}
+	if summary.Protocols, err = sqlCountBy(handle, query, dialect, "protocol", 0); err != nil {
+		return nil, err
+	}
+	// Every destination has a protocol
+	for _, protocol := range summary.Protocols {
+		summary.Destinations += protocol.Count
+	}
+	return summary, nil
+}
+
+// Looks up all the server names in a single query
+func sqlSeenServerNames(handle *sqlx.DB, query *DestinationQuery, dialect string, serverNames []string) (map[string]bool, error) {
+	seen := map[string]bool{}
+	if len(serverNames) == 0 {
+		return seen, nil
+	}
+	self := sqlFilters(query, dialect)
+	args := make([]interface{}, len(serverNames))
+	for i, serverName := range serverNames {
+		args[i] = serverName
+	}
+	self.add("server_name IN ("+strings.TrimSuffix(strings.Repeat("?, ", len(serverNames)), ", ")+")", args...)
+	rows, err := handle.Query("SELECT DISTINCT server_name FROM "+DESTINATIONS_TABLE_NAME+self.where(), self.args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var serverName string
+		if err := rows.Scan(&serverName); err != nil {
+			return nil, err
+		}
+		seen[serverName] = true
+	}
+	return seen, rows.Err()
+}
@@ -0,0 +1,419 @@
+package base
+
+import (
+	"bytes"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Formats of the events sent by SyslogGarinDB
+const (
+	SYSLOG_FORMAT_RFC5424 = "rfc5424"
+	SYSLOG_FORMAT_CEF     = "cef"
+	SYSLOG_FORMAT_LEEF    = "leef"
+)
+
+// Headers put in front of the events
+const (
+	SYSLOG_HEADER_RFC5424 = "rfc5424"
+	SYSLOG_HEADER_RFC3164 = "rfc3164"
+	SYSLOG_HEADER_NONE    = "none"
+)
+
+// Identify garin in the CEF and LEEF headers
+const (
+	SIEM_DEVICE_VENDOR  = "julsemaan"
+	SIEM_DEVICE_PRODUCT = "garin"
+	SIEM_DEVICE_VERSION = "1.0"
+	SIEM_EVENT_ID       = "destination"
+	// Seeing a destination is informational, on the 0 to 10 scale of CEF
+	CEF_SEVERITY = 1
+)
+
+// The fields of the events when the fields option isn't set, they are mapped to the fields of the destination documents
+var defaultSyslogFields = map[string]string{
+	SYSLOG_FORMAT_RFC5424: "src:source_ip,dst:destination_ip,serverName:server_name,protocol:protocol,interface:interface,tunnelType:tunnel_type,tunnelId:tunnel_id",
+	SYSLOG_FORMAT_CEF:     "rt:timestamp,src:source_ip,dst:destination_ip,dhost:server_name,app:protocol,deviceInboundInterface:interface",
+	SYSLOG_FORMAT_LEEF:    "devTime:timestamp,src:source_ip,dst:destination_ip,serverName:server_name,protocol:protocol,interface:interface",
+}
+
+var syslogFacilities = map[string]int{
+	"kern": 0, "user": 1, "mail": 2, "daemon": 3, "auth": 4, "syslog": 5, "lpr": 6, "news": 7,
+	"uucp": 8, "cron": 9, "authpriv": 10, "ftp": 11,
+	"local0": 16, "local1": 17, "local2": 18, "local3": 19, "local4": 20, "local5": 21, "local6": 22, "local7": 23,
+}
+
+var syslogSeverities = map[string]int{
+	"emerg": 0, "alert": 1, "crit": 2, "err": 3, "warning": 4, "notice": 5, "info": 6, "debug": 7,
+}
+
+// The LEEF devTime is formatted with this layout, which is announced in the devTimeFormat attribute
+const (
+	LEEF_TIME_LAYOUT = "Jan 02 2006 15:04:05.000 MST"
+	LEEF_TIME_FORMAT = "MMM dd yyyy HH:mm:ss.SSS z"
+)
+
+// SyslogGarinDB sends every destination as an event to a syslog collector or a SIEM
+// The args are the URL of the collector followed by the options (ex: tls://siem.example.com:6514?format=cef)
+// The events are RFC 5424 messages with the destination in the structured data, or CEF or LEEF events in a syslog header
+type SyslogGarinDB struct {
+	AbstractGarinDB
+	options *syslogOptions
+	conn    net.Conn
+}
+
+type syslogField struct {
+	key string
+	// Field of the destination document, empty when the value is a literal
+	field   string
+	literal string
+}
+
+type syslogOptions struct {
+	network string
+	address string
+	format  string
+	header  string
+	fields  []syslogField
+	// Priority of the messages, computed from the facility and the severity
+	priority int
+	appName  string
+	hostname string
+	// Structured data ID of the RFC 5424 messages, must be registered or contain an enterprise number
+	sdId string
+	// Whether the messages sent over TCP are prefixed by their length (RFC 6587) instead of being followed by a newline
+	octetCounting bool
+	timeout       time.Duration
+	tlsConfig     *tls.Config
+}
+
+func parseSyslogArgs(args string) (*syslogOptions, error) {
+	collectorURL, err := url.Parse(args)
+	if err != nil {
+		return nil, err
+	}
+	options := &syslogOptions{
+		format:        SYSLOG_FORMAT_RFC5424,
+		header:        SYSLOG_HEADER_RFC5424,
+		appName:       "garin",
+		sdId:          "garin@32473",
+		octetCounting: true,
+		timeout:       10 * time.Second,
+	}
+	switch collectorURL.Scheme {
+	case "udp", "tcp":
+		options.network = collectorURL.Scheme
+	case "tls":
+		options.network = "tcp"
+		options.tlsConfig = &tls.Config{ServerName: collectorURL.Hostname()}
+	default:
+		return nil, fmt.Errorf("invalid syslog URL %q, the scheme must be udp, tcp or tls", args)
+	}
+	if collectorURL.Port() == "" {
+		return nil, fmt.Errorf("no port specified in syslog URL %q", args)
+	}
+	options.address = collectorURL.Host
+	options.hostname, _ = os.Hostname()
+
+	facility, severity := syslogFacilities["local0"], syslogSeverities["info"]
+	fields := ""
+	for key, values := range collectorURL.Query() {
+		value := values[len(values)-1]
+		var ok bool
+		switch key {
+		case "format":
+			options.format = value
+			if _, ok = defaultSyslogFields[value]; !ok {
+				err = fmt.Errorf("must be rfc5424, cef or leef")
+			}
+		case "header":
+			options.header = value
+			if value != SYSLOG_HEADER_RFC5424 && value != SYSLOG_HEADER_RFC3164 && value != SYSLOG_HEADER_NONE {
+				err = fmt.Errorf("must be rfc5424, rfc3164 or none")
+			}
+		case "fields":
+			fields = value
+		case "facility":
+			if facility, ok = syslogFacilities[value]; !ok {
+				err = fmt.Errorf("unknown facility")
+			}
+		case "severity":
+			if severity, ok = syslogSeverities[value]; !ok {
+				err = fmt.Errorf("unknown severity")
+			}
+		case "app-name":
+			options.appName = value
+		case "hostname":
+			options.hostname = value
+		case "sd-id":
+			options.sdId = value
+		case "framing":
+			options.octetCounting = value == "octet-counting"
+			if value != "octet-counting" && value != "newline" {
+				err = fmt.Errorf("must be octet-counting or newline")
+			}
+		case "timeout":
+			options.timeout, err = time.ParseDuration(value)
+		case "tls-skip-verify":
+			if options.tlsConfig == nil {
+				err = fmt.Errorf("only valid with the tls scheme")
+			} else {
+				options.tlsConfig.InsecureSkipVerify, err = strconv.ParseBool(value)
+			}
+		case "ca-file":
+			if options.tlsConfig == nil {
+				err = fmt.Errorf("only valid with the tls scheme")
+			} else {
+				options.tlsConfig.RootCAs, err = loadCertificates(value)
+			}
+		default:
+			err = fmt.Errorf("unknown option")
+		}
+		if err != nil {
+			return nil, fmt.Errorf("invalid syslog option %s=%s: %s", key, value, err)
+		}
+	}
+	if options.format == SYSLOG_FORMAT_RFC5424 && options.header != SYSLOG_HEADER_RFC5424 {
+		return nil, fmt.Errorf("the rfc5424 format requires the rfc5424 header")
+	}
+	options.priority = facility*8 + severity
+
+	if fields == "" {
+		fields = defaultSyslogFields[options.format]
+	}
+	if options.fields, err = parseSyslogFields(fields); err != nil {
+		return nil, fmt.Errorf("invalid syslog fields %q: %s", fields, err)
+	}
+	return options, nil
+}
+
+func loadCertificates(path string) (*x509.CertPool, error) {
+	pem, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(pem) {
+		return nil, fmt.Errorf("no certificate found in %s", path)
+	}
+	return pool, nil
+}
+
+// Parses the comma separated key:field mappings, a value between single quotes is a literal (ex: cs1Label:'Tunnel type')
+func parseSyslogFields(mappings string) ([]syslogField, error) {
+	var fields []syslogField
+	for _, mapping := range strings.Split(mappings, ",") {
+		parts := strings.SplitN(strings.TrimSpace(mapping), ":", 2)
+		if len(parts) != 2 || parts[0] == "" || strings.ContainsAny(parts[0], " =\"]|\t") {
+			return nil, fmt.Errorf("invalid mapping %q", mapping)
+		}
+		value := parts[1]
+		if len(value) >= 2 && strings.HasPrefix(value, "'") && strings.HasSuffix(value, "'") {
+			fields = append(fields, syslogField{key: parts[0], literal: value[1 : len(value)-1]})
+			continue
+		}
+		if _, ok := destinationFieldNames[value]; !ok {
+			return nil, fmt.Errorf("unknown destination field %q", value)
+		}
+		fields = append(fields, syslogField{key: parts[0], field: value})
+	}
+	return fields, nil
+}
+
+// Names of the fields of the destination documents that can be mapped
+var destinationFieldNames = map[string]bool{
+	"timestamp": true, "source_ip": true, "destination_ip": true, "server_name": true,
+	"protocol": true, "interface": true, "tunnel_type": true, "tunnel_id": true,
+	"bytes_sent": true, "bytes_received": true, "packets_sent": true, "packets_received": true,
+	"duration_ms": true, "out_of_order": true, "skipped_bytes": true, "end_reason": true,
+	"source_port": true, "destination_port": true, "tls_fingerprint": true,
+}
+
+// Returns the value of a field of the destination, the timestamp is formatted the way the format expects it
+func (self *syslogOptions) fieldValue(field syslogField, destination *Destination) string {
+	switch field.field {
+	case "":
+		return field.literal
+	case "timestamp":
+		switch self.format {
+		case SYSLOG_FORMAT_CEF:
+			return strconv.FormatInt(destination.Timestamp.UnixNano()/int64(time.Millisecond), 10)
+		case SYSLOG_FORMAT_LEEF:
+			return destination.Timestamp.UTC().Format(LEEF_TIME_LAYOUT)
+		}
+		return destination.Timestamp.UTC().Format(time.RFC3339Nano)
+	case "source_ip":
+		return destination.SourceIp
+	case "destination_ip":
+		return destination.DestinationIp
+	case "server_name":
+		return destination.ServerName
+	case "protocol":
+		return destination.Protocol
+	case "interface":
+		return destination.Interface
+	case "tunnel_type":
+		return destination.TunnelType
+	case "tunnel_id":
+		if destination.TunnelId == 0 {
+			return ""
+		}
+		return strconv.FormatUint(uint64(destination.TunnelId), 10)
+	case "bytes_sent":
+		return strconv.FormatInt(destination.BytesSent, 10)
+	case "bytes_received":
+		return strconv.FormatInt(destination.BytesReceived, 10)
+	case "packets_sent":
+		return strconv.FormatInt(destination.PacketsSent, 10)
+	case "packets_received":
+		return strconv.FormatInt(destination.PacketsReceived, 10)
+	case "duration_ms":
+		return strconv.FormatInt(destination.DurationMs, 10)
+	case "out_of_order":
+		return strconv.FormatInt(destination.OutOfOrder, 10)
+	case "skipped_bytes":
+		return strconv.FormatInt(destination.SkippedBytes, 10)
+	case "end_reason":
+		return destination.EndReason
+	case "source_port":
+		return formatPort(destination.SourcePort)
+	case "destination_port":
+		return formatPort(destination.DestinationPort)
+	case "tls_fingerprint":
+		return destination.TLSFingerprint
+	}
+	return ""
+}
+
+// The ports aren't known for every destination, like the tunnel ID they are empty rather than 0 when they aren't
+func formatPort(port uint16) string {
+	if port == 0 {
+		return ""
+	}
+	return strconv.FormatUint(uint64(port), 10)
+}
+
+var cefHeaderEscaper = strings.NewReplacer(`\`, `\\`, `|`, `\|`)
+var cefExtensionEscaper = strings.NewReplacer(`\`, `\\`, `=`, `\=`, "\n", `\n`, "\r", `\r`)
+var leefValueEscaper = strings.NewReplacer("\t", " ", "\n", " ", "\r", " ")
+var sdValueEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, `]`, `\]`)
+
+// Returns the header value or - when it is empty, as RFC 5424 requires
+func nilValue(value string) string {
+	if value == "" {
+		return "-"
+	}
+	return strings.Replace(value, " ", "_", -1)
+}
+
+// formatMessage returns the complete syslog message of a destination, without the transport framing
+func (self *syslogOptions) formatMessage(destination *Destination) []byte {
+	message := &bytes.Buffer{}
+	switch self.header {
+	case SYSLOG_HEADER_RFC5424:
+		fmt.Fprintf(message, "<%d>1 %s %s %s %d %s ", self.priority, destination.Timestamp.UTC().Format("2006-01-02T15:04:05.000000Z07:00"), nilValue(self.hostname), nilValue(self.appName), os.Getpid(), SIEM_EVENT_ID)
+		// The CEF and LEEF payloads are the MSG so the STRUCTURED-DATA that precedes it is nil
+		if self.format != SYSLOG_FORMAT_RFC5424 {
+			message.WriteString("- ")
+		}
+	case SYSLOG_HEADER_RFC3164:
+		fmt.Fprintf(message, "<%d>%s %s %s[%d]: ", self.priority, destination.Timestamp.Local().Format(time.Stamp), nilValue(self.hostname), self.appName, os.Getpid())
+	}
+
+	switch self.format {
+	case SYSLOG_FORMAT_CEF:
+		fmt.Fprintf(message, "CEF:0|%s|%s|%s|%s|%s|%d|", cefHeaderEscaper.Replace(SIEM_DEVICE_VENDOR), cefHeaderEscaper.Replace(SIEM_DEVICE_PRODUCT), SIEM_DEVICE_VERSION, SIEM_EVENT_ID, cefHeaderEscaper.Replace("Destination "+destination.ServerName), CEF_SEVERITY)
+		separator := ""
+		for _, field := range self.fields {
+			if value := self.fieldValue(field, destination); value != "" {
+				fmt.Fprintf(message, "%s%s=%s", separator, field.key, cefExtensionEscaper.Replace(value))
+				separator = " "
+			}
+		}
+	case SYSLOG_FORMAT_LEEF:
+		fmt.Fprintf(message, "LEEF:1.0|%s|%s|%s|%s|", SIEM_DEVICE_VENDOR, SIEM_DEVICE_PRODUCT, SIEM_DEVICE_VERSION, SIEM_EVENT_ID)
+		separator := ""
+		for _, field := range self.fields {
+			if value := self.fieldValue(field, destination); value != "" {
+				fmt.Fprintf(message, "%s%s=%s", separator, field.key, leefValueEscaper.Replace(value))
+				separator = "\t"
+				if field.field == "timestamp" {
+					fmt.Fprintf(message, "\tdevTimeFormat=%s", LEEF_TIME_FORMAT)
+				}
+			}
+		}
+	default:
+		fmt.Fprintf(message, "[%s", self.sdId)
+		for _, field := range self.fields {
+			if value := self.fieldValue(field, destination); value != "" {
+				fmt.Fprintf(message, ` %s="%s"`, field.key, sdValueEscaper.Replace(value))
+			}
+		}
+		fmt.Fprintf(message, "] %s -> %s (%s)", destination.SourceIp, destination.ServerName, destination.Protocol)
+	}
+	return message.Bytes()
+}
+
+func (self *SyslogGarinDB) Open() error {
+	options, err := parseSyslogArgs(self.dbArgs)
+	if err != nil {
+		return &DBError{Err: err, Retryable: false}
+	}
+	self.options = options
+
+	dialer := &net.Dialer{Timeout: options.timeout}
+	if options.tlsConfig != nil {
+		self.conn, err = tls.DialWithDialer(dialer, options.network, options.address, options.tlsConfig)
+	} else {
+		self.conn, err = dialer.Dial(options.network, options.address)
+	}
+	return err
+}
+
+func (self *SyslogGarinDB) Close() error {
+	if self.conn == nil {
+		return nil
+	}
+	err := self.conn.Close()
+	self.conn = nil
+	return err
+}
+
+func (self *SyslogGarinDB) RecordDestination(destination *Destination) error {
+	return self.RecordDestinations([]*Destination{destination})
+}
+
+// Each event is sent in its own datagram over UDP while the events of a batch are written at once over TCP
+func (self *SyslogGarinDB) RecordDestinations(destinations []*Destination) error {
+	self.conn.SetWriteDeadline(time.Now().Add(self.options.timeout))
+	if self.options.network == "udp" {
+		for _, destination := range destinations {
+			if _, err := self.conn.Write(self.options.formatMessage(destination)); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	buffer := &bytes.Buffer{}
+	for _, destination := range destinations {
+		message := self.options.formatMessage(destination)
+		if self.options.octetCounting {
+			fmt.Fprintf(buffer, "%d ", len(message))
+			buffer.Write(message)
+		} else {
+			buffer.Write(message)
+			buffer.WriteByte('\n')
+		}
+	}
+	_, err := self.conn.Write(buffer.Bytes())
+	return err
+}
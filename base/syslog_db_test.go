@@ -0,0 +1,146 @@
+package base
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func testSyslogDestination() *Destination {
+	return &Destination{SourceIp: "10.0.0.1", DestinationIp: "192.0.2.1", ServerName: "a=b|c.example.com", Protocol: "HTTPS", Timestamp: time.Date(2020, 1, 2, 3, 4, 5, 6000000, time.UTC), TunnelId: 42}
+}
+
+func formatTestSyslog(t *testing.T, args string) string {
+	options, err := parseSyslogArgs(args)
+	if err != nil {
+		t.Fatalf("Can't parse args %q : %s", args, err)
+	}
+	options.hostname = "probe"
+	message := string(options.formatMessage(testSyslogDestination()))
+	// The process ID changes between the runs
+	return strings.Replace(message, " "+strconv.Itoa(os.Getpid())+" ", " PID ", 1)
+}
+
+func TestSyslogFormats(t *testing.T) {
+	tests := []struct {
+		args     string
+		expected string
+	}{
+		{
+			"udp://127.0.0.1:514",
+			`<134>1 2020-01-02T03:04:05.006000Z probe garin PID destination [garin@32473 src="10.0.0.1" dst="192.0.2.1" serverName="a=b|c.example.com" protocol="HTTPS" tunnelId="42"] 10.0.0.1 -> a=b|c.example.com (HTTPS)`,
+		},
+		{
+			"tcp://127.0.0.1:514?format=cef&facility=auth&severity=notice",
+			`<37>1 2020-01-02T03:04:05.006000Z probe garin PID destination - CEF:0|julsemaan|garin|1.0|destination|Destination a=b\|c.example.com|1|rt=1577934245006 src=10.0.0.1 dst=192.0.2.1 dhost=a\=b|c.example.com app=HTTPS`,
+		},
+		{
+			"udp://127.0.0.1:514?format=leef&fields=src:source_ip",
+			"<134>1 2020-01-02T03:04:05.006000Z probe garin PID destination - LEEF:1.0|julsemaan|garin|1.0|destination|src=10.0.0.1",
+		},
+		{
+			"udp://127.0.0.1:514?format=leef&header=none&fields=devTime:timestamp,src:source_ip,vlan:tunnel_id,cat:'web'",
+			"LEEF:1.0|julsemaan|garin|1.0|destination|devTime=Jan 02 2020 03:04:05.006 UTC\tdevTimeFormat=MMM dd yyyy HH:mm:ss.SSS z\tsrc=10.0.0.1\tvlan=42\tcat=web",
+		},
+	}
+	for _, test := range tests {
+		if message := formatTestSyslog(t, test.args); message != test.expected {
+			t.Errorf("Message of %s is\n%s\ninstead of\n%s", test.args, message, test.expected)
+		}
+	}
+
+	for _, args := range []string{"http://127.0.0.1:514", "udp://127.0.0.1", "udp://127.0.0.1:514?format=json", "udp://127.0.0.1:514?format=cef&fields=src:ip", "udp://127.0.0.1:514?header=rfc3164", "udp://127.0.0.1:514?tls-skip-verify=true"} {
+		if _, err := parseSyslogArgs(args); err == nil {
+			t.Errorf("Invalid args %q were accepted", args)
+		}
+	}
+}
+
+func TestSyslogTransports(t *testing.T) {
+	// UDP : one datagram per destination
+	packetConn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Can't listen : %s", err)
+	}
+	defer packetConn.Close()
+	db := &SyslogGarinDB{}
+	db.Setup("syslog", "udp://"+packetConn.LocalAddr().String()+"?format=cef")
+	if err := db.Open(); err != nil {
+		t.Fatalf("Can't open syslog : %s", err)
+	}
+	if err := db.RecordDestinations([]*Destination{testSyslogDestination(), testSyslogDestination()}); err != nil {
+		t.Fatalf("Can't record destinations over UDP : %s", err)
+	}
+	db.Close()
+	buffer := make([]byte, 4096)
+	for i := 0; i < 2; i++ {
+		packetConn.SetReadDeadline(time.Now().Add(5 * time.Second))
+		n, _, err := packetConn.ReadFrom(buffer)
+		if err != nil || !strings.Contains(string(buffer[:n]), "CEF:0|") {
+			t.Errorf("Datagram %d isn't a CEF event : %q %v", i, buffer[:n], err)
+		}
+	}
+
+	// TCP : the messages are framed by octet counting or newlines
+	for _, framing := range []string{"octet-counting", "newline"} {
+		listener, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatalf("Can't listen : %s", err)
+		}
+		received := make(chan []string)
+		go func() {
+			var messages []string
+			conn, err := listener.Accept()
+			if err == nil {
+				reader := bufio.NewReader(conn)
+				for {
+					if framing == "newline" {
+						line, err := reader.ReadString('\n')
+						if err != nil {
+							break
+						}
+						messages = append(messages, strings.TrimSuffix(line, "\n"))
+					} else {
+						var length int
+						if _, err := fmt.Fscanf(reader, "%d ", &length); err != nil {
+							break
+						}
+						message := make([]byte, length)
+						if _, err := io.ReadFull(reader, message); err != nil {
+							break
+						}
+						messages = append(messages, string(message))
+					}
+				}
+				conn.Close()
+			}
+			received <- messages
+		}()
+
+		db := &SyslogGarinDB{}
+		db.Setup("syslog", "tcp://"+listener.Addr().String()+"?framing="+framing)
+		if err := db.Open(); err != nil {
+			t.Fatalf("Can't open syslog : %s", err)
+		}
+		if err := db.RecordDestinations([]*Destination{testSyslogDestination(), testSyslogDestination(), testSyslogDestination()}); err != nil {
+			t.Fatalf("Can't record destinations over TCP : %s", err)
+		}
+		db.Close()
+		messages := <-received
+		listener.Close()
+		if len(messages) != 3 {
+			t.Errorf("Collector received %d messages with %s framing instead of 3", len(messages), framing)
+		}
+		for _, message := range messages {
+			if !strings.HasPrefix(message, "<134>1 ") || !strings.HasSuffix(message, "(HTTPS)") {
+				t.Errorf("Invalid message with %s framing : %q", framing, message)
+			}
+		}
+	}
+}
@@ -0,0 +1,197 @@
+package base
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/tls"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"text/template"
+	"time"
+)
+
+// WebhookGarinDB POSTs the batches of destinations to a URL
+// The args are the URL followed by the options in its fragment, which is never sent (ex: https://hooks.example.com/garin?token=abc#hmac-secret=s3cr3t&timeout=10s)
+// The body is a JSON array of the destinations unless a text/template is configured
+type WebhookGarinDB struct {
+	AbstractGarinDB
+	options *webhookOptions
+	client  *http.Client
+}
+
+type webhookOptions struct {
+	url           string
+	method        string
+	contentType   string
+	headers       http.Header
+	template      *template.Template
+	hmacSecret    []byte
+	hmacHeader    string
+	timeout       time.Duration
+	skipTLSVerify bool
+}
+
+// WebhookPayload is what the body template is executed with
+type WebhookPayload struct {
+	Destinations []*DestinationDocument
+}
+
+var webhookTemplateFuncs = template.FuncMap{
+	"json": func(value interface{}) (string, error) {
+		data, err := json.Marshal(value)
+		return string(data), err
+	},
+}
+
+func parseWebhookArgs(args string) (*webhookOptions, error) {
+	webhookURL, err := url.Parse(args)
+	if err != nil {
+		return nil, err
+	}
+	if webhookURL.Scheme != "http" && webhookURL.Scheme != "https" {
+		return nil, fmt.Errorf("invalid webhook URL %q", args)
+	}
+	options := &webhookOptions{
+		method:      "POST",
+		contentType: "application/json",
+		headers:     http.Header{},
+		hmacHeader:  "X-Garin-Signature",
+		timeout:     30 * time.Second,
+	}
+	query, err := url.ParseQuery(webhookURL.EscapedFragment())
+	if err != nil {
+		return nil, err
+	}
+	for key, values := range query {
+		value := values[len(values)-1]
+		switch key {
+		case "method":
+			options.method = strings.ToUpper(value)
+		case "content-type":
+			options.contentType = value
+		case "header":
+			// Can be repeated to set multiple headers
+			for _, header := range values {
+				parts := strings.SplitN(header, ":", 2)
+				if len(parts) != 2 || strings.TrimSpace(parts[0]) == "" {
+					err = fmt.Errorf("must be formatted as Name: value")
+					break
+				}
+				options.headers.Add(strings.TrimSpace(parts[0]), strings.TrimSpace(parts[1]))
+			}
+		case "template":
+			options.template, err = template.New("webhook").Funcs(webhookTemplateFuncs).Parse(value)
+		case "template-file":
+			var data []byte
+			if data, err = ioutil.ReadFile(value); err == nil {
+				options.template, err = template.New(value).Funcs(webhookTemplateFuncs).Parse(string(data))
+			}
+		case "hmac-secret":
+			options.hmacSecret = []byte(value)
+		case "hmac-header":
+			options.hmacHeader = value
+		case "timeout":
+			options.timeout, err = time.ParseDuration(value)
+		case "tls-skip-verify":
+			options.skipTLSVerify, err = strconv.ParseBool(value)
+		default:
+			err = fmt.Errorf("unknown option")
+		}
+		if err != nil {
+			return nil, fmt.Errorf("invalid webhook option %s=%s: %s", key, value, err)
+		}
+	}
+	webhookURL.Fragment, webhookURL.RawFragment = "", ""
+	options.url = webhookURL.String()
+	return options, nil
+}
+
+func (self *WebhookGarinDB) Open() error {
+	options, err := parseWebhookArgs(self.dbArgs)
+	if err != nil {
+		return &DBError{Err: err, Retryable: false}
+	}
+	self.options = options
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	if options.skipTLSVerify {
+		transport.TLSClientConfig = &tls.Config{InsecureSkipVerify: true}
+	}
+	self.client = &http.Client{Timeout: options.timeout, Transport: transport}
+	return nil
+}
+
+func (self *WebhookGarinDB) Close() error {
+	if self.client != nil {
+		self.client.CloseIdleConnections()
+	}
+	return nil
+}
+
+func (self *WebhookGarinDB) RecordDestination(destination *Destination) error {
+	return self.RecordDestinations([]*Destination{destination})
+}
+
+// Sends the batch in a single request, the retries are done by the retry policy of the output
+func (self *WebhookGarinDB) RecordDestinations(destinations []*Destination) error {
+	body, err := self.options.body(destinations)
+	if err != nil {
+		return &DBError{Err: err, Retryable: false}
+	}
+	return self.post(body)
+}
+
+// Renders the body of a batch
+func (self *webhookOptions) body(destinations []*Destination) ([]byte, error) {
+	documents := make([]*DestinationDocument, len(destinations))
+	for i, destination := range destinations {
+		documents[i] = destination.Document()
+	}
+	if self.template == nil {
+		return json.Marshal(documents)
+	}
+	body := &bytes.Buffer{}
+	err := self.template.Execute(body, &WebhookPayload{Destinations: documents})
+	return body.Bytes(), err
+}
+
+// Returns the hex encoded HMAC-SHA256 of the body, prefixed by the algorithm
+func webhookSignature(secret []byte, body []byte) string {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// Sends the body once, the error carries how long the endpoint asked to wait before retrying, if it did
+func (self *WebhookGarinDB) post(body []byte) error {
+	request, err := http.NewRequest(self.options.method, self.options.url, bytes.NewReader(body))
+	if err != nil {
+		return &DBError{Err: err, Retryable: false}
+	}
+	for name, values := range self.options.headers {
+		request.Header[name] = values
+	}
+	request.Header.Set("Content-Type", self.options.contentType)
+	if self.options.hmacSecret != nil {
+		request.Header.Set(self.options.hmacHeader, webhookSignature(self.options.hmacSecret, body))
+	}
+
+	response, err := self.client.Do(request)
+	if err != nil {
+		return err
+	}
+	defer response.Body.Close()
+	if response.StatusCode >= 300 {
+		return newHTTPStatusError(response)
+	}
+	// The body is read so the connection can be reused but its content doesn't matter
+	io.Copy(ioutil.Discard, io.LimitReader(response.Body, HTTP_ERROR_BODY_MAX_SIZE))
+	return nil
+}
@@ -0,0 +1,148 @@
+package base
+
+import (
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+type testWebhookRequest struct {
+	header http.Header
+	query  url.Values
+	body   []byte
+}
+
+// Stands in for a webhook endpoint, it fails the first requests with the configured statuses, Retry-After and body
+type testWebhook struct {
+	mutex      *sync.Mutex
+	statuses   []int
+	retryAfter string
+	errorBody  string
+	requests   []testWebhookRequest
+}
+
+func (self *testWebhook) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+	body, _ := ioutil.ReadAll(r.Body)
+	self.requests = append(self.requests, testWebhookRequest{header: r.Header, query: r.URL.Query(), body: body})
+	if len(self.statuses) > 0 {
+		status := self.statuses[0]
+		self.statuses = self.statuses[1:]
+		if self.retryAfter != "" {
+			w.Header().Set("Retry-After", self.retryAfter)
+		}
+		errorBody := self.errorBody
+		if errorBody == "" {
+			errorBody = "unavailable"
+		}
+		http.Error(w, errorBody, status)
+	}
+}
+
+func openTestWebhook(t *testing.T, args string) *WebhookGarinDB {
+	db := &WebhookGarinDB{}
+	db.Setup("webhook", args)
+	if err := db.Open(); err != nil {
+		t.Fatalf("Can't open webhook : %s", err)
+	}
+	return db
+}
+
+func TestWebhook(t *testing.T) {
+	endpoint := &testWebhook{mutex: &sync.Mutex{}, statuses: []int{http.StatusServiceUnavailable, http.StatusTooManyRequests}}
+	server := httptest.NewServer(endpoint)
+	defer server.Close()
+
+	destinations := []*Destination{
+		{SourceIp: "10.0.0.1", DestinationIp: "192.0.2.1", ServerName: "a.example.com", Protocol: "HTTPS", Timestamp: time.Now()},
+		{SourceIp: "10.0.0.2", DestinationIp: "192.0.2.2", ServerName: "b.example.com", Protocol: "HTTP", Timestamp: time.Now()},
+	}
+
+	// The retryable statuses are retried by the retry policy and the query of the URL is kept
+	db := openTestWebhook(t, server.URL+"/hook?token=abc#hmac-secret=s3cr3t&header=Authorization:+Bearer+xyz&header=X-Source:+garin")
+	retry := RetryPolicy{MaxAttempts: 3, InitialBackoff: time.Millisecond, MaxBackoff: 2 * time.Millisecond}
+	reconnectingDB, err := NewReconnectingGarinDB(db, retry, NewHealthState("webhook"))
+	if err != nil {
+		t.Fatalf("Can't create database : %s", err)
+	}
+	if err := reconnectingDB.RecordDestinations(destinations); err != nil {
+		t.Fatalf("Can't record destinations : %s", err)
+	}
+	reconnectingDB.Close()
+	if len(endpoint.requests) != 3 {
+		t.Fatalf("Webhook received %d requests instead of 3", len(endpoint.requests))
+	}
+	request := endpoint.requests[2]
+	if request.query.Get("token") != "abc" || request.header.Get("Authorization") != "Bearer xyz" || request.header.Get("X-Source") != "garin" {
+		t.Errorf("Request doesn't have the query and headers of the webhook : %v %v", request.query, request.header)
+	}
+	if signature := request.header.Get("X-Garin-Signature"); signature != webhookSignature([]byte("s3cr3t"), request.body) {
+		t.Errorf("Signature %q doesn't match the body", signature)
+	}
+	var documents []DestinationDocument
+	if err := json.Unmarshal(request.body, &documents); err != nil || len(documents) != 2 || documents[1].ServerName != "b.example.com" {
+		t.Errorf("Body isn't the JSON array of the destinations : %s", request.body)
+	}
+
+	// Templated body
+	endpoint.requests = nil
+	db = openTestWebhook(t, server.URL+"#content-type=text/plain&template="+url.QueryEscape(`{{range .Destinations}}{{.SourceIp}} {{json .ServerName}};{{end}}`))
+	if err := db.RecordDestinations(destinations); err != nil {
+		t.Fatalf("Can't record destinations : %s", err)
+	}
+	if body := string(endpoint.requests[0].body); body != `10.0.0.1 "a.example.com";10.0.0.2 "b.example.com";` {
+		t.Errorf("Templated body is %q", body)
+	}
+	if contentType := endpoint.requests[0].header.Get("Content-Type"); contentType != "text/plain" {
+		t.Errorf("Content type is %q instead of text/plain", contentType)
+	}
+
+	// Client errors aren't retried
+	endpoint.requests = nil
+	endpoint.statuses = []int{http.StatusBadRequest}
+	if err := db.RecordDestinations(destinations); err == nil || IsRetryable(err) || len(endpoint.requests) != 1 {
+		t.Errorf("Bad request was retried or is retryable : %v", err)
+	}
+
+	// Retryable errors are reported after a single request, with the Retry-After and the beginning of the body
+	endpoint.requests = nil
+	endpoint.statuses = []int{503}
+	endpoint.retryAfter = "1"
+	endpoint.errorBody = strings.Repeat("x", 2*HTTP_ERROR_BODY_MAX_SIZE)
+	err = db.RecordDestinations(destinations)
+	var httpErr *HTTPStatusError
+	if !errors.As(err, &httpErr) || !IsRetryable(err) || len(endpoint.requests) != 1 {
+		t.Fatalf("Server error wasn't reported after a single request : %v", err)
+	}
+	if httpErr.RetryAfter != time.Second || len(httpErr.Body) != HTTP_ERROR_BODY_MAX_SIZE {
+		t.Errorf("Error has a Retry-After of %s and a body of %d bytes instead of 1s and %d bytes", httpErr.RetryAfter, len(httpErr.Body), HTTP_ERROR_BODY_MAX_SIZE)
+	}
+
+	// The Retry-After is the minimum backoff of the retry policy, up to its max backoff
+	endpoint.requests = nil
+	endpoint.statuses = []int{503}
+	endpoint.retryAfter = "86400"
+	retry.MaxBackoff = 100 * time.Millisecond
+	reconnectingDB, _ = NewReconnectingGarinDB(db, retry, NewHealthState("webhook"))
+	start := time.Now()
+	if err := reconnectingDB.RecordDestinations(destinations); err != nil || len(endpoint.requests) != 2 {
+		t.Fatalf("Server error wasn't retried : %v", err)
+	}
+	if elapsed := time.Since(start); elapsed < retry.MaxBackoff || elapsed > time.Second {
+		t.Errorf("Retried after %s instead of the %s max backoff", elapsed, retry.MaxBackoff)
+	}
+
+	for _, args := range []string{"ftp://127.0.0.1/", "http://127.0.0.1/#header=invalid", "http://127.0.0.1/#template={{.Unclosed", "http://127.0.0.1/#max-retries=1"} {
+		if _, err := parseWebhookArgs(args); err == nil {
+			t.Errorf("Invalid args %q were accepted", args)
+		}
+	}
+}
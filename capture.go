@@ -0,0 +1,141 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"github.com/google/gopacket/pcap"
+	"math"
+	"strings"
+	"time"
+)
+
+const (
+	CAPTURE_BACKEND_PCAP     = "pcap"
+	CAPTURE_BACKEND_AFPACKET = "afpacket"
+)
+
+// Tunnelled packets can't be filtered on their inner TCP ports by the kernel so all the tunnel traffic is captured
+// This covers VXLAN, GENEVE and GRE (including ERSPAN)
+const TUNNELS_CAPTURE_FILTER = "udp port 4789 or udp port 6081 or ip proto 47 or ip6 proto 47"
+
+// 802.1Q/802.1ad and MPLS are matched on the ethertype which only exists when the capture has Ethernet headers
+const ETHERNET_TUNNELS_CAPTURE_FILTER = "ether proto 0x8100 or ether proto 0x88a8 or ether proto 0x8847"
+
+// Only the first fragment of a packet carries the TCP header so the port filters can't match the others, all the fragments are captured so they can be reassembled
+// This covers the IPv4 fragments and the IPv6 packets that start with a fragment header
+const FRAGMENTS_CAPTURE_FILTER = "(ip[6:2] & 0x3fff != 0) or ip6 proto 44"
+
+// Returned by a CaptureHandle when no packet was seen before the read timeout
+// This allows the capture loop to do its housekeeping even on an idle interface
+var ErrCaptureTimeout = errors.New("capture timeout expired")
+
+type CaptureStats struct {
+	PacketsReceived uint64
+	PacketsDropped  uint64
+	// Drops that happened on the interface itself (pcap)
+	PacketsIfDropped uint64
+	// Times the ring was frozen because it was full (afpacket)
+	RingFreezes uint64
+}
+
+// CaptureHandle abstracts the packet source so the capture loop doesn't need to know which backend is being used
+type CaptureHandle interface {
+	ZeroCopyReadPacketData() ([]byte, gopacket.CaptureInfo, error)
+	SetBPFFilter(filter string) error
+	LinkType() layers.LinkType
+	Stats() (*CaptureStats, error)
+	Close()
+}
+
+type PcapCaptureHandle struct {
+	handle *pcap.Handle
+}
+
+func NewPcapOfflineCaptureHandle(file string) (CaptureHandle, error) {
+	handle, err := pcap.OpenOffline(file)
+	if err != nil {
+		return nil, err
+	}
+	return &PcapCaptureHandle{handle: handle}, nil
+}
+
+// NewLiveCaptureHandle opens the interface using the backend selected in the configuration
+// ifaceIndex is the position of the interface in the list of captured interfaces
+func NewLiveCaptureHandle(backend string, iface string, ifaceIndex int, timeout time.Duration) (CaptureHandle, error) {
+	switch backend {
+	case CAPTURE_BACKEND_PCAP:
+		handle, err := pcap.OpenLive(iface, int32(cfg.Capture.Snaplen), true, timeout)
+		if err != nil {
+			return nil, err
+		}
+		return &PcapCaptureHandle{handle: handle}, nil
+	case CAPTURE_BACKEND_AFPACKET:
+		fanoutGroup, err := afpacketFanoutGroup(cfg.Capture.Afpacket_fanout_group, ifaceIndex)
+		if err != nil {
+			return nil, err
+		}
+		return NewAfpacketCaptureHandle(iface, fanoutGroup, timeout)
+	default:
+		return nil, fmt.Errorf("unknown capture backend %q", backend)
+	}
+}
+
+// afpacketFanoutGroup returns the fanout group ID of the interface at a position in the list, 0 when fanout is disabled
+// A fanout group can only contain sockets bound to the same interface so each interface gets its own group
+func afpacketFanoutGroup(group int, ifaceIndex int) (int, error) {
+	if group == 0 {
+		return 0, nil
+	}
+	fanoutGroup := group + ifaceIndex
+	if group < 0 || fanoutGroup > math.MaxUint16 {
+		return 0, fmt.Errorf("afpacket fanout group %d of the interface at position %d isn't between 1 and %d", fanoutGroup, ifaceIndex, math.MaxUint16)
+	}
+	return fanoutGroup, nil
+}
+
+// BuildCaptureFilter builds the BPF filter that selects the packets to capture on a link type
+// The filter has to compile for the link type of the handle so the Ethernet-only terms are left out of the others
+func BuildCaptureFilter(ports []string, decapsulateTunnels bool, linkType layers.LinkType) string {
+	filter := "tcp port " + strings.Join(ports, " or ") + " or " + FRAGMENTS_CAPTURE_FILTER
+	if decapsulateTunnels {
+		filter += " or " + TUNNELS_CAPTURE_FILTER
+		if linkType == layers.LinkTypeEthernet {
+			filter += " or " + ETHERNET_TUNNELS_CAPTURE_FILTER
+		}
+	}
+	return filter
+}
+
+func (self *PcapCaptureHandle) ZeroCopyReadPacketData() ([]byte, gopacket.CaptureInfo, error) {
+	data, ci, err := self.handle.ZeroCopyReadPacketData()
+	if err == pcap.NextErrorTimeoutExpired {
+		err = ErrCaptureTimeout
+	}
+	return data, ci, err
+}
+
+func (self *PcapCaptureHandle) SetBPFFilter(filter string) error {
+	return self.handle.SetBPFFilter(filter)
+}
+
+func (self *PcapCaptureHandle) LinkType() layers.LinkType {
+	return self.handle.LinkType()
+}
+
+func (self *PcapCaptureHandle) Stats() (*CaptureStats, error) {
+	stats, err := self.handle.Stats()
+	if err != nil {
+		return nil, err
+	}
+	return &CaptureStats{
+		PacketsReceived:  uint64(stats.PacketsReceived),
+		PacketsDropped:   uint64(stats.PacketsDropped),
+		PacketsIfDropped: uint64(stats.PacketsIfDropped),
+	}, nil
+}
+
+func (self *PcapCaptureHandle) Close() {
+	self.handle.Close()
+}
@@ -0,0 +1,52 @@
+package main
+
+import (
+	"github.com/google/gopacket/layers"
+	"strings"
+	"testing"
+)
+
+func TestBuildCaptureFilterLinkType(t *testing.T) {
+	ports := []string{"443", "80"}
+
+	filter := BuildCaptureFilter(ports, true, layers.LinkTypeEthernet)
+	if !strings.Contains(filter, TUNNELS_CAPTURE_FILTER) || !strings.Contains(filter, ETHERNET_TUNNELS_CAPTURE_FILTER) {
+		t.Errorf("The Ethernet filter doesn't capture all the tunnels: %s", filter)
+	}
+
+	filter = BuildCaptureFilter(ports, true, layers.LinkTypeRaw)
+	if !strings.Contains(filter, TUNNELS_CAPTURE_FILTER) {
+		t.Errorf("The raw IP filter doesn't capture the IP tunnels: %s", filter)
+	}
+	if strings.Contains(filter, "ether") {
+		t.Errorf("The raw IP filter matches on the ethertype: %s", filter)
+	}
+
+	filter = BuildCaptureFilter(ports, false, layers.LinkTypeEthernet)
+	if strings.Contains(filter, TUNNELS_CAPTURE_FILTER) {
+		t.Errorf("The filter captures the tunnels when they aren't decapsulated: %s", filter)
+	}
+}
+
+func TestAfpacketFanoutGroup(t *testing.T) {
+	tests := []struct {
+		group       int
+		ifaceIndex  int
+		fanoutGroup int
+		valid       bool
+	}{
+		{0, 0, 0, true},
+		{0, 3, 0, true},
+		{42, 0, 42, true},
+		{42, 2, 44, true},
+		{65535, 0, 65535, true},
+		{65535, 1, 0, false},
+		{-1, 0, 0, false},
+	}
+	for _, test := range tests {
+		fanoutGroup, err := afpacketFanoutGroup(test.group, test.ifaceIndex)
+		if (err == nil) != test.valid || fanoutGroup != test.fanoutGroup {
+			t.Errorf("Fanout group %d of the interface at position %d is %d (%v) instead of %d", test.group, test.ifaceIndex, fanoutGroup, err, test.fanoutGroup)
+		}
+	}
+}
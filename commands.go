@@ -0,0 +1,51 @@
+package main
+
+import (
+	"fmt"
+	"github.com/julsemaan/garin/base"
+	"os"
+	"strings"
+)
+
+// Commands that can be given after the flags instead of starting the capture
+var commands = map[string]func(){
+	"db migrate": migrateDB,
+}
+
+func runCommand(args []string) {
+	command, ok := commands[strings.Join(args, " ")]
+	if !ok {
+		fmt.Fprintf(os.Stderr, "Unknown command %q, available commands are :\n", strings.Join(args, " "))
+		for name := range commands {
+			fmt.Fprintln(os.Stderr, "  "+name)
+		}
+		os.Exit(2)
+	}
+	command()
+}
+
+// Applies the schema migrations that weren't applied yet to the databases of the configured outputs
+// The outputs whose type has no schema migrations (ex: kafka, webhook) are skipped
+func migrateDB() {
+	failed := false
+	names, outputCfgs := configuredOutputs()
+	for _, name := range names {
+		outputCfg := outputCfgs[name]
+		if _, err := base.Migrations(outputCfg.Type); err != nil {
+			continue
+		}
+		applied, version, err := base.MigrateDB(outputCfg.Type, outputCfg.Args)
+		for _, migration := range applied {
+			fmt.Printf("Applied migration %d to output %s : %s\n", migration.Version, name, migration.Description)
+		}
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Can't migrate the database of output %s : %s\n", name, err)
+			failed = true
+			continue
+		}
+		fmt.Printf("Database schema of output %s is at version %d\n", name, version)
+	}
+	if failed {
+		os.Exit(1)
+	}
+}
@@ -0,0 +1,42 @@
+package main
+
+import (
+	"github.com/julsemaan/garin/base"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestMigrateDBOutputs(t *testing.T) {
+	dir, err := ioutil.TempDir("", "garin-migrate")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	confFile := filepath.Join(dir, "garin.conf")
+	dbFiles := []string{filepath.Join(dir, "first.db"), filepath.Join(dir, "second.db")}
+	conf := "[output \"first\"]\ntype=sqlite3\nargs=" + dbFiles[0] + "\n" +
+		"[output \"second\"]\ntype=sqlite3\nargs=" + dbFiles[1] + "\n" +
+		"[output \"siem\"]\ntype=jsonl\nargs=" + filepath.Join(dir, "garin.jsonl") + "\n"
+	if err := ioutil.WriteFile(confFile, []byte(conf), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	previousCfg := cfg
+	cfg = BuildConfig(confFile)
+	defer func() { cfg = previousCfg }()
+
+	migrateDB()
+
+	for _, dbFile := range dbFiles {
+		applied, version, err := base.MigrateDB("sqlite3", dbFile)
+		if err != nil {
+			t.Fatalf("Can't check the schema of %s : %s", dbFile, err)
+		}
+		if len(applied) != 0 || version == 0 {
+			t.Errorf("The database of %s wasn't migrated, %d migrations were left and it was at version %d", dbFile, len(applied), version)
+		}
+	}
+}
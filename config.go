@@ -13,9 +13,12 @@ type Config struct {
 		Log_level                string
 		Parsing_concurrency      int
 		Recording_threads        int
+		Recording_queue_capacity int
+		Recording_queue_overflow string
 		Dont_record_destinations bool
 	}
 	Capture struct {
+		Backend                 string
 		Interface               string
 		Unencrypted_ports       string
 		Encrypted_ports         string
@@ -23,16 +26,78 @@ type Config struct {
 		Buffered_per_connection int
 		Total_max_buffer        int
 		Flush_after             string
+		Decapsulate_tunnels     bool
+		Defrag_timeout          string
+		Defrag_max_packets      int
+		Defrag_max_fragments    int
+		Afpacket_frame_size     int
+		Afpacket_block_size     int
+		Afpacket_num_blocks     int
+		Afpacket_fanout_group   int
+		Afpacket_fanout_type    string
 	}
 	Database struct {
 		Type                  string
 		Args                  string
 		Debounce_destinations string
+		Debounce_edge         string
+		Debounce_key          string
+		Debounce_max_entries  int
+		Aggregate_sessions    string
+		Batch_size            int
+		Batch_max_latency     string
+		Retry_attempts        int
+		Retry_initial_backoff string
+		Retry_max_backoff     string
 	}
+	Http struct {
+		Listen       string
+		Query_output string
+	}
+	Spool struct {
+		Directory      string
+		Segment_size   int64
+		Max_size       int64
+		Fsync          string
+		Fsync_interval string
+		Retry_interval string
+	}
+	// Values of the keys that aren't set in the [output "name"] sections
+	Default_output OutputConfig
+	// When there is none, the destinations are recorded in the database of the [database] section
+	Output map[string]*OutputConfig
+}
+
+type OutputConfig struct {
+	Type                     string
+	Args                     string
+	Recording_threads        int
+	Recording_queue_capacity int
+	Recording_queue_overflow string
+	Debounce_destinations    string
+	Debounce_edge            string
+	Debounce_key             string
+	Debounce_max_entries     int
+	Aggregate_sessions       string
+	Batch_size               int
+	Batch_max_latency        string
+	Retry_attempts           int
+	Retry_initial_backoff    string
+	Retry_max_backoff        string
+	Spool_directory          string
+	Include_protocols        string
+	Exclude_protocols        string
+	Include_hosts            string
+	Exclude_hosts            string
+	Include_subnets          string
+	Exclude_subnets          string
 }
 
 func NewConfig(filename string) *Config {
-	cfg := &Config{}
+	return readConfig(&Config{}, filename)
+}
+
+func readConfig(cfg *Config, filename string) *Config {
 	err := gcfg.ReadFileInto(cfg, filename)
 	if err != nil {
 		base.Die("Failed to parse gcfg", err)
@@ -42,13 +107,19 @@ func NewConfig(filename string) *Config {
 
 func BuildConfig(filename string) *Config {
 	default_cfg := NewConfig(DEFAULT_CONF_FILE)
-	cfg := NewConfig(filename)
+	// The output sections of the configuration are created from the default ones
+	cfg := readConfig(&Config{Default_output: default_cfg.Default_output}, filename)
 
 	reflect_default_cfg := reflect.ValueOf(default_cfg).Elem()
 	reflect_cfg := reflect.ValueOf(cfg).Elem()
 	for i := 0; i < reflect_default_cfg.NumField(); i++ {
 		default_cfg_section := reflect_default_cfg.Field(i)
 		cfg_section := reflect_cfg.Field(i)
+		// Sections with subsections only come from the configuration
+		if cfg_section.Kind() == reflect.Map {
+			default_cfg_section.Set(cfg_section)
+			continue
+		}
 
 		for j := 0; j < default_cfg_section.NumField(); j++ {
 			default_field := default_cfg_section.Field(j)
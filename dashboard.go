@@ -0,0 +1,165 @@
+package main
+
+import (
+	"embed"
+	"fmt"
+	"github.com/julsemaan/garin/base"
+	"io/fs"
+	"net/http"
+	"sort"
+	"strconv"
+	"time"
+)
+
+//go:embed dashboard
+var dashboardFiles embed.FS
+
+const (
+	// Maximum amount of server names of the last hour, the most seen, that are looked up in the baseline to know if they are new
+	SUMMARY_MAX_NEW_CANDIDATES = 1000
+	// Maximum amount of new server names returned, the ones first seen most recently
+	SUMMARY_MAX_NEW_SERVER_NAMES = 50
+	SUMMARY_DEFAULT_TOP          = 10
+	// Time before the last hour in which a server name must not have been seen to be new
+	SUMMARY_DEFAULT_BASELINE = 7 * 24 * time.Hour
+)
+
+type summaryCount struct {
+	Name  string `json:"name"`
+	Count int64  `json:"count"`
+}
+
+type summaryNewServerName struct {
+	Name      string    `json:"name"`
+	FirstSeen time.Time `json:"first_seen"`
+	Count     int64     `json:"count"`
+}
+
+type apiSummaryResponse struct {
+	Since          time.Time               `json:"since"`
+	Until          time.Time               `json:"until"`
+	Destinations   int64                   `json:"destinations"`
+	ServerNames    []*summaryCount         `json:"server_names"`
+	Clients        []*summaryCount         `json:"clients"`
+	Protocols      []*summaryCount         `json:"protocols"`
+	NewServerNames []*summaryNewServerName `json:"new_server_names"`
+}
+
+func summaryCounts(counts []*base.DestinationCount) []*summaryCount {
+	result := make([]*summaryCount, 0, len(counts))
+	for _, count := range counts {
+		result = append(result, &summaryCount{Name: count.Value, Count: count.Count})
+	}
+	return result
+}
+
+func (self *destinationsAPI) summarize(query *base.DestinationQuery) (*base.DestinationSummary, error) {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+	return self.db.SummarizeDestinations(query)
+}
+
+func (self *destinationsAPI) seenServerNames(query *base.DestinationQuery, serverNames []string) (map[string]bool, error) {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+	return self.db.SeenServerNames(query, serverNames)
+}
+
+// Returns the server names of a query seen in the last hour that weren't seen during the baseline before it, from the most recently first seen
+func (self *destinationsAPI) newServerNames(query *base.DestinationQuery, hourAgo time.Time, baseline time.Duration) ([]*summaryNewServerName, error) {
+	lastHour := *query
+	if lastHour.Since.Before(hourAgo) {
+		lastHour.Since = hourAgo
+	}
+	lastHour.Limit = SUMMARY_MAX_NEW_CANDIDATES
+	summary, err := self.summarize(&lastHour)
+	if err != nil {
+		return nil, err
+	}
+	var candidates []string
+	for _, count := range summary.ServerNames {
+		candidates = append(candidates, count.Value)
+	}
+	baselineQuery := &base.DestinationQuery{Since: hourAgo.Add(-baseline), Until: hourAgo, Limit: 1}
+	if err := baselineQuery.Validate(); err != nil {
+		return nil, err
+	}
+	seen, err := self.seenServerNames(baselineQuery, candidates)
+	if err != nil {
+		return nil, err
+	}
+
+	newServerNames := []*summaryNewServerName{}
+	for _, count := range summary.ServerNames {
+		if count.Value != "" && !seen[count.Value] {
+			newServerNames = append(newServerNames, &summaryNewServerName{Name: count.Value, FirstSeen: count.FirstSeen, Count: count.Count})
+		}
+	}
+	sort.SliceStable(newServerNames, func(i, j int) bool { return newServerNames[i].FirstSeen.After(newServerNames[j].FirstSeen) })
+	if len(newServerNames) > SUMMARY_MAX_NEW_SERVER_NAMES {
+		newServerNames = newServerNames[:SUMMARY_MAX_NEW_SERVER_NAMES]
+	}
+	return newServerNames, nil
+}
+
+// serveSummary answers the aggregations shown by the dashboard for the destinations selected by the same parameters as the API
+// The destinations are counted by the database rather than read here
+func (self *destinationsAPI) serveSummary(w http.ResponseWriter, r *http.Request) {
+	now := time.Now()
+	params := r.URL.Query()
+	if params.Get("since") == "" {
+		params.Set("since", "24h")
+	}
+	query, _, err := parseAPIQuery(params, now)
+	if err != nil {
+		writeAPIError(w, http.StatusBadRequest, err)
+		return
+	}
+	top := SUMMARY_DEFAULT_TOP
+	if value := params.Get("top"); value != "" {
+		if top, err = strconv.Atoi(value); err != nil || top <= 0 {
+			writeAPIError(w, http.StatusBadRequest, fmt.Errorf("invalid top %q", value))
+			return
+		}
+	}
+	baseline := SUMMARY_DEFAULT_BASELINE
+	if value := params.Get("baseline"); value != "" {
+		if baseline, err = time.ParseDuration(value); err != nil || baseline <= 0 {
+			writeAPIError(w, http.StatusBadRequest, fmt.Errorf("invalid baseline %q", value))
+			return
+		}
+	}
+
+	response := &apiSummaryResponse{Since: query.Since, Until: query.Until}
+	if response.Until.IsZero() {
+		response.Until = now
+	}
+	query.Offset, query.Limit = 0, top
+	summary, err := self.summarize(query)
+	if err == nil {
+		response.NewServerNames, err = self.newServerNames(query, response.Until.Add(-time.Hour), baseline)
+	}
+	if err != nil {
+		Logger().Errorf("can't summarize the destinations: %s", err)
+		status := http.StatusInternalServerError
+		if base.IsRetryable(err) {
+			status = http.StatusServiceUnavailable
+		}
+		writeAPIError(w, status, err)
+		return
+	}
+	response.Destinations = summary.Destinations
+	response.ServerNames = summaryCounts(summary.ServerNames)
+	response.Clients = summaryCounts(summary.Clients)
+	response.Protocols = summaryCounts(summary.Protocols)
+	writeAPIResponse(w, response)
+}
+
+// Serves the dashboard, which only uses the API
+func dashboardHandler() http.Handler {
+	files, err := fs.Sub(dashboardFiles, "dashboard")
+	if err != nil {
+		base.Die("can't load the dashboard: ", err)
+	}
+	return http.StripPrefix("/dashboard/", http.FileServer(http.FS(files)))
+}
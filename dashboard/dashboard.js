@@ -0,0 +1,173 @@
+// The dashboard only uses the query API, it is refreshed every minute
+"use strict";
+
+var REFRESH_INTERVAL = 60 * 1000;
+// Amount of bars of the timeline of a host
+var HISTOGRAM_BUCKETS = 24;
+var TIMELINE_LIMIT = 1000;
+
+function $(id) {
+  return document.getElementById(id);
+}
+
+function apiURL(path, params) {
+  var query = new URLSearchParams();
+  Object.keys(params).forEach(function (key) {
+    if (params[key]) {
+      query.set(key, params[key]);
+    }
+  });
+  return "../api/" + path + "?" + query.toString();
+}
+
+function fetchJSON(url) {
+  return fetch(url).then(function (response) {
+    return response.json().then(function (body) {
+      if (!response.ok) {
+        throw new Error(body.error || response.statusText);
+      }
+      return body;
+    });
+  });
+}
+
+function element(tag, text, className) {
+  var node = document.createElement(tag);
+  if (text !== undefined) {
+    node.textContent = text;
+  }
+  if (className) {
+    node.className = className;
+  }
+  return node;
+}
+
+function formatTime(timestamp) {
+  return new Date(timestamp).toLocaleString();
+}
+
+function rangeDuration() {
+  return parseInt($("range").value, 10) * 3600 * 1000;
+}
+
+// Shows counts as horizontal bars, the ones that can be clicked call onClick with their name
+function renderBars(list, counts, onClick) {
+  list.replaceChildren();
+  if (counts.length === 0) {
+    list.appendChild(element("li", "No destinations", "empty"));
+    return;
+  }
+  var max = counts[0].count;
+  counts.forEach(function (count) {
+    var item = element("li");
+    var bar = element("div", undefined, "bar");
+    bar.style.width = (100 * count.count / max) + "%";
+    item.appendChild(bar);
+    item.appendChild(element("span", count.name || "(none)"));
+    item.appendChild(element("span", count.count.toLocaleString()));
+    if (onClick) {
+      item.className = "clickable";
+      item.addEventListener("click", function () { onClick(count.name); });
+    }
+    list.appendChild(item);
+  });
+}
+
+function renderRows(table, rows) {
+  var body = table.querySelector("tbody");
+  body.replaceChildren();
+  if (rows.length === 0) {
+    var row = element("tr");
+    var cell = element("td", "Nothing to show", "empty");
+    cell.colSpan = table.querySelectorAll("th").length;
+    row.appendChild(cell);
+    body.appendChild(row);
+    return;
+  }
+  rows.forEach(function (values) {
+    var row = element("tr");
+    values.forEach(function (value) {
+      row.appendChild(element("td", value));
+    });
+    body.appendChild(row);
+  });
+}
+
+function showStatus(text, isError) {
+  $("status").textContent = text;
+  $("status").className = isError ? "error" : "";
+}
+
+function refreshSummary() {
+  var params = {since: $("range").value, source: $("source").value.trim()};
+  return fetchJSON(apiURL("summary", params)).then(function (summary) {
+    renderBars($("protocols"), summary.protocols);
+    renderBars($("server-names"), summary.server_names);
+    renderBars($("clients"), summary.clients, showTimeline);
+    renderRows($("new-server-names"), summary.new_server_names.map(function (serverName) {
+      return [serverName.name, formatTime(serverName.first_seen), serverName.count.toLocaleString()];
+    }));
+    showStatus(summary.destinations.toLocaleString() + " destinations, updated " + new Date().toLocaleTimeString());
+  });
+}
+
+// Shows the destinations of a host along with how many there are over the time range
+function showTimeline(host) {
+  $("host").value = host;
+  return refreshTimeline();
+}
+
+function refreshTimeline() {
+  var host = $("host").value.trim();
+  if (!host) {
+    return Promise.resolve();
+  }
+  var params = {source: host, since: $("range").value, limit: TIMELINE_LIMIT};
+  var exportParams = Object.assign({}, params, {format: "csv", limit: 10000});
+  $("export").href = apiURL("destinations", exportParams);
+  $("export").hidden = false;
+  return fetchJSON(apiURL("destinations", params)).then(function (response) {
+    var until = Date.now();
+    var bucketDuration = rangeDuration() / HISTOGRAM_BUCKETS;
+    var buckets = new Array(HISTOGRAM_BUCKETS).fill(0);
+    response.destinations.forEach(function (destination) {
+      var bucket = HISTOGRAM_BUCKETS - 1 - Math.floor((until - new Date(destination.timestamp).getTime()) / bucketDuration);
+      if (bucket >= 0 && bucket < HISTOGRAM_BUCKETS) {
+        buckets[bucket]++;
+      }
+    });
+    var max = Math.max.apply(null, buckets) || 1;
+    var histogram = $("histogram");
+    histogram.replaceChildren();
+    buckets.forEach(function (count, i) {
+      var bar = element("div");
+      bar.style.height = (100 * count / max) + "%";
+      bar.title = formatTime(until - (HISTOGRAM_BUCKETS - i) * bucketDuration) + ": " + count;
+      histogram.appendChild(bar);
+    });
+    renderRows($("timeline"), response.destinations.map(function (destination) {
+      return [formatTime(destination.timestamp), destination.server_name, destination.destination_ip, destination.protocol, destination.interface || ""];
+    }));
+  });
+}
+
+function refresh() {
+  return Promise.all([refreshSummary(), refreshTimeline()]).catch(function (error) {
+    showStatus("Can't load the destinations: " + error.message, true);
+  });
+}
+
+$("filters").addEventListener("submit", function (event) {
+  event.preventDefault();
+  refresh();
+});
+$("range").addEventListener("change", refresh);
+$("timeline-form").addEventListener("submit", function (event) {
+  event.preventDefault();
+  refreshTimeline().catch(function (error) {
+    showStatus("Can't load the timeline: " + error.message, true);
+  });
+});
+
+refresh();
+setInterval(refresh, REFRESH_INTERVAL);
@@ -0,0 +1,93 @@
+package main
+
+import (
+	"encoding/json"
+	"github.com/julsemaan/garin/base"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestSummary(t *testing.T) {
+	directory, _ := ioutil.TempDir("", "garin-summary")
+	defer os.RemoveAll(directory)
+	db, err := base.NewGarinDB("sqlite3", filepath.Join(directory, "garin.sqlite3"), apiRetryPolicy, base.NewHealthState("the API"))
+	if err != nil {
+		t.Fatalf("Can't open database : %s", err)
+	}
+	defer db.Close()
+	now := time.Now()
+	destinations := []*base.Destination{
+		{SourceIp: "10.0.0.1", DestinationIp: "192.0.2.1", ServerName: "example.com", Protocol: "HTTP", Timestamp: now.Add(-5 * time.Minute)},
+		{SourceIp: "10.0.0.1", DestinationIp: "192.0.2.2", ServerName: "new.example.com", Protocol: "TLS/SSL", Timestamp: now.Add(-10 * time.Minute)},
+		{SourceIp: "10.0.0.1", DestinationIp: "192.0.2.2", ServerName: "new.example.com", Protocol: "TLS/SSL", Timestamp: now.Add(-20 * time.Minute)},
+		{SourceIp: "10.0.0.2", DestinationIp: "192.0.2.1", ServerName: "example.com", Protocol: "TLS/SSL", Timestamp: now.Add(-90 * time.Minute)},
+		{SourceIp: "10.0.0.3", DestinationIp: "192.0.2.1", ServerName: "example.com", Protocol: "TLS/SSL", Timestamp: now.Add(-3 * time.Hour)},
+		{SourceIp: "10.0.0.3", DestinationIp: "192.0.2.3", ServerName: "old.example.com", Protocol: "TLS/SSL", Timestamp: now.Add(-72 * time.Hour)},
+	}
+	if err := db.RecordDestinations(destinations); err != nil {
+		t.Fatalf("Can't record destinations : %s", err)
+	}
+	api := newDestinationsAPI(db)
+
+	recorder := httptest.NewRecorder()
+	api.serveSummary(recorder, httptest.NewRequest("GET", "/api/summary?top=2", nil))
+	summary := &apiSummaryResponse{}
+	if err := json.NewDecoder(recorder.Body).Decode(summary); recorder.Code != http.StatusOK || err != nil {
+		t.Fatalf("Summary returned %d : %v", recorder.Code, err)
+	}
+	if summary.Destinations != 5 {
+		t.Errorf("Summary counted %d destinations", summary.Destinations)
+	}
+	if len(summary.ServerNames) != 2 || summary.ServerNames[0].Name != "example.com" || summary.ServerNames[0].Count != 3 || summary.ServerNames[1].Name != "new.example.com" {
+		t.Errorf("Top server names are %+v", summary.ServerNames)
+	}
+	if len(summary.Clients) != 2 || summary.Clients[0].Name != "10.0.0.1" || summary.Clients[0].Count != 3 || summary.Clients[1].Name != "10.0.0.2" {
+		t.Errorf("Top clients are %+v", summary.Clients)
+	}
+	if len(summary.Protocols) != 2 || summary.Protocols[0].Name != "TLS/SSL" || summary.Protocols[0].Count != 4 {
+		t.Errorf("Protocols are %+v", summary.Protocols)
+	}
+	if len(summary.NewServerNames) != 1 || summary.NewServerNames[0].Name != "new.example.com" || summary.NewServerNames[0].Count != 2 {
+		t.Fatalf("New server names are %+v", summary.NewServerNames)
+	}
+	// SQLite computes the first time a server name was seen to the millisecond
+	if offset := summary.NewServerNames[0].FirstSeen.Sub(destinations[2].Timestamp); offset < -time.Millisecond || offset > time.Millisecond {
+		t.Errorf("New server name was first seen at %s instead of %s", summary.NewServerNames[0].FirstSeen, destinations[2].Timestamp)
+	}
+
+	recorder = httptest.NewRecorder()
+	api.serveSummary(recorder, httptest.NewRequest("GET", "/api/summary?baseline=1h", nil))
+	summary = &apiSummaryResponse{}
+	json.NewDecoder(recorder.Body).Decode(summary)
+	if len(summary.NewServerNames) != 1 {
+		t.Errorf("New server names with a short baseline are %+v", summary.NewServerNames)
+	}
+
+	recorder = httptest.NewRecorder()
+	api.serveSummary(recorder, httptest.NewRequest("GET", "/api/summary?top=0", nil))
+	if recorder.Code != http.StatusBadRequest {
+		t.Errorf("Invalid top returned %d", recorder.Code)
+	}
+}
+
+func TestDashboard(t *testing.T) {
+	server := httptest.NewServer(dashboardHandler())
+	defer server.Close()
+	for _, file := range []string{"", "dashboard.js", "dashboard.css"} {
+		response, err := http.Get(server.URL + "/dashboard/" + file)
+		if err != nil || response.StatusCode != http.StatusOK {
+			t.Fatalf("Can't get the dashboard file %q : %v", file, err)
+		}
+		body, _ := ioutil.ReadAll(response.Body)
+		response.Body.Close()
+		if file == "" && (!strings.HasPrefix(response.Header.Get("Content-Type"), "text/html") || !strings.Contains(string(body), "dashboard.js")) {
+			t.Errorf("Dashboard index isn't served : %s", body)
+		}
+	}
+}
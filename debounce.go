@@ -0,0 +1,186 @@
+package main
+
+import (
+	"container/list"
+	"fmt"
+	"github.com/julsemaan/garin/base"
+	"strings"
+	"sync"
+	"time"
+)
+
+// When the destinations seen during a debounce window are recorded
+const (
+	// The first destination is recorded right away and the others are dropped until the window ends
+	DEBOUNCE_EDGE_LEADING = "leading"
+	// The last destination is recorded once the window ends, with the time it was seen
+	DEBOUNCE_EDGE_TRAILING = "trailing"
+)
+
+// The fields of a destination that can identify it in the debounce key
+var debounceKeyFields = map[string]func(*base.Destination) string{
+	"source_ip":      func(destination *base.Destination) string { return destination.SourceIp },
+	"destination_ip": func(destination *base.Destination) string { return destination.DestinationIp },
+	"server_name":    func(destination *base.Destination) string { return destination.ServerName },
+	"protocol":       func(destination *base.Destination) string { return destination.Protocol },
+	"interface":      func(destination *base.Destination) string { return destination.Interface },
+	"tunnel": func(destination *base.Destination) string {
+		return fmt.Sprintf("%s:%d", destination.TunnelType, destination.TunnelId)
+	},
+}
+
+type debounceEntry struct {
+	key string
+	// The window starts with the first destination seen with the key
+	windowEnd time.Time
+	// Destination to record when the window ends, nil when it was already recorded
+	pending *base.Destination
+}
+
+// Deduplicator records the destinations that have the same key only once per window
+// The entries are evicted in least recently seen order once there are too many of them, their pending destination is then recorded early
+type Deduplicator struct {
+	window     time.Duration
+	edge       string
+	keyFields  []func(*base.Destination) string
+	maxEntries int
+	mutex      *sync.Mutex
+	entries    map[string]*list.Element
+	// Least recently seen entries at the back
+	recentlySeen *list.List
+	evicted      uint64
+}
+
+// NewDeduplicator creates a deduplicator whose keys are made of a comma separated list of fields, maxEntries 0 or less is infinite
+func NewDeduplicator(window time.Duration, edge string, keyFields string, maxEntries int) (*Deduplicator, error) {
+	if window <= 0 {
+		return nil, fmt.Errorf("invalid debounce window %s", window)
+	}
+	switch edge {
+	case DEBOUNCE_EDGE_LEADING, DEBOUNCE_EDGE_TRAILING:
+	default:
+		return nil, fmt.Errorf("unknown debounce edge %q", edge)
+	}
+	deduplicator := &Deduplicator{
+		window:       window,
+		edge:         edge,
+		maxEntries:   maxEntries,
+		mutex:        &sync.Mutex{},
+		entries:      make(map[string]*list.Element),
+		recentlySeen: list.New(),
+	}
+	for _, field := range splitList(keyFields) {
+		keyField, ok := debounceKeyFields[strings.ToLower(field)]
+		if !ok {
+			return nil, fmt.Errorf("unknown debounce key field %q", field)
+		}
+		deduplicator.keyFields = append(deduplicator.keyFields, keyField)
+	}
+	if len(deduplicator.keyFields) == 0 {
+		return nil, fmt.Errorf("the debounce key has no fields")
+	}
+	return deduplicator, nil
+}
+
+func (self *Deduplicator) key(destination *base.Destination) string {
+	values := make([]string, len(self.keyFields))
+	for i, keyField := range self.keyFields {
+		values[i] = keyField(destination)
+	}
+	return strings.Join(values, "|")
+}
+
+// Offer returns the destinations that must be recorded right away, which can include destinations of other keys that were evicted
+func (self *Deduplicator) Offer(destination *base.Destination, now time.Time) []*base.Destination {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+	key := self.key(destination)
+	if element := self.entries[key]; element != nil {
+		entry := element.Value.(*debounceEntry)
+		if now.Before(entry.windowEnd) {
+			self.recentlySeen.MoveToFront(element)
+			if self.edge == DEBOUNCE_EDGE_TRAILING {
+				entry.pending = destination
+			}
+			return nil
+		}
+		// The window ended but the entry wasn't expired yet, a new window starts
+		self.remove(element)
+		if entry.pending != nil {
+			return append([]*base.Destination{entry.pending}, self.add(key, destination, now)...)
+		}
+	}
+	return self.add(key, destination, now)
+}
+
+// Starts the window of a key, the mutex must be held
+func (self *Deduplicator) add(key string, destination *base.Destination, now time.Time) []*base.Destination {
+	var record []*base.Destination
+	entry := &debounceEntry{key: key, windowEnd: now.Add(self.window)}
+	if self.edge == DEBOUNCE_EDGE_TRAILING {
+		entry.pending = destination
+	} else {
+		record = append(record, destination)
+	}
+	self.entries[key] = self.recentlySeen.PushFront(entry)
+
+	for self.maxEntries > 0 && len(self.entries) > self.maxEntries {
+		evicted := self.remove(self.recentlySeen.Back())
+		self.evicted++
+		if evicted.pending != nil {
+			record = append(record, evicted.pending)
+		}
+	}
+	return record
+}
+
+func (self *Deduplicator) remove(element *list.Element) *debounceEntry {
+	entry := self.recentlySeen.Remove(element).(*debounceEntry)
+	delete(self.entries, entry.key)
+	return entry
+}
+
+// Expire ends the windows that are over and returns the destinations that must be recorded
+func (self *Deduplicator) Expire(now time.Time) []*base.Destination {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+	var record []*base.Destination
+	for _, element := range self.entries {
+		entry := element.Value.(*debounceEntry)
+		if now.Before(entry.windowEnd) {
+			continue
+		}
+		self.remove(element)
+		if entry.pending != nil {
+			record = append(record, entry.pending)
+		}
+	}
+	return record
+}
+
+// Flush ends all the windows and returns the destinations that must be recorded
+func (self *Deduplicator) Flush() []*base.Destination {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+	var record []*base.Destination
+	for element := self.recentlySeen.Back(); element != nil; element = self.recentlySeen.Back() {
+		if entry := self.remove(element); entry.pending != nil {
+			record = append(record, entry.pending)
+		}
+	}
+	return record
+}
+
+// Len returns the amount of keys whose window isn't over
+func (self *Deduplicator) Len() int {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+	return len(self.entries)
+}
+
+// Evicted returns the amount of entries that were evicted before the end of their window
+func (self *Deduplicator) Evicted() uint64 {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+	return self.evicted
+}
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func newTestDeduplicator(t *testing.T, edge string, keyFields string, maxEntries int) *Deduplicator {
+	deduplicator, err := NewDeduplicator(time.Minute, edge, keyFields, maxEntries)
+	if err != nil {
+		t.Fatalf("Can't create deduplicator : %s", err)
+	}
+	return deduplicator
+}
+
+func TestDeduplicatorLeadingEdge(t *testing.T) {
+	deduplicator := newTestDeduplicator(t, DEBOUNCE_EDGE_LEADING, "source_ip,server_name", 0)
+	now := time.Now()
+	if record := deduplicator.Offer(testDestination("example.com", "TLS/SSL", "10.0.0.1"), now); len(record) != 1 {
+		t.Errorf("First destination of the window wasn't recorded right away : %v", record)
+	}
+	if record := deduplicator.Offer(testDestination("example.com", "TLS/SSL", "10.0.0.1"), now.Add(59*time.Second)); len(record) != 0 {
+		t.Errorf("Destination was recorded inside the window : %v", record)
+	}
+	if record := deduplicator.Expire(now.Add(59 * time.Second)); len(record) != 0 || deduplicator.Len() != 1 {
+		t.Errorf("Window was expired before it was over : %v", record)
+	}
+	if record := deduplicator.Expire(now.Add(time.Minute)); len(record) != 0 || deduplicator.Len() != 0 {
+		t.Errorf("Window wasn't expired once it was over : %v", record)
+	}
+	if record := deduplicator.Offer(testDestination("example.com", "TLS/SSL", "10.0.0.1"), now.Add(time.Minute)); len(record) != 1 {
+		t.Errorf("Destination of a new window wasn't recorded : %v", record)
+	}
+}
+
+func TestDeduplicatorTrailingEdge(t *testing.T) {
+	deduplicator := newTestDeduplicator(t, DEBOUNCE_EDGE_TRAILING, "source_ip,server_name", 0)
+	now := time.Now()
+	for i := 0; i < 3; i++ {
+		if record := deduplicator.Offer(testDestination("example.com", "TLS/SSL", "10.0.0.1"), now.Add(time.Duration(i)*time.Second)); len(record) != 0 {
+			t.Errorf("Destination was recorded before the end of the window : %v", record)
+		}
+	}
+	// The interface isn't part of the key
+	other := testDestination("example.com", "TLS/SSL", "10.0.0.1")
+	other.Interface = "eth1"
+	deduplicator.Offer(other, now.Add(3*time.Second))
+	if deduplicator.Len() != 1 {
+		t.Errorf("Destinations with the same key are in %d windows", deduplicator.Len())
+	}
+
+	record := deduplicator.Expire(now.Add(time.Minute))
+	if len(record) != 1 || record[0] != other {
+		t.Errorf("Last destination of the window wasn't recorded once it was over : %v", record)
+	}
+	// A window that is over but wasn't expired yet is recorded when a new one starts
+	deduplicator.Offer(testDestination("example.com", "TLS/SSL", "10.0.0.1"), now)
+	if record := deduplicator.Offer(testDestination("example.com", "TLS/SSL", "10.0.0.1"), now.Add(2*time.Minute)); len(record) != 1 || deduplicator.Len() != 1 {
+		t.Errorf("Window that was over wasn't recorded : %v", record)
+	}
+}
+
+func TestDeduplicatorEvictsLeastRecentlySeen(t *testing.T) {
+	deduplicator := newTestDeduplicator(t, DEBOUNCE_EDGE_TRAILING, "server_name", 2)
+	now := time.Now()
+	first := testDestination("1.example.com", "TLS/SSL", "10.0.0.1")
+	deduplicator.Offer(first, now)
+	deduplicator.Offer(testDestination("2.example.com", "TLS/SSL", "10.0.0.1"), now)
+	// Seeing the first one again makes the second one the least recently seen
+	deduplicator.Offer(first, now)
+	record := deduplicator.Offer(testDestination("3.example.com", "TLS/SSL", "10.0.0.1"), now)
+	if len(record) != 1 || record[0].ServerName != "2.example.com" || deduplicator.Len() != 2 || deduplicator.Evicted() != 1 {
+		t.Errorf("Least recently seen destination wasn't evicted : %v", record)
+	}
+
+	record = deduplicator.Flush()
+	if len(record) != 2 || deduplicator.Len() != 0 {
+		t.Errorf("Pending destinations weren't flushed : %v", record)
+	}
+}
+
+func TestDeduplicatorInvalid(t *testing.T) {
+	if _, err := NewDeduplicator(time.Minute, "middle", "server_name", 0); err == nil {
+		t.Errorf("Unknown edge was accepted")
+	}
+	if _, err := NewDeduplicator(time.Minute, DEBOUNCE_EDGE_LEADING, "server_name,port", 0); err == nil {
+		t.Errorf("Unknown key field was accepted")
+	}
+	if _, err := NewDeduplicator(time.Minute, DEBOUNCE_EDGE_LEADING, "", 0); err == nil {
+		t.Errorf("Empty key was accepted")
+	}
+}
@@ -2,10 +2,14 @@ package main
 
 import (
 	"bytes"
+	"crypto/md5"
 	"crypto/x509"
 	"encoding/hex"
+	"fmt"
 	"github.com/julsemaan/garin/base"
 	"github.com/julsemaan/garin/util"
+	"strconv"
+	"strings"
 )
 
 type TLSPacket struct {
@@ -15,6 +19,8 @@ type TLSPacket struct {
 	handshakeType uint8
 
 	serverName string
+	// JA3 fingerprint of the client hello
+	fingerprint string
 }
 
 type TLSExchange struct {
@@ -23,7 +29,12 @@ type TLSExchange struct {
 
 type TLSClientHello struct {
 	TLSExchange
-	sessionId string
+	sessionId                 string
+	clientVersion             uint16
+	cipherSuites              []uint16
+	extensions                []uint16
+	ellipticCurves            []uint16
+	ellipticCurvePointFormats []uint16
 }
 
 type TLSServerHello struct {
@@ -100,7 +111,11 @@ func (self *TLSClientHello) Parse(tlsPacket *TLSPacket, buf *bytes.Buffer) {
 		return
 	}
 
-	readTLSHeader(buf)
+	// 3 bytes length, then the version of the client
+	buf.Next(3)
+	self.clientVersion = util.ReadBigEndian16(buf)
+	// 4 bytes timestamp, 28 random bytes
+	buf.Next(4 + 28)
 
 	// Read session ID if there
 	sessionIdLength := util.ReadUint8(buf)
@@ -108,34 +123,80 @@ func (self *TLSClientHello) Parse(tlsPacket *TLSPacket, buf *bytes.Buffer) {
 
 	// Read ciphers suites
 	cipherSuitesLength := util.ReadBigEndian16(buf)
-	buf.Next(int(cipherSuitesLength))
+	self.cipherSuites = readUint16List(bytes.NewBuffer(buf.Next(int(cipherSuitesLength))))
 
 	// Read compression methods
 	compressionMethodsLength := util.ReadUint8(buf)
 	buf.Next(int(compressionMethodsLength))
 
 	extensionsLength := int(util.ReadBigEndian16(buf))
-	if extensionsLength > 0 {
-		i := 0
-		for i < extensionsLength {
-			extensionType := util.ReadBigEndian16(buf)
-			extensionLength := util.ReadBigEndian16(buf)
-
-			// if its the server name, then we analyse. Otherwise, we skip the extension
-			if extensionType == 0 {
-				// list length (2 bytes), server name type 1 byte, length 2 bytes
-				buf.Next(3)
-				serverNameLength := util.ReadBigEndian16(buf)
-				self.serverName = string(buf.Next(int(serverNameLength)))
-				break
-			} else {
-				buf.Next(int(extensionLength))
+	i := 0
+	for i < extensionsLength && buf.Len() >= 4 {
+		extensionType := util.ReadBigEndian16(buf)
+		extensionLength := util.ReadBigEndian16(buf)
+		extension := bytes.NewBuffer(buf.Next(int(extensionLength)))
+		self.extensions = append(self.extensions, extensionType)
+
+		switch extensionType {
+		case 0:
+			// Server name : list length (2 bytes), server name type 1 byte, length 2 bytes
+			extension.Next(3)
+			serverNameLength := util.ReadBigEndian16(extension)
+			self.serverName = string(extension.Next(int(serverNameLength)))
+		case 10:
+			// Supported groups : list length (2 bytes) then the groups
+			extension.Next(2)
+			self.ellipticCurves = readUint16List(extension)
+		case 11:
+			// EC point formats : list length (1 byte) then the formats
+			extension.Next(1)
+			for extension.Len() > 0 {
+				self.ellipticCurvePointFormats = append(self.ellipticCurvePointFormats, uint16(util.ReadUint8(extension)))
 			}
+		}
+
+		// length + the extension type + extension length
+		i += int(extensionLength + 4)
+	}
+}
 
-			// length + the extension type + extension length
-			i += int(extensionLength + 4)
+func readUint16List(buf *bytes.Buffer) []uint16 {
+	var values []uint16
+	for buf.Len() >= 2 {
+		values = append(values, util.ReadBigEndian16(buf))
+	}
+	return values
+}
+
+// GREASE values (RFC 8701) are random and are left out of the fingerprints
+func isGREASE(value uint16) bool {
+	return value&0x0f0f == 0x0a0a && value>>8 == value&0xff
+}
+
+func joinJA3Values(values []uint16) string {
+	var joined []string
+	for _, value := range values {
+		if !isGREASE(value) {
+			joined = append(joined, strconv.Itoa(int(value)))
 		}
 	}
+	return strings.Join(joined, "-")
+}
+
+// JA3String returns the fields of the client hello that identify the TLS client : version, ciphers, extensions, elliptic curves and point formats
+func (self *TLSClientHello) JA3String() string {
+	return strings.Join([]string{
+		strconv.Itoa(int(self.clientVersion)),
+		joinJA3Values(self.cipherSuites),
+		joinJA3Values(self.extensions),
+		joinJA3Values(self.ellipticCurves),
+		joinJA3Values(self.ellipticCurvePointFormats),
+	}, ",")
+}
+
+// JA3 returns the JA3 fingerprint of the client hello, the MD5 of its JA3 string
+func (self *TLSClientHello) JA3() string {
+	return fmt.Sprintf("%x", md5.Sum([]byte(self.JA3String())))
 }
 
 func (self *TLSServerCertExchange) Parse(tlsPacket *TLSPacket, buf *bytes.Buffer) {
@@ -163,6 +224,9 @@ func (self *TLSPacket) Parse(buf *bytes.Buffer) {
 		client_hello.Parse(self, buf)
 		//spew.Dump(hello)
 		self.serverName = client_hello.serverName
+		if self.isTLS() {
+			self.fingerprint = client_hello.JA3()
+		}
 	} else if self.handshakeType == 2 {
 		Logger().Debug("Found server hello")
 		// We read the whole server hello but not doing anything with it yet
@@ -198,7 +262,9 @@ func ParseHTTPS(packet *util.Packet) *base.Destination {
 	tlsPacket := &TLSPacket{}
 	tlsPacket.Parse(buf)
 	if tlsPacket.serverName != "" {
-		return base.NewDestination(tlsPacket.serverName, packet.Hosts.Src().String(), packet.Hosts.Dst().String())
+		destination := base.NewDestination(tlsPacket.serverName, packet.Hosts.Src().String(), packet.Hosts.Dst().String())
+		destination.TLSFingerprint = tlsPacket.fingerprint
+		return destination
 	}
 	return nil
 }
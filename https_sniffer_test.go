@@ -0,0 +1,96 @@
+package main
+
+import (
+	"bytes"
+	"crypto/md5"
+	"crypto/tls"
+	"encoding/binary"
+	"fmt"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+func appendUint16(data []byte, values ...uint16) []byte {
+	for _, value := range values {
+		data = binary.BigEndian.AppendUint16(data, value)
+	}
+	return data
+}
+
+func appendTLSExtension(data []byte, extensionType uint16, extension []byte) []byte {
+	data = appendUint16(data, extensionType, uint16(len(extension)))
+	return append(data, extension...)
+}
+
+// Builds a client hello with GREASE values in the ciphers, the extensions and the groups
+func testClientHello(serverName string) []byte {
+	hello := appendUint16(nil, 0x0303)
+	hello = append(hello, make([]byte, 32)...)
+	// No session ID
+	hello = append(hello, 0)
+	hello = appendUint16(hello, 6, 0x0a0a, 0x1301, 0xc02f)
+	// Null compression
+	hello = append(hello, 1, 0)
+
+	var extensions []byte
+	extensions = appendTLSExtension(extensions, 0x0a0a, nil)
+	sni := appendUint16(nil, uint16(len(serverName)+3))
+	sni = append(sni, 0)
+	sni = appendUint16(sni, uint16(len(serverName)))
+	extensions = appendTLSExtension(extensions, 0, append(sni, serverName...))
+	extensions = appendTLSExtension(extensions, 10, appendUint16(nil, 6, 0x2a2a, 29, 23))
+	extensions = appendTLSExtension(extensions, 11, []byte{1, 0})
+	extensions = appendTLSExtension(extensions, 23, nil)
+	hello = appendUint16(hello, uint16(len(extensions)))
+	hello = append(hello, extensions...)
+
+	handshake := []byte{1, 0, byte(len(hello) >> 8), byte(len(hello))}
+	handshake = append(handshake, hello...)
+	record := []byte{22, 3, 1}
+	record = appendUint16(record, uint16(len(handshake)))
+	return append(record, handshake...)
+}
+
+func TestClientHelloJA3(t *testing.T) {
+	tlsPacket := &TLSPacket{}
+	tlsPacket.Parse(bytes.NewBuffer(testClientHello("example.com")))
+	if tlsPacket.serverName != "example.com" {
+		t.Errorf("Server name is %q instead of example.com", tlsPacket.serverName)
+	}
+	expected := fmt.Sprintf("%x", md5.Sum([]byte("771,4865-49199,0-10-11-23,29-23,0")))
+	if tlsPacket.fingerprint != expected {
+		t.Errorf("JA3 fingerprint is %s instead of %s", tlsPacket.fingerprint, expected)
+	}
+}
+
+// The client hello of the Go TLS client has the server name after other extensions
+func TestClientHelloGoClient(t *testing.T) {
+	client, server := net.Pipe()
+	defer server.Close()
+	go func() {
+		conn := tls.Client(client, &tls.Config{ServerName: "garin.example.com"})
+		conn.SetDeadline(time.Now().Add(5 * time.Second))
+		conn.Handshake()
+		client.Close()
+	}()
+	hello := make([]byte, 4096)
+	server.SetReadDeadline(time.Now().Add(5 * time.Second))
+	n, err := server.Read(hello)
+	if err != nil {
+		t.Fatalf("Can't read the client hello : %s", err)
+	}
+
+	tlsPacket := &TLSPacket{}
+	tlsPacket.Parse(bytes.NewBuffer(hello[:n]))
+	if tlsPacket.serverName != "garin.example.com" {
+		t.Errorf("Server name is %q instead of garin.example.com", tlsPacket.serverName)
+	}
+	clientHello := &TLSClientHello{}
+	buf := bytes.NewBuffer(hello[6:n])
+	clientHello.Parse(&TLSPacket{tlsVersion: 0x301}, buf)
+	if ja3 := clientHello.JA3String(); !strings.HasPrefix(ja3, "771,") || strings.Count(ja3, ",") != 4 {
+		t.Errorf("Invalid JA3 string %q", ja3)
+	}
+}
@@ -0,0 +1,264 @@
+package main
+
+import (
+	"bytes"
+	"container/list"
+	"encoding/binary"
+	"errors"
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"time"
+)
+
+// Maximum size of a reassembled IP payload
+const MAX_REASSEMBLED_SIZE = 65535
+
+// ipv6FragmentLayer decodes the IPv6 fragment header. gopacket only offers it as a gopacket.Decoder so it can't be used in a DecodingLayerParser.
+// It must be added to the parser after the IPv6ExtensionSkipper so it is the one used for the fragment headers.
+type ipv6FragmentLayer struct {
+	layers.IPv6Fragment
+}
+
+func (self *ipv6FragmentLayer) CanDecode() gopacket.LayerClass {
+	return layers.LayerTypeIPv6Fragment
+}
+
+// The payload of a fragment can't be decoded until the packet is reassembled
+func (self *ipv6FragmentLayer) NextLayerType() gopacket.LayerType {
+	return gopacket.LayerTypeFragment
+}
+
+func (self *ipv6FragmentLayer) DecodeFromBytes(data []byte, df gopacket.DecodeFeedback) error {
+	if len(data) < 8 {
+		df.SetTruncated()
+		return errors.New("IPv6 fragment header too short")
+	}
+	self.NextHeader = layers.IPProtocol(data[0])
+	self.Reserved1 = data[1]
+	self.FragmentOffset = binary.BigEndian.Uint16(data[2:4]) >> 3
+	self.Reserved2 = data[3] & 0x6 >> 1
+	self.MoreFragments = data[3]&0x1 != 0
+	self.Identification = binary.BigEndian.Uint32(data[4:8])
+	self.BaseLayer = layers.BaseLayer{Contents: data[:8], Payload: data[8:]}
+	return nil
+}
+
+// Identifies the fragments of the same packet
+// The tunnel is part of it so the packets of different mirrored networks don't get mixed together
+type fragmentKey struct {
+	netFlow gopacket.Flow
+	id      uint32
+	// Only set for IPv4, IPv6 uses the protocol of the first fragment
+	protocol layers.IPProtocol
+	tunnel   Tunnel
+}
+
+type fragment struct {
+	offset int
+	data   []byte
+}
+
+func (self *fragment) end() int {
+	return self.offset + len(self.data)
+}
+
+// A packet for which fragments were received
+type fragmentedPacket struct {
+	key       fragmentKey
+	firstSeen time.Time
+	// Sorted by offset
+	fragments []fragment
+	// Known once the last fragment is received
+	size     int
+	protocol layers.IPProtocol
+	element  *list.Element
+}
+
+// Adds a fragment to the packet
+// Fragments that overlap must have the same content where they overlap, otherwise the packet can't be reassembled reliably and an error is returned
+func (self *fragmentedPacket) add(offset int, data []byte, last bool) error {
+	end := offset + len(data)
+	if end > MAX_REASSEMBLED_SIZE {
+		return errors.New("reassembled packet would be too big")
+	}
+	if last {
+		if self.size != 0 && self.size != end {
+			return errors.New("conflicting last fragments")
+		}
+		self.size = end
+	}
+	if self.size != 0 && end > self.size {
+		return errors.New("fragment goes past the end of the packet")
+	}
+
+	position := len(self.fragments)
+	for i := range self.fragments {
+		existing := &self.fragments[i]
+		if existing.offset > offset && position == len(self.fragments) {
+			position = i
+		}
+		overlapStart, overlapEnd := offset, end
+		if existing.offset > overlapStart {
+			overlapStart = existing.offset
+		}
+		if existing.end() < overlapEnd {
+			overlapEnd = existing.end()
+		}
+		if overlapStart >= overlapEnd {
+			continue
+		}
+		if !bytes.Equal(data[overlapStart-offset:overlapEnd-offset], existing.data[overlapStart-existing.offset:overlapEnd-existing.offset]) {
+			return errors.New("overlapping fragments with different content")
+		}
+		if overlapStart == offset && overlapEnd == end {
+			// Retransmitted fragment, everything is already there
+			return nil
+		}
+	}
+
+	// The capture buffer is reused for the next packet so the data has to be copied
+	self.fragments = append(self.fragments, fragment{})
+	copy(self.fragments[position+1:], self.fragments[position:])
+	self.fragments[position] = fragment{offset: offset, data: append([]byte(nil), data...)}
+	return nil
+}
+
+// Returns the reassembled payload if all the fragments were received
+func (self *fragmentedPacket) reassemble() []byte {
+	if self.size == 0 {
+		return nil
+	}
+	covered := 0
+	for i := range self.fragments {
+		if self.fragments[i].offset > covered {
+			return nil
+		}
+		if self.fragments[i].end() > covered {
+			covered = self.fragments[i].end()
+		}
+	}
+	if covered != self.size {
+		return nil
+	}
+
+	payload := make([]byte, self.size)
+	for _, fragment := range self.fragments {
+		copy(payload[fragment.offset:], fragment.data)
+	}
+	return payload
+}
+
+// IPDefragmenter reassembles fragmented IPv4 and IPv6 packets
+// It isn't safe for concurrent use, each capture has its own
+type IPDefragmenter struct {
+	// Time after which the fragments of an incomplete packet are discarded
+	Timeout time.Duration
+	// Maximum amount of packets being reassembled, the oldest one is discarded when it is reached
+	MaxPackets int
+	// Maximum amount of fragments of a packet, it is discarded if it has more
+	MaxFragments int
+
+	// Counters of the packets reassembled and discarded since the creation of the defragmenter
+	Reassembled uint64
+	Discarded   uint64
+
+	packets map[fragmentKey]*fragmentedPacket
+	// The packets from the oldest to the newest
+	order *list.List
+}
+
+func NewIPDefragmenter(timeout time.Duration, maxPackets int, maxFragments int) *IPDefragmenter {
+	return &IPDefragmenter{
+		Timeout:      timeout,
+		MaxPackets:   maxPackets,
+		MaxFragments: maxFragments,
+		packets:      make(map[fragmentKey]*fragmentedPacket),
+		order:        list.New(),
+	}
+}
+
+// Pending returns the amount of packets that are waiting for fragments
+func (self *IPDefragmenter) Pending() int {
+	return len(self.packets)
+}
+
+// DefragmentIPv4 adds an IPv4 fragment and returns the reassembled payload along with its protocol when the packet is complete
+func (self *IPDefragmenter) DefragmentIPv4(ip4 *layers.IPv4, tunnel Tunnel, timestamp time.Time) ([]byte, layers.IPProtocol) {
+	key := fragmentKey{netFlow: ip4.NetworkFlow(), id: uint32(ip4.Id), protocol: ip4.Protocol, tunnel: tunnel}
+	last := ip4.Flags&layers.IPv4MoreFragments == 0
+	return self.defragment(key, int(ip4.FragOffset)*8, ip4.Payload, last, ip4.Protocol, timestamp)
+}
+
+// DefragmentIPv6 adds an IPv6 fragment and returns the reassembled payload along with its protocol when the packet is complete
+func (self *IPDefragmenter) DefragmentIPv6(ip6 *layers.IPv6, fragmentHeader *layers.IPv6Fragment, tunnel Tunnel, timestamp time.Time) ([]byte, layers.IPProtocol) {
+	// Atomic fragments are complete packets (RFC 6946)
+	if fragmentHeader.FragmentOffset == 0 && !fragmentHeader.MoreFragments {
+		return fragmentHeader.Payload, fragmentHeader.NextHeader
+	}
+	key := fragmentKey{netFlow: ip6.NetworkFlow(), id: fragmentHeader.Identification, tunnel: tunnel}
+	return self.defragment(key, int(fragmentHeader.FragmentOffset)*8, fragmentHeader.Payload, !fragmentHeader.MoreFragments, fragmentHeader.NextHeader, timestamp)
+}
+
+// The protocol of the reassembled payload is the one of the first fragment
+func (self *IPDefragmenter) defragment(key fragmentKey, offset int, data []byte, last bool, protocol layers.IPProtocol, timestamp time.Time) ([]byte, layers.IPProtocol) {
+	self.discardOlderThan(timestamp.Add(-self.Timeout))
+
+	// All the fragments but the last one carry a multiple of 8 bytes
+	if !last && len(data)%8 != 0 {
+		Logger().Debugf("ignoring fragment of %d bytes which isn't a multiple of 8", len(data))
+		return nil, 0
+	}
+
+	packet, ok := self.packets[key]
+	if !ok {
+		if self.MaxPackets > 0 && len(self.packets) >= self.MaxPackets {
+			Logger().Debugf("too many packets being reassembled, discarding the oldest one")
+			self.discard(self.order.Front().Value.(*fragmentedPacket))
+		}
+		packet = &fragmentedPacket{key: key, firstSeen: timestamp}
+		packet.element = self.order.PushBack(packet)
+		self.packets[key] = packet
+	}
+
+	if err := packet.add(offset, data, last); err != nil {
+		Logger().Debugf("discarding fragmented packet %s: %s", key.netFlow, err)
+		self.discard(packet)
+		return nil, 0
+	}
+	if offset == 0 {
+		packet.protocol = protocol
+	}
+	if self.MaxFragments > 0 && len(packet.fragments) > self.MaxFragments {
+		Logger().Debugf("discarding fragmented packet %s which has more than %d fragments", key.netFlow, self.MaxFragments)
+		self.discard(packet)
+		return nil, 0
+	}
+
+	payload := packet.reassemble()
+	if payload != nil {
+		self.remove(packet)
+		self.Reassembled++
+	}
+	return payload, packet.protocol
+}
+
+func (self *IPDefragmenter) discardOlderThan(limit time.Time) {
+	for element := self.order.Front(); element != nil; element = self.order.Front() {
+		packet := element.Value.(*fragmentedPacket)
+		if !packet.firstSeen.Before(limit) {
+			return
+		}
+		Logger().Debugf("discarding fragmented packet %s that wasn't completed in %s", packet.key.netFlow, self.Timeout)
+		self.discard(packet)
+	}
+}
+
+func (self *IPDefragmenter) discard(packet *fragmentedPacket) {
+	self.remove(packet)
+	self.Discarded++
+}
+
+func (self *IPDefragmenter) remove(packet *fragmentedPacket) {
+	self.order.Remove(packet.element)
+	delete(self.packets, packet.key)
+}
@@ -0,0 +1,178 @@
+package main
+
+import (
+	"bytes"
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"net"
+	"testing"
+	"time"
+)
+
+// A TCP segment big enough to be split in several fragments
+func testTCPSegment(t *testing.T) []byte {
+	payload := make([]byte, 100)
+	for i := range payload {
+		payload[i] = byte(i)
+	}
+	return serializeTestPacket(t, &layers.TCP{SrcPort: 51000, DstPort: 443, PSH: true, ACK: true}, gopacket.Payload(payload))
+}
+
+// Splits the payload in fragments of 40 bytes and builds the ethernet frame of each one of them
+func testIPv4Fragments(t *testing.T, id uint16, payload []byte) [][]byte {
+	var frames [][]byte
+	for offset := 0; offset < len(payload); offset += 40 {
+		end := offset + 40
+		ip4 := testIPv4("10.0.0.1", "10.0.0.2", layers.IPProtocolTCP)
+		ip4.Id = id
+		ip4.FragOffset = uint16(offset / 8)
+		if end < len(payload) {
+			ip4.Flags = layers.IPv4MoreFragments
+		} else {
+			end = len(payload)
+		}
+		frames = append(frames, serializeTestPacket(t, testEthernet(layers.EthernetTypeIPv4), ip4, gopacket.Payload(payload[offset:end])))
+	}
+	return frames
+}
+
+func testIPv6Fragments(t *testing.T, id uint32, payload []byte) [][]byte {
+	var frames [][]byte
+	for offset := 0; offset < len(payload); offset += 40 {
+		end := offset + 40
+		more := byte(1)
+		if end >= len(payload) {
+			end = len(payload)
+			more = 0
+		}
+		ip6 := &layers.IPv6{Version: 6, HopLimit: 64, NextHeader: layers.IPProtocolIPv6Fragment, SrcIP: net.ParseIP("fd00::1"), DstIP: net.ParseIP("fd00::2")}
+		fragmentHeader := gopacket.Payload{byte(layers.IPProtocolTCP), 0, byte(offset >> 8), byte(offset) | more, byte(id >> 24), byte(id >> 16), byte(id >> 8), byte(id)}
+		frames = append(frames, serializeTestPacket(t, testEthernet(layers.EthernetTypeIPv6), ip6, fragmentHeader, gopacket.Payload(payload[offset:end])))
+	}
+	return frames
+}
+
+func testDefragDecoder() *PacketDecoder {
+	decoder, _ := NewPacketDecoder(layers.LinkTypeEthernet)
+	decoder.Defragmenter = NewIPDefragmenter(30*time.Second, 16, 8)
+	return decoder
+}
+
+// Decodes the frames in order and checks that only the last one completes the TCP segment
+func assertReassembled(t *testing.T, decoder *PacketDecoder, frames [][]byte, expectedSrc string) {
+	now := time.Now()
+	for i, frame := range frames {
+		found, err := decoder.Decode(frame, now)
+		if err != nil {
+			t.Fatalf("Error while decoding fragment %d: %s", i, err)
+		}
+		if found != (i == len(frames)-1) {
+			t.Fatalf("TCP layer found = %v after fragment %d of %d", found, i+1, len(frames))
+		}
+	}
+	if decoder.NetFlow.Src().String() != expectedSrc {
+		t.Errorf("Network flow isn't the one of the fragmented packet : %s", decoder.NetFlow)
+	}
+	if decoder.TCP.DstPort != 443 || len(decoder.TCP.Payload) != 100 || decoder.TCP.Payload[99] != 99 {
+		t.Errorf("TCP segment wasn't reassembled correctly, port %d with %d bytes of payload", decoder.TCP.DstPort, len(decoder.TCP.Payload))
+	}
+	if decoder.Defragmenter.Pending() != 0 {
+		t.Errorf("%d packets are still pending after the reassembly", decoder.Defragmenter.Pending())
+	}
+}
+
+func TestDefragIPv4(t *testing.T) {
+	frames := testIPv4Fragments(t, 1, testTCPSegment(t))
+	assertReassembled(t, testDefragDecoder(), frames, "10.0.0.1")
+
+	// Out of order with a retransmitted fragment
+	outOfOrder := [][]byte{frames[2], frames[0], frames[0], frames[1]}
+	assertReassembled(t, testDefragDecoder(), outOfOrder, "10.0.0.1")
+}
+
+func TestDefragIPv6(t *testing.T) {
+	frames := testIPv6Fragments(t, 0x01020304, testTCPSegment(t))
+	assertReassembled(t, testDefragDecoder(), frames, "fd00::1")
+}
+
+func TestDefragTunnelled(t *testing.T) {
+	// The outer VXLAN packet is fragmented
+	inner := serializeTestPacket(t, append(testInnerFrame(), gopacket.Payload(bytes.Repeat([]byte{0xff}, 100)))...)
+	vxlan := serializeTestPacket(t, &layers.UDP{SrcPort: 40000, DstPort: 4789}, &layers.VXLAN{ValidIDFlag: true, VNI: 42}, gopacket.Payload(inner))
+
+	var frames [][]byte
+	for offset := 0; offset < len(vxlan); offset += 80 {
+		end := offset + 80
+		ip4 := testIPv4("192.168.0.1", "192.168.0.2", layers.IPProtocolUDP)
+		ip4.FragOffset = uint16(offset / 8)
+		if end < len(vxlan) {
+			ip4.Flags = layers.IPv4MoreFragments
+		} else {
+			end = len(vxlan)
+		}
+		frames = append(frames, serializeTestPacket(t, testEthernet(layers.EthernetTypeIPv4), ip4, gopacket.Payload(vxlan[offset:end])))
+	}
+
+	decoder := testDefragDecoder()
+	var found bool
+	for _, frame := range frames {
+		found, _ = decoder.Decode(frame, time.Now())
+	}
+	if !found {
+		t.Fatalf("TCP layer wasn't found in the reassembled tunnel packet")
+	}
+	if decoder.NetFlow.Src().String() != "10.0.0.1" || decoder.Tunnel != (Tunnel{Type: TUNNEL_TYPE_VXLAN, Id: 42}) {
+		t.Errorf("Inner packet wasn't decoded : %s in %+v", decoder.NetFlow, decoder.Tunnel)
+	}
+}
+
+func TestDefragConflictingOverlap(t *testing.T) {
+	segment := testTCPSegment(t)
+	frames := testIPv4Fragments(t, 1, segment)
+
+	altered := append([]byte(nil), segment...)
+	altered[45] = 0xff
+	conflicting := testIPv4Fragments(t, 1, altered)
+
+	decoder := testDefragDecoder()
+	for _, frame := range [][]byte{frames[0], frames[1], conflicting[1], frames[2]} {
+		if found, _ := decoder.Decode(frame, time.Now()); found {
+			t.Fatalf("Packet with conflicting overlapping fragments was reassembled")
+		}
+	}
+	if decoder.Defragmenter.Discarded != 1 {
+		t.Errorf("%d packets were discarded instead of 1", decoder.Defragmenter.Discarded)
+	}
+}
+
+func TestDefragLimits(t *testing.T) {
+	frames := testIPv4Fragments(t, 1, testTCPSegment(t))
+
+	// Incomplete packets expire
+	decoder := testDefragDecoder()
+	start := time.Now()
+	decoder.Decode(frames[0], start)
+	decoder.Decode(frames[1], start)
+	if found, _ := decoder.Decode(frames[2], start.Add(time.Minute)); found {
+		t.Errorf("Packet was reassembled with expired fragments")
+	}
+
+	// The oldest packets are discarded when too many are pending
+	decoder = testDefragDecoder()
+	decoder.Defragmenter.MaxPackets = 2
+	for id := uint16(1); id <= 3; id++ {
+		decoder.Decode(testIPv4Fragments(t, id, testTCPSegment(t))[0], start)
+	}
+	if decoder.Defragmenter.Pending() != 2 || decoder.Defragmenter.Discarded != 1 {
+		t.Errorf("%d packets are pending and %d were discarded instead of 2 and 1", decoder.Defragmenter.Pending(), decoder.Defragmenter.Discarded)
+	}
+
+	// Packets with too many fragments are discarded
+	decoder = testDefragDecoder()
+	decoder.Defragmenter.MaxFragments = 2
+	for _, frame := range frames {
+		if found, _ := decoder.Decode(frame, start); found {
+			t.Errorf("Packet with too many fragments was reassembled")
+		}
+	}
+}
@@ -0,0 +1,148 @@
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+)
+
+// Link types that gopacket doesn't know about
+const (
+	// DLT_LINUX_SLL2 is 276 but gopacket's LinkType is a uint8 so pcap hands it to us truncated
+	// 20 isn't assigned to any other link type so there is no ambiguity
+	LinkTypeLinuxSLL2 layers.LinkType = 276 & 0xff
+)
+
+var LayerTypeLinuxSLL2 = gopacket.RegisterLayerType(1001, gopacket.LayerTypeMetadata{Name: "LinuxSLL2", Decoder: gopacket.DecodeFunc(decodeLinuxSLL2)})
+var LayerTypeRawIP = gopacket.RegisterLayerType(1002, gopacket.LayerTypeMetadata{Name: "RawIP", Decoder: gopacket.DecodeFunc(decodeRawIP)})
+
+// FirstLayerType gives the layer with which the packets of a link type start
+func FirstLayerType(linkType layers.LinkType) (gopacket.LayerType, error) {
+	switch linkType {
+	case layers.LinkTypeEthernet:
+		return layers.LayerTypeEthernet, nil
+	case layers.LinkTypeLinuxSLL:
+		return layers.LayerTypeLinuxSLL, nil
+	case LinkTypeLinuxSLL2:
+		return LayerTypeLinuxSLL2, nil
+	case layers.LinkTypeRaw:
+		return LayerTypeRawIP, nil
+	case layers.LinkTypeIPv4:
+		return layers.LayerTypeIPv4, nil
+	case layers.LinkTypeIPv6:
+		return layers.LayerTypeIPv6, nil
+	case layers.LinkTypeNull, layers.LinkTypeLoop:
+		return layers.LayerTypeLoopback, nil
+	case layers.LinkTypeIEEE80211Radio:
+		return layers.LayerTypeRadioTap, nil
+	case layers.LinkTypeIEEE802_11:
+		return layers.LayerTypeDot11, nil
+	default:
+		return gopacket.LayerTypeZero, fmt.Errorf("unsupported link type %s (%d)", linkType, linkType)
+	}
+}
+
+// LinuxSLL2 is the Linux cooked capture v2 header used when capturing on the "any" interface with recent versions of libpcap
+//
+//	+---------------------------+
+//	|      Protocol type        |
+//	|         (2 Octets)        |
+//	+---------------------------+
+//	|       Reserved (MBZ)      |
+//	|         (2 Octets)        |
+//	+---------------------------+
+//	|       Interface index     |
+//	|         (4 Octets)        |
+//	+---------------------------+
+//	|        ARPHRD_ type       |
+//	|         (2 Octets)        |
+//	+---------------------------+
+//	|        Packet type        |
+//	|         (1 Octet)         |
+//	+---------------------------+
+//	| Link-layer address length |
+//	|         (1 Octets)        |
+//	+---------------------------+
+//	|    Link-layer address     |
+//	|         (8 Octets)        |
+//	+---------------------------+
+type LinuxSLL2 struct {
+	layers.BaseLayer
+	EthernetType   layers.EthernetType
+	InterfaceIndex uint32
+	AddrType       uint16
+	PacketType     layers.LinuxSLLPacketType
+	AddrLen        uint8
+	Addr           []byte
+}
+
+func (self *LinuxSLL2) LayerType() gopacket.LayerType { return LayerTypeLinuxSLL2 }
+
+func (self *LinuxSLL2) CanDecode() gopacket.LayerClass { return LayerTypeLinuxSLL2 }
+
+func (self *LinuxSLL2) NextLayerType() gopacket.LayerType { return self.EthernetType.LayerType() }
+
+func (self *LinuxSLL2) DecodeFromBytes(data []byte, df gopacket.DecodeFeedback) error {
+	if len(data) < 20 {
+		df.SetTruncated()
+		return errors.New("Linux SLL2 packet too small")
+	}
+	self.EthernetType = layers.EthernetType(binary.BigEndian.Uint16(data[0:2]))
+	self.InterfaceIndex = binary.BigEndian.Uint32(data[4:8])
+	self.AddrType = binary.BigEndian.Uint16(data[8:10])
+	self.PacketType = layers.LinuxSLLPacketType(data[10])
+	self.AddrLen = data[11]
+	addrLen := int(self.AddrLen)
+	if addrLen > 8 {
+		addrLen = 8
+	}
+	self.Addr = data[12 : 12+addrLen]
+	self.BaseLayer = layers.BaseLayer{Contents: data[:20], Payload: data[20:]}
+	return nil
+}
+
+func decodeLinuxSLL2(data []byte, p gopacket.PacketBuilder) error {
+	sll := &LinuxSLL2{}
+	if err := sll.DecodeFromBytes(data, p); err != nil {
+		return err
+	}
+	p.AddLayer(sll)
+	return p.NextDecoder(sll.NextLayerType())
+}
+
+// RawIP is an empty layer for the link types that carry IP packets without any header (ex: tun and wireguard interfaces)
+// It only dispatches to IPv4 or IPv6 depending on the version of the packet
+type RawIP struct {
+	layers.BaseLayer
+}
+
+func (self *RawIP) LayerType() gopacket.LayerType { return LayerTypeRawIP }
+
+func (self *RawIP) CanDecode() gopacket.LayerClass { return LayerTypeRawIP }
+
+func (self *RawIP) NextLayerType() gopacket.LayerType {
+	if len(self.Payload) == 0 {
+		return gopacket.LayerTypeZero
+	}
+	switch self.Payload[0] >> 4 {
+	case 4:
+		return layers.LayerTypeIPv4
+	case 6:
+		return layers.LayerTypeIPv6
+	default:
+		return gopacket.LayerTypeZero
+	}
+}
+
+func (self *RawIP) DecodeFromBytes(data []byte, df gopacket.DecodeFeedback) error {
+	self.BaseLayer = layers.BaseLayer{Contents: data[:0], Payload: data}
+	return nil
+}
+
+func decodeRawIP(data []byte, p gopacket.PacketBuilder) error {
+	raw := &RawIP{}
+	raw.DecodeFromBytes(data, p)
+	return p.NextDecoder(raw.NextLayerType())
+}
@@ -0,0 +1,189 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/gorilla/websocket"
+	"github.com/julsemaan/garin/base"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	// Destinations buffered for each client of the live feed, the ones that don't fit are dropped
+	LIVE_BUFFER_SIZE = 1024
+	// A client that doesn't read what is sent to it for this long is disconnected
+	LIVE_WRITE_TIMEOUT = 10 * time.Second
+	// Sent when there is nothing else so the proxies don't close the idle connections
+	LIVE_KEEPALIVE_INTERVAL = 15 * time.Second
+)
+
+// liveFeed sends the destinations to the clients watching them as soon as they are detected
+type liveFeed struct {
+	mutex   *sync.RWMutex
+	clients map[*liveClient]bool
+}
+
+var live = &liveFeed{mutex: &sync.RWMutex{}, clients: map[*liveClient]bool{}}
+
+type liveClient struct {
+	filter       *OutputFilter
+	destinations chan *base.Destination
+	// Destinations that didn't fit in the buffer since the client was last told about it
+	dropped int64
+}
+
+// liveMessage is what the WebSocket clients receive, the Server-Sent Events have the event as their type and the rest as their data
+type liveMessage struct {
+	Event       string                    `json:"event"`
+	Destination *base.DestinationDocument `json:"destination,omitempty"`
+	Dropped     int64                     `json:"dropped,omitempty"`
+}
+
+func (self *liveFeed) subscribe(filter *OutputFilter) *liveClient {
+	client := &liveClient{filter: filter, destinations: make(chan *base.Destination, LIVE_BUFFER_SIZE)}
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+	self.clients[client] = true
+	liveClientsGauge.Inc()
+	return client
+}
+
+func (self *liveFeed) unsubscribe(client *liveClient) {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+	delete(self.clients, client)
+	liveClientsGauge.Dec()
+}
+
+// publish never blocks so a slow client can't slow down the capture, the destinations it can't keep up with are dropped
+func (self *liveFeed) publish(destination *base.Destination) {
+	self.mutex.RLock()
+	defer self.mutex.RUnlock()
+	for client := range self.clients {
+		if !client.filter.Match(destination) {
+			continue
+		}
+		select {
+		case client.destinations <- destination:
+		default:
+			atomic.AddInt64(&client.dropped, 1)
+			liveDroppedCounter.Inc()
+		}
+	}
+}
+
+// Returns the messages to send for a destination, preceded by the amount of destinations dropped before it
+func (self *liveClient) messages(destination *base.Destination) []*liveMessage {
+	var messages []*liveMessage
+	if dropped := atomic.SwapInt64(&self.dropped, 0); dropped > 0 {
+		messages = append(messages, &liveMessage{Event: "dropped", Dropped: dropped})
+	}
+	return append(messages, &liveMessage{Event: "destination", Destination: destination.Document()})
+}
+
+var liveUpgrader = websocket.Upgrader{}
+
+// liveAPI streams the destinations over WebSocket or, for the other requests, as Server-Sent Events
+// The destinations are filtered like the ones of the outputs, by subnet (source or destination IP), host glob and protocol
+type liveAPI struct{}
+
+func (self *liveAPI) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	params := r.URL.Query()
+	filter, err := NewOutputFilter(&OutputConfig{
+		Include_subnets:   params.Get("subnet"),
+		Include_hosts:     params.Get("host"),
+		Include_protocols: params.Get("protocol"),
+	})
+	if err != nil {
+		writeAPIError(w, http.StatusBadRequest, err)
+		return
+	}
+	// Subscribing before answering makes sure the client doesn't miss the destinations detected once it is connected
+	client := live.subscribe(filter)
+	defer live.unsubscribe(client)
+	if websocket.IsWebSocketUpgrade(r) {
+		serveLiveWebSocket(w, r, client)
+	} else {
+		serveLiveEvents(w, r, client)
+	}
+}
+
+func serveLiveEvents(w http.ResponseWriter, r *http.Request, client *liveClient) {
+	controller := http.NewResponseController(w)
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	// Stops nginx from buffering the events
+	w.Header().Set("X-Accel-Buffering", "no")
+	w.WriteHeader(http.StatusOK)
+	if err := controller.Flush(); err != nil {
+		return
+	}
+
+	keepalive := time.NewTicker(LIVE_KEEPALIVE_INTERVAL)
+	defer keepalive.Stop()
+	for {
+		controller.SetWriteDeadline(time.Now().Add(LIVE_WRITE_TIMEOUT))
+		select {
+		case <-r.Context().Done():
+			return
+		case destination := <-client.destinations:
+			for _, message := range client.messages(destination) {
+				var data []byte
+				if message.Destination != nil {
+					data, _ = json.Marshal(message.Destination)
+				} else {
+					data, _ = json.Marshal(map[string]int64{"dropped": message.Dropped})
+				}
+				fmt.Fprintf(w, "event: %s\ndata: %s\n\n", message.Event, data)
+			}
+		case <-keepalive.C:
+			fmt.Fprint(w, ": keepalive\n\n")
+		}
+		if err := controller.Flush(); err != nil {
+			return
+		}
+	}
+}
+
+func serveLiveWebSocket(w http.ResponseWriter, r *http.Request, client *liveClient) {
+	// The upgrader answers the requests it refuses
+	conn, err := liveUpgrader.Upgrade(w, r, nil)
+	if err != nil {
+		return
+	}
+	defer conn.Close()
+
+	// What the client sends is only read to answer the control frames and to notice when it goes away
+	closed := make(chan struct{})
+	go func() {
+		defer close(closed)
+		for {
+			if _, _, err := conn.NextReader(); err != nil {
+				return
+			}
+		}
+	}()
+
+	keepalive := time.NewTicker(LIVE_KEEPALIVE_INTERVAL)
+	defer keepalive.Stop()
+	for {
+		select {
+		case <-closed:
+			return
+		case destination := <-client.destinations:
+			conn.SetWriteDeadline(time.Now().Add(LIVE_WRITE_TIMEOUT))
+			for _, message := range client.messages(destination) {
+				if err := conn.WriteJSON(message); err != nil {
+					return
+				}
+			}
+		case <-keepalive.C:
+			if err := conn.WriteControl(websocket.PingMessage, nil, time.Now().Add(LIVE_WRITE_TIMEOUT)); err != nil {
+				return
+			}
+		}
+	}
+}
@@ -0,0 +1,118 @@
+package main
+
+import (
+	"bufio"
+	"github.com/gorilla/websocket"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// Waits for the clients of the live feed to be subscribed
+func waitLiveClients(t *testing.T, count int) {
+	for i := 0; i < 100; i++ {
+		live.mutex.RLock()
+		subscribed := len(live.clients)
+		live.mutex.RUnlock()
+		if subscribed == count {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatalf("%d clients aren't subscribed to the live feed", count)
+}
+
+func TestLiveEvents(t *testing.T) {
+	server := httptest.NewServer(&liveAPI{})
+	defer server.Close()
+	response, err := http.Get(server.URL + "/api/live?subnet=10.0.0.0/24&host=*.example.com&protocol=tls/ssl")
+	if err != nil {
+		t.Fatalf("Can't connect to the live feed : %s", err)
+	}
+	defer response.Body.Close()
+	if response.Header.Get("Content-Type") != "text/event-stream" {
+		t.Errorf("Content type is %s", response.Header.Get("Content-Type"))
+	}
+
+	live.publish(testDestination("www.example.com", "TLS/SSL", "10.0.1.1"))
+	live.publish(testDestination("example.org", "TLS/SSL", "10.0.0.1"))
+	live.publish(testDestination("www.example.com", "TLS/SSL", "10.0.0.1"))
+	reader := bufio.NewReader(response.Body)
+	var lines []string
+	for len(lines) < 2 {
+		line, err := reader.ReadString('\n')
+		if err != nil {
+			t.Fatalf("Can't read the events : %s", err)
+		}
+		if line = strings.TrimSpace(line); line != "" {
+			lines = append(lines, line)
+		}
+	}
+	if lines[0] != "event: destination" || !strings.Contains(lines[1], `"server_name":"www.example.com"`) || !strings.Contains(lines[1], `"source_ip":"10.0.0.1"`) {
+		t.Errorf("Received %q", lines)
+	}
+
+	response, err = http.Get(server.URL + "/api/live?subnet=10.0.0")
+	if err != nil || response.StatusCode != http.StatusBadRequest {
+		t.Fatalf("Invalid filter was accepted")
+	}
+	response.Body.Close()
+}
+
+func TestLiveWebSocket(t *testing.T) {
+	server := httptest.NewServer(&liveAPI{})
+	defer server.Close()
+	conn, _, err := websocket.DefaultDialer.Dial(strings.Replace(server.URL, "http://", "ws://", 1)+"/api/live?host=example.com", nil)
+	if err != nil {
+		t.Fatalf("Can't connect to the live feed : %s", err)
+	}
+	defer conn.Close()
+	waitLiveClients(t, 1)
+
+	live.publish(testDestination("www.example.com", "TLS/SSL", "10.0.0.1"))
+	live.publish(testDestination("example.com", "TLS/SSL", "10.0.0.2"))
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	message := &liveMessage{}
+	if err := conn.ReadJSON(message); err != nil {
+		t.Fatalf("Can't read the messages : %s", err)
+	}
+	if message.Event != "destination" || message.Destination.ServerName != "example.com" || message.Destination.SourceIp != "10.0.0.2" {
+		t.Errorf("Received %+v", message)
+	}
+
+	conn.Close()
+	waitLiveClients(t, 0)
+}
+
+// Publishing to a client that never reads doesn't block
+func TestLiveSlowClient(t *testing.T) {
+	filter, _ := NewOutputFilter(&OutputConfig{})
+	client := live.subscribe(filter)
+	defer live.unsubscribe(client)
+	done := make(chan bool)
+	go func() {
+		for i := 0; i < 2*LIVE_BUFFER_SIZE; i++ {
+			live.publish(testDestination("example.com", "TLS/SSL", "10.0.0.1"))
+		}
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Publishing blocked on a slow client")
+	}
+	if client.dropped != LIVE_BUFFER_SIZE {
+		t.Errorf("%d destinations were dropped instead of %d", client.dropped, LIVE_BUFFER_SIZE)
+	}
+
+	// The client is told about the drops before the next destination
+	messages := client.messages(<-client.destinations)
+	if len(messages) != 2 || messages[0].Event != "dropped" || messages[0].Dropped != LIVE_BUFFER_SIZE || messages[1].Event != "destination" {
+		t.Errorf("Messages are %+v", messages)
+	}
+	if messages = client.messages(<-client.destinations); len(messages) != 1 {
+		t.Errorf("Drops were reported twice : %+v", messages)
+	}
+}
@@ -4,18 +4,14 @@ import (
 	"flag"
 	"github.com/google/gopacket"
 	"github.com/google/gopacket/examples/util"
-	"github.com/google/gopacket/layers"
-	"github.com/google/gopacket/pcap"
 	"github.com/google/gopacket/tcpassembly"
 	"github.com/julsemaan/garin/base"
 	"github.com/op/go-logging"
-	"github.com/revel/cmd/harness"
-	"github.com/revel/revel"
 	_ "net/http/pprof"
 	"os"
 	"os/signal"
 	"runtime/debug"
-	"strings"
+	"sort"
 	"sync"
 	"time"
 )
@@ -24,35 +20,41 @@ var cfgFile = flag.String("c", "/etc/garin.conf", "Configuration to use for exec
 var cfg = BuildConfig(*cfgFile)
 var params = NewParams(cfg)
 
-var wg sync.WaitGroup
+// Tracks the capture loops
+var captureWg sync.WaitGroup
 
-var recordingQueue = NewRecordingQueue()
+// Tracks the streams being parsed
+var parsingWg sync.WaitGroup
+
+// Where the parsed destinations are recorded, empty when they aren't
+var outputs = &Outputs{}
 
 var parsingConcurrencyChan = make(chan int, *params.ParsingConcurrency)
 
-var running = true
-var stopChan = make(chan int, 1)
+var stopChan = make(chan int)
+var stopOnce sync.Once
 
 func Logger() *logging.Logger {
 	return base.LoggerWithLevel(cfg.General.Log_level)
 }
 
 func main() {
+	if flag.NArg() > 0 {
+		runCommand(flag.Args())
+		return
+	}
+
 	defer util.Run()()
 	var err error
 
-	filter := "tcp port " + strings.Join(params.AllPorts, " or ")
-
 	flushDuration, err := time.ParseDuration(*params.FlushAfter)
 	if err != nil {
 		base.Die("invalid flush duration: ", params.FlushAfter)
 	}
 
-	debounceThreshold, err := time.ParseDuration(*params.DebounceDestinations)
+	defragTimeout, err := time.ParseDuration(cfg.Capture.Defrag_timeout)
 	if err != nil {
-		base.Die("invalid debounce destinations duration: ", params.DebounceDestinations)
-	} else {
-		recordingQueue.SetDebounceThreshold(debounceThreshold)
+		base.Die("invalid defragmentation timeout: ", cfg.Capture.Defrag_timeout)
 	}
 
 	//go func() {
@@ -60,114 +62,196 @@ func main() {
 	//}()
 
 	if !*params.DontRecordDestinations {
-		for i := 1; i <= *params.RecordingThreads; i++ {
-			Logger().Info("Spawning recording thread", i)
-			wg.Add(1)
-			go func() {
-				db := base.NewGarinDB(cfg.Database.Type, cfg.Database.Args)
-				defer db.Close()
-				for running || !recordingQueue.empty() {
-					if !recordingQueue.work(db) {
-						// When the queue hasn't provided something, we sleep to save some CPU time
-						time.Sleep(time.Millisecond * 10)
-					}
-				}
-				wg.Done()
-			}()
-		}
-	} else {
-		recordingQueue.dummy = true
+		buildOutputs()
+		outputs.start()
 	}
 
-	//go runWeb()
+	if cfg.Http.Listen != "" {
+		go runHTTPServer()
+	}
 
 	go func() {
 		tick := time.Tick(flushDuration)
 		for _ = range tick {
 			debug.FreeOSMemory()
+			outputs.logStats()
+			outputs.logHealth()
 		}
 	}()
 
-	// Set up pcap packet capture
-	var handle *pcap.Handle
+	// Set up packet capture
 	if *params.PcapFile != "" {
 		Logger().Infof("starting capture from file %q", *params.PcapFile)
-		handle, err = pcap.OpenOffline(*params.PcapFile)
+		handle, err := NewPcapOfflineCaptureHandle(*params.PcapFile)
+		if err != nil {
+			base.Die("error opening capture handle: ", err.Error())
+		}
+		startCapture("", handle, flushDuration, defragTimeout)
 	} else {
-		Logger().Infof("starting capture on interface %q", *params.Iface)
-		handle, err = pcap.OpenLive(*params.Iface, int32(cfg.Capture.Snaplen), true, flushDuration/2)
+		for i, iface := range params.Ifaces {
+			Logger().Infof("starting %s capture on interface %q", *params.CaptureBackend, iface)
+			handle, err := NewLiveCaptureHandle(*params.CaptureBackend, iface, i, flushDuration/2)
+			if err != nil {
+				base.Die("error opening capture handle on ", iface, ": ", err.Error())
+			}
+			startCapture(iface, handle, flushDuration, defragTimeout)
+		}
 	}
+
+	c := make(chan os.Signal, 1)
+	signal.Notify(c, os.Interrupt)
+	signal.Notify(c, os.Kill)
+	go func() {
+		for _ = range c {
+			stopCapture()
+			outputs.stopRetrying()
+		}
+	}()
+
+	// The captures complete either when they have read all their packets or when we are asked to stop
+	captureWg.Wait()
+
+	// Once all the streams are parsed, the recording threads can drain the queues and exit
+	parsingWg.Wait()
+	outputs.close()
+}
+
+// Creates the outputs of the configuration or the one of the [database] section if there is none
+func buildOutputs() {
+	names, outputCfgs := configuredOutputs()
+	for _, name := range names {
+		addOutput(name, outputCfgs[name])
+	}
+}
+
+// Returns the sorted names and the configurations of the outputs, the [database] section is the "database" output when no output is configured
+func configuredOutputs() ([]string, map[string]*OutputConfig) {
+	if len(cfg.Output) == 0 {
+		outputCfg := cfg.Default_output
+		outputCfg.Type = cfg.Database.Type
+		outputCfg.Args = cfg.Database.Args
+		outputCfg.Recording_threads = *params.RecordingThreads
+		outputCfg.Recording_queue_capacity = *params.RecordingQueueCapacity
+		outputCfg.Recording_queue_overflow = *params.RecordingQueueOverflow
+		outputCfg.Debounce_destinations = *params.DebounceDestinations
+		outputCfg.Debounce_edge = cfg.Database.Debounce_edge
+		outputCfg.Debounce_key = cfg.Database.Debounce_key
+		outputCfg.Debounce_max_entries = cfg.Database.Debounce_max_entries
+		outputCfg.Aggregate_sessions = cfg.Database.Aggregate_sessions
+		outputCfg.Batch_size = cfg.Database.Batch_size
+		outputCfg.Batch_max_latency = cfg.Database.Batch_max_latency
+		outputCfg.Retry_attempts = cfg.Database.Retry_attempts
+		outputCfg.Retry_initial_backoff = cfg.Database.Retry_initial_backoff
+		outputCfg.Retry_max_backoff = cfg.Database.Retry_max_backoff
+		outputCfg.Spool_directory = cfg.Spool.Directory
+		return []string{"database"}, map[string]*OutputConfig{"database": &outputCfg}
+	}
+
+	names := make([]string, 0, len(cfg.Output))
+	for name := range cfg.Output {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names, cfg.Output
+}
+
+func addOutput(name string, outputCfg *OutputConfig) {
+	output, err := NewOutput(name, outputCfg)
 	if err != nil {
-		base.Die("error opening pcap handle: ", err.Error())
+		base.Die("invalid output ", name, ": ", err)
+	}
+	if outputCfg.Spool_directory != "" {
+		startSpool(output, outputCfg.Spool_directory)
 	}
+	Logger().Infof("recording the destinations of output %s in %s", name, outputCfg.Type)
+	outputs.Add(output)
+}
 
+func startSpool(output *Output, directory string) {
+	fsyncInterval, err := time.ParseDuration(cfg.Spool.Fsync_interval)
+	if err != nil {
+		base.Die("invalid spool fsync interval: ", cfg.Spool.Fsync_interval)
+	}
+	retryInterval, err := time.ParseDuration(cfg.Spool.Retry_interval)
+	if err != nil {
+		base.Die("invalid spool retry interval: ", cfg.Spool.Retry_interval)
+	}
+	spool, err := OpenSpool(directory, cfg.Spool.Segment_size, cfg.Spool.Max_size, cfg.Spool.Fsync, fsyncInterval)
+	if err != nil {
+		base.Die("can't open the spool: ", err)
+	}
+	Logger().Infof("spooling the destinations that output %s can't record in %s", output.Name, directory)
+	output.EnableSpool(spool, retryInterval)
+}
+
+func stopCapture() {
+	stopOnce.Do(func() {
+		close(stopChan)
+	})
+}
+
+func startCapture(iface string, handle CaptureHandle, flushDuration time.Duration, defragTimeout time.Duration) {
+	filter := BuildCaptureFilter(params.AllPorts, *params.DecapsulateTunnels, handle.LinkType())
 	Logger().Info("Using filter", filter)
 	if err := handle.SetBPFFilter(filter); err != nil {
 		base.Die("error setting BPF filter: ", err)
 	}
 
+	captureStats.add(iface, handle)
+	captureWg.Add(1)
+	go func() {
+		capturePackets(iface, handle, flushDuration, defragTimeout)
+		captureWg.Done()
+	}()
+}
+
+// capturePackets reads the packets of a capture handle and reassembles their streams until the capture is stopped or all the packets were read
+// Each capture has its own assembler so the streams can be tagged with the interface they were seen on
+func capturePackets(iface string, handle CaptureHandle, flushDuration time.Duration, defragTimeout time.Duration) {
 	// Set up assembly
-	streamFactory := &sniffStreamFactory{}
+	streamFactory := &sniffStreamFactory{iface: iface}
 	streamPool := tcpassembly.NewStreamPool(streamFactory)
 	assembler := tcpassembly.NewAssembler(streamPool)
 	assembler.MaxBufferedPagesPerConnection = *params.BufferedPerConnection
 	assembler.MaxBufferedPagesTotal = *params.BufferedTotal
 
-	Logger().Info("reading in packets")
-
-	// We use a DecodingLayerParser here instead of a simpler PacketSource.
-	// This approach should be measurably faster, but is also more rigid.
-	// PacketSource will handle any known type of packet safely and easily,
-	// but DecodingLayerParser will only handle those packet types we
-	// specifically pass in.  This trade-off can be quite useful, though, in
-	// high-throughput situations.
-	var eth layers.Ethernet
-	var dot1q layers.Dot1Q
-	var ip4 layers.IPv4
-	var ip6 layers.IPv6
-	var ip6extensions layers.IPv6ExtensionSkipper
-	var tcp layers.TCP
-	var payload gopacket.Payload
-	parser := gopacket.NewDecodingLayerParser(layers.LayerTypeEthernet,
-		&eth, &dot1q, &ip4, &ip6, &ip6extensions, &tcp, &payload)
-	decoded := make([]gopacket.LayerType, 0, 4)
+	Logger().Infof("reading in packets on %q", iface)
+
+	decoder, err := NewPacketDecoder(handle.LinkType())
+	if err != nil {
+		base.Die("can't decode the packets captured on ", iface, ": ", err)
+	}
+	Logger().Infof("decoding packets captured on %q as %s", iface, handle.LinkType())
+	decoder.Defragmenter = NewIPDefragmenter(defragTimeout, cfg.Capture.Defrag_max_packets, cfg.Capture.Defrag_max_fragments)
 
 	nextFlush := time.Now().Add(flushDuration / 2)
 
+	packetsRead := packetsCounter.WithLabelValues(iface)
+	bytesRead := bytesCounter.WithLabelValues(iface)
+	decodeErrors := decodeErrorsCounter.WithLabelValues(iface)
+	bufferedPages := bufferedPagesGauge.WithLabelValues(iface)
+
 	var byteCount int64
 	start := time.Now()
 
-	stop := func() {
-		running = false
-		stopChan <- 1
-		wg.Wait()
+	defer func() {
 		assembler.FlushAll()
-		Logger().Infof("processed %d bytes in %v", byteCount, time.Since(start))
-		os.Exit(0)
-	}
-
-	defer stop()
-
-	c := make(chan os.Signal, 1)
-	signal.Notify(c, os.Interrupt)
-	signal.Notify(c, os.Kill)
-	go func() {
-		for _ = range c {
-			stop()
-		}
+		Logger().Infof("processed %d bytes in %v on %q", byteCount, time.Since(start), iface)
 	}()
 
-	wg.Add(1)
-loop:
-	for running {
+	for {
 		// Check to see if we should flush the streams we have
 		// that haven't seen any new data in a while.  Note we set a
 		// timeout on our PCAP handle, so this should happen even if we
 		// never see packet data.
 		if time.Now().After(nextFlush) {
 			stats, _ := handle.Stats()
-			Logger().Infof("flushing all streams that haven't seen packets in the last %q, pcap stats: %+v", params.FlushAfter, stats)
+			Logger().Infof("flushing all streams that haven't seen packets in the last %q, capture stats for %q: %+v", params.FlushAfter, iface, stats)
+			Logger().Infof("defragmentation stats for %q: %d reassembled, %d discarded, %d pending", iface, decoder.Defragmenter.Reassembled, decoder.Defragmenter.Discarded, decoder.Defragmenter.Pending())
 			assembler.FlushOlderThan(time.Now().Add(flushDuration))
+			if pages, ok := assemblerBufferedPages(assembler); ok {
+				bufferedPages.Set(float64(pages))
+			}
 			nextFlush = time.Now().Add(flushDuration / 2)
 		}
 
@@ -190,90 +274,42 @@ loop:
 		}()
 
 		// We wait for either a stop sign or for a packet - whichever comes first
-		// If we detect we need to stop, we signal it to the group and we stop
 		select {
 		case <-packetIn:
 		case <-stopChan:
-			wg.Done()
 			return
 		}
 
 		if err != nil {
-			if err.Error() == "EOF" {
+			if err == ErrCaptureTimeout {
+				// Nothing was captured, go back to flushing the streams if needed
+				continue
+			} else if err.Error() == "EOF" {
 				// Read all packets in the case of a pcap file
 				Logger().Info("Read all packets")
-				wg.Done()
 				return
 			} else {
 				Logger().Errorf("error getting packet: %v", err)
 				continue
 			}
 		}
-		err = parser.DecodeLayers(data, &decoded)
+		packetsRead.Inc()
+		bytesRead.Add(float64(len(data)))
+		foundTCP, err := decoder.Decode(data, ci.Timestamp)
 		if err != nil {
+			decodeErrors.Inc()
 			Logger().Errorf("error decoding packet: %v", err)
 			continue
 		}
 		if *params.LogAllPackets {
-			Logger().Debugf("decoded the following layers: %v", decoded)
+			Logger().Debugf("decoded the following layers: %v", decoder.Decoded)
 		}
 		byteCount += int64(len(data))
-		// Find either the IPv4 or IPv6 address to use as our network
-		// layer.
-		foundNetLayer := false
-		var netFlow gopacket.Flow
-		for _, typ := range decoded {
-			switch typ {
-			case layers.LayerTypeIPv4:
-				netFlow = ip4.NetworkFlow()
-				foundNetLayer = true
-			case layers.LayerTypeIPv6:
-				netFlow = ip6.NetworkFlow()
-				foundNetLayer = true
-			case layers.LayerTypeTCP:
-				if foundNetLayer {
-					assembler.AssembleWithTimestamp(netFlow, &tcp, ci.Timestamp)
-				} else {
-					Logger().Debug("could not find IPv4 or IPv6 layer, inoring")
-				}
-				continue loop
-			}
+		if foundTCP {
+			// The stream factory is called synchronously by the assembler so the tunnel is attached to the streams it creates
+			streamFactory.tunnel = decoder.Tunnel
+			streamFactory.count(decoder.NetFlow, decoder.TCP.TransportFlow(), decoder.TCP.RST)
+			assembler.AssembleWithTimestamp(decoder.NetFlow, &decoder.TCP, ci.Timestamp)
 		}
-		Logger().Debug("could not find TCP layer")
-	}
-	wg.Done()
-
-}
-
-func runStatsServer() {
-
-}
-
-func runWeb() {
-	// Determine the run mode.
-	mode := "dev"
-	port := 9090
-
-	// Find and parse app.conf
-	revel.Init(mode, "github.com/julsemaan/garin/web", "")
-	revel.LoadMimeConfig()
-
-	revel.INFO.Printf("Running %s (%s) in %s mode\n", revel.AppName, revel.ImportPath, mode)
-	revel.TRACE.Println("Base path:", revel.BasePath)
-
-	// If the app is run in "watched" mode, use the harness to run it.
-	if revel.Config.BoolDefault("watch", true) && revel.Config.BoolDefault("watch.code", true) {
-		revel.TRACE.Println("Running in watched mode.")
-		revel.HttpPort = port
-		harness.NewHarness().Run() // Never returns.
-	}
-
-	// Else, just build and run the app.
-	revel.TRACE.Println("Running in live build mode.")
-	app, err := harness.Build()
-	if err != nil {
-		base.Die("Failed to build app:", err)
 	}
-	app.Port = port
-	app.Cmd().Run()
 }
@@ -0,0 +1,194 @@
+package main
+
+import (
+	"github.com/google/gopacket/tcpassembly"
+	"github.com/julsemaan/garin/base"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"reflect"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Registry of the metrics served on /metrics
+var metricsRegistry = prometheus.NewRegistry()
+
+var (
+	packetsCounter = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "garin_packets_total",
+		Help: "Packets read by the captures.",
+	}, []string{"interface"})
+	bytesCounter = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "garin_bytes_total",
+		Help: "Bytes read by the captures.",
+	}, []string{"interface"})
+	decodeErrorsCounter = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "garin_decode_errors_total",
+		Help: "Packets that couldn't be decoded.",
+	}, []string{"interface"})
+	activeStreamsGauge = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "garin_streams_active",
+		Help: "TCP streams being reassembled.",
+	})
+	bufferedPagesGauge = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "garin_assembler_buffered_pages",
+		Help: "Pages of out of order data buffered by the TCP assembler, updated when the streams are flushed.",
+	}, []string{"interface"})
+	parseResultsCounter = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "garin_parse_results_total",
+		Help: "Streams parsed by protocol and result (success, failure when no destination was found, error when the parser failed).",
+	}, []string{"protocol", "result"})
+	dbWriteDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "garin_db_write_duration_seconds",
+		Help:    "Time taken to record a batch of destinations, including the retries.",
+		Buckets: prometheus.ExponentialBuckets(0.001, 2, 15),
+	}, []string{"output"})
+	dbErrorsCounter = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "garin_db_errors_total",
+		Help: "Batches of destinations that couldn't be recorded, by whether the error was retryable.",
+	}, []string{"output", "retryable"})
+	liveClientsGauge = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "garin_live_clients",
+		Help: "Clients watching the live feed.",
+	})
+	liveDroppedCounter = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "garin_live_dropped_total",
+		Help: "Destinations not sent to the clients of the live feed because they didn't keep up.",
+	})
+)
+
+var (
+	capturePacketsReceivedDesc = prometheus.NewDesc("garin_capture_packets_received_total", "Packets received by the capture backend.", []string{"interface"}, nil)
+	capturePacketsDroppedDesc  = prometheus.NewDesc("garin_capture_packets_dropped_total", "Packets dropped by the capture backend (kernel) or the interface (interface), and times the afpacket ring was frozen because it was full (ring_freeze).", []string{"interface", "reason"}, nil)
+	queueLengthDesc            = prometheus.NewDesc("garin_recording_queue_length", "Destinations waiting to be recorded.", []string{"output"}, nil)
+	queueDroppedDesc           = prometheus.NewDesc("garin_recording_queue_dropped_total", "Destinations dropped because the recording queue was full.", []string{"output"}, nil)
+	debounceEntriesDesc        = prometheus.NewDesc("garin_debounce_entries", "Destinations whose debounce window isn't over.", []string{"output"}, nil)
+	debounceEvictionsDesc      = prometheus.NewDesc("garin_debounce_evictions_total", "Destinations evicted from the debounce before the end of their window because it held too many.", []string{"output"}, nil)
+	aggregatedSessionsDesc     = prometheus.NewDesc("garin_aggregated_sessions", "Sessions being aggregated until they are recorded.", []string{"output"}, nil)
+)
+
+func init() {
+	metricsRegistry.MustRegister(
+		packetsCounter,
+		bytesCounter,
+		decodeErrorsCounter,
+		activeStreamsGauge,
+		bufferedPagesGauge,
+		parseResultsCounter,
+		dbWriteDuration,
+		dbErrorsCounter,
+		liveClientsGauge,
+		liveDroppedCounter,
+		captureStats,
+		&outputsCollector{outputs: outputs},
+		collectors.NewGoCollector(),
+		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+	)
+}
+
+// captureStatsCollector reads the statistics of the capture handles when the metrics are scraped
+type captureStatsCollector struct {
+	mutex   *sync.Mutex
+	handles map[string]CaptureHandle
+}
+
+var captureStats = &captureStatsCollector{mutex: &sync.Mutex{}, handles: map[string]CaptureHandle{}}
+
+func (self *captureStatsCollector) add(iface string, handle CaptureHandle) {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+	self.handles[iface] = handle
+}
+
+func (self *captureStatsCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- capturePacketsReceivedDesc
+	ch <- capturePacketsDroppedDesc
+}
+
+func (self *captureStatsCollector) Collect(ch chan<- prometheus.Metric) {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+	for iface, handle := range self.handles {
+		// Captures from a file have no statistics
+		stats, err := handle.Stats()
+		if err != nil {
+			continue
+		}
+		ch <- prometheus.MustNewConstMetric(capturePacketsReceivedDesc, prometheus.CounterValue, float64(stats.PacketsReceived), iface)
+		ch <- prometheus.MustNewConstMetric(capturePacketsDroppedDesc, prometheus.CounterValue, float64(stats.PacketsDropped), iface, "kernel")
+		ch <- prometheus.MustNewConstMetric(capturePacketsDroppedDesc, prometheus.CounterValue, float64(stats.PacketsIfDropped), iface, "interface")
+		ch <- prometheus.MustNewConstMetric(capturePacketsDroppedDesc, prometheus.CounterValue, float64(stats.RingFreezes), iface, "ring_freeze")
+	}
+}
+
+// outputsCollector reads the state of the recording queues when the metrics are scraped
+type outputsCollector struct {
+	outputs *Outputs
+}
+
+func (self *outputsCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- queueLengthDesc
+	ch <- queueDroppedDesc
+	ch <- debounceEntriesDesc
+	ch <- debounceEvictionsDesc
+	ch <- aggregatedSessionsDesc
+}
+
+func (self *outputsCollector) Collect(ch chan<- prometheus.Metric) {
+	for _, output := range self.outputs.outputs {
+		ch <- prometheus.MustNewConstMetric(queueLengthDesc, prometheus.GaugeValue, float64(output.queue.Len()), output.Name)
+		ch <- prometheus.MustNewConstMetric(queueDroppedDesc, prometheus.CounterValue, float64(output.queue.Dropped()), output.Name)
+		ch <- prometheus.MustNewConstMetric(debounceEntriesDesc, prometheus.GaugeValue, float64(output.queue.DebounceLen()), output.Name)
+		ch <- prometheus.MustNewConstMetric(debounceEvictionsDesc, prometheus.CounterValue, float64(output.queue.DebounceEvicted()), output.Name)
+		ch <- prometheus.MustNewConstMetric(aggregatedSessionsDesc, prometheus.GaugeValue, float64(output.queue.SessionsLen()), output.Name)
+	}
+}
+
+// instrumentedGarinDB measures the writes of an output
+type instrumentedGarinDB struct {
+	base.GarinDB
+	output string
+}
+
+func (self *instrumentedGarinDB) RecordDestination(destination *base.Destination) error {
+	return self.observe(func() error {
+		return self.GarinDB.RecordDestination(destination)
+	})
+}
+
+func (self *instrumentedGarinDB) RecordDestinations(destinations []*base.Destination) error {
+	return self.observe(func() error {
+		return self.GarinDB.RecordDestinations(destinations)
+	})
+}
+
+func (self *instrumentedGarinDB) RecordSessions(sessions []*base.Session) error {
+	return self.observe(func() error {
+		return self.GarinDB.RecordSessions(sessions)
+	})
+}
+
+func (self *instrumentedGarinDB) observe(write func() error) error {
+	start := time.Now()
+	err := write()
+	dbWriteDuration.WithLabelValues(self.output).Observe(time.Since(start).Seconds())
+	if err != nil {
+		dbErrorsCounter.WithLabelValues(self.output, strconv.FormatBool(base.IsRetryable(err))).Inc()
+	}
+	return err
+}
+
+// assemblerBufferedPages returns the amount of pages an assembler buffers
+// tcpassembly doesn't expose it so it is read from its page cache, false is returned if its internals changed
+func assemblerBufferedPages(assembler *tcpassembly.Assembler) (int64, bool) {
+	pageCache := reflect.ValueOf(assembler).Elem().FieldByName("pc")
+	if pageCache.Kind() != reflect.Ptr || pageCache.IsNil() {
+		return 0, false
+	}
+	used := pageCache.Elem().FieldByName("used")
+	if used.Kind() != reflect.Int {
+		return 0, false
+	}
+	return used.Int(), true
+}
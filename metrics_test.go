@@ -0,0 +1,119 @@
+package main
+
+import (
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"github.com/google/gopacket/tcpassembly"
+	"github.com/julsemaan/garin/base"
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+	"sync"
+	"testing"
+)
+
+// Returns the metric of a family with the given labels
+func findMetric(t *testing.T, gatherer prometheus.Gatherer, name string, labels map[string]string) *dto.Metric {
+	families, err := gatherer.Gather()
+	if err != nil {
+		t.Fatalf("Can't gather the metrics : %s", err)
+	}
+	for _, family := range families {
+		if family.GetName() != name {
+			continue
+		}
+	metrics:
+		for _, metric := range family.GetMetric() {
+			for _, label := range metric.GetLabel() {
+				if value, ok := labels[label.GetName()]; ok && value != label.GetValue() {
+					continue metrics
+				}
+			}
+			return metric
+		}
+	}
+	return nil
+}
+
+func TestInstrumentedGarinDB(t *testing.T) {
+	db := &instrumentedGarinDB{GarinDB: &testGarinDB{failures: 1}, output: "metrics-test"}
+	destination := base.NewDestination("example.com", "10.0.0.1", "10.0.0.2")
+	if err := db.RecordDestination(destination); err == nil {
+		t.Fatal("The first write didn't fail")
+	}
+	if err := db.RecordDestinations([]*base.Destination{destination, destination}); err != nil {
+		t.Fatalf("Can't record destinations : %s", err)
+	}
+
+	histogram := findMetric(t, metricsRegistry, "garin_db_write_duration_seconds", map[string]string{"output": "metrics-test"})
+	if histogram == nil || histogram.GetHistogram().GetSampleCount() != 2 {
+		t.Errorf("Write durations weren't observed : %v", histogram)
+	}
+	errors := findMetric(t, metricsRegistry, "garin_db_errors_total", map[string]string{"output": "metrics-test", "retryable": "true"})
+	if errors == nil || errors.GetCounter().GetValue() != 1 {
+		t.Errorf("Write error wasn't counted : %v", errors)
+	}
+}
+
+func TestOutputsMetrics(t *testing.T) {
+	testOutputs := &Outputs{}
+	output, err := NewOutput("queue-test", &cfg.Default_output)
+	if err != nil {
+		t.Fatalf("Can't create output : %s", err)
+	}
+	output.push(base.NewDestination("example.com", "10.0.0.1", "10.0.0.2"))
+	testOutputs.Add(output)
+
+	registry := prometheus.NewRegistry()
+	registry.MustRegister(&outputsCollector{outputs: testOutputs})
+	if queueLength := findMetric(t, registry, "garin_recording_queue_length", map[string]string{"output": "queue-test"}); queueLength == nil || queueLength.GetGauge().GetValue() != 1 {
+		t.Errorf("Queue length isn't reported : %v", queueLength)
+	}
+	if debounce := findMetric(t, registry, "garin_debounce_entries", map[string]string{"output": "queue-test"}); debounce == nil || debounce.GetGauge().GetValue() != 0 {
+		t.Errorf("Debounce map size isn't reported : %v", debounce)
+	}
+}
+
+// The buffered pages are read from the internals of tcpassembly, this catches changes to them
+func TestAssemblerBufferedPages(t *testing.T) {
+	assembler := tcpassembly.NewAssembler(tcpassembly.NewStreamPool(&sniffStreamFactory{}))
+	if pages, ok := assemblerBufferedPages(assembler); !ok || pages != 0 {
+		t.Errorf("Can't read the buffered pages of the assembler : %d %v", pages, ok)
+	}
+}
+
+// Reports fixed statistics
+type testStatsCaptureHandle struct {
+	stats CaptureStats
+}
+
+func (self *testStatsCaptureHandle) ZeroCopyReadPacketData() ([]byte, gopacket.CaptureInfo, error) {
+	return nil, gopacket.CaptureInfo{}, ErrCaptureTimeout
+}
+
+func (self *testStatsCaptureHandle) SetBPFFilter(filter string) error {
+	return nil
+}
+
+func (self *testStatsCaptureHandle) LinkType() layers.LinkType {
+	return layers.LinkTypeEthernet
+}
+
+func (self *testStatsCaptureHandle) Stats() (*CaptureStats, error) {
+	return &self.stats, nil
+}
+
+func (self *testStatsCaptureHandle) Close() {}
+
+func TestCaptureStatsMetrics(t *testing.T) {
+	collector := &captureStatsCollector{mutex: &sync.Mutex{}, handles: map[string]CaptureHandle{}}
+	collector.add("eth0", &testStatsCaptureHandle{stats: CaptureStats{PacketsReceived: 10, PacketsDropped: 3, PacketsIfDropped: 2, RingFreezes: 1}})
+	registry := prometheus.NewRegistry()
+	registry.MustRegister(collector)
+
+	for reason, expected := range map[string]float64{"kernel": 3, "interface": 2, "ring_freeze": 1} {
+		dropped := findMetric(t, registry, "garin_capture_packets_dropped_total", map[string]string{"interface": "eth0", "reason": reason})
+		if dropped == nil || dropped.GetCounter().GetValue() != expected {
+			t.Errorf("Drops of reason %s are %v instead of %v", reason, dropped, expected)
+		}
+	}
+}
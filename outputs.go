@@ -0,0 +1,303 @@
+package main
+
+import (
+	"fmt"
+	"github.com/julsemaan/garin/base"
+	"net"
+	"path"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+)
+
+// OutputFilter decides which destinations are sent to an output
+// A destination must match all the include filters that are set and none of the exclude filters
+type OutputFilter struct {
+	includeProtocols map[string]bool
+	excludeProtocols map[string]bool
+	includeHosts     []string
+	excludeHosts     []string
+	includeSubnets   []*net.IPNet
+	excludeSubnets   []*net.IPNet
+}
+
+func splitList(list string) []string {
+	var values []string
+	for _, value := range regexp.MustCompile(",").Split(list, -1) {
+		value = strings.TrimSpace(value)
+		if value != "" {
+			values = append(values, value)
+		}
+	}
+	return values
+}
+
+func parseProtocols(list string) map[string]bool {
+	protocols := make(map[string]bool)
+	for _, protocol := range splitList(list) {
+		protocols[strings.ToUpper(protocol)] = true
+	}
+	return protocols
+}
+
+func parseHostPatterns(list string) ([]string, error) {
+	var patterns []string
+	for _, pattern := range splitList(list) {
+		pattern = strings.ToLower(pattern)
+		if _, err := path.Match(pattern, ""); err != nil {
+			return nil, fmt.Errorf("invalid host pattern %q: %s", pattern, err)
+		}
+		patterns = append(patterns, pattern)
+	}
+	return patterns, nil
+}
+
+func parseSubnets(list string) ([]*net.IPNet, error) {
+	var subnets []*net.IPNet
+	for _, cidr := range splitList(list) {
+		_, subnet, err := net.ParseCIDR(cidr)
+		if err != nil {
+			return nil, err
+		}
+		subnets = append(subnets, subnet)
+	}
+	return subnets, nil
+}
+
+func NewOutputFilter(outputCfg *OutputConfig) (*OutputFilter, error) {
+	filter := &OutputFilter{
+		includeProtocols: parseProtocols(outputCfg.Include_protocols),
+		excludeProtocols: parseProtocols(outputCfg.Exclude_protocols),
+	}
+	var err error
+	if filter.includeHosts, err = parseHostPatterns(outputCfg.Include_hosts); err != nil {
+		return nil, err
+	}
+	if filter.excludeHosts, err = parseHostPatterns(outputCfg.Exclude_hosts); err != nil {
+		return nil, err
+	}
+	if filter.includeSubnets, err = parseSubnets(outputCfg.Include_subnets); err != nil {
+		return nil, err
+	}
+	if filter.excludeSubnets, err = parseSubnets(outputCfg.Exclude_subnets); err != nil {
+		return nil, err
+	}
+	return filter, nil
+}
+
+func matchHost(patterns []string, host string) bool {
+	for _, pattern := range patterns {
+		if matched, _ := path.Match(pattern, host); matched {
+			return true
+		}
+	}
+	return false
+}
+
+// Matches when either the source or the destination IP is in one of the subnets
+func matchSubnet(subnets []*net.IPNet, ips ...net.IP) bool {
+	for _, subnet := range subnets {
+		for _, ip := range ips {
+			if ip != nil && subnet.Contains(ip) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func (self *OutputFilter) Match(destination *base.Destination) bool {
+	protocol := strings.ToUpper(destination.Protocol)
+	if len(self.includeProtocols) > 0 && !self.includeProtocols[protocol] {
+		return false
+	}
+	if self.excludeProtocols[protocol] {
+		return false
+	}
+
+	host := strings.ToLower(destination.ServerName)
+	if len(self.includeHosts) > 0 && !matchHost(self.includeHosts, host) {
+		return false
+	}
+	if matchHost(self.excludeHosts, host) {
+		return false
+	}
+
+	if len(self.includeSubnets) == 0 && len(self.excludeSubnets) == 0 {
+		return true
+	}
+	sourceIp := net.ParseIP(destination.SourceIp)
+	destinationIp := net.ParseIP(destination.DestinationIp)
+	if len(self.includeSubnets) > 0 && !matchSubnet(self.includeSubnets, sourceIp, destinationIp) {
+		return false
+	}
+	return !matchSubnet(self.excludeSubnets, sourceIp, destinationIp)
+}
+
+// Output records the destinations that match its filter in a backend, using its own queue and recording threads
+type Output struct {
+	Name             string
+	dbType           string
+	dbArgs           string
+	recordingThreads int
+	retry            base.RetryPolicy
+	health           *base.HealthState
+	filter           *OutputFilter
+	queue            *RecordingQueue
+	wg               sync.WaitGroup
+	// Closed when the output is closing so the recording threads don't keep retrying
+	stopRetries     chan int
+	stopRetriesOnce sync.Once
+}
+
+// NewOutput creates an output from its configuration, the spool is configured by the caller
+func NewOutput(name string, outputCfg *OutputConfig) (*Output, error) {
+	output := &Output{Name: name, dbType: outputCfg.Type, dbArgs: outputCfg.Args, recordingThreads: outputCfg.Recording_threads, health: base.NewHealthState("output " + name), stopRetries: make(chan int)}
+	var err error
+	if output.filter, err = NewOutputFilter(outputCfg); err != nil {
+		return nil, err
+	}
+
+	queue, err := NewQueue(outputCfg.Recording_queue_capacity, outputCfg.Recording_queue_overflow)
+	if err != nil {
+		return nil, err
+	}
+	output.queue = newRecordingQueue(queue)
+
+	debounceThreshold, err := time.ParseDuration(outputCfg.Debounce_destinations)
+	if err != nil {
+		return nil, fmt.Errorf("invalid debounce destinations duration: %s", outputCfg.Debounce_destinations)
+	}
+	aggregationInterval, err := time.ParseDuration(outputCfg.Aggregate_sessions)
+	if err != nil {
+		return nil, fmt.Errorf("invalid aggregate sessions interval: %s", outputCfg.Aggregate_sessions)
+	}
+	if aggregationInterval != 0 && !base.SupportsSessions(outputCfg.Type) {
+		return nil, fmt.Errorf("%s can't record aggregated sessions", outputCfg.Type)
+	}
+	if aggregationInterval != 0 {
+		output.queue.SetAggregation(aggregationInterval)
+	} else if debounceThreshold != 0 {
+		deduplicator, err := NewDeduplicator(debounceThreshold, outputCfg.Debounce_edge, outputCfg.Debounce_key, outputCfg.Debounce_max_entries)
+		if err != nil {
+			return nil, err
+		}
+		output.queue.SetDebounce(deduplicator)
+	}
+
+	batchMaxLatency, err := time.ParseDuration(outputCfg.Batch_max_latency)
+	if err != nil {
+		return nil, fmt.Errorf("invalid batch max latency: %s", outputCfg.Batch_max_latency)
+	}
+	output.queue.SetBatching(outputCfg.Batch_size, batchMaxLatency)
+
+	initialBackoff, err := time.ParseDuration(outputCfg.Retry_initial_backoff)
+	if err != nil {
+		return nil, fmt.Errorf("invalid retry initial backoff: %s", outputCfg.Retry_initial_backoff)
+	}
+	maxBackoff, err := time.ParseDuration(outputCfg.Retry_max_backoff)
+	if err != nil {
+		return nil, fmt.Errorf("invalid retry max backoff: %s", outputCfg.Retry_max_backoff)
+	}
+	output.retry = base.RetryPolicy{MaxAttempts: outputCfg.Retry_attempts, InitialBackoff: initialBackoff, MaxBackoff: maxBackoff, Stop: output.stopRetries}
+	return output, nil
+}
+
+// EnableSpool makes the destinations that the output can't record go to a spool
+func (self *Output) EnableSpool(spool *Spool, retryInterval time.Duration) {
+	self.queue.EnableSpool(spool, self.dbType, self.dbArgs, self.health, retryInterval)
+}
+
+func (self *Output) start() {
+	for i := 1; i <= self.recordingThreads; i++ {
+		Logger().Infof("Spawning recording thread %d of output %s", i, self.Name)
+		self.wg.Add(1)
+		go func() {
+			defer self.wg.Done()
+			db, err := base.NewGarinDB(self.dbType, self.dbArgs, self.retry, self.health)
+			if err != nil {
+				base.Die("can't open the ", self.dbType, " database of output ", self.Name, ": ", err)
+			}
+			defer db.Close()
+			db = &instrumentedGarinDB{GarinDB: db, output: self.Name}
+			for self.queue.work(db) {
+			}
+		}()
+	}
+}
+
+func (self *Output) push(destination *base.Destination) {
+	if self.filter.Match(destination) {
+		self.queue.push(destination)
+	}
+}
+
+// Interrupts the backoff of the recording threads, the destinations that fail from now on aren't retried
+func (self *Output) stopRetrying() {
+	self.stopRetriesOnce.Do(func() {
+		close(self.stopRetries)
+	})
+}
+
+// Records what is left in the queue and stops the recording threads
+func (self *Output) close() {
+	self.stopRetrying()
+	self.queue.close()
+	self.wg.Wait()
+	self.queue.closeSpool()
+}
+
+// Outputs sends every destination to all the outputs
+type Outputs struct {
+	outputs []*Output
+}
+
+func (self *Outputs) Add(output *Output) {
+	self.outputs = append(self.outputs, output)
+}
+
+func (self *Outputs) start() {
+	for _, output := range self.outputs {
+		output.start()
+	}
+}
+
+func (self *Outputs) push(destination *base.Destination) {
+	for _, output := range self.outputs {
+		output.push(destination)
+	}
+}
+
+func (self *Outputs) stopRetrying() {
+	for _, output := range self.outputs {
+		output.stopRetrying()
+	}
+}
+
+// close waits for all the outputs to record their destinations, they are closed at the same time so a slow one doesn't delay the others
+func (self *Outputs) close() {
+	var wg sync.WaitGroup
+	for _, output := range self.outputs {
+		wg.Add(1)
+		go func(output *Output) {
+			defer wg.Done()
+			output.close()
+		}(output)
+	}
+	wg.Wait()
+}
+
+func (self *Outputs) logStats() {
+	for _, output := range self.outputs {
+		Logger().Infof("output %s recording queue stats: %d queued, %d dropped", output.Name, output.queue.Len(), output.queue.Dropped())
+	}
+}
+
+func (self *Outputs) logHealth() {
+	for _, output := range self.outputs {
+		if healthy, since, err := output.health.Status(); !healthy {
+			Logger().Warningf("database of output %s is unavailable since %s: %s", output.Name, since, err)
+		}
+	}
+}
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"github.com/julsemaan/garin/base"
+	"io/ioutil"
+	"os"
+	"testing"
+)
+
+func newTestOutput(t *testing.T, name string, outputCfg OutputConfig) *Output {
+	defaults := BuildConfig(DEFAULT_CONF_FILE).Default_output
+	defaults.Include_protocols = outputCfg.Include_protocols
+	defaults.Exclude_protocols = outputCfg.Exclude_protocols
+	defaults.Include_hosts = outputCfg.Include_hosts
+	defaults.Exclude_hosts = outputCfg.Exclude_hosts
+	defaults.Include_subnets = outputCfg.Include_subnets
+	defaults.Exclude_subnets = outputCfg.Exclude_subnets
+	output, err := NewOutput(name, &defaults)
+	if err != nil {
+		t.Fatalf("Can't create output %s : %s", name, err)
+	}
+	return output
+}
+
+// The destination the tests of the package record, filter and publish
+func testDestination(serverName string, protocol string, sourceIp string) *base.Destination {
+	destination := base.NewDestination(serverName, sourceIp, "192.0.2.1")
+	destination.Protocol = protocol
+	return destination
+}
+
+func TestOutputFilter(t *testing.T) {
+	filter, err := NewOutputFilter(&OutputConfig{
+		Include_protocols: "tls/ssl",
+		Exclude_hosts:     "*.example.com, example.org",
+		Include_subnets:   "10.0.0.0/8,2001:db8::/32",
+	})
+	if err != nil {
+		t.Fatalf("Can't create filter : %s", err)
+	}
+	tests := []struct {
+		destination *base.Destination
+		match       bool
+	}{
+		{testDestination("example.net", "TLS/SSL", "10.0.0.1"), true},
+		{testDestination("example.net", "TLS/SSL", "2001:db8::1"), true},
+		{testDestination("example.net", "HTTP", "10.0.0.1"), false},
+		{testDestination("WWW.Example.com", "TLS/SSL", "10.0.0.1"), false},
+		{testDestination("example.org", "TLS/SSL", "10.0.0.1"), false},
+		{testDestination("example.net", "TLS/SSL", "172.16.0.1"), false},
+	}
+	for _, test := range tests {
+		if filter.Match(test.destination) != test.match {
+			t.Errorf("Filter match of %+v is %v instead of %v", test.destination, !test.match, test.match)
+		}
+	}
+
+	for _, outputCfg := range []OutputConfig{{Include_subnets: "10.0.0.0"}, {Exclude_hosts: "[example.com"}} {
+		if _, err := NewOutputFilter(&outputCfg); err == nil {
+			t.Errorf("Invalid filter %+v was accepted", outputCfg)
+		}
+	}
+}
+
+func TestOutputsFanOut(t *testing.T) {
+	all := newTestOutput(t, "all", OutputConfig{})
+	http := newTestOutput(t, "http", OutputConfig{Include_protocols: "HTTP"})
+	outputs := &Outputs{}
+	outputs.Add(all)
+	outputs.Add(http)
+
+	outputs.push(testDestination("example.com", "HTTP", "10.0.0.1"))
+	outputs.push(testDestination("example.com", "TLS/SSL", "10.0.0.1"))
+
+	if all.queue.Len() != 2 || http.queue.Len() != 1 {
+		t.Errorf("Outputs received %d and %d destinations instead of 2 and 1", all.queue.Len(), http.queue.Len())
+	}
+}
+
+func TestOutputSectionsDefaults(t *testing.T) {
+	file, _ := ioutil.TempFile("", "garin.conf")
+	defer os.Remove(file.Name())
+	file.WriteString("[output \"siem\"]\ntype=jsonl\nargs=/tmp/garin.jsonl\nbatch-size=10\n")
+	file.Close()
+
+	cfg := BuildConfig(file.Name())
+	outputCfg := cfg.Output["siem"]
+	if outputCfg == nil {
+		t.Fatal("Output section wasn't parsed")
+	}
+	if outputCfg.Type != "jsonl" || outputCfg.Batch_size != 10 || outputCfg.Recording_threads != 1 || outputCfg.Batch_max_latency != "1s" {
+		t.Errorf("Output section doesn't have the default values : %+v", outputCfg)
+	}
+}
@@ -1,6 +1,7 @@
 package main
 
 import (
+	"encoding/binary"
 	"github.com/google/gopacket"
 	"github.com/google/gopacket/tcpassembly"
 	"github.com/julsemaan/garin/base"
@@ -9,15 +10,53 @@ import (
 )
 
 // simpleStreamFactory implements tcpassembly.StreamFactory
-type sniffStreamFactory struct{}
+type sniffStreamFactory struct {
+	// interface on which the streams are captured
+	iface string
+	// tunnel of the packet being assembled
+	tunnel Tunnel
+	// Connections whose streams are being reassembled
+	// The assembler creates and completes the streams from the goroutine of its capture so it isn't locked
+	connections map[connectionKey]*sniffConnection
+}
+
+// Both directions of a connection have the same key
+type connectionKey struct {
+	net, transport gopacket.Flow
+}
+
+func newConnectionKey(net, transport gopacket.Flow) connectionKey {
+	if net.Dst().LessThan(net.Src()) || (net.Src() == net.Dst() && transport.Dst().LessThan(transport.Src())) {
+		return connectionKey{net.Reverse(), transport.Reverse()}
+	}
+	return connectionKey{net, transport}
+}
+
+// sniffConnection holds the streams of both directions of a TCP connection, which the assembler reassembles separately
+type sniffConnection struct {
+	key     connectionKey
+	streams []*sniffStream
+	// Streams whose reassembly isn't complete yet
+	open int
+	// The assembler ends the streams the same way on FIN and RST so the resets are flagged by the capture
+	reset bool
+}
 
 // sniffStream will handle the actual decoding of sniff requests.
 type sniffStream struct {
+	iface                                  string
+	tunnel                                 Tunnel
+	factory                                *sniffStreamFactory
+	connection                             *sniffConnection
 	net, transport                         gopacket.Flow
 	bytesLen, packets, outOfOrder, skipped int64
-	start, end                             time.Time
-	sawStart, sawEnd                       bool
-	bytes                                  []byte
+	start                                  time.Time
+	// Capture time of the first and last packets
+	first, end       time.Time
+	sawStart, sawEnd bool
+	bytes            []byte
+	// Receives the destination of the stream once it is parsed, nil if none was found
+	parsed chan *base.Destination
 }
 
 // New creates a new stream.  It's called whenever the assembler sees a stream
@@ -25,26 +64,96 @@ type sniffStream struct {
 func (factory *sniffStreamFactory) New(net, transport gopacket.Flow) tcpassembly.Stream {
 	//	log.Printf("new stream %v:%v started", net, transport)
 	s := &sniffStream{
+		iface:     factory.iface,
+		tunnel:    factory.tunnel,
+		factory:   factory,
 		net:       net,
 		transport: transport,
 		start:     time.Now(),
+		// The assembler creates the stream for the packet it is assembling
+		packets: 1,
+	}
+	if factory.connections == nil {
+		factory.connections = make(map[connectionKey]*sniffConnection)
 	}
-	s.end = s.start
+	key := newConnectionKey(net, transport)
+	connection := factory.connections[key]
+	if connection == nil {
+		connection = &sniffConnection{key: key}
+		factory.connections[key] = connection
+	}
+	connection.streams = append(connection.streams, s)
+	connection.open++
+	s.connection = connection
+	activeStreamsGauge.Inc()
 	// ReaderStream implements tcpassembly.Stream, so we can return a pointer to it.
 	return s
 }
 
+// count counts a packet in the stream of its direction and flags the connection when the packet has the RST flag
+// It must be called before the packet is assembled, the packets without payload are counted even though the assembler ignores them
+func (factory *sniffStreamFactory) count(net, transport gopacket.Flow, reset bool) {
+	connection := factory.connections[newConnectionKey(net, transport)]
+	if connection == nil {
+		return
+	}
+	if reset {
+		connection.reset = true
+	}
+	for _, s := range connection.streams {
+		if s.net == net && s.transport == transport {
+			s.packets++
+			return
+		}
+	}
+}
+
+// traffic returns the traffic of the connection as seen from the source of one of its streams
+func (self *sniffConnection) traffic(sent *sniffStream) base.Traffic {
+	traffic := base.Traffic{EndReason: base.END_REASON_FLUSH}
+	var first, end time.Time
+	for _, s := range self.streams {
+		if s == sent {
+			traffic.BytesSent += s.bytesLen
+			traffic.PacketsSent += s.packets
+		} else {
+			traffic.BytesReceived += s.bytesLen
+			traffic.PacketsReceived += s.packets
+		}
+		traffic.OutOfOrder += s.outOfOrder
+		traffic.SkippedBytes += s.skipped
+		if s.sawEnd {
+			traffic.EndReason = base.END_REASON_FIN
+		}
+		if !s.first.IsZero() && (first.IsZero() || s.first.Before(first)) {
+			first = s.first
+		}
+		if s.end.After(end) {
+			end = s.end
+		}
+	}
+	if self.reset {
+		traffic.EndReason = base.END_REASON_RST
+	}
+	if !first.IsZero() {
+		traffic.DurationMs = end.Sub(first).Milliseconds()
+	}
+	return traffic
+}
+
 // Reassembled is called whenever new packet data is available for reading.
 // Reassembly objects contain stream data IN ORDER.
 func (s *sniffStream) Reassembled(reassemblies []tcpassembly.Reassembly) {
 	for _, reassembly := range reassemblies {
+		if s.first.IsZero() || reassembly.Seen.Before(s.first) {
+			s.first = reassembly.Seen
+		}
 		if reassembly.Seen.Before(s.end) {
 			s.outOfOrder++
 		} else {
 			s.end = reassembly.Seen
 		}
 		s.bytesLen += int64(len(reassembly.Bytes))
-		s.packets += 1
 		if reassembly.Skip > 0 {
 			s.skipped += int64(reassembly.Skip)
 		}
@@ -54,20 +163,61 @@ func (s *sniffStream) Reassembled(reassemblies []tcpassembly.Reassembly) {
 	}
 }
 
+// Returns the port of a TCP endpoint
+func flowPort(endpoint gopacket.Endpoint) uint16 {
+	raw := endpoint.Raw()
+	if len(raw) != 2 {
+		return 0
+	}
+	return binary.BigEndian.Uint16(raw)
+}
+
+func countParseResult(protocol string, destination *base.Destination) {
+	if destination != nil {
+		parseResultsCounter.WithLabelValues(protocol, "success").Inc()
+	} else {
+		parseResultsCounter.WithLabelValues(protocol, "failure").Inc()
+	}
+}
+
 // ReassemblyComplete is called when the TCP assembler believes a stream has
 // finished.
+// The streams are parsed as soon as they are complete and recorded once both directions of their connection are so the destinations hold its whole traffic
 func (s *sniffStream) ReassemblyComplete() {
 	//diffSecs := float64(s.end.Sub(s.start)) / float64(time.Second)
 	//	log.Printf("Reassembly of stream %v:%v complete - start:%v end:%v bytes:%v packets:%v ooo:%v bps:%v pps:%v skipped:%v",
 	//s.net, s.transport, s.start, s.end, s.bytesLen, s.packets, s.outOfOrder,
 	//float64(s.bytesLen)/diffSecs, float64(s.packets)/diffSecs, s.skipped)
+	activeStreamsGauge.Dec()
+	s.parse()
+
+	connection := s.connection
+	connection.open--
+	if connection.open > 0 {
+		return
+	}
+	delete(s.factory.connections, connection.key)
+	for _, stream := range connection.streams {
+		stream.record(connection.traffic(stream))
+	}
+}
 
+// parse looks for the destination of the stream and publishes it on the live feed, it is recorded by record once its connection is complete
+func (s *sniffStream) parse() {
+	s.parsed = make(chan *base.Destination, 1)
+	parsingWg.Add(1)
 	go func() {
-		wg.Add(1)
 		parsingConcurrencyChan <- 1
 
+		// Protocol being parsed
+		protocol := ""
+		var destination *base.Destination
 		defer func() {
 			if r := recover(); r != nil {
+				destination = nil
+				if protocol != "" {
+					parseResultsCounter.WithLabelValues(protocol, "error").Inc()
+				}
 				err, ok := r.(error)
 				if ok && err.Error() == "runtime error: index out of range" {
 					Logger().Debug("Error decoding packet due to its unknown format. This is likely normal.", err.Error())
@@ -76,21 +226,25 @@ func (s *sniffStream) ReassemblyComplete() {
 				}
 			}
 			<-parsingConcurrencyChan
-			wg.Done()
+			s.parsed <- destination
+			parsingWg.Done()
 		}()
 
-		var destination *base.Destination
 		if params.UnencryptedPorts[s.transport.Src().String()] || params.UnencryptedPorts[s.transport.Dst().String()] {
+			protocol = "HTTP"
 			http_packet := &GarinUtil.Packet{Hosts: s.net, Ports: s.transport, Payload: s.bytes}
 			destination = ParseHTTP(http_packet)
+			countParseResult(protocol, destination)
 			if destination != nil {
 				destination.Protocol = "HTTP"
 			}
 		}
 
 		if params.EncryptedPorts[s.transport.Src().String()] || params.EncryptedPorts[s.transport.Dst().String()] {
+			protocol = "TLS/SSL"
 			https_packet := &GarinUtil.Packet{Hosts: s.net, Ports: s.transport, Payload: s.bytes}
 			destination = ParseHTTPS(https_packet)
+			countParseResult(protocol, destination)
 			if destination != nil {
 				destination.Protocol = "TLS/SSL"
 			}
@@ -98,8 +252,27 @@ func (s *sniffStream) ReassemblyComplete() {
 
 		if destination != nil {
 			destination.Timestamp = s.start
-			recordingQueue.push(destination)
-			Logger().Infof("Destination detected protocol='%s' source_ip='%s' destination_ip='%s' host='%s' packet_timestamp='%s'", destination.Protocol, destination.SourceIp, destination.DestinationIp, destination.ServerName, destination.Timestamp)
+			destination.Interface = s.iface
+			destination.TunnelType = s.tunnel.Type
+			destination.TunnelId = s.tunnel.Id
+			destination.SourcePort = flowPort(s.transport.Src())
+			destination.DestinationPort = flowPort(s.transport.Dst())
+			// The traffic is set on the destination that is recorded while the live feed may still be sending this copy
+			detected := *destination
+			live.publish(&detected)
+		}
+	}()
+}
+
+// record waits for the parsing of the stream and records its destination along with the traffic of its connection
+func (s *sniffStream) record(traffic base.Traffic) {
+	parsingWg.Add(1)
+	go func() {
+		defer parsingWg.Done()
+		if destination := <-s.parsed; destination != nil {
+			destination.Traffic = traffic
+			outputs.push(destination)
+			Logger().Infof("Destination detected protocol='%s' source_ip='%s' destination_ip='%s' host='%s' packet_timestamp='%s' interface='%s' tunnel='%s:%d' bytes_sent=%d bytes_received=%d end_reason='%s'", destination.Protocol, destination.SourceIp, destination.DestinationIp, destination.ServerName, destination.Timestamp, destination.Interface, destination.TunnelType, destination.TunnelId, destination.BytesSent, destination.BytesReceived, destination.EndReason)
 		}
 	}()
 }
@@ -0,0 +1,119 @@
+package main
+
+import (
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"github.com/google/gopacket/tcpassembly"
+	"github.com/julsemaan/garin/base"
+	"net"
+	"testing"
+	"time"
+)
+
+func testFlows(sourceIp string, sourcePort uint16, destinationIp string, destinationPort uint16) (gopacket.Flow, gopacket.Flow) {
+	netFlow := gopacket.NewFlow(layers.EndpointIPv4, net.ParseIP(sourceIp).To4(), net.ParseIP(destinationIp).To4())
+	transport := gopacket.NewFlow(layers.EndpointTCPPort, []byte{byte(sourcePort >> 8), byte(sourcePort)}, []byte{byte(destinationPort >> 8), byte(destinationPort)})
+	return netFlow, transport
+}
+
+func TestConnectionTraffic(t *testing.T) {
+	factory := &sniffStreamFactory{}
+	clientNet, clientTransport := testFlows("10.0.0.1", 40000, "192.0.2.1", 443)
+	start := time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)
+
+	client := factory.New(clientNet, clientTransport).(*sniffStream)
+	client.Reassembled([]tcpassembly.Reassembly{
+		{Bytes: make([]byte, 517), Seen: start, Start: true},
+		{Bytes: make([]byte, 100), Seen: start.Add(2 * time.Second)},
+	})
+	server := factory.New(clientNet.Reverse(), clientTransport.Reverse()).(*sniffStream)
+	// The packets are counted whether they carry payload or not, the first ones by the creation of the streams
+	for i := 0; i < 2; i++ {
+		factory.count(clientNet, clientTransport, false)
+	}
+	for i := 0; i < 3; i++ {
+		factory.count(clientNet.Reverse(), clientTransport.Reverse(), false)
+	}
+	server.Reassembled([]tcpassembly.Reassembly{
+		{Bytes: make([]byte, 3000), Seen: start.Add(100 * time.Millisecond), Start: true},
+		// Delivered after a packet that was captured later
+		{Bytes: make([]byte, 1000), Seen: start.Add(50 * time.Millisecond), Skip: 20, End: true},
+	})
+	// Another connection of the same hosts
+	otherNet, otherTransport := testFlows("10.0.0.1", 40001, "192.0.2.1", 443)
+	factory.New(otherNet, otherTransport)
+
+	if len(factory.connections) != 2 || client.connection != server.connection || client.connection.open != 2 {
+		t.Fatalf("Both directions of the connection weren't paired : %d connections", len(factory.connections))
+	}
+	expected := base.Traffic{BytesSent: 617, BytesReceived: 4000, PacketsSent: 3, PacketsReceived: 4, DurationMs: 2000, OutOfOrder: 1, SkippedBytes: 20, EndReason: base.END_REASON_FIN}
+	if traffic := client.connection.traffic(client); traffic != expected {
+		t.Errorf("Traffic of the connection is %+v instead of %+v", traffic, expected)
+	}
+	if traffic := client.connection.traffic(server); traffic.BytesSent != 4000 || traffic.BytesReceived != 617 {
+		t.Errorf("Traffic seen from the server is %+v", traffic)
+	}
+
+	factory.count(clientNet.Reverse(), clientTransport.Reverse(), true)
+	if traffic := client.connection.traffic(client); traffic.EndReason != base.END_REASON_RST {
+		t.Errorf("Reset connection ended with %s", traffic.EndReason)
+	}
+
+	// The connection is parsed once its other direction is complete as well
+	client.ReassemblyComplete()
+	if client.connection.open != 1 || factory.connections[client.connection.key] == nil {
+		t.Errorf("Connection was completed with one of its directions")
+	}
+}
+
+func TestFlushedConnectionTraffic(t *testing.T) {
+	factory := &sniffStreamFactory{}
+	clientNet, clientTransport := testFlows("10.0.0.1", 40000, "192.0.2.1", 80)
+	client := factory.New(clientNet, clientTransport).(*sniffStream)
+	client.Reassembled([]tcpassembly.Reassembly{{Bytes: make([]byte, 10), Seen: time.Now()}})
+	if traffic := client.connection.traffic(client); traffic.EndReason != base.END_REASON_FLUSH || traffic.BytesSent != 10 || traffic.DurationMs != 0 {
+		t.Errorf("Traffic of a flushed connection is %+v", traffic)
+	}
+}
+
+func TestStreamParsedBeforeConnectionCompletes(t *testing.T) {
+	filter, _ := NewOutputFilter(&OutputConfig{})
+	client := live.subscribe(filter)
+	defer live.unsubscribe(client)
+	output := newTestOutput(t, "parsed", OutputConfig{})
+	previous := outputs
+	outputs = &Outputs{}
+	outputs.Add(output)
+	defer func() { outputs = previous }()
+
+	factory := &sniffStreamFactory{}
+	clientNet, clientTransport := testFlows("10.0.0.1", 40000, "192.0.2.1", 80)
+	request := factory.New(clientNet, clientTransport).(*sniffStream)
+	request.Reassembled([]tcpassembly.Reassembly{{Bytes: []byte("GET / HTTP/1.1\r\nHost: example.com\r\n\r\n"), Seen: time.Now(), Start: true}})
+	response := factory.New(clientNet.Reverse(), clientTransport.Reverse()).(*sniffStream)
+
+	// The destination is detected as soon as the request is complete
+	request.ReassemblyComplete()
+	select {
+	case destination := <-client.destinations:
+		if destination.ServerName != "example.com" || destination.SourcePort != 40000 {
+			t.Errorf("Detected destination is %+v", destination)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Destination wasn't published before the connection was complete")
+	}
+	if output.queue.Len() != 0 {
+		t.Errorf("Destination was recorded before the connection was complete")
+	}
+
+	// And recorded along with the traffic of the connection once it is complete
+	response.Reassembled([]tcpassembly.Reassembly{{Bytes: make([]byte, 100), Seen: time.Now(), Start: true, End: true}})
+	response.ReassemblyComplete()
+	parsingWg.Wait()
+	if output.queue.Len() != 1 {
+		t.Fatalf("%d destinations were recorded instead of 1", output.queue.Len())
+	}
+	if destination := output.queue.queue.Shift().(*base.Destination); destination.ServerName != "example.com" || destination.BytesReceived != 100 || destination.EndReason != base.END_REASON_FIN {
+		t.Errorf("Recorded destination is %+v", destination)
+	}
+}
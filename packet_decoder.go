@@ -0,0 +1,159 @@
+package main
+
+import (
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"time"
+)
+
+// PacketDecoder decodes the captured packets down to their TCP layer, going through the tunnels it finds on the way.
+// Tunnelled packets are decoded using the same layers as the outer packet so the layers hold the values of the innermost packet once decoded.
+// Fragmented IP packets are handed to the defragmenter and the decoding continues from their payload once they are reassembled.
+//
+// We use a DecodingLayerParser here instead of a simpler PacketSource.
+// This approach should be measurably faster, but is also more rigid.
+// PacketSource will handle any known type of packet safely and easily,
+// but DecodingLayerParser will only handle those packet types we
+// specifically pass in.  This trade-off can be quite useful, though, in
+// high-throughput situations.
+type PacketDecoder struct {
+	parser *gopacket.DecodingLayerParser
+	// Parsers used to decode the reassembled payloads, by the type of their first layer
+	reassembledParsers map[gopacket.LayerType]*gopacket.DecodingLayerParser
+	Decoded            []gopacket.LayerType
+
+	eth           layers.Ethernet
+	sll           layers.LinuxSLL
+	sll2          LinuxSLL2
+	loopback      layers.Loopback
+	rawIP         RawIP
+	radiotap      layers.RadioTap
+	dot11         layers.Dot11
+	dot11QOSData  layers.Dot11DataQOSData
+	dot11Data     layers.Dot11Data
+	llc           layers.LLC
+	snap          layers.SNAP
+	vlan          vlanLayer
+	mpls          mplsLayer
+	ip4           layers.IPv4
+	ip6           layers.IPv6
+	ip6extensions layers.IPv6ExtensionSkipper
+	ip6fragment   ipv6FragmentLayer
+	udp           layers.UDP
+	gre           greLayer
+	erspanII      erspanIILayer
+	erspanIII     erspanIIILayer
+	vxlan         vxlanLayer
+	geneve        geneveLayer
+	payload       gopacket.Payload
+
+	// Reassembles the fragmented packets, they are ignored when it is nil
+	Defragmenter *IPDefragmenter
+
+	// Valid after a successful call to Decode
+	TCP     layers.TCP
+	NetFlow gopacket.Flow
+	Tunnel  Tunnel
+}
+
+// NewPacketDecoder creates a decoder for the packets of a link type
+func NewPacketDecoder(linkType layers.LinkType) (*PacketDecoder, error) {
+	firstLayerType, err := FirstLayerType(linkType)
+	if err != nil {
+		return nil, err
+	}
+
+	decoder := &PacketDecoder{}
+	decoder.vlan.tunnel = &decoder.Tunnel
+	decoder.mpls.tunnel = &decoder.Tunnel
+	decoder.gre.tunnel = &decoder.Tunnel
+	decoder.erspanII.tunnel = &decoder.Tunnel
+	decoder.erspanIII.tunnel = &decoder.Tunnel
+	decoder.vxlan.tunnel = &decoder.Tunnel
+	decoder.geneve.tunnel = &decoder.Tunnel
+
+	decoder.parser = decoder.newParser(firstLayerType)
+	decoder.reassembledParsers = make(map[gopacket.LayerType]*gopacket.DecodingLayerParser)
+	decoder.Decoded = make([]gopacket.LayerType, 0, 16)
+	return decoder, nil
+}
+
+// All the parsers share the same layers
+func (self *PacketDecoder) newParser(firstLayerType gopacket.LayerType) *gopacket.DecodingLayerParser {
+	parser := gopacket.NewDecodingLayerParser(firstLayerType,
+		&self.eth, &self.sll, &self.sll2, &self.loopback, &self.rawIP,
+		&self.radiotap, &self.dot11, &self.dot11QOSData, &self.dot11Data, &self.llc, &self.snap,
+		&self.vlan, &self.mpls, &self.ip4, &self.ip6, &self.ip6extensions, &self.ip6fragment,
+		&self.udp, &self.gre, &self.erspanII, &self.erspanIII, &self.vxlan, &self.geneve,
+		&self.TCP, &self.payload)
+	// Packets that aren't TCP can end up in layers we don't decode, they are ignored afterwards since there is no TCP layer
+	parser.IgnoreUnsupported = true
+	return parser
+}
+
+// Decode decodes the packet and returns whether or not it contains a TCP layer along with its network layer
+// The timestamp of the packet is used to expire the fragments that are never completed
+func (self *PacketDecoder) Decode(data []byte, timestamp time.Time) (bool, error) {
+	self.Tunnel = Tunnel{}
+	parser := self.parser
+	// Find either the IPv4 or IPv6 address to use as our network
+	// layer. The last one seen before the TCP layer is the one of the innermost packet.
+	foundNetLayer := false
+	for {
+		err := parser.DecodeLayers(data, &self.Decoded)
+		if err != nil {
+			return false, err
+		}
+
+		for _, typ := range self.Decoded {
+			switch typ {
+			case layers.LayerTypeIPv4:
+				self.NetFlow = self.ip4.NetworkFlow()
+				foundNetLayer = true
+			case layers.LayerTypeIPv6:
+				self.NetFlow = self.ip6.NetworkFlow()
+				foundNetLayer = true
+			case layers.LayerTypeTCP:
+				if foundNetLayer {
+					return true, nil
+				}
+				Logger().Debug("could not find IPv4 or IPv6 layer, inoring")
+				return false, nil
+			}
+		}
+
+		// Fragments are the last layer that can be decoded, the decoding continues with the payload once it is reassembled
+		var protocol layers.IPProtocol
+		data, protocol = self.defragment(timestamp)
+		if data == nil {
+			Logger().Debug("could not find TCP layer")
+			return false, nil
+		}
+		parser = self.reassembledParser(protocol.LayerType())
+	}
+}
+
+// Gives the last decoded layer to the defragmenter when it is a fragment
+func (self *PacketDecoder) defragment(timestamp time.Time) ([]byte, layers.IPProtocol) {
+	if self.Defragmenter == nil || len(self.Decoded) == 0 {
+		return nil, 0
+	}
+	switch self.Decoded[len(self.Decoded)-1] {
+	case layers.LayerTypeIPv4:
+		if self.ip4.Flags&layers.IPv4MoreFragments != 0 || self.ip4.FragOffset != 0 {
+			return self.Defragmenter.DefragmentIPv4(&self.ip4, self.Tunnel, timestamp)
+		}
+	case layers.LayerTypeIPv6Fragment:
+		return self.Defragmenter.DefragmentIPv6(&self.ip6, &self.ip6fragment.IPv6Fragment, self.Tunnel, timestamp)
+	}
+	return nil, 0
+}
+
+func (self *PacketDecoder) reassembledParser(firstLayerType gopacket.LayerType) *gopacket.DecodingLayerParser {
+	parser, ok := self.reassembledParsers[firstLayerType]
+	if !ok {
+		parser = self.newParser(firstLayerType)
+		self.reassembledParsers[firstLayerType] = parser
+	}
+	return parser
+}
@@ -0,0 +1,258 @@
+package main
+
+import (
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"net"
+	"testing"
+	"time"
+)
+
+func serializeTestPacket(t *testing.T, packetLayers ...gopacket.SerializableLayer) []byte {
+	buf := gopacket.NewSerializeBuffer()
+	err := gopacket.SerializeLayers(buf, gopacket.SerializeOptions{FixLengths: true}, packetLayers...)
+	if err != nil {
+		t.Fatalf("Can't serialize test packet: %s", err)
+	}
+	return buf.Bytes()
+}
+
+func testEthernet(ethernetType layers.EthernetType) *layers.Ethernet {
+	return &layers.Ethernet{
+		SrcMAC:       net.HardwareAddr{0, 1, 2, 3, 4, 5},
+		DstMAC:       net.HardwareAddr{0, 1, 2, 3, 4, 6},
+		EthernetType: ethernetType,
+	}
+}
+
+func testIPv4(src string, dst string, protocol layers.IPProtocol) *layers.IPv4 {
+	return &layers.IPv4{Version: 4, TTL: 64, Protocol: protocol, SrcIP: net.ParseIP(src), DstIP: net.ParseIP(dst)}
+}
+
+// The inner packet carried by the tunnels
+func testInnerPacket() []gopacket.SerializableLayer {
+	return []gopacket.SerializableLayer{
+		testIPv4("10.0.0.1", "10.0.0.2", layers.IPProtocolTCP),
+		&layers.TCP{SrcPort: 51000, DstPort: 443, SYN: true},
+	}
+}
+
+func testInnerFrame() []gopacket.SerializableLayer {
+	return append([]gopacket.SerializableLayer{testEthernet(layers.EthernetTypeIPv4)}, testInnerPacket()...)
+}
+
+func assertDecodedInnerPacket(t *testing.T, data []byte, expectedTunnel Tunnel) {
+	assertDecodedLinkTypePacket(t, layers.LinkTypeEthernet, data, expectedTunnel)
+}
+
+func assertDecodedLinkTypePacket(t *testing.T, linkType layers.LinkType, data []byte, expectedTunnel Tunnel) {
+	decoder, err := NewPacketDecoder(linkType)
+	if err != nil {
+		t.Fatalf("Can't create decoder: %s", err)
+	}
+	found, err := decoder.Decode(data, time.Now())
+	if err != nil {
+		t.Fatalf("Error while decoding packet: %s", err)
+	}
+	if !found {
+		t.Fatalf("TCP layer wasn't found in %v", decoder.Decoded)
+	}
+	if decoder.NetFlow.Src().String() != "10.0.0.1" || decoder.NetFlow.Dst().String() != "10.0.0.2" {
+		t.Errorf("Network flow isn't the one of the inner packet : %s", decoder.NetFlow)
+	}
+	if decoder.TCP.DstPort != 443 {
+		t.Errorf("TCP destination port is incorrect %d instead of 443", decoder.TCP.DstPort)
+	}
+	if decoder.Tunnel != expectedTunnel {
+		t.Errorf("Tunnel is incorrect %+v instead of %+v", decoder.Tunnel, expectedTunnel)
+	}
+}
+
+func TestPacketDecoderNoTunnel(t *testing.T) {
+	data := serializeTestPacket(t, testInnerFrame()...)
+	assertDecodedInnerPacket(t, data, Tunnel{})
+}
+
+func TestPacketDecoderQinQ(t *testing.T) {
+	packet := []gopacket.SerializableLayer{
+		testEthernet(layers.EthernetTypeQinQ),
+		&layers.Dot1Q{VLANIdentifier: 100, Type: layers.EthernetTypeDot1Q},
+		&layers.Dot1Q{VLANIdentifier: 200, Type: layers.EthernetTypeIPv4},
+	}
+	data := serializeTestPacket(t, append(packet, testInnerPacket()...)...)
+	assertDecodedInnerPacket(t, data, Tunnel{Type: TUNNEL_TYPE_VLAN, Id: 100})
+}
+
+func TestPacketDecoderMPLS(t *testing.T) {
+	packet := []gopacket.SerializableLayer{
+		testEthernet(layers.EthernetTypeMPLSUnicast),
+		&layers.MPLS{Label: 16, TTL: 64},
+		&layers.MPLS{Label: 17, TTL: 64, StackBottom: true},
+	}
+	data := serializeTestPacket(t, append(packet, testInnerPacket()...)...)
+	assertDecodedInnerPacket(t, data, Tunnel{Type: TUNNEL_TYPE_MPLS, Id: 16})
+}
+
+func TestPacketDecoderVXLAN(t *testing.T) {
+	packet := []gopacket.SerializableLayer{
+		testEthernet(layers.EthernetTypeIPv4),
+		testIPv4("192.168.0.1", "192.168.0.2", layers.IPProtocolUDP),
+		&layers.UDP{SrcPort: 40000, DstPort: 4789},
+		&layers.VXLAN{ValidIDFlag: true, VNI: 42},
+	}
+	data := serializeTestPacket(t, append(packet, testInnerFrame()...)...)
+	assertDecodedInnerPacket(t, data, Tunnel{Type: TUNNEL_TYPE_VXLAN, Id: 42})
+}
+
+func TestPacketDecoderGeneve(t *testing.T) {
+	packet := []gopacket.SerializableLayer{
+		testEthernet(layers.EthernetTypeIPv4),
+		testIPv4("192.168.0.1", "192.168.0.2", layers.IPProtocolUDP),
+		&layers.UDP{SrcPort: 40000, DstPort: 6081},
+		// No options, transparent ethernet bridging, VNI 0x010203
+		gopacket.Payload{0x00, 0x00, 0x65, 0x58, 0x01, 0x02, 0x03, 0x00},
+	}
+	data := serializeTestPacket(t, append(packet, testInnerFrame()...)...)
+	assertDecodedInnerPacket(t, data, Tunnel{Type: TUNNEL_TYPE_GENEVE, Id: 0x010203})
+
+	// The options of the previous packets must not be kept by the decoder
+	decoder, _ := NewPacketDecoder(layers.LinkTypeEthernet)
+	withOption := serializeTestPacket(t, append(append(packet[:3:3],
+		gopacket.Payload{0x01, 0x00, 0x65, 0x58, 0x01, 0x02, 0x03, 0x00, 0x01, 0x02, 0x03, 0x00}), testInnerFrame()...)...)
+	for i := 0; i < 2; i++ {
+		if _, err := decoder.Decode(withOption, time.Now()); err != nil {
+			t.Fatalf("Error while decoding packet: %s", err)
+		}
+	}
+	if len(decoder.geneve.Options) != 1 {
+		t.Errorf("Geneve options are kept between packets, %d options instead of 1", len(decoder.geneve.Options))
+	}
+}
+
+func TestPacketDecoderGREKey(t *testing.T) {
+	packet := []gopacket.SerializableLayer{
+		testEthernet(layers.EthernetTypeIPv4),
+		testIPv4("192.168.0.1", "192.168.0.2", layers.IPProtocolGRE),
+		&layers.GRE{KeyPresent: true, Key: 1234, Protocol: layers.EthernetTypeTransparentEthernetBridging},
+	}
+	data := serializeTestPacket(t, append(packet, testInnerFrame()...)...)
+	assertDecodedInnerPacket(t, data, Tunnel{Type: TUNNEL_TYPE_GRE, Id: 1234})
+}
+
+func TestPacketDecoderERSPANI(t *testing.T) {
+	packet := []gopacket.SerializableLayer{
+		testEthernet(layers.EthernetTypeIPv4),
+		testIPv4("192.168.0.1", "192.168.0.2", layers.IPProtocolGRE),
+		&layers.GRE{Protocol: layers.EthernetTypeERSPAN},
+	}
+	data := serializeTestPacket(t, append(packet, testInnerFrame()...)...)
+	// Type I has no header so there is no session to identify the tunnel
+	assertDecodedInnerPacket(t, data, Tunnel{})
+}
+
+func TestPacketDecoderERSPANII(t *testing.T) {
+	packet := []gopacket.SerializableLayer{
+		testEthernet(layers.EthernetTypeIPv4),
+		testIPv4("192.168.0.1", "192.168.0.2", layers.IPProtocolGRE),
+		&layers.GRE{SeqPresent: true, Seq: 1, Protocol: layers.EthernetTypeERSPAN},
+		&layers.ERSPANII{Version: layers.ERSPANIIVersion, SessionID: 7},
+	}
+	data := serializeTestPacket(t, append(packet, testInnerFrame()...)...)
+	assertDecodedInnerPacket(t, data, Tunnel{Type: TUNNEL_TYPE_ERSPAN, Id: 7})
+}
+
+func TestPacketDecoderERSPANIII(t *testing.T) {
+	packet := []gopacket.SerializableLayer{
+		testEthernet(layers.EthernetTypeIPv4),
+		testIPv4("192.168.0.1", "192.168.0.2", layers.IPProtocolGRE),
+		&layers.GRE{SeqPresent: true, Seq: 1, Protocol: ethernetTypeERSPANIII},
+		// Version 2, VLAN 10, session 300, ethernet frame, platform specific subheader present
+		gopacket.Payload{0x20, 0x0a, 0x01, 0x2c, 0, 0, 0, 0, 0, 0, 0x00, 0x01, 0, 0, 0, 0, 0, 0, 0, 0},
+	}
+	data := serializeTestPacket(t, append(packet, testInnerFrame()...)...)
+	assertDecodedInnerPacket(t, data, Tunnel{Type: TUNNEL_TYPE_ERSPAN, Id: 300})
+
+	// IP frame type, no subheader
+	packet[3] = gopacket.Payload{0x20, 0x0a, 0x01, 0x2c, 0, 0, 0, 0, 0, 0, 0x08, 0x00}
+	data = serializeTestPacket(t, append(packet, testInnerPacket()...)...)
+	assertDecodedInnerPacket(t, data, Tunnel{Type: TUNNEL_TYPE_ERSPAN, Id: 300})
+}
+
+func TestPacketDecoderNotTCP(t *testing.T) {
+	data := serializeTestPacket(t,
+		testEthernet(layers.EthernetTypeIPv4),
+		testIPv4("10.0.0.1", "10.0.0.2", layers.IPProtocolUDP),
+		&layers.UDP{SrcPort: 40000, DstPort: 53},
+		gopacket.Payload{1, 2, 3, 4},
+	)
+	decoder, _ := NewPacketDecoder(layers.LinkTypeEthernet)
+	found, err := decoder.Decode(data, time.Now())
+	if err != nil {
+		t.Fatalf("Error while decoding packet: %s", err)
+	}
+	if found {
+		t.Error("TCP layer was found in a UDP packet")
+	}
+}
+
+func TestPacketDecoderLinuxSLL(t *testing.T) {
+	// Outgoing packet, ethernet address, IPv4
+	header := gopacket.Payload{0x00, 0x04, 0x00, 0x01, 0x00, 0x06, 0, 1, 2, 3, 4, 5, 0, 0, 0x08, 0x00}
+	data := serializeTestPacket(t, append([]gopacket.SerializableLayer{header}, testInnerPacket()...)...)
+	assertDecodedLinkTypePacket(t, layers.LinkTypeLinuxSLL, data, Tunnel{})
+}
+
+func TestPacketDecoderLinuxSLL2(t *testing.T) {
+	// IPv4, interface 2, ethernet address, outgoing packet
+	header := gopacket.Payload{0x08, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x02, 0x00, 0x01, 0x04, 0x06, 0, 1, 2, 3, 4, 5, 0, 0}
+	data := serializeTestPacket(t, append([]gopacket.SerializableLayer{header}, testInnerPacket()...)...)
+	assertDecodedLinkTypePacket(t, LinkTypeLinuxSLL2, data, Tunnel{})
+}
+
+func TestPacketDecoderRawIP(t *testing.T) {
+	data := serializeTestPacket(t, testInnerPacket()...)
+	assertDecodedLinkTypePacket(t, layers.LinkTypeRaw, data, Tunnel{})
+	assertDecodedLinkTypePacket(t, layers.LinkTypeIPv4, data, Tunnel{})
+}
+
+func TestPacketDecoderLoopback(t *testing.T) {
+	data := serializeTestPacket(t, append([]gopacket.SerializableLayer{&layers.Loopback{Family: layers.ProtocolFamilyIPv4}}, testInnerPacket()...)...)
+	assertDecodedLinkTypePacket(t, layers.LinkTypeNull, data, Tunnel{})
+}
+
+func testDot11Frame(t *testing.T, frameType layers.Dot11Type) []byte {
+	packet := []gopacket.SerializableLayer{
+		&layers.Dot11{
+			Type:     frameType,
+			Flags:    layers.Dot11FlagsToDS,
+			Address1: net.HardwareAddr{0, 1, 2, 3, 4, 5},
+			Address2: net.HardwareAddr{0, 1, 2, 3, 4, 6},
+			Address3: net.HardwareAddr{0, 1, 2, 3, 4, 7},
+		},
+	}
+	if frameType == layers.Dot11TypeDataQOSData {
+		packet = append(packet, gopacket.Payload{0x00, 0x00})
+	}
+	packet = append(packet,
+		&layers.LLC{DSAP: 0xaa, SSAP: 0xaa, Control: 0x03},
+		&layers.SNAP{OrganizationalCode: []byte{0, 0, 0}, Type: layers.EthernetTypeIPv4},
+	)
+	return serializeTestPacket(t, append(packet, testInnerPacket()...)...)
+}
+
+func TestPacketDecoderRadiotap(t *testing.T) {
+	// Radiotap header without any field
+	withoutFCS := append([]byte{0x00, 0x00, 0x08, 0x00, 0x00, 0x00, 0x00, 0x00}, testDot11Frame(t, layers.Dot11TypeData)...)
+	assertDecodedLinkTypePacket(t, layers.LinkTypeIEEE80211Radio, withoutFCS, Tunnel{})
+
+	// Radiotap header with the flags field saying the frame ends with a FCS
+	withFCS := append([]byte{0x00, 0x00, 0x09, 0x00, 0x02, 0x00, 0x00, 0x00, 0x10}, testDot11Frame(t, layers.Dot11TypeDataQOSData)...)
+	withFCS = append(withFCS, 0xde, 0xad, 0xbe, 0xef)
+	assertDecodedLinkTypePacket(t, layers.LinkTypeIEEE80211Radio, withFCS, Tunnel{})
+}
+
+func TestPacketDecoderUnsupportedLinkType(t *testing.T) {
+	if _, err := NewPacketDecoder(layers.LinkTypeTokenRing); err == nil {
+		t.Error("Decoder was created for an unsupported link type")
+	}
+}
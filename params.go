@@ -4,7 +4,9 @@ import (
 	"flag"
 	"fmt"
 	"github.com/davecgh/go-spew/spew"
+	"github.com/julsemaan/garin/base"
 	"regexp"
+	"strings"
 )
 
 type Params struct {
@@ -13,9 +15,14 @@ type Params struct {
 	AllPorts               []string
 	ParsingConcurrency     *int
 	RecordingThreads       *int
+	RecordingQueueCapacity *int
+	RecordingQueueOverflow *string
 	DontRecordDestinations *bool
+	CaptureBackend         *string
 	Iface                  *string
+	Ifaces                 []string
 	PcapFile               *string
+	DecapsulateTunnels     *bool
 	LogAllPackets          *bool
 	BufferedPerConnection  *int
 	BufferedTotal          *int
@@ -32,6 +39,8 @@ func NewParams(cfg *Config) *Params {
 	params.ParsingConcurrency = flag.Int("parsing-concurrency", cfg.General.Parsing_concurrency, "Amount of concurrent threads that will parse the incoming traffic")
 
 	params.RecordingThreads = flag.Int("recording-threads", cfg.General.Recording_threads, "Amount of concurrent threads that will work the recording queue (used to persist parsed data)")
+	params.RecordingQueueCapacity = flag.Int("recording-queue-capacity", cfg.General.Recording_queue_capacity, "Maximum amount of destinations waiting to be recorded. If zero or less, this is infinite")
+	params.RecordingQueueOverflow = flag.String("recording-queue-overflow", cfg.General.Recording_queue_overflow, "What to do when the recording queue is full (block, drop-oldest or drop-newest)")
 	params.DontRecordDestinations = flag.Bool("dont-record-destinations", cfg.General.Dont_record_destinations, "Don't record the destinations in the DB backend")
 
 	var unencryptedPortsArg = flag.String("unencrypted-ports", cfg.Capture.Unencrypted_ports, "The ports on which to parse unencrypted HTTP traffic")
@@ -40,8 +49,10 @@ func NewParams(cfg *Config) *Params {
 	params.UnencryptedPorts = make(map[string]bool)
 	params.EncryptedPorts = make(map[string]bool)
 
-	params.Iface = flag.String("i", cfg.Capture.Interface, "Interface to get packets from")
+	params.CaptureBackend = flag.String("capture-backend", cfg.Capture.Backend, "Backend to use for live captures (pcap or afpacket)")
+	params.Iface = flag.String("i", cfg.Capture.Interface, "Interfaces to get packets from (comma separated)")
 	params.PcapFile = flag.String("offline-pcap", "", "PCAP file to read from (ignores -i)")
+	params.DecapsulateTunnels = flag.Bool("decapsulate-tunnels", cfg.Capture.Decapsulate_tunnels, "Capture the tunnelled traffic (VXLAN, GENEVE, GRE, ERSPAN, 802.1Q, MPLS) in order to decode the packets it carries")
 	params.LogAllPackets = flag.Bool("log-all-packets", false, "Log whenever we see a packet")
 	params.BufferedPerConnection = flag.Int("connection-max-buffer", cfg.Capture.Buffered_per_connection, `Max packets to buffer for a single connection before skipping over a gap in data
 	and continuing to stream the connection after the buffer.  If zero or less, this
@@ -72,6 +83,30 @@ func NewParams(cfg *Config) *Params {
 	}
 	params.AllPorts = allPorts
 
+	// The captures are tracked by interface name so an interface can't be captured twice
+	seenIfaces := make(map[string]bool)
+	for _, iface := range splitInterfaces(*params.Iface) {
+		if seenIfaces[iface] {
+			base.Die("interface ", iface, " is listed more than once")
+		}
+		seenIfaces[iface] = true
+		params.Ifaces = append(params.Ifaces, iface)
+	}
+	if len(params.Ifaces) == 0 && *params.PcapFile == "" {
+		base.Die("no interface to capture from")
+	}
+
 	fmt.Println("Starting using parameters : ", spew.Sdump(params))
 	return params
 }
+
+// Splits a comma separated list of interfaces, ignoring the spaces around the names and the empty entries
+func splitInterfaces(list string) []string {
+	var ifaces []string
+	for _, iface := range strings.Split(list, ",") {
+		if iface = strings.TrimSpace(iface); iface != "" {
+			ifaces = append(ifaces, iface)
+		}
+	}
+	return ifaces
+}
@@ -1,37 +1,205 @@
 package main
 
 import (
+	"fmt"
 	"sync"
+	"time"
 )
 
+// What happens when pushing to a full queue
+const (
+	// Wait for a consumer to make some room
+	QUEUE_OVERFLOW_BLOCK = "block"
+	// Drop the oldest element in the queue to make room for the new one
+	QUEUE_OVERFLOW_DROP_OLDEST = "drop-oldest"
+	// Drop the element being pushed
+	QUEUE_OVERFLOW_DROP_NEWEST = "drop-newest"
+)
+
+// Initial amount of elements allocated, the buffer then grows as needed up to the capacity
+const QUEUE_INITIAL_SIZE = 64
+
+// Queue is a FIFO queue with an optional capacity that consumers can wait on
+// The elements are kept in a ring buffer so the memory of the shifted elements is reused
 type Queue struct {
-	queue      []interface{}
-	queueMutex *sync.Mutex
+	queue []interface{}
+	// Index of the first element in the ring buffer
+	head int
+	// Amount of elements in the queue
+	size int
+	// 0 or less is infinite
+	capacity       int
+	overflowPolicy string
+	closed         bool
+	dropped        uint64
+	queueMutex     *sync.Mutex
+	notEmpty       *sync.Cond
+	notFull        *sync.Cond
 }
 
-func NewQueue() *Queue {
+func NewQueue(capacity int, overflowPolicy string) (*Queue, error) {
+	switch overflowPolicy {
+	case QUEUE_OVERFLOW_BLOCK, QUEUE_OVERFLOW_DROP_OLDEST, QUEUE_OVERFLOW_DROP_NEWEST:
+	default:
+		return nil, fmt.Errorf("unknown queue overflow policy %q", overflowPolicy)
+	}
+
 	queue := &Queue{}
-	queue.queue = make([]interface{}, 0)
+	initialSize := QUEUE_INITIAL_SIZE
+	if capacity > 0 && capacity < initialSize {
+		initialSize = capacity
+	}
+	queue.queue = make([]interface{}, initialSize)
+	queue.capacity = capacity
+	queue.overflowPolicy = overflowPolicy
 	queue.queueMutex = &sync.Mutex{}
-	return queue
+	queue.notEmpty = sync.NewCond(queue.queueMutex)
+	queue.notFull = sync.NewCond(queue.queueMutex)
+	return queue, nil
+}
+
+func (self *Queue) full() bool {
+	return self.capacity > 0 && self.size >= self.capacity
 }
 
-func (self *Queue) Push(o interface{}) {
+// Push adds an element at the end of the queue and returns whether or not it was added
+// When the queue is full, the overflow policy decides which element is dropped, if any
+// Elements pushed to a closed queue are dropped
+func (self *Queue) Push(o interface{}) bool {
 	self.queueMutex.Lock()
-	self.queue = append(self.queue, o)
-	self.queueMutex.Unlock()
+	defer self.queueMutex.Unlock()
+
+	for self.full() && !self.closed {
+		switch self.overflowPolicy {
+		case QUEUE_OVERFLOW_DROP_NEWEST:
+			self.dropped++
+			return false
+		case QUEUE_OVERFLOW_DROP_OLDEST:
+			self.shift()
+			self.dropped++
+		default:
+			self.notFull.Wait()
+		}
+	}
+	if self.closed {
+		self.dropped++
+		return false
+	}
+
+	if self.size == len(self.queue) {
+		self.grow()
+	}
+	self.queue[(self.head+self.size)%len(self.queue)] = o
+	self.size++
+	self.notEmpty.Signal()
+	return true
+}
+
+// Doubles the size of the ring buffer without going over the capacity
+func (self *Queue) grow() {
+	newSize := len(self.queue) * 2
+	if self.capacity > 0 && newSize > self.capacity {
+		newSize = self.capacity
+	}
+	queue := make([]interface{}, newSize)
+	for i := 0; i < self.size; i++ {
+		queue[i] = self.queue[(self.head+i)%len(self.queue)]
+	}
+	self.queue = queue
+	self.head = 0
+}
+
+// Removes the first element, the queue mutex must be held
+func (self *Queue) shift() interface{} {
+	if self.size == 0 {
+		return nil
+	}
+	o := self.queue[self.head]
+	// Release the reference so the element can be garbage collected
+	self.queue[self.head] = nil
+	self.head = (self.head + 1) % len(self.queue)
+	self.size--
+	self.notFull.Signal()
+	return o
 }
 
+// Shift removes the first element of the queue and returns it, or nil if the queue is empty
 func (self *Queue) Shift() interface{} {
 	self.queueMutex.Lock()
-	var o interface{}
-	if len(self.queue) > 0 {
-		o, self.queue = self.queue[0], self.queue[1:]
+	defer self.queueMutex.Unlock()
+	return self.shift()
+}
+
+// Pop waits for an element to be available and removes it from the queue
+// Once the queue is closed, the remaining elements are returned after which it returns false
+func (self *Queue) Pop() (interface{}, bool) {
+	self.queueMutex.Lock()
+	defer self.queueMutex.Unlock()
+	for self.size == 0 {
+		if self.closed {
+			return nil, false
+		}
+		self.notEmpty.Wait()
 	}
-	self.queueMutex.Unlock()
-	return o
+	return self.shift(), true
+}
+
+// PopBatch waits for an element to be available and then for more elements until there are max of them or maxWait has elapsed
+// Once the queue is closed, the remaining elements are returned without waiting after which it returns false
+func (self *Queue) PopBatch(max int, maxWait time.Duration) ([]interface{}, bool) {
+	self.queueMutex.Lock()
+	defer self.queueMutex.Unlock()
+	for self.size == 0 {
+		if self.closed {
+			return nil, false
+		}
+		self.notEmpty.Wait()
+	}
+
+	batch := make([]interface{}, 0, max)
+	deadline := time.Now().Add(maxWait)
+	// Wakes up the wait below once the deadline is reached
+	timer := time.AfterFunc(maxWait, func() {
+		self.queueMutex.Lock()
+		self.notEmpty.Broadcast()
+		self.queueMutex.Unlock()
+	})
+	defer timer.Stop()
+	for len(batch) < max {
+		if self.size > 0 {
+			batch = append(batch, self.shift())
+		} else if self.closed || !time.Now().Before(deadline) {
+			break
+		} else {
+			self.notEmpty.Wait()
+		}
+	}
+	return batch, true
+}
+
+// Close wakes up the consumers and the producers waiting on the queue
+// The elements already in the queue can still be popped but new ones are dropped
+func (self *Queue) Close() {
+	self.queueMutex.Lock()
+	defer self.queueMutex.Unlock()
+	self.closed = true
+	self.notEmpty.Broadcast()
+	self.notFull.Broadcast()
+}
+
+func (self *Queue) Len() int {
+	self.queueMutex.Lock()
+	defer self.queueMutex.Unlock()
+	return self.size
 }
 
 func (self *Queue) IsEmpty() bool {
-	return len(self.queue) == 0
+	return self.Len() == 0
+}
+
+// Dropped returns the amount of elements that were dropped because the queue was full or closed
+func (self *Queue) Dropped() uint64 {
+	self.queueMutex.Lock()
+	defer self.queueMutex.Unlock()
+	return self.dropped
 }
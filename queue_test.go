@@ -2,55 +2,60 @@ package main
 
 import (
 	"testing"
+	"time"
 )
 
+func newTestQueue(t *testing.T, capacity int, overflowPolicy string) *Queue {
+	q, err := NewQueue(capacity, overflowPolicy)
+	if err != nil {
+		t.Fatalf("Can't create queue: %s", err)
+	}
+	return q
+}
+
 func TestQueuePushShift(t *testing.T) {
-	q := NewQueue()
+	q := newTestQueue(t, 0, QUEUE_OVERFLOW_BLOCK)
 	s1 := "test"
 	q.Push(s1)
 
-	if len(q.queue) != 1 {
-		t.Errorf("Queue length is incorrect after push %d instead of 1", len(q.queue))
-	}
-
-	if q.queue[0] != s1 {
-		t.Errorf("Value in queue isn't correct %s instead of %s", q.queue[0], s1)
+	if q.Len() != 1 {
+		t.Errorf("Queue length is incorrect after push %d instead of 1", q.Len())
 	}
 
 	s2 := "test2"
 	q.Push(s2)
 
-	if len(q.queue) != 2 {
-		t.Errorf("Queue length is incorrect after push %d instead of 2", len(q.queue))
-	}
-
-	if q.queue[1] != s2 {
-		t.Errorf("Value in queue isn't correct %s instead of %s", q.queue[1], s2)
+	if q.Len() != 2 {
+		t.Errorf("Queue length is incorrect after push %d instead of 2", q.Len())
 	}
 
 	res := q.Shift()
 
-	if len(q.queue) != 1 {
-		t.Errorf("Queue length is incorrect after push %d instead of 1", len(q.queue))
+	if q.Len() != 1 {
+		t.Errorf("Queue length is incorrect after shift %d instead of 1", q.Len())
 	}
 
 	if res != s1 {
-		t.Error("Element that was dequeued doesn't have the right value. %s instead of %s", res, s1)
+		t.Errorf("Element that was dequeued doesn't have the right value. %s instead of %s", res, s1)
 	}
 
 	res = q.Shift()
 
-	if len(q.queue) != 0 {
-		t.Errorf("Queue length is incorrect after push %d instead of 0", len(q.queue))
+	if q.Len() != 0 {
+		t.Errorf("Queue length is incorrect after shift %d instead of 0", q.Len())
 	}
 
 	if res != s2 {
-		t.Error("Element that was dequeued doesn't have the right value. %s instead of %s", res, s2)
+		t.Errorf("Element that was dequeued doesn't have the right value. %s instead of %s", res, s2)
+	}
+
+	if res = q.Shift(); res != nil {
+		t.Errorf("Shifting an empty queue returned %s instead of nil", res)
 	}
 }
 
 func TestQueueEmpty(t *testing.T) {
-	q := NewQueue()
+	q := newTestQueue(t, 0, QUEUE_OVERFLOW_BLOCK)
 
 	for i := 0; i < 5; i++ {
 		q.Push("")
@@ -69,3 +74,141 @@ func TestQueueEmpty(t *testing.T) {
 	}
 
 }
+
+func TestQueueOrder(t *testing.T) {
+	// Enough elements to grow the buffer and wrap around it
+	q := newTestQueue(t, 0, QUEUE_OVERFLOW_BLOCK)
+	next := 0
+	for i := 0; i < 1000; i++ {
+		q.Push(i)
+		if i%3 == 0 {
+			if res := q.Shift(); res != next {
+				t.Fatalf("Element that was dequeued doesn't have the right value. %v instead of %d", res, next)
+			}
+			next++
+		}
+	}
+	for ; next < 1000; next++ {
+		if res := q.Shift(); res != next {
+			t.Fatalf("Element that was dequeued doesn't have the right value. %v instead of %d", res, next)
+		}
+	}
+}
+
+func TestQueueOverflowPolicies(t *testing.T) {
+	q := newTestQueue(t, 3, QUEUE_OVERFLOW_DROP_NEWEST)
+	for i := 0; i < 5; i++ {
+		q.Push(i)
+	}
+	if q.Len() != 3 || q.Dropped() != 2 {
+		t.Errorf("Queue has %d elements and dropped %d instead of 3 and 2", q.Len(), q.Dropped())
+	}
+	if res := q.Shift(); res != 0 {
+		t.Errorf("Oldest element was dropped, %v was dequeued instead of 0", res)
+	}
+
+	q = newTestQueue(t, 3, QUEUE_OVERFLOW_DROP_OLDEST)
+	for i := 0; i < 5; i++ {
+		q.Push(i)
+	}
+	if q.Len() != 3 || q.Dropped() != 2 {
+		t.Errorf("Queue has %d elements and dropped %d instead of 3 and 2", q.Len(), q.Dropped())
+	}
+	if res := q.Shift(); res != 2 {
+		t.Errorf("Newest elements were dropped, %v was dequeued instead of 2", res)
+	}
+
+	if _, err := NewQueue(3, "invalid"); err == nil {
+		t.Error("Queue was created with an invalid overflow policy")
+	}
+}
+
+func TestQueueBlocking(t *testing.T) {
+	q := newTestQueue(t, 1, QUEUE_OVERFLOW_BLOCK)
+	q.Push(1)
+
+	pushed := make(chan bool)
+	go func() {
+		pushed <- q.Push(2)
+	}()
+	select {
+	case <-pushed:
+		t.Fatal("Pushing to a full queue didn't block")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	if res, ok := q.Pop(); !ok || res != 1 {
+		t.Errorf("Pop returned %v, %v instead of 1, true", res, ok)
+	}
+	if !<-pushed {
+		t.Error("Blocked element wasn't pushed once there was room in the queue")
+	}
+
+	popped := make(chan interface{})
+	go func() {
+		res, _ := q.Pop()
+		popped <- res
+		_, ok := q.Pop()
+		popped <- ok
+	}()
+	if res := <-popped; res != 2 {
+		t.Errorf("Pop returned %v instead of 2", res)
+	}
+	select {
+	case <-popped:
+		t.Fatal("Popping an empty queue didn't block")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	q.Close()
+	if ok := <-popped; ok != false {
+		t.Error("Pop didn't return once the queue was closed")
+	}
+	if q.Push(3) {
+		t.Error("Element was pushed to a closed queue")
+	}
+}
+
+func TestQueuePopBatch(t *testing.T) {
+	q := newTestQueue(t, 0, QUEUE_OVERFLOW_BLOCK)
+	for i := 0; i < 5; i++ {
+		q.Push(i)
+	}
+
+	// Full batch without waiting
+	batch, ok := q.PopBatch(3, time.Hour)
+	if !ok || len(batch) != 3 || batch[0] != 0 || batch[2] != 2 {
+		t.Errorf("PopBatch returned %v, %v instead of [0 1 2], true", batch, ok)
+	}
+
+	// Partial batch once the maximum wait has elapsed
+	start := time.Now()
+	batch, ok = q.PopBatch(3, 50*time.Millisecond)
+	if !ok || len(batch) != 2 || batch[0] != 3 {
+		t.Errorf("PopBatch returned %v, %v instead of [3 4], true", batch, ok)
+	}
+	if time.Since(start) < 50*time.Millisecond {
+		t.Error("PopBatch didn't wait for more elements")
+	}
+
+	// Elements pushed while waiting are part of the batch
+	go func() {
+		time.Sleep(10 * time.Millisecond)
+		q.Push(5)
+		q.Push(6)
+	}()
+	batch, ok = q.PopBatch(2, time.Hour)
+	if !ok || len(batch) != 2 || batch[1] != 6 {
+		t.Errorf("PopBatch returned %v, %v instead of [5 6], true", batch, ok)
+	}
+
+	q.Push(7)
+	q.Close()
+	batch, ok = q.PopBatch(3, time.Hour)
+	if !ok || len(batch) != 1 {
+		t.Errorf("PopBatch returned %v, %v instead of [7], true once the queue was closed", batch, ok)
+	}
+	if _, ok = q.PopBatch(3, time.Hour); ok {
+		t.Error("PopBatch didn't return false once the queue was closed and empty")
+	}
+}
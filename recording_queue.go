@@ -6,121 +6,338 @@ import (
 	"time"
 )
 
-type DebouncedRecording struct {
-	lastSave    time.Time
-	destination *base.Destination
+// RecordingQueue holds the destinations waiting to be recorded
+// It contains *base.Destination elements for the destinations that are ready to be saved and *base.Session elements for the aggregated sessions that were flushed
+type RecordingQueue struct {
+	queue *Queue
+	// The destinations go through it before being queued, nil when the debounce is disabled
+	deduplicator    *Deduplicator
+	stopDebounce    chan int
+	debounceDone    chan int
+	batchSize       int
+	batchMaxLatency time.Duration
+	// Holds the destinations that couldn't be recorded, nil when spooling is disabled
+	spool      *Spool
+	stopReplay chan int
+	replayDone chan int
+	// The destinations are aggregated in sessions that are flushed at this interval instead of being recorded, 0 when the aggregation is disabled
+	aggregationInterval time.Duration
+	sessions            map[base.SessionKey]*base.Session
+	sessionsMutex       *sync.Mutex
+	stopAggregation     chan int
+	aggregationDone     chan int
 }
 
-type RecordingQueue struct {
-	dummy             bool
-	queue             *Queue
-	debouncedQueue    *Queue
-	DebounceThreshold time.Duration
-	debounceMap       map[string]*DebouncedRecording
-	debounceMutex     *sync.Mutex
+func NewRecordingQueue(capacity int, overflowPolicy string) *RecordingQueue {
+	queue, err := NewQueue(capacity, overflowPolicy)
+	if err != nil {
+		base.Die("invalid recording queue: ", err)
+	}
+	return newRecordingQueue(queue)
 }
 
-func NewRecordingQueue() *RecordingQueue {
+func newRecordingQueue(queue *Queue) *RecordingQueue {
 	recording_queue := &RecordingQueue{}
-	recording_queue.queue = NewQueue()
-	recording_queue.debouncedQueue = NewQueue()
-	recording_queue.debounceMutex = &sync.Mutex{}
-	recording_queue.dummy = false
+	recording_queue.queue = queue
+	recording_queue.sessionsMutex = &sync.Mutex{}
+	recording_queue.batchSize = 1
 	return recording_queue
 }
 
 func (self *RecordingQueue) push(destination *base.Destination) {
+	if self.aggregationInterval != 0 {
+		self.aggregate(destination)
+		return
+	}
+	if self.deduplicator != nil {
+		self.pushAll(self.deduplicator.Offer(destination, time.Now()))
+		return
+	}
 	self.queue.Push(destination)
 }
 
-func (self *RecordingQueue) empty() bool {
-	return self.queue.IsEmpty() && self.debouncedQueue.IsEmpty()
+func (self *RecordingQueue) pushAll(destinations []*base.Destination) {
+	for _, destination := range destinations {
+		self.queue.Push(destination)
+	}
 }
 
-func (self *RecordingQueue) _shift(queue *Queue) *base.Destination {
-	o := queue.Shift()
-	if o == nil {
-		return nil
+// close makes the recording threads exit once they have recorded what is left in the queue
+// This includes the sessions being aggregated and the destinations whose debounce window isn't over
+func (self *RecordingQueue) close() {
+	if self.aggregationInterval != 0 {
+		close(self.stopAggregation)
+		<-self.aggregationDone
+		self.flushSessions()
 	}
-	destination, ok := o.(*base.Destination)
-	if !ok {
-		panic("Element in queue wasn't a destination")
+	if self.deduplicator != nil {
+		close(self.stopDebounce)
+		<-self.debounceDone
+		self.pushAll(self.deduplicator.Flush())
 	}
-	return destination
+	self.queue.Close()
 }
 
-func (self *RecordingQueue) shift() *base.Destination {
-	return self._shift(self.queue)
+// Len returns the amount of elements waiting to be recorded
+func (self *RecordingQueue) Len() int {
+	return self.queue.Len()
 }
 
-func (self *RecordingQueue) shiftDebounced() *base.Destination {
-	return self._shift(self.debouncedQueue)
+// Dropped returns the amount of elements that were dropped because the queue was full
+func (self *RecordingQueue) Dropped() uint64 {
+	return self.queue.Dropped()
 }
 
-func (self *RecordingQueue) SetDebounceThreshold(debounceThreshold time.Duration) {
-	Logger().Debugf("Debounce threshold set to %s", debounceThreshold)
-	if debounceThreshold.Seconds() != 0 {
-		self.DebounceThreshold = debounceThreshold
-		self.debounceMap = make(map[string]*DebouncedRecording)
-		go func() {
-			tickSeconds := debounceThreshold / 2
-			Logger().Infof("Debounce worker will run every %s", tickSeconds)
-			tick := time.Tick(tickSeconds)
-			for _ = range tick {
-				self.workDebounceMap()
+// SetDebounce makes the destinations go through a deduplicator before being queued
+// The windows that are over are expired every half window so they end at most that late
+func (self *RecordingQueue) SetDebounce(deduplicator *Deduplicator) {
+	Logger().Infof("Debouncing the destinations with a %s window on their %s edge", deduplicator.window, deduplicator.edge)
+	self.deduplicator = deduplicator
+	self.stopDebounce = make(chan int)
+	self.debounceDone = make(chan int)
+	go func() {
+		defer close(self.debounceDone)
+		ticker := time.NewTicker(deduplicator.window / 2)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				// Pushing can block when the queue is full, the deduplicator doesn't hold its lock meanwhile
+				self.pushAll(deduplicator.Expire(time.Now()))
+			case <-self.stopDebounce:
+				return
 			}
-		}()
+		}
+	}()
+}
+
+// DebounceLen returns the amount of destinations whose debounce window isn't over
+func (self *RecordingQueue) DebounceLen() int {
+	if self.deduplicator == nil {
+		return 0
 	}
+	return self.deduplicator.Len()
 }
 
-func (self *RecordingQueue) workDebounceMap() {
-	Logger().Debug("Working debounce map")
-	self.debounceMutex.Lock()
-	defer self.debounceMutex.Unlock()
-	var toDelete []string
-	for hash, info := range self.debounceMap {
-		if info.lastSave.Unix()+int64(self.DebounceThreshold.Seconds()) > time.Now().Unix() {
-			Logger().Debugf("Entry %s is ready to be saved", hash)
-			self.debouncedQueue.Push(info.destination)
-			toDelete = append(toDelete, hash)
-		}
+// DebounceEvicted returns the amount of destinations evicted from the debounce before the end of their window
+func (self *RecordingQueue) DebounceEvicted() uint64 {
+	if self.deduplicator == nil {
+		return 0
+	}
+	return self.deduplicator.Evicted()
+}
+
+// SetAggregation makes the destinations be aggregated in sessions, which are recorded every interval instead of the destinations themselves
+// The debounce doesn't apply to the aggregated destinations
+func (self *RecordingQueue) SetAggregation(interval time.Duration) {
+	if interval == 0 {
+		return
 	}
-	for _, hash := range toDelete {
-		Logger().Debugf("Removing %s from debounce map", hash)
-		delete(self.debounceMap, hash)
-	}
-	Logger().Debug("Done working debounce map")
-}
-
-func (self *RecordingQueue) saveWithDebounce(destination *base.Destination, db base.GarinDB) {
-	if self.DebounceThreshold != 0 {
-		self.debounceMutex.Lock()
-		defer self.debounceMutex.Unlock()
-		hash := destination.Hash()
-		info := self.debounceMap[hash]
-		if info != nil {
-			Logger().Debug("Updating entry in debounce map")
-			self.debounceMap[hash].lastSave = time.Now()
-		} else {
-			Logger().Debug("Creating entry in debounce map")
-			self.debounceMap[hash] = &DebouncedRecording{time.Now(), destination}
+	Logger().Infof("Aggregating the destinations in sessions recorded every %s", interval)
+	self.aggregationInterval = interval
+	self.sessions = make(map[base.SessionKey]*base.Session)
+	self.stopAggregation = make(chan int)
+	self.aggregationDone = make(chan int)
+	go func() {
+		defer close(self.aggregationDone)
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				self.flushSessions()
+			case <-self.stopAggregation:
+				return
+			}
 		}
+	}()
+}
+
+func (self *RecordingQueue) aggregate(destination *base.Destination) {
+	self.sessionsMutex.Lock()
+	defer self.sessionsMutex.Unlock()
+	key := destination.SessionKey()
+	if session := self.sessions[key]; session != nil {
+		session.Add(destination)
 	} else {
-		destination.Save(db)
+		self.sessions[key] = base.NewSession(destination)
+	}
+}
+
+// flushSessions sends the sessions aggregated since the last flush to the recording threads
+func (self *RecordingQueue) flushSessions() {
+	self.sessionsMutex.Lock()
+	sessions := self.sessions
+	self.sessions = make(map[base.SessionKey]*base.Session)
+	self.sessionsMutex.Unlock()
+
+	Logger().Debugf("Flushing %d aggregated sessions", len(sessions))
+	// Pushing can block when the queue is full so it must be done without holding the lock the parsing threads need
+	for _, session := range sessions {
+		self.queue.Push(session)
+	}
+}
+
+// SessionsLen returns the amount of sessions being aggregated
+func (self *RecordingQueue) SessionsLen() int {
+	self.sessionsMutex.Lock()
+	defer self.sessionsMutex.Unlock()
+	return len(self.sessions)
+}
+
+// EnableSpool makes the destinations that can't be recorded go to the spool
+// They are replayed in order, using a dedicated connection to the database, once it is available again
+func (self *RecordingQueue) EnableSpool(spool *Spool, dbType string, dbArgs string, health *base.HealthState, retryInterval time.Duration) {
+	self.spool = spool
+	self.stopReplay = make(chan int)
+	self.replayDone = make(chan int)
+	go self.replaySpool(dbType, dbArgs, health, retryInterval)
+}
+
+func (self *RecordingQueue) replaySpool(dbType string, dbArgs string, health *base.HealthState, retryInterval time.Duration) {
+	defer close(self.replayDone)
+	var db base.GarinDB
+	defer func() {
+		if db != nil {
+			db.Close()
+		}
+	}()
+
+	for {
+		destination, err := self.spool.Peek()
+		if err != nil {
+			Logger().Errorf("can't read the spool: %s", err)
+		} else if destination != nil {
+			if db == nil {
+				// Retrying is done here so the replay can be stopped while waiting
+				db, err = base.NewGarinDB(dbType, dbArgs, base.RetryPolicy{MaxAttempts: 1}, health)
+			}
+			if err == nil {
+				err = destination.Save(db)
+				if err == nil {
+					self.spool.Advance()
+					continue
+				}
+				if !base.IsRetryable(err) {
+					// Replaying it again would fail the same way and block the rest of the spool
+					Logger().Errorf("can't record spooled destination, dropping it: %s", err)
+					self.spool.Advance()
+					continue
+				}
+			}
+			Logger().Warningf("database is still unavailable, retrying to replay the spool in %s: %s", retryInterval, err)
+		}
+
+		// The spool is empty or the database is unavailable
+		select {
+		case <-time.After(retryInterval):
+		case <-self.stopReplay:
+			return
+		}
 	}
 }
 
+// closeSpool stops the replay and syncs the spool, what is left in it is replayed the next time garin starts
+func (self *RecordingQueue) closeSpool() {
+	if self.spool == nil {
+		return
+	}
+	close(self.stopReplay)
+	<-self.replayDone
+	if err := self.spool.Close(); err != nil {
+		Logger().Errorf("can't close the spool: %s", err)
+	}
+}
+
+// save records destinations or spools them if that fails
+// The database already retried the operation so the destinations are dropped when it fails and there is no spool
+func (self *RecordingQueue) save(destinations []*base.Destination, db base.GarinDB) {
+	// As long as there are destinations to replay, the new ones go after them so they are recorded in order
+	if self.spool == nil || self.spool.IsEmpty() {
+		err := base.SaveDestinations(destinations, db)
+		if err == nil {
+			return
+		}
+		if !base.IsRetryable(err) && len(destinations) > 1 {
+			// A single invalid destination makes the whole batch fail
+			Logger().Warningf("can't record %d destinations at once, recording them one by one: %s", len(destinations), err)
+			self.saveOneByOne(destinations, db)
+			return
+		}
+		if self.spool == nil || !base.IsRetryable(err) {
+			Logger().Errorf("can't record %d destinations, dropping them: %s", len(destinations), err)
+			return
+		}
+		Logger().Errorf("can't record %d destinations, spooling them: %s", len(destinations), err)
+	}
+	self.spoolDestinations(destinations)
+}
+
+// saveSessions records sessions, they aren't spooled so they are dropped when the database fails after its retries
+func (self *RecordingQueue) saveSessions(sessions []*base.Session, db base.GarinDB) {
+	if err := db.RecordSessions(sessions); err != nil {
+		Logger().Errorf("can't record %d sessions, dropping them: %s", len(sessions), err)
+	}
+}
+
+func (self *RecordingQueue) saveOneByOne(destinations []*base.Destination, db base.GarinDB) {
+	for i, destination := range destinations {
+		err := destination.Save(db)
+		if err == nil {
+			continue
+		}
+		if base.IsRetryable(err) && self.spool != nil {
+			Logger().Errorf("can't record %d destinations, spooling them: %s", len(destinations)-i, err)
+			self.spoolDestinations(destinations[i:])
+			return
+		}
+		Logger().Errorf("can't record destination %s, dropping it: %s", destination.Hash(), err)
+	}
+}
+
+func (self *RecordingQueue) spoolDestinations(destinations []*base.Destination) {
+	for _, destination := range destinations {
+		if err := self.spool.Write(destination); err != nil {
+			Logger().Errorf("can't spool destination, dropping it: %s", err)
+		}
+	}
+}
+
+// SetBatching makes the recording threads record up to batchSize destinations at once
+// A destination waits at most batchMaxLatency for the batch it is part of to fill up
+func (self *RecordingQueue) SetBatching(batchSize int, batchMaxLatency time.Duration) {
+	if batchSize < 1 {
+		batchSize = 1
+	}
+	Logger().Debugf("Recording destinations in batches of %d, waiting at most %s", batchSize, batchMaxLatency)
+	self.batchSize = batchSize
+	self.batchMaxLatency = batchMaxLatency
+}
+
+// work waits for elements of the queue and records them
+// It returns false once the queue is closed and empty
 func (self *RecordingQueue) work(db base.GarinDB) bool {
-	worked := false
-	destination := self.shift()
-	if destination != nil {
-		self.saveWithDebounce(destination, db)
-		worked = true
-	}
-	destination = self.shiftDebounced()
-	if destination != nil {
-		destination.Save(db)
-		worked = true
-	}
-	return worked
+	elements, ok := self.queue.PopBatch(self.batchSize, self.batchMaxLatency)
+	if !ok {
+		return false
+	}
+	destinations := make([]*base.Destination, 0, len(elements))
+	var sessions []*base.Session
+	for _, o := range elements {
+		switch element := o.(type) {
+		case *base.Destination:
+			destinations = append(destinations, element)
+		case *base.Session:
+			sessions = append(sessions, element)
+		default:
+			panic("Element in queue wasn't a destination")
+		}
+	}
+	if len(destinations) > 0 {
+		self.save(destinations, db)
+	}
+	if len(sessions) > 0 {
+		self.saveSessions(sessions, db)
+	}
+	return true
 }
@@ -0,0 +1,255 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"github.com/julsemaan/garin/base"
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+)
+
+// Records the batches it receives in memory and fails when asked to
+type testGarinDB struct {
+	base.AbstractGarinDB
+	batches  [][]*base.Destination
+	sessions []*base.Session
+	failing  bool
+	// Destinations with this server name are refused as if they were invalid
+	invalidServerName string
+	// Fails that many operations before it becomes available
+	failures int
+	opened   int
+}
+
+func (self *testGarinDB) Open() error {
+	if self.failing {
+		return &base.DBError{Err: errors.New("database is unavailable"), Retryable: true}
+	}
+	self.opened++
+	return nil
+}
+
+func (self *testGarinDB) Close() error { return nil }
+
+func (self *testGarinDB) RecordDestination(destination *base.Destination) error {
+	return self.RecordDestinations([]*base.Destination{destination})
+}
+
+func (self *testGarinDB) RecordDestinations(destinations []*base.Destination) error {
+	if self.failing || self.failures > 0 {
+		self.failures--
+		return &base.DBError{Err: errors.New("database is unavailable"), Retryable: true}
+	}
+	for _, destination := range destinations {
+		if destination.ServerName == self.invalidServerName {
+			return &base.DBError{Err: errors.New("invalid destination"), Retryable: false}
+		}
+	}
+	self.batches = append(self.batches, destinations)
+	return nil
+}
+
+func (self *testGarinDB) RecordSessions(sessions []*base.Session) error {
+	if self.failing {
+		return &base.DBError{Err: errors.New("database is unavailable"), Retryable: true}
+	}
+	self.sessions = append(self.sessions, sessions...)
+	return nil
+}
+
+func newTestRecordingQueue(batchSize int) *RecordingQueue {
+	recordingQueue := NewRecordingQueue(0, QUEUE_OVERFLOW_BLOCK)
+	recordingQueue.SetBatching(batchSize, 10*time.Millisecond)
+	return recordingQueue
+}
+
+func TestRecordingQueueBatches(t *testing.T) {
+	recordingQueue := newTestRecordingQueue(3)
+	for i := 0; i < 5; i++ {
+		recordingQueue.push(base.NewDestination(fmt.Sprintf("%d.example.com", i), "10.0.0.1", "10.0.0.2"))
+	}
+	recordingQueue.close()
+
+	db := &testGarinDB{}
+	for recordingQueue.work(db) {
+	}
+	if len(db.batches) != 2 || len(db.batches[0]) != 3 || len(db.batches[1]) != 2 {
+		t.Errorf("Destinations weren't recorded in batches of 3 : %v", db.batches)
+	}
+}
+
+func TestRecordingQueueSpoolsFailedBatches(t *testing.T) {
+	directory, _ := ioutil.TempDir("", "garin-spool")
+	defer os.RemoveAll(directory)
+	spool := openTestSpool(t, directory, 1024*1024, 0)
+	defer spool.Close()
+
+	recordingQueue := newTestRecordingQueue(2)
+	recordingQueue.spool = spool
+	db := &testGarinDB{failing: true}
+	for i := 0; i < 4; i++ {
+		recordingQueue.push(base.NewDestination(fmt.Sprintf("%d.example.com", i), "10.0.0.1", "10.0.0.2"))
+		if i == 1 {
+			recordingQueue.work(db)
+			// The database is back but the new destinations must go after the spooled ones
+			db.failing = false
+		}
+	}
+	recordingQueue.work(db)
+
+	if len(db.batches) != 0 {
+		t.Errorf("Destinations were recorded before the spooled ones : %v", db.batches)
+	}
+	assertSpooledDestinations(t, readTestDestinations(t, spool), 0, 4)
+}
+
+func TestRecordingQueueInvalidDestination(t *testing.T) {
+	recordingQueue := newTestRecordingQueue(3)
+	for i := 0; i < 3; i++ {
+		recordingQueue.push(base.NewDestination(fmt.Sprintf("%d.example.com", i), "10.0.0.1", "10.0.0.2"))
+	}
+	recordingQueue.close()
+
+	// The other destinations of the batch are still recorded
+	db := &testGarinDB{invalidServerName: "1.example.com"}
+	for recordingQueue.work(db) {
+	}
+	if len(db.batches) != 2 || db.batches[0][0].ServerName != "0.example.com" || db.batches[1][0].ServerName != "2.example.com" {
+		t.Errorf("Valid destinations weren't recorded one by one : %v", db.batches)
+	}
+}
+
+func TestRecordingQueueFlushesDebounceOnClose(t *testing.T) {
+	recordingQueue := newTestRecordingQueue(10)
+	deduplicator, _ := NewDeduplicator(time.Hour, DEBOUNCE_EDGE_TRAILING, "source_ip,server_name", 0)
+	recordingQueue.SetDebounce(deduplicator)
+	for i := 0; i < 3; i++ {
+		recordingQueue.push(base.NewDestination("example.com", "10.0.0.1", "10.0.0.2"))
+	}
+	if recordingQueue.Len() != 0 || recordingQueue.DebounceLen() != 1 {
+		t.Errorf("Destinations weren't debounced : %d queued, %d debounced", recordingQueue.Len(), recordingQueue.DebounceLen())
+	}
+	recordingQueue.close()
+
+	db := &testGarinDB{}
+	for recordingQueue.work(db) {
+	}
+	if len(db.batches) != 1 || len(db.batches[0]) != 1 {
+		t.Errorf("Debounced destination wasn't recorded on close : %v", db.batches)
+	}
+}
+
+func TestRecordingQueueAggregatesSessions(t *testing.T) {
+	recordingQueue := newTestRecordingQueue(10)
+	recordingQueue.SetAggregation(time.Hour)
+	now := time.Now()
+	for i := 0; i < 3; i++ {
+		destination := base.NewDestination("example.com", "10.0.0.1", "10.0.0.2")
+		destination.Timestamp = now.Add(time.Duration(i) * time.Second)
+		destination.Traffic = base.Traffic{BytesSent: 60, BytesReceived: 40, PacketsSent: 1, PacketsReceived: 1}
+		recordingQueue.push(destination)
+	}
+	recordingQueue.push(base.NewDestination("other.example.com", "10.0.0.1", "10.0.0.2"))
+	if recordingQueue.Len() != 0 || recordingQueue.SessionsLen() != 2 {
+		t.Errorf("Destinations weren't aggregated : %d queued, %d sessions", recordingQueue.Len(), recordingQueue.SessionsLen())
+	}
+	// The sessions being aggregated are recorded on close
+	recordingQueue.close()
+
+	db := &testGarinDB{}
+	for recordingQueue.work(db) {
+	}
+	if len(db.batches) != 0 || len(db.sessions) != 2 {
+		t.Fatalf("Sessions weren't recorded instead of the destinations : %v %v", db.batches, db.sessions)
+	}
+	for _, session := range db.sessions {
+		if session.ServerName == "example.com" && (session.Connections != 3 || session.Bytes != 300 || session.Packets != 6 || !session.FirstSeen.Equal(now) || !session.LastSeen.Equal(now.Add(2*time.Second))) {
+			t.Errorf("Session wasn't aggregated : %+v", session)
+		}
+	}
+}
+
+func TestReconnectingGarinDB(t *testing.T) {
+	retry := base.RetryPolicy{MaxAttempts: 3, InitialBackoff: time.Millisecond, MaxBackoff: 2 * time.Millisecond}
+	testDB := &testGarinDB{failures: 2}
+	health := base.NewHealthState("output test")
+	otherHealth := base.NewHealthState("output other")
+	db, err := base.NewReconnectingGarinDB(testDB, retry, health)
+	if err != nil {
+		t.Fatalf("Can't create database : %s", err)
+	}
+
+	destination := base.NewDestination("example.com", "10.0.0.1", "10.0.0.2")
+	if err := db.RecordDestination(destination); err != nil {
+		t.Errorf("Destination wasn't recorded after 2 failures : %s", err)
+	}
+	if testDB.opened != 3 || len(testDB.batches) != 1 {
+		t.Errorf("Database was opened %d times and recorded %d batches instead of 3 and 1", testDB.opened, len(testDB.batches))
+	}
+	if !health.Healthy() {
+		t.Error("Database isn't healthy after recording a destination")
+	}
+
+	testDB.failures = 3
+	err = db.RecordDestination(destination)
+	if err == nil || !base.IsRetryable(err) {
+		t.Errorf("Recording didn't fail with a retryable error after 3 attempts : %v", err)
+	}
+	if health.Healthy() {
+		t.Error("Database is healthy after failing to record a destination")
+	}
+	if !otherHealth.Healthy() {
+		t.Error("The health of another output changed when the database failed")
+	}
+
+	// Permanent errors aren't retried
+	testDB.invalidServerName = "example.com"
+	err = db.RecordDestination(destination)
+	if err == nil || base.IsRetryable(err) || testDB.opened != 6 {
+		t.Errorf("Recording an invalid destination returned %v after opening the database %d times", err, testDB.opened)
+	}
+}
+
+func TestReconnectingGarinDBStop(t *testing.T) {
+	stop := make(chan int)
+	retry := base.RetryPolicy{MaxAttempts: 5, InitialBackoff: time.Hour, MaxBackoff: time.Hour, Stop: stop}
+	testDB := &testGarinDB{failures: 5}
+	db, err := base.NewReconnectingGarinDB(testDB, retry, base.NewHealthState("output stop-test"))
+	if err != nil {
+		t.Fatalf("Can't create database : %s", err)
+	}
+
+	go func() {
+		time.Sleep(10 * time.Millisecond)
+		close(stop)
+	}()
+	start := time.Now()
+	err = db.RecordDestination(base.NewDestination("example.com", "10.0.0.1", "10.0.0.2"))
+	if err == nil || !base.IsRetryable(err) {
+		t.Errorf("Recording didn't fail with the retryable error once stopped : %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("Stopping the retries took %s", elapsed)
+	}
+
+	// Once stopped, the failures aren't retried at all
+	testDB.failures = 1
+	if err := db.RecordDestination(base.NewDestination("example.com", "10.0.0.1", "10.0.0.2")); err == nil || testDB.failures != 0 {
+		t.Errorf("Failure was retried after the retries were stopped : %v", err)
+	}
+}
+
+func TestRetryPolicyBackoff(t *testing.T) {
+	retry := base.RetryPolicy{InitialBackoff: time.Second, MaxBackoff: 5 * time.Second}
+	for failures, expected := range []time.Duration{0, time.Second, 2 * time.Second, 4 * time.Second, 5 * time.Second, 5 * time.Second} {
+		if failures == 0 {
+			continue
+		}
+		backoff := retry.Backoff(failures)
+		if backoff > expected || backoff < expected/2 {
+			t.Errorf("Backoff after %d failures is %s instead of between %s and %s", failures, backoff, expected/2, expected)
+		}
+	}
+}
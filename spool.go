@@ -0,0 +1,376 @@
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/julsemaan/garin/base"
+	"hash/crc32"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+)
+
+// When the spooled destinations are synced to the disk
+const (
+	// After every destination
+	SPOOL_FSYNC_ALWAYS = "always"
+	// Every fsync-interval
+	SPOOL_FSYNC_INTERVAL = "interval"
+	// When the operating system decides to
+	SPOOL_FSYNC_NEVER = "never"
+)
+
+const SPOOL_SEGMENT_PATTERN = "spool-%020d.log"
+
+// Size of the header of each record : length and CRC32 of the record
+const SPOOL_RECORD_HEADER_SIZE = 8
+
+var errCorruptedSpoolRecord = errors.New("corrupted spool record")
+
+type spoolSegment struct {
+	sequence uint64
+	path     string
+	size     int64
+}
+
+// Spool is an append-only log of destinations kept on disk while they can't be recorded in the database
+// The log is split in segments that are deleted once all their destinations are read
+// A destination is only removed from the spool once Advance is called so it is replayed again if garin stops before that
+// The read position isn't persisted so the destinations of a partially replayed segment are replayed again after a restart
+type Spool struct {
+	directory     string
+	segmentSize   int64
+	maxSize       int64
+	fsyncPolicy   string
+	fsyncInterval time.Duration
+
+	spoolMutex *sync.Mutex
+	// From the oldest to the newest, the last one is the one being written to
+	segments []*spoolSegment
+	writer   *os.File
+	// The segment being written to can't be used once it is full or when it was left by a previous run
+	writerFull bool
+
+	reader       *os.File
+	bufReader    *bufio.Reader
+	readerOffset int64
+	// The destination returned by Peek and the size of its record
+	peeked     *base.Destination
+	peekedSize int64
+
+	// Segments that were dropped because of the size cap
+	droppedSegments uint64
+
+	stopSync chan int
+	syncDone chan int
+}
+
+func OpenSpool(directory string, segmentSize int64, maxSize int64, fsyncPolicy string, fsyncInterval time.Duration) (*Spool, error) {
+	switch fsyncPolicy {
+	case SPOOL_FSYNC_ALWAYS, SPOOL_FSYNC_INTERVAL, SPOOL_FSYNC_NEVER:
+	default:
+		return nil, fmt.Errorf("unknown spool fsync policy %q", fsyncPolicy)
+	}
+	if err := os.MkdirAll(directory, 0700); err != nil {
+		return nil, err
+	}
+
+	spool := &Spool{
+		directory:     directory,
+		segmentSize:   segmentSize,
+		maxSize:       maxSize,
+		fsyncPolicy:   fsyncPolicy,
+		fsyncInterval: fsyncInterval,
+		spoolMutex:    &sync.Mutex{},
+		// Writes always start in a new segment so they don't follow a record that was partially written before a crash
+		writerFull: true,
+	}
+
+	paths, err := filepath.Glob(filepath.Join(directory, "spool-*.log"))
+	if err != nil {
+		return nil, err
+	}
+	for _, path := range paths {
+		segment := &spoolSegment{path: path}
+		if _, err := fmt.Sscanf(filepath.Base(path), SPOOL_SEGMENT_PATTERN, &segment.sequence); err != nil {
+			Logger().Warningf("ignoring unknown file %s in the spool", path)
+			continue
+		}
+		info, err := os.Stat(path)
+		if err != nil {
+			return nil, err
+		}
+		segment.size = info.Size()
+		spool.segments = append(spool.segments, segment)
+	}
+	sort.Slice(spool.segments, func(i, j int) bool { return spool.segments[i].sequence < spool.segments[j].sequence })
+	if len(spool.segments) > 0 {
+		Logger().Infof("found %d bytes of spooled destinations to replay in %s", spool.pendingBytes(), directory)
+	}
+
+	if fsyncPolicy == SPOOL_FSYNC_INTERVAL {
+		spool.stopSync = make(chan int)
+		spool.syncDone = make(chan int)
+		go spool.syncPeriodically()
+	}
+	return spool, nil
+}
+
+func (self *Spool) syncPeriodically() {
+	defer close(self.syncDone)
+	tick := time.NewTicker(self.fsyncInterval)
+	defer tick.Stop()
+	for {
+		select {
+		case <-tick.C:
+			self.spoolMutex.Lock()
+			self.sync()
+			self.spoolMutex.Unlock()
+		case <-self.stopSync:
+			return
+		}
+	}
+}
+
+func (self *Spool) sync() {
+	if self.writer == nil {
+		return
+	}
+	if err := self.writer.Sync(); err != nil {
+		Logger().Errorf("can't sync the spool: %s", err)
+	}
+}
+
+func (self *Spool) totalBytes() int64 {
+	var size int64
+	for _, segment := range self.segments {
+		size += segment.size
+	}
+	return size
+}
+
+// Amount of bytes that were written but not read yet
+func (self *Spool) pendingBytes() int64 {
+	return self.totalBytes() - self.readerOffset
+}
+
+// IsEmpty returns whether or not all the spooled destinations were read
+func (self *Spool) IsEmpty() bool {
+	self.spoolMutex.Lock()
+	defer self.spoolMutex.Unlock()
+	return self.pendingBytes() == 0
+}
+
+// DroppedSegments returns the amount of segments that were deleted before being read because the spool was full
+func (self *Spool) DroppedSegments() uint64 {
+	self.spoolMutex.Lock()
+	defer self.spoolMutex.Unlock()
+	return self.droppedSegments
+}
+
+// Write appends a destination to the spool
+func (self *Spool) Write(destination *base.Destination) error {
+	data, err := json.Marshal(destination)
+	if err != nil {
+		return err
+	}
+	record := make([]byte, SPOOL_RECORD_HEADER_SIZE+len(data))
+	binary.BigEndian.PutUint32(record[0:4], uint32(len(data)))
+	binary.BigEndian.PutUint32(record[4:8], crc32.ChecksumIEEE(data))
+	copy(record[SPOOL_RECORD_HEADER_SIZE:], data)
+
+	self.spoolMutex.Lock()
+	defer self.spoolMutex.Unlock()
+
+	if self.writerFull || self.segments[len(self.segments)-1].size+int64(len(record)) > self.segmentSize {
+		if err := self.newSegment(); err != nil {
+			return err
+		}
+	}
+	self.enforceMaxSize(int64(len(record)))
+
+	segment := self.segments[len(self.segments)-1]
+	n, err := self.writer.Write(record)
+	segment.size += int64(n)
+	if err != nil {
+		// The partial record can't be read back, the next records go to a new segment
+		self.writerFull = true
+		return err
+	}
+
+	if self.fsyncPolicy == SPOOL_FSYNC_ALWAYS {
+		self.sync()
+	}
+	return nil
+}
+
+func (self *Spool) newSegment() error {
+	if self.writer != nil {
+		self.sync()
+		self.writer.Close()
+		self.writer = nil
+	}
+
+	var sequence uint64
+	if len(self.segments) > 0 {
+		sequence = self.segments[len(self.segments)-1].sequence + 1
+	}
+	path := filepath.Join(self.directory, fmt.Sprintf(SPOOL_SEGMENT_PATTERN, sequence))
+	writer, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL|os.O_APPEND, 0600)
+	if err != nil {
+		return err
+	}
+	self.writer = writer
+	self.writerFull = false
+	self.segments = append(self.segments, &spoolSegment{sequence: sequence, path: path})
+	return nil
+}
+
+// Deletes the oldest segments until there is room for a record
+// The segment being written to is never deleted
+func (self *Spool) enforceMaxSize(recordSize int64) {
+	if self.maxSize <= 0 {
+		return
+	}
+	for len(self.segments) > 1 && self.totalBytes()+recordSize > self.maxSize {
+		Logger().Warningf("spool is full, dropping the destinations of %s", self.segments[0].path)
+		self.removeOldestSegment()
+		self.droppedSegments++
+	}
+}
+
+func (self *Spool) removeOldestSegment() {
+	if self.reader != nil {
+		self.reader.Close()
+		self.reader = nil
+		self.bufReader = nil
+	}
+	self.readerOffset = 0
+	self.peeked = nil
+	if err := os.Remove(self.segments[0].path); err != nil {
+		Logger().Errorf("can't remove spool segment: %s", err)
+	}
+	self.segments = self.segments[1:]
+}
+
+// Peek returns the oldest destination of the spool without removing it, or nil if the spool is empty
+func (self *Spool) Peek() (*base.Destination, error) {
+	self.spoolMutex.Lock()
+	defer self.spoolMutex.Unlock()
+
+	for self.peeked == nil {
+		if self.pendingBytes() == 0 {
+			self.releaseConsumedWriter()
+			return nil, nil
+		}
+		segment := self.segments[0]
+		if self.readerOffset >= segment.size {
+			self.removeOldestSegment()
+			continue
+		}
+
+		if self.reader == nil {
+			reader, err := os.Open(segment.path)
+			if err != nil {
+				return nil, err
+			}
+			if _, err := reader.Seek(self.readerOffset, io.SeekStart); err != nil {
+				reader.Close()
+				return nil, err
+			}
+			self.reader = reader
+			self.bufReader = bufio.NewReader(reader)
+		}
+
+		destination, size, err := self.readRecord()
+		if err != nil {
+			// The rest of the segment can't be trusted, most likely because of a crash while it was written
+			Logger().Warningf("skipping the rest of spool segment %s after %d bytes: %s", segment.path, self.readerOffset, err)
+			self.readerOffset = segment.size
+			if segment == self.segments[len(self.segments)-1] {
+				self.writerFull = true
+			}
+			continue
+		}
+		self.peeked = destination
+		self.peekedSize = size
+	}
+	return self.peeked, nil
+}
+
+func (self *Spool) readRecord() (*base.Destination, int64, error) {
+	header := make([]byte, SPOOL_RECORD_HEADER_SIZE)
+	if _, err := io.ReadFull(self.bufReader, header); err != nil {
+		return nil, 0, err
+	}
+	length := binary.BigEndian.Uint32(header[0:4])
+	if int64(length) > self.segments[0].size-self.readerOffset-SPOOL_RECORD_HEADER_SIZE {
+		return nil, 0, errCorruptedSpoolRecord
+	}
+	data := make([]byte, length)
+	if _, err := io.ReadFull(self.bufReader, data); err != nil {
+		return nil, 0, err
+	}
+	if crc32.ChecksumIEEE(data) != binary.BigEndian.Uint32(header[4:8]) {
+		return nil, 0, errCorruptedSpoolRecord
+	}
+	destination := &base.Destination{}
+	if err := json.Unmarshal(data, destination); err != nil {
+		return nil, 0, err
+	}
+	return destination, int64(SPOOL_RECORD_HEADER_SIZE + length), nil
+}
+
+// Advance removes the destination returned by Peek from the spool
+func (self *Spool) Advance() {
+	self.spoolMutex.Lock()
+	defer self.spoolMutex.Unlock()
+	if self.peeked == nil {
+		return
+	}
+	self.readerOffset += self.peekedSize
+	self.peeked = nil
+}
+
+// Once everything was read, the segment being written to is deleted so the spool doesn't keep growing on disk
+func (self *Spool) releaseConsumedWriter() {
+	if len(self.segments) == 0 {
+		return
+	}
+	if self.writer != nil {
+		self.writer.Close()
+		self.writer = nil
+	}
+	self.writerFull = true
+	for len(self.segments) > 0 {
+		self.removeOldestSegment()
+	}
+}
+
+// Close syncs the spool to the disk, the destinations it contains will be replayed when it is opened again
+func (self *Spool) Close() error {
+	if self.stopSync != nil {
+		close(self.stopSync)
+		<-self.syncDone
+	}
+
+	self.spoolMutex.Lock()
+	defer self.spoolMutex.Unlock()
+	if self.reader != nil {
+		self.reader.Close()
+		self.reader = nil
+	}
+	if self.writer != nil {
+		self.sync()
+		err := self.writer.Close()
+		self.writer = nil
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,124 @@
+package main
+
+import (
+	"fmt"
+	"github.com/julsemaan/garin/base"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func openTestSpool(t *testing.T, directory string, segmentSize int64, maxSize int64) *Spool {
+	spool, err := OpenSpool(directory, segmentSize, maxSize, SPOOL_FSYNC_NEVER, time.Second)
+	if err != nil {
+		t.Fatalf("Can't open spool: %s", err)
+	}
+	return spool
+}
+
+func writeTestDestinations(t *testing.T, spool *Spool, from int, to int) {
+	for i := from; i < to; i++ {
+		if err := spool.Write(base.NewDestination(fmt.Sprintf("%d.example.com", i), "10.0.0.1", "10.0.0.2")); err != nil {
+			t.Fatalf("Can't write to spool: %s", err)
+		}
+	}
+}
+
+// Reads the spool until it is empty and returns the server names of the destinations
+func readTestDestinations(t *testing.T, spool *Spool) []string {
+	var serverNames []string
+	for {
+		destination, err := spool.Peek()
+		if err != nil {
+			t.Fatalf("Can't read spool: %s", err)
+		}
+		if destination == nil {
+			return serverNames
+		}
+		serverNames = append(serverNames, destination.ServerName)
+		spool.Advance()
+	}
+}
+
+func assertSpooledDestinations(t *testing.T, serverNames []string, from int, to int) {
+	if len(serverNames) != to-from {
+		t.Fatalf("%d destinations were read instead of %d", len(serverNames), to-from)
+	}
+	for i, serverName := range serverNames {
+		if expected := fmt.Sprintf("%d.example.com", from+i); serverName != expected {
+			t.Fatalf("Destination %d is %s instead of %s", i, serverName, expected)
+		}
+	}
+}
+
+func TestSpoolReplayInOrder(t *testing.T) {
+	directory, _ := ioutil.TempDir("", "garin-spool")
+	defer os.RemoveAll(directory)
+
+	// Small segments so the destinations are spread in several files
+	spool := openTestSpool(t, directory, 512, 0)
+	writeTestDestinations(t, spool, 0, 20)
+	if spool.IsEmpty() {
+		t.Error("Spool reports as empty when its not")
+	}
+
+	// Peeking without advancing gives the same destination
+	first, _ := spool.Peek()
+	again, _ := spool.Peek()
+	if first != again {
+		t.Error("Destination was removed from the spool without calling Advance")
+	}
+	spool.Close()
+
+	// Destinations are replayed after a restart, with the new ones after them
+	spool = openTestSpool(t, directory, 512, 0)
+	writeTestDestinations(t, spool, 20, 25)
+	assertSpooledDestinations(t, readTestDestinations(t, spool), 0, 25)
+	if !spool.IsEmpty() {
+		t.Error("Spool doesn't report as empty when it is")
+	}
+	spool.Close()
+
+	files, _ := filepath.Glob(filepath.Join(directory, "*"))
+	if len(files) != 0 {
+		t.Errorf("Spool files %v were kept once they were replayed", files)
+	}
+}
+
+func TestSpoolMaxSize(t *testing.T) {
+	directory, _ := ioutil.TempDir("", "garin-spool")
+	defer os.RemoveAll(directory)
+
+	spool := openTestSpool(t, directory, 1024, 2048)
+	defer spool.Close()
+	writeTestDestinations(t, spool, 0, 100)
+	if spool.DroppedSegments() == 0 {
+		t.Fatal("No segment was dropped when the spool went over its maximum size")
+	}
+
+	// The newest destinations are kept
+	serverNames := readTestDestinations(t, spool)
+	assertSpooledDestinations(t, serverNames, 100-len(serverNames), 100)
+}
+
+func TestSpoolCorruptedSegment(t *testing.T) {
+	directory, _ := ioutil.TempDir("", "garin-spool")
+	defer os.RemoveAll(directory)
+
+	spool := openTestSpool(t, directory, 1024*1024, 0)
+	writeTestDestinations(t, spool, 0, 5)
+	spool.Close()
+
+	// Simulates a crash while a record was written
+	files, _ := filepath.Glob(filepath.Join(directory, "spool-*.log"))
+	f, _ := os.OpenFile(files[0], os.O_WRONLY|os.O_APPEND, 0600)
+	f.Write([]byte{0, 0, 1, 0, 1, 2})
+	f.Close()
+
+	spool = openTestSpool(t, directory, 1024*1024, 0)
+	defer spool.Close()
+	writeTestDestinations(t, spool, 5, 10)
+	assertSpooledDestinations(t, readTestDestinations(t, spool), 0, 10)
+}
@@ -0,0 +1,269 @@
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+)
+
+const (
+	TUNNEL_TYPE_VLAN   = "vlan"
+	TUNNEL_TYPE_MPLS   = "mpls"
+	TUNNEL_TYPE_GRE    = "gre"
+	TUNNEL_TYPE_ERSPAN = "erspan"
+	TUNNEL_TYPE_VXLAN  = "vxlan"
+	TUNNEL_TYPE_GENEVE = "geneve"
+)
+
+// GRE protocol type of ERSPAN type III, gopacket only knows about type II (0x88be)
+const ethernetTypeERSPANIII layers.EthernetType = 0x22eb
+
+var LayerTypeERSPANIII = gopacket.RegisterLayerType(1000, gopacket.LayerTypeMetadata{Name: "ERSPANIII", Decoder: gopacket.DecodeFunc(decodeERSPANIII)})
+
+// Tunnel identifies the outermost encapsulation a packet was captured in
+type Tunnel struct {
+	Type string
+	Id   uint32
+}
+
+// Only the first tunnel seen in a packet is kept since it is the outermost one
+func (self *Tunnel) record(tunnelType string, id uint32) {
+	if self.Type == "" {
+		self.Type = tunnelType
+		self.Id = id
+	}
+}
+
+// Guesses the type of a payload that doesn't advertise it using the IP version nibble
+// Anything that isn't IP is considered to be an ethernet frame
+func guessPayloadLayerType(payload []byte) gopacket.LayerType {
+	if len(payload) == 0 {
+		return gopacket.LayerTypeZero
+	}
+	switch payload[0] >> 4 {
+	case 4:
+		return layers.LayerTypeIPv4
+	case 6:
+		return layers.LayerTypeIPv6
+	default:
+		return layers.LayerTypeEthernet
+	}
+}
+
+// vlanLayer decodes 802.1Q tags. Stacked tags (QinQ) are decoded one after the other.
+type vlanLayer struct {
+	layers.Dot1Q
+	tunnel *Tunnel
+}
+
+func (self *vlanLayer) DecodeFromBytes(data []byte, df gopacket.DecodeFeedback) error {
+	if err := self.Dot1Q.DecodeFromBytes(data, df); err != nil {
+		return err
+	}
+	self.tunnel.record(TUNNEL_TYPE_VLAN, uint32(self.VLANIdentifier))
+	return nil
+}
+
+// mplsLayer decodes MPLS labels. gopacket only offers MPLS as a gopacket.Decoder so it can't be used in a DecodingLayerParser.
+type mplsLayer struct {
+	layers.MPLS
+	tunnel *Tunnel
+}
+
+func (self *mplsLayer) CanDecode() gopacket.LayerClass {
+	return layers.LayerTypeMPLS
+}
+
+func (self *mplsLayer) DecodeFromBytes(data []byte, df gopacket.DecodeFeedback) error {
+	if len(data) < 4 {
+		df.SetTruncated()
+		return errors.New("MPLS packet too short")
+	}
+	decoded := binary.BigEndian.Uint32(data[:4])
+	self.Label = decoded >> 12
+	self.TrafficClass = uint8(decoded>>9) & 0x7
+	self.StackBottom = decoded&0x100 != 0
+	self.TTL = uint8(decoded)
+	self.BaseLayer = layers.BaseLayer{Contents: data[:4], Payload: data[4:]}
+	self.tunnel.record(TUNNEL_TYPE_MPLS, self.Label)
+	return nil
+}
+
+// MPLS doesn't tell what it carries so once the bottom of the stack is reached, the payload type is guessed
+func (self *mplsLayer) NextLayerType() gopacket.LayerType {
+	if !self.StackBottom {
+		return layers.LayerTypeMPLS
+	}
+	return guessPayloadLayerType(self.Payload)
+}
+
+// greLayer decodes GRE and dispatches to the right ERSPAN type
+type greLayer struct {
+	layers.GRE
+	tunnel *Tunnel
+}
+
+func (self *greLayer) DecodeFromBytes(data []byte, df gopacket.DecodeFeedback) error {
+	if len(data) < 4 {
+		df.SetTruncated()
+		return errors.New("GRE packet too short")
+	}
+	if err := self.GRE.DecodeFromBytes(data, df); err != nil {
+		return err
+	}
+	// Without a key, the tunnel is identified by the ERSPAN session (if any)
+	if self.KeyPresent {
+		self.tunnel.record(TUNNEL_TYPE_GRE, self.Key)
+	}
+	return nil
+}
+
+func (self *greLayer) NextLayerType() gopacket.LayerType {
+	switch self.Protocol {
+	case layers.EthernetTypeERSPAN:
+		// ERSPAN type I has no header and is distinguished from type II by the absence of sequence number
+		if !self.SeqPresent {
+			return layers.LayerTypeEthernet
+		}
+		return layers.LayerTypeERSPANII
+	case ethernetTypeERSPANIII:
+		return LayerTypeERSPANIII
+	default:
+		return self.GRE.NextLayerType()
+	}
+}
+
+type erspanIILayer struct {
+	layers.ERSPANII
+	tunnel *Tunnel
+}
+
+func (self *erspanIILayer) DecodeFromBytes(data []byte, df gopacket.DecodeFeedback) error {
+	if len(data) < 8 {
+		df.SetTruncated()
+		return errors.New("ERSPAN type II packet too short")
+	}
+	if err := self.ERSPANII.DecodeFromBytes(data, df); err != nil {
+		return err
+	}
+	self.tunnel.record(TUNNEL_TYPE_ERSPAN, uint32(self.SessionID))
+	return nil
+}
+
+// ERSPANIII is the ERSPAN type III header
+//
+//	 0                   1                   2                   3
+//	 0 1 2 3 4 5 6 7 8 9 0 1 2 3 4 5 6 7 8 9 0 1 2 3 4 5 6 7 8 9 0 1
+//	+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+
+//	|  Ver  |          VLAN         | COS |BSO|T|     Session ID    |
+//	+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+
+//	|                          Timestamp                            |
+//	+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+
+//	|             SGT               |P|    FT   |   Hw ID   |D|Gra|O|
+//	+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+
+//
+// When O is set, an 8 bytes platform specific subheader follows
+type ERSPANIII struct {
+	layers.BaseLayer
+	Version        uint8
+	VLANIdentifier uint16
+	SessionID      uint16
+	Timestamp      uint32
+	FrameType      uint8
+}
+
+// Frame types of the ERSPAN type III header
+const (
+	erspanIIIFrameTypeEthernet = 0
+	erspanIIIFrameTypeIP       = 2
+)
+
+func (self *ERSPANIII) LayerType() gopacket.LayerType { return LayerTypeERSPANIII }
+
+func (self *ERSPANIII) CanDecode() gopacket.LayerClass { return LayerTypeERSPANIII }
+
+func (self *ERSPANIII) DecodeFromBytes(data []byte, df gopacket.DecodeFeedback) error {
+	if len(data) < 12 {
+		df.SetTruncated()
+		return errors.New("ERSPAN type III packet too short")
+	}
+	headerLength := 12
+	if data[11]&0x1 != 0 {
+		headerLength += 8
+	}
+	if len(data) < headerLength {
+		df.SetTruncated()
+		return errors.New("ERSPAN type III platform specific subheader too short")
+	}
+
+	self.Version = data[0] >> 4
+	self.VLANIdentifier = binary.BigEndian.Uint16(data[0:2]) & 0x0fff
+	self.SessionID = binary.BigEndian.Uint16(data[2:4]) & 0x03ff
+	self.Timestamp = binary.BigEndian.Uint32(data[4:8])
+	self.FrameType = (data[10] >> 2) & 0x1f
+	self.BaseLayer = layers.BaseLayer{Contents: data[:headerLength], Payload: data[headerLength:]}
+	return nil
+}
+
+func (self *ERSPANIII) NextLayerType() gopacket.LayerType {
+	if self.FrameType == erspanIIIFrameTypeIP {
+		return guessPayloadLayerType(self.Payload)
+	}
+	return layers.LayerTypeEthernet
+}
+
+func decodeERSPANIII(data []byte, p gopacket.PacketBuilder) error {
+	erspan := &ERSPANIII{}
+	if err := erspan.DecodeFromBytes(data, p); err != nil {
+		return err
+	}
+	p.AddLayer(erspan)
+	return p.NextDecoder(erspan.NextLayerType())
+}
+
+type erspanIIILayer struct {
+	ERSPANIII
+	tunnel *Tunnel
+}
+
+func (self *erspanIIILayer) DecodeFromBytes(data []byte, df gopacket.DecodeFeedback) error {
+	if err := self.ERSPANIII.DecodeFromBytes(data, df); err != nil {
+		return err
+	}
+	self.tunnel.record(TUNNEL_TYPE_ERSPAN, uint32(self.SessionID))
+	return nil
+}
+
+type vxlanLayer struct {
+	layers.VXLAN
+	tunnel *Tunnel
+}
+
+func (self *vxlanLayer) DecodeFromBytes(data []byte, df gopacket.DecodeFeedback) error {
+	if err := self.VXLAN.DecodeFromBytes(data, df); err != nil {
+		return err
+	}
+	self.tunnel.record(TUNNEL_TYPE_VXLAN, self.VNI)
+	return nil
+}
+
+// geneveLayer decodes GENEVE. gopacket's Geneve doesn't implement CanDecode so it can't be used in a DecodingLayerParser as is.
+type geneveLayer struct {
+	layers.Geneve
+	tunnel *Tunnel
+}
+
+func (self *geneveLayer) CanDecode() gopacket.LayerClass {
+	return layers.LayerTypeGeneve
+}
+
+func (self *geneveLayer) DecodeFromBytes(data []byte, df gopacket.DecodeFeedback) error {
+	// The options are appended on every decode, so they need to be cleared since the layer is reused
+	self.Options = self.Options[:0]
+	if err := self.Geneve.DecodeFromBytes(data, df); err != nil {
+		return err
+	}
+	self.tunnel.record(TUNNEL_TYPE_GENEVE, self.VNI)
+	return nil
+}